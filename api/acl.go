@@ -0,0 +1,252 @@
+// acl.go -- per-client authorization for the REST and EST APIs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/opencoff/certik/ops"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// API operations a client can be allowed to perform
+const (
+	OpIssue  = "issue"
+	OpRenew  = "renew"
+	OpRevoke = "revoke"
+	OpRead   = "read"
+
+	// initial EST enrollment
+	OpEnroll = "enroll"
+)
+
+var validOps = map[string]bool{
+	OpIssue:  true,
+	OpRenew:  true,
+	OpRevoke: true,
+	OpRead:   true,
+	OpEnroll: true,
+}
+
+// ACL maps client cert CNs to what they are allowed to do. Anything
+// not explicitly allowed is denied; the CRL is readable by every
+// authenticated client.
+type ACL struct {
+	Clients []*Client `yaml:"clients"`
+
+	byCN map[string]*Client
+}
+
+// Client describes what the holder of the client cert 'CN' may do.
+// Signers, profiles and names may use shell style wildcards; '*'
+// matches '/' too, so "*" allows anything and "spiffe://td/*" allows
+// every SPIFFE ID in the trust domain td.
+type Client struct {
+	CN string `yaml:"cn"`
+
+	// Operations: issue, renew, revoke, read and enroll
+	Ops []string `yaml:"ops"`
+
+	// bcrypt hash of the password of EST clients that authenticate
+	// with HTTP basic auth; the user name is CN
+	Password string `yaml:"password"`
+
+	// CNs of the CAs this client may issue from; the root CA must be
+	// named explicitly like any other signer
+	Signers []string `yaml:"signers"`
+
+	// Kinds of certs this client may issue: server, peer, user or
+	// spiffe for X509-SVIDs. Renewing or revoking an intermediate CA
+	// needs "CA" here; a wildcard doesn't match it. The root CA is
+	// never allowed.
+	Profiles []string `yaml:"profiles"`
+
+	// Patterns that the CN, DNS names, email addresses and URIs of
+	// issued certs must match
+	Names []string `yaml:"names"`
+
+	// Networks that the IP addresses of issued certs must be in
+	IPs []string `yaml:"ips"`
+
+	ops  map[string]bool
+	nets []*net.IPNet
+}
+
+// LoadACL reads and validates the YAML ACL in file 'fn'
+func LoadACL(fn string) (*ACL, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ACL{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(a); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	if err := a.init(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return a, nil
+}
+
+// validate the ACL and build the lookup tables
+func (a *ACL) init() error {
+	a.byCN = make(map[string]*Client)
+	for _, c := range a.Clients {
+		if len(c.CN) == 0 {
+			return fmt.Errorf("client without a cn")
+		}
+		if _, ok := a.byCN[c.CN]; ok {
+			return fmt.Errorf("%s: duplicate client", c.CN)
+		}
+
+		c.ops = make(map[string]bool)
+		for _, op := range c.Ops {
+			if !validOps[op] {
+				return fmt.Errorf("%s: unknown op %s", c.CN, op)
+			}
+			c.ops[op] = true
+		}
+
+		if len(c.Password) > 0 {
+			if _, err := bcrypt.Cost([]byte(c.Password)); err != nil {
+				return fmt.Errorf("%s: password is not a bcrypt hash", c.CN)
+			}
+		}
+
+		for _, pats := range [][]string{c.Signers, c.Profiles, c.Names} {
+			for _, p := range pats {
+				if _, err := glob(p, ""); err != nil {
+					return fmt.Errorf("%s: bad pattern %q", c.CN, p)
+				}
+			}
+		}
+
+		c.nets = nil
+		for _, s := range c.IPs {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return fmt.Errorf("%s: %w", c.CN, err)
+			}
+			c.nets = append(c.nets, n)
+		}
+		a.byCN[c.CN] = c
+	}
+	return nil
+}
+
+// Return the ACL entry for client 'cn'
+func (a *ACL) client(cn string) *Client {
+	if a == nil {
+		return nil
+	}
+	return a.byCN[cn]
+}
+
+// Can returns true if the client may perform 'op'
+func (c *Client) Can(op string) bool {
+	return c != nil && c.ops[op]
+}
+
+// Return the ACL entry of the client 'user' if 'pw' is its password
+func (a *ACL) basicAuth(user, pw string) *Client {
+	c := a.client(user)
+	if c == nil || len(c.Password) == 0 {
+		return nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(pw)) != nil {
+		return nil
+	}
+	return c
+}
+
+// certReq is the part of a cert request that is subject to the ACL
+type certReq struct {
+	profile string
+	signer  string
+	cn      string
+	names   []string
+	ips     []net.IP
+}
+
+// Return an error if the client 'c' may not have the cert 'r' issued.
+// A cert named after another client would authenticate as that client;
+// only the client itself may have it issued.
+func (a *ACL) allow(c *Client, r *certReq) error {
+	if o := a.client(r.cn); o != nil && o != c {
+		return fmt.Errorf("name %s belongs to client %s", r.cn, o.CN)
+	}
+	return c.allow(r)
+}
+
+// Return an error if the client may not have the cert 'r' issued
+func (c *Client) allow(r *certReq) error {
+	switch r.profile {
+	case ops.KindRoot:
+		return fmt.Errorf("profile %s not allowed", r.profile)
+	case ops.KindCA:
+		if !slices.Contains(c.Profiles, r.profile) {
+			return fmt.Errorf("profile %s not allowed", r.profile)
+		}
+	}
+	if !match(c.Profiles, r.profile) {
+		return fmt.Errorf("profile %s not allowed", r.profile)
+	}
+	if !match(c.Signers, r.signer) {
+		return fmt.Errorf("signer %s not allowed", r.signer)
+	}
+	if !match(c.Names, r.cn) {
+		return fmt.Errorf("name %s not allowed", r.cn)
+	}
+	for _, nm := range r.names {
+		if !match(c.Names, nm) {
+			return fmt.Errorf("name %s not allowed", nm)
+		}
+	}
+
+	for _, ip := range r.ips {
+		ok := false
+		for _, n := range c.nets {
+			if n.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("IP address %s not allowed", ip)
+		}
+	}
+	return nil
+}
+
+// return true if 's' matches one of the patterns
+func match(pats []string, s string) bool {
+	for _, p := range pats {
+		if ok, _ := glob(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// path.Match with '/' as an ordinary character so that wildcards span
+// the path of URIs
+func glob(p, s string) (bool, error) {
+	return path.Match(strings.ReplaceAll(p, "/", "\x00"), strings.ReplaceAll(s, "/", "\x00"))
+}
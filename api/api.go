@@ -0,0 +1,702 @@
+// api.go -- REST API for issuing and revoking certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package api serves a certik DB over HTTPS. Clients authenticate
+// with a cert issued from the same DB and are authorized by an ACL
+// keyed on the client cert's CommonName.
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+)
+
+// max size of a request body
+const maxBody = 64 * 1024
+
+// Server is an http.Handler serving the REST API for a DB
+type Server struct {
+	// Log is called for every authorized change to the DB; the
+	// default discards the messages.
+	Log func(format string, v ...any)
+
+	db  *ops.DB
+	acl *ACL
+	mux *http.ServeMux
+
+	// ops.DB isn't safe for concurrent use
+	sync.Mutex
+}
+
+// IssueRequest asks for a new server, peer or user cert, or an X509-SVID
+// with the spiffe profile. If CSR is set, the cert is issued for its
+// public key and its CN and names are used unless the request has its
+// own.
+type IssueRequest struct {
+	Profile  string   `json:"profile"`
+	CN       string   `json:"cn"`
+	Signer   string   `json:"signer,omitempty"`
+	Validity string   `json:"validity,omitempty"`
+	DNS      []string `json:"dns,omitempty"`
+	IP       []string `json:"ip,omitempty"`
+	Email    []string `json:"email,omitempty"`
+	URI      []string `json:"uri,omitempty"`
+	CSR      string   `json:"csr,omitempty"`
+
+	// openssl style subject fields that replace the signer's
+	Subject string `json:"subject,omitempty"`
+
+	// Encrypt the generated private key with this password
+	Password string `json:"password,omitempty"`
+
+	// Metadata kept with the cert in the DB
+	Owner  string            `json:"owner,omitempty"`
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// RenewRequest asks for a cert to be reissued; a CSR replaces the key
+type RenewRequest struct {
+	CN       string `json:"cn"`
+	Validity string `json:"validity,omitempty"`
+	CSR      string `json:"csr,omitempty"`
+
+	// Keep the old cert valid until it expires
+	KeepOld bool `json:"keep_old,omitempty"`
+}
+
+// RevokeRequest asks for a cert to be revoked
+type RevokeRequest struct {
+	CN string `json:"cn"`
+}
+
+// CertInfo describes a cert in the DB
+type CertInfo struct {
+	CN        string    `json:"cn"`
+	Kind      string    `json:"kind"`
+	Serial    string    `json:"serial"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNS       []string  `json:"dns,omitempty"`
+	IP        []string  `json:"ip,omitempty"`
+	Email     []string  `json:"email,omitempty"`
+	URI       []string  `json:"uri,omitempty"`
+
+	Owner  string            `json:"owner,omitempty"`
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// CertResponse is a cert along with its chain and, for newly
+// generated keys, the private key; all PEM encoded.
+type CertResponse struct {
+	CertInfo
+
+	Cert  string `json:"cert"`
+	Chain string `json:"chain"`
+	Key   string `json:"key,omitempty"`
+}
+
+// New returns a Server for the open DB 'd' authorizing clients with 'acl'
+func New(d *ops.DB, acl *ACL) *Server {
+	s := &Server{
+		db:  d,
+		acl: acl,
+		mux: http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("POST /v1/issue", s.issue)
+	s.mux.HandleFunc("POST /v1/renew", s.renew)
+	s.mux.HandleFunc("POST /v1/revoke", s.revoke)
+	s.mux.HandleFunc("GET /v1/certs", s.list)
+	s.mux.HandleFunc("GET /v1/certs/{cn}", s.get)
+	s.mux.HandleFunc("GET /v1/certs/{cn}/chain", s.chain)
+	s.mux.HandleFunc("GET /v1/crl", s.crl)
+	return s
+}
+
+// TLSConfig returns a server TLS config using the server cert 'cn'
+// from the DB; its private key must not be encrypted. Clients must
+// present a cert issued by one of the CAs in the DB.
+func (s *Server) TLSConfig(cn string) (*tls.Config, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return tlsConfig(s.db, cn, tls.RequireAndVerifyClientCert)
+}
+
+// return a server TLS config for the server cert 'cn' that verifies
+// client certs against the CAs in the DB
+func tlsConfig(d *ops.DB, cn string, auth tls.ClientAuthType) (*tls.Config, error) {
+	c, err := d.Find(cn)
+	if err != nil {
+		return nil, fmt.Errorf("can't find server %s: %w", cn, err)
+	}
+	if c.Kind != ops.KindServer && c.Kind != ops.KindPeer {
+		return nil, fmt.Errorf("%s is not a server cert", cn)
+	}
+
+	crt, key, err := d.CertPEM(cn, true)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't use key (is it encrypted?): %w", cn, err)
+	}
+
+	bundle, err := d.TrustBundle("")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no CA certs in the DB")
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{kp},
+		ClientAuth:   auth,
+		ClientCAs:    pool,
+	}
+	return cfg, nil
+}
+
+// ServeHTTP authenticates the client and dispatches the request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	who, err := certClient(s.db, r)
+	if err != nil {
+		httpError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), clientKey{}, who)
+	s.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// context key for the CN of the authenticated client
+type clientKey struct{}
+
+// Authenticate the client: its verified cert must be the current,
+// unrevoked cert of that name in the DB.
+func certClient(d *ops.DB, r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", fmt.Errorf("no verified client cert")
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	cn := leaf.Subject.CommonName
+	c, err := d.Find(cn)
+	if err != nil || !bytes.Equal(c.Raw, leaf.Raw) {
+		return "", fmt.Errorf("client cert %s is not valid", cn)
+	}
+	return cn, nil
+}
+
+// Return the ACL entry of the client if it may perform 'op'
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, op string) (*Client, bool) {
+	who, _ := r.Context().Value(clientKey{}).(string)
+	c := s.acl.client(who)
+	if !c.Can(op) {
+		httpError(w, http.StatusForbidden, fmt.Errorf("%s: %s not allowed", who, op))
+		return nil, false
+	}
+	return c, true
+}
+
+func (s *Server) issue(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorize(w, r, OpIssue)
+	if !ok {
+		return
+	}
+
+	var req IssueRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	switch req.Profile {
+	case ops.KindServer, ops.KindPeer, ops.KindUser, ops.ProfileSPIFFE:
+	default:
+		httpError(w, http.StatusBadRequest, fmt.Errorf("unknown profile '%s'", req.Profile))
+		return
+	}
+
+	o := &ops.CertOpts{
+		Signer:         req.Signer,
+		DNSNames:       req.DNS,
+		EmailAddresses: req.Email,
+		Passwd:         req.Password,
+		Owner:          req.Owner,
+		Note:           req.Note,
+		Labels:         req.Labels,
+	}
+	if err := parseOpts(o, req.Validity, req.IP); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, s := range req.URI {
+		u, err := ops.ParseURI(s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		o.URIs = append(o.URIs, u)
+	}
+	if len(req.Subject) > 0 {
+		n, err := ops.ParseSubject(req.Subject)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		o.Subject = n
+	}
+
+	cn := req.CN
+	if len(req.CSR) > 0 {
+		csr, err := parseCSR(req.CSR)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(cn) == 0 {
+			cn = csr.Subject.CommonName
+		}
+		if cn != csr.Subject.CommonName {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("CSR CN %s doesn't match %s", csr.Subject.CommonName, cn))
+			return
+		}
+		if len(o.DNSNames) == 0 && len(o.IPAddresses) == 0 && len(o.EmailAddresses) == 0 && len(o.URIs) == 0 {
+			o.DNSNames = csr.DNSNames
+			o.IPAddresses = csr.IPAddresses
+			o.EmailAddresses = csr.EmailAddresses
+			o.URIs = csr.URIs
+		}
+		o.PublicKey = csr.PublicKey
+	}
+
+	if len(cn) == 0 {
+		cn = o.Subject.CommonName
+	}
+	if len(cn) == 0 {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("missing cn"))
+		return
+	}
+
+	if err := s.acl.allow(c, newCertReq(s.db, req.Profile, cn, o)); err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if _, err := issue(s.db, req.Profile, cn, o); err != nil {
+		httpError(w, issueStatus(err), err)
+		return
+	}
+
+	s.log("%s: issued %s %s", c.CN, req.Profile, cn)
+	s.sendCert(w, http.StatusCreated, cn, o.PublicKey == nil)
+}
+
+func (s *Server) renew(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorize(w, r, OpRenew)
+	if !ok {
+		return
+	}
+
+	var req RenewRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	old, ok := s.find(w, req.CN)
+	if !ok {
+		return
+	}
+
+	o := &ops.CertOpts{KeepOld: req.KeepOld}
+	if err := parseOpts(o, req.Validity, nil); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.CSR) > 0 {
+		csr, err := parseCSR(req.CSR)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		if csr.Subject.CommonName != req.CN {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("CSR CN %s doesn't match %s", csr.Subject.CommonName, req.CN))
+			return
+		}
+		o.PublicKey = csr.PublicKey
+	}
+
+	if err := s.acl.allow(c, existing(old)); err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if _, err := s.db.Renew(req.CN, o); err != nil {
+		httpError(w, issueStatus(err), err)
+		return
+	}
+
+	s.log("%s: renewed %s %s", c.CN, old.Kind, req.CN)
+	s.sendCert(w, http.StatusOK, req.CN, o.PublicKey == nil)
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.authorize(w, r, OpRevoke)
+	if !ok {
+		return
+	}
+
+	var req RevokeRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	old, ok := s.find(w, req.CN)
+	if !ok {
+		return
+	}
+
+	if err := c.allow(existing(old)); err != nil {
+		httpError(w, http.StatusForbidden, err)
+		return
+	}
+
+	if err := s.db.Revoke(req.CN); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.log("%s: revoked %s %s", c.CN, old.Kind, req.CN)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, OpRead); !ok {
+		return
+	}
+
+	// ?label=K=V only returns the certs with that label
+	want := map[string]string{}
+	for _, l := range r.URL.Query()["label"] {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("invalid label '%s'", l))
+			return
+		}
+		want[k] = v
+	}
+
+	certs, err := s.db.List()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	v := make([]CertInfo, 0, len(certs))
+	for _, c := range certs {
+		if c.Meta.Match(want) {
+			v = append(v, certInfo(c))
+		}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, OpRead); !ok {
+		return
+	}
+
+	cn := r.PathValue("cn")
+	if _, ok := s.find(w, cn); !ok {
+		return
+	}
+	s.sendCert(w, http.StatusOK, cn, false)
+}
+
+func (s *Server) chain(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorize(w, r, OpRead); !ok {
+		return
+	}
+
+	cn := r.PathValue("cn")
+	if _, ok := s.find(w, cn); !ok {
+		return
+	}
+
+	certs, err := s.db.Chain(cn)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(pemCerts(certs))
+}
+
+// the CRL is available to every authenticated client
+func (s *Server) crl(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = "der"
+	}
+	if format != "der" && format != "pem" {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("unknown CRL format %s", format))
+		return
+	}
+
+	crl, err := s.db.CRL(&ops.CRLOpts{DER: format == "der"})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ct := "application/pkix-crl"
+	if format == "pem" {
+		ct = "application/x-pem-file"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Write(crl)
+}
+
+// Find the active cert 'cn' or send an error
+func (s *Server) find(w http.ResponseWriter, cn string) (*ops.Cert, bool) {
+	c, err := s.db.Find(cn)
+	if c == nil {
+		httpError(w, http.StatusNotFound, fmt.Errorf("can't find %s: %w", cn, err))
+		return nil, false
+	}
+	return c, true
+}
+
+// Send the cert 'cn' with its chain and optionally its private key
+func (s *Server) sendCert(w http.ResponseWriter, status int, cn string, withKey bool) {
+	c, err := s.db.Find(cn)
+	if c == nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	certs, err := s.db.Chain(cn)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := &CertResponse{
+		CertInfo: certInfo(c),
+		Cert:     string(pemCerts(certs[:1])),
+		Chain:    string(pemCerts(certs[1:])),
+	}
+
+	if withKey {
+		_, key, err := s.db.CertPEM(cn, false)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Key = string(key)
+	}
+	writeJSON(w, status, resp)
+}
+
+// Issue a server, peer or user cert or an X509-SVID
+func issue(d *ops.DB, kind, cn string, o *ops.CertOpts) (*x509.Certificate, error) {
+	switch kind {
+	case ops.KindServer:
+		return d.NewServer(cn, o)
+	case ops.KindPeer:
+		return d.NewPeer(cn, o)
+	case ops.ProfileSPIFFE:
+		// SVIDs are user certs like those of the workload agent
+		o.Profile = ops.ProfileSPIFFE
+		return d.NewUser(cn, o)
+	default:
+		return d.NewUser(cn, o)
+	}
+}
+
+// Describe a new cert for the ACL; an empty signer is the root CA
+func newCertReq(d *ops.DB, profile, cn string, o *ops.CertOpts) *certReq {
+	signer := o.Signer
+	if len(signer) == 0 {
+		signer = d.CA.Subject.CommonName
+	}
+
+	return &certReq{
+		profile: profile,
+		signer:  signer,
+		cn:      cn,
+		names:   sanNames(o.DNSNames, o.EmailAddresses, o.URIs),
+		ips:     o.IPAddresses,
+	}
+}
+
+// Describe an existing cert for the ACL; certs with a single SPIFFE ID
+// are renewed as SVIDs and need the spiffe profile.
+func existing(c *ops.Cert) *certReq {
+	profile := c.Kind
+	if c.Kind != ops.KindCA && c.Kind != ops.KindRoot && len(c.URIs) == 1 && c.URIs[0].Scheme == "spiffe" {
+		profile = ops.ProfileSPIFFE
+	}
+
+	return &certReq{
+		profile: profile,
+		signer:  c.Issuer.CommonName,
+		cn:      c.Subject.CommonName,
+		names:   sanNames(c.DNSNames, c.EmailAddresses, c.URIs),
+		ips:     c.IPAddresses,
+	}
+}
+
+// the DNS, email and URI SANs of a cert as strings
+func sanNames(dns, email []string, uris []*url.URL) []string {
+	names := append(append([]string{}, dns...), email...)
+	for _, u := range uris {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// Return the HTTP status for a failed issue or renew
+func issueStatus(err error) int {
+	if errors.Is(err, ops.ErrPolicy) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func (s *Server) log(f string, v ...any) {
+	if s.Log != nil {
+		s.Log(f, v...)
+	}
+}
+
+// fill in the validity and IP addresses of 'o'
+func parseOpts(o *ops.CertOpts, validity string, ips []string) error {
+	if len(validity) > 0 {
+		v, err := ops.ParseValidity(validity, 'y')
+		if err != nil {
+			return err
+		}
+		o.Validity = v
+	}
+
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("can't parse IP address %s", s)
+		}
+		o.IPAddresses = append(o.IPAddresses, ip)
+	}
+	return nil
+}
+
+// parse and verify a PEM encoded CSR
+func parseCSR(s string) (*x509.CertificateRequest, error) {
+	blk, _ := pem.Decode([]byte(s))
+	if blk == nil || blk.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("CSR is not PEM encoded")
+	}
+
+	return checkCSR(blk.Bytes)
+}
+
+// parse and verify a DER encoded CSR
+func checkCSR(der []byte) (*x509.CertificateRequest, error) {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR: %w", err)
+	}
+	return csr, nil
+}
+
+func certInfo(c *ops.Cert) CertInfo {
+	ci := CertInfo{
+		CN:        c.Subject.CommonName,
+		Kind:      c.Kind,
+		Serial:    fmt.Sprintf("%x", c.SerialNumber),
+		Issuer:    c.Issuer.CommonName,
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		DNS:       c.DNSNames,
+		Email:     c.EmailAddresses,
+		Owner:     c.Meta.Owner,
+		Note:      c.Meta.Note,
+		Labels:    c.Meta.Labels,
+	}
+	for _, ip := range c.IPAddresses {
+		ci.IP = append(ci.IP, ip.String())
+	}
+	for _, u := range c.URIs {
+		ci.URI = append(ci.URI, u.String())
+	}
+	return ci
+}
+
+func pemCerts(certs []*x509.Certificate) []byte {
+	var b bytes.Buffer
+	for _, c := range certs {
+		pem.Encode(&b, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c.Raw,
+		})
+	}
+	return b.Bytes()
+}
+
+// decode the JSON request body into 'v' or send an error
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("bad request: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
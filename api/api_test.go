@@ -0,0 +1,609 @@
+// api_test.go -- tests for the REST API
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/opencoff/certik/ops"
+)
+
+const testACL = `
+clients:
+  - cn: prov
+    ops: [issue, renew, revoke, read]
+    signers: [ica]
+    profiles: [server]
+    names: ["*.example.com", "spiffe://example.com/*"]
+    ips: [10.0.0.0/8]
+  - cn: reader
+    ops: [read]
+  - cn: admin
+    ops: [issue, renew, revoke]
+    signers: ["*"]
+    profiles: ["*"]
+    names: ["*"]
+  - cn: ghost
+    ops: [read]
+  - cn: mesh
+    ops: [issue, renew]
+    signers: [ica]
+    profiles: [spiffe]
+    names: ["svid-*", "spiffe://td/*"]
+`
+
+type testEnv struct {
+	d   *ops.DB
+	srv *httptest.Server
+	cas *x509.CertPool
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	dir := t.TempDir()
+	d, err := ops.Init(filepath.Join(dir, "test.db"), "test-ca", &ops.InitOpts{Passwd: "test-pw"})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	d.Warn = t.Logf
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewServer("api.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	for _, cn := range []string{"prov", "reader", "nobody"} {
+		if _, err := d.NewUser(cn, nil); err != nil {
+			t.Fatalf("user: %s", err)
+		}
+	}
+
+	fn := filepath.Join(dir, "acl.yaml")
+	if err := os.WriteFile(fn, []byte(testACL), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	acl, err := LoadACL(fn)
+	if err != nil {
+		t.Fatalf("acl: %s", err)
+	}
+
+	s := New(d, acl)
+	s.Log = t.Logf
+	cfg, err := s.TLSConfig("api.example.com")
+	if err != nil {
+		t.Fatalf("tls: %s", err)
+	}
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	bundle, err := d.TrustBundle("")
+	if err != nil {
+		t.Fatalf("bundle: %s", err)
+	}
+	cas := x509.NewCertPool()
+	cas.AppendCertsFromPEM(bundle)
+
+	return &testEnv{d, srv, cas}
+}
+
+// Make a request as the client 'cn'; decode a JSON response into 'v'
+func (e *testEnv) do(t *testing.T, cn, method, url string, req, v any) int {
+	t.Helper()
+
+	crt, key, err := e.d.CertPEM(cn, false)
+	if err != nil {
+		t.Fatalf("%s: %s", cn, err)
+	}
+	kp, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatalf("%s: %s", cn, err)
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{kp},
+				RootCAs:      e.cas,
+				ServerName:   "api.example.com",
+			},
+		},
+	}
+
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	hr, err := http.NewRequest(method, e.srv.URL+url, body)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	resp, err := hc.Do(hr)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+
+	switch x := v.(type) {
+	case nil:
+	case *[]byte:
+		*x = b
+	default:
+		if resp.StatusCode < 300 {
+			if err := json.Unmarshal(b, v); err != nil {
+				t.Fatalf("%s %s: %s", method, url, err)
+			}
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestIssue(t *testing.T) {
+	e := newTestEnv(t)
+
+	req := &IssueRequest{
+		Profile:  "server",
+		CN:       "www.example.com",
+		Signer:   "ica",
+		Validity: "90d",
+		IP:       []string{"10.1.2.3"},
+		Owner:    "web-team",
+		Labels:   map[string]string{"tier": "web"},
+	}
+
+	var resp CertResponse
+	if st := e.do(t, "prov", "POST", "/v1/issue", req, &resp); st != http.StatusCreated {
+		t.Fatalf("issue: status %d", st)
+	}
+	if resp.Kind != ops.KindServer || resp.Issuer != "ica" || len(resp.Key) == 0 || resp.Owner != "web-team" {
+		t.Fatalf("issue: bad response %+v", resp.CertInfo)
+	}
+
+	var certs []CertInfo
+	if st := e.do(t, "reader", "GET", "/v1/certs?label=tier=web", nil, &certs); st != http.StatusOK {
+		t.Fatalf("list: status %d", st)
+	}
+	if len(certs) != 1 || certs[0].CN != "www.example.com" || certs[0].Labels["tier"] != "web" {
+		t.Fatalf("list: bad certs with tier=web %+v", certs)
+	}
+	if n := len(pemBlocks(resp.Chain)); n != 2 {
+		t.Fatalf("issue: exp 2 chain certs, saw %d", n)
+	}
+	if _, err := tls.X509KeyPair([]byte(resp.Cert), []byte(resp.Key)); err != nil {
+		t.Fatalf("issue: key doesn't match cert: %s", err)
+	}
+
+	denied := []*IssueRequest{
+		{Profile: "server", CN: "a.example.com"},
+		{Profile: "server", CN: "a.example.org", Signer: "ica"},
+		{Profile: "server", CN: "a.example.com", Signer: "ica", DNS: []string{"a.example.org"}},
+		{Profile: "server", CN: "a.example.com", Signer: "ica", IP: []string{"192.168.1.1"}},
+		{Profile: "user", CN: "u.example.com", Signer: "ica"},
+		{Profile: "server", CN: "b.example.com", Signer: "ica", URI: []string{"spiffe://example.org/b"}},
+	}
+	for i, r := range denied {
+		if st := e.do(t, "prov", "POST", "/v1/issue", r, nil); st != http.StatusForbidden {
+			t.Fatalf("%d: exp 403, saw %d", i, st)
+		}
+	}
+
+	// wildcards span the path of URIs
+	r := &IssueRequest{Profile: "server", CN: "c.example.com", Signer: "ica", URI: []string{"spiffe://example.com/ns/web/sa/c"}}
+	if st := e.do(t, "prov", "POST", "/v1/issue", r, &resp); st != http.StatusCreated {
+		t.Fatalf("uri: status %d", st)
+	}
+
+	if st := e.do(t, "prov", "POST", "/v1/issue", &IssueRequest{Profile: "server", CN: "b.example.com", Signer: "ica", URI: []string{"b"}}, nil); st != http.StatusBadRequest {
+		t.Fatalf("bad uri: exp 400, saw %d", st)
+	}
+
+	// the CA policy applies to API requests
+	if err := e.d.SetPolicy("ica", &ops.Policy{DenyDNSSuffixes: []string{"deny.example.com"}}); err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+	r = &IssueRequest{Profile: "server", CN: "x.deny.example.com", Signer: "ica"}
+	if st := e.do(t, "prov", "POST", "/v1/issue", r, nil); st != http.StatusForbidden {
+		t.Fatalf("policy: exp 403, saw %d", st)
+	}
+
+	if st := e.do(t, "reader", "POST", "/v1/issue", req, nil); st != http.StatusForbidden {
+		t.Fatalf("reader: exp 403, saw %d", st)
+	}
+	if st := e.do(t, "prov", "POST", "/v1/issue", &IssueRequest{Profile: "CA", CN: "x"}, nil); st != http.StatusBadRequest {
+		t.Fatalf("bad profile: exp 400, saw %d", st)
+	}
+}
+
+func TestIssueSVID(t *testing.T) {
+	e := newTestEnv(t)
+	if _, err := e.d.NewUser("mesh", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if err := e.d.SetPolicy("ica", &ops.Policy{TrustDomain: "td"}); err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+
+	req := &IssueRequest{Profile: "spiffe", CN: "svid-web", Signer: "ica", URI: []string{"spiffe://td/ns/x/sa/y"}}
+	var resp CertResponse
+	if st := e.do(t, "mesh", "POST", "/v1/issue", req, &resp); st != http.StatusCreated {
+		t.Fatalf("issue: status %d", st)
+	}
+
+	blk, _ := pem.Decode([]byte(resp.Cert))
+	if blk == nil {
+		t.Fatalf("issue: no cert")
+	}
+	c, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	if len(c.URIs) != 1 || c.URIs[0].String() != "spiffe://td/ns/x/sa/y" {
+		t.Fatalf("issue: bad URIs %v", c.URIs)
+	}
+	if !slices.Equal(c.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}) {
+		t.Fatalf("issue: bad EKU %v", c.ExtKeyUsage)
+	}
+	if _, err := tls.X509KeyPair([]byte(resp.Cert), []byte(resp.Key)); err != nil {
+		t.Fatalf("issue: key doesn't match cert: %s", err)
+	}
+
+	denied := []*IssueRequest{
+		{Profile: "spiffe", CN: "svid-db", Signer: "ica", URI: []string{"spiffe://other/ns/x/sa/db"}},
+		{Profile: "user", CN: "svid-db", Signer: "ica", URI: []string{"spiffe://td/ns/x/sa/db"}},
+		{Profile: "spiffe", CN: "db", Signer: "ica", URI: []string{"spiffe://td/ns/x/sa/db"}},
+	}
+	for i, r := range denied {
+		if st := e.do(t, "mesh", "POST", "/v1/issue", r, nil); st != http.StatusForbidden {
+			t.Fatalf("%d: exp 403, saw %d", i, st)
+		}
+	}
+
+	// the profile needs exactly one SPIFFE ID
+	r := &IssueRequest{Profile: "spiffe", CN: "svid-db", Signer: "ica", URI: []string{"spiffe://td/a", "spiffe://td/b"}}
+	if st := e.do(t, "mesh", "POST", "/v1/issue", r, nil); st != http.StatusBadRequest {
+		t.Fatalf("two IDs: exp 400, saw %d", st)
+	}
+
+	var renewed CertResponse
+	if st := e.do(t, "mesh", "POST", "/v1/renew", &RenewRequest{CN: "svid-web"}, &renewed); st != http.StatusOK {
+		t.Fatalf("renew: status %d", st)
+	}
+	if renewed.Serial == resp.Serial || len(renewed.URI) != 1 || renewed.URI[0] != "spiffe://td/ns/x/sa/y" {
+		t.Fatalf("renew: bad cert %+v", renewed.CertInfo)
+	}
+}
+
+func TestIssueCSR(t *testing.T) {
+	e := newTestEnv(t)
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "csr.example.com"},
+		DNSNames: []string{"alt.example.com"},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, sk)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+
+	var resp CertResponse
+	req := &IssueRequest{Profile: "server", Signer: "ica", CSR: csr}
+	if st := e.do(t, "prov", "POST", "/v1/issue", req, &resp); st != http.StatusCreated {
+		t.Fatalf("issue: status %d", st)
+	}
+	if resp.CN != "csr.example.com" || len(resp.Key) > 0 {
+		t.Fatalf("issue: bad response %+v", resp.CertInfo)
+	}
+
+	certs := pemBlocks(resp.Cert)
+	c, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !sk.PublicKey.Equal(c.PublicKey) {
+		t.Fatalf("issue: cert isn't for the CSR key")
+	}
+
+	// the CSR names are subject to the ACL
+	tmpl.DNSNames = []string{"alt.example.org"}
+	tmpl.Subject.CommonName = "csr2.example.com"
+	der, _ = x509.CreateCertificateRequest(rand.Reader, tmpl, sk)
+	req.CSR = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	if st := e.do(t, "prov", "POST", "/v1/issue", req, nil); st != http.StatusForbidden {
+		t.Fatalf("csr names: exp 403, saw %d", st)
+	}
+
+	// renewing with a CSR keeps the key with the caller
+	resp = CertResponse{}
+	rr := &RenewRequest{CN: "csr.example.com", CSR: csr}
+	if st := e.do(t, "prov", "POST", "/v1/renew", rr, &resp); st != http.StatusOK {
+		t.Fatalf("renew: status %d", st)
+	}
+	if len(resp.Key) > 0 || resp.Serial == c.SerialNumber.Text(16) {
+		t.Fatalf("renew: bad response %+v", resp.CertInfo)
+	}
+}
+
+func TestRenewRevoke(t *testing.T) {
+	e := newTestEnv(t)
+
+	var old CertResponse
+	req := &IssueRequest{Profile: "server", CN: "www.example.com", Signer: "ica"}
+	if st := e.do(t, "prov", "POST", "/v1/issue", req, &old); st != http.StatusCreated {
+		t.Fatalf("issue: status %d", st)
+	}
+
+	var resp CertResponse
+	if st := e.do(t, "prov", "POST", "/v1/renew", &RenewRequest{CN: "www.example.com"}, &resp); st != http.StatusOK {
+		t.Fatalf("renew: status %d", st)
+	}
+	if resp.Serial == old.Serial || len(resp.Key) == 0 {
+		t.Fatalf("renew: cert wasn't reissued")
+	}
+
+	// prov can't touch certs outside its ACL
+	for _, url := range []string{"/v1/renew", "/v1/revoke"} {
+		if st := e.do(t, "prov", "POST", url, &RevokeRequest{CN: "api.example.com"}, nil); st != http.StatusForbidden {
+			t.Fatalf("%s: exp 403, saw %d", url, st)
+		}
+	}
+
+	if st := e.do(t, "prov", "POST", "/v1/revoke", &RevokeRequest{CN: "www.example.com"}, nil); st != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", st)
+	}
+	if st := e.do(t, "prov", "POST", "/v1/revoke", &RevokeRequest{CN: "www.example.com"}, nil); st != http.StatusNotFound {
+		t.Fatalf("revoke again: exp 404, saw %d", st)
+	}
+
+	var crl []byte
+	if st := e.do(t, "nobody", "GET", "/v1/crl", nil, &crl); st != http.StatusOK {
+		t.Fatalf("crl: status %d", st)
+	}
+	rl, err := x509.ParseRevocationList(crl)
+	if err != nil {
+		t.Fatalf("crl: %s", err)
+	}
+	found := false
+	for _, x := range rl.RevokedCertificateEntries {
+		if x.SerialNumber.Text(16) == resp.Serial {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("crl: missing serial %s", resp.Serial)
+	}
+}
+
+func TestRevokeCA(t *testing.T) {
+	e := newTestEnv(t)
+	if _, err := e.d.NewUser("admin", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := e.d.NewServer("web.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	// a wildcard doesn't allow CAs
+	for _, cn := range []string{"ica", "test-ca"} {
+		for _, url := range []string{"/v1/renew", "/v1/revoke"} {
+			if st := e.do(t, "admin", "POST", url, &RevokeRequest{CN: cn}, nil); st != http.StatusForbidden {
+				t.Fatalf("%s %s: exp 403, saw %d", url, cn, st)
+			}
+		}
+	}
+	if _, err := e.d.Find("ica"); err != nil {
+		t.Fatalf("ica: %s", err)
+	}
+
+	if st := e.do(t, "admin", "POST", "/v1/revoke", &RevokeRequest{CN: "web.example.com"}, nil); st != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", st)
+	}
+}
+
+func TestClientNames(t *testing.T) {
+	e := newTestEnv(t)
+	if _, err := e.d.NewUser("admin", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+
+	// certs named after another client would authenticate as it
+	for _, cn := range []string{"ghost", "prov"} {
+		req := &IssueRequest{Profile: "user", CN: cn, Signer: "ica"}
+		if st := e.do(t, "admin", "POST", "/v1/issue", req, nil); st != http.StatusForbidden {
+			t.Fatalf("issue %s: exp 403, saw %d", cn, st)
+		}
+	}
+	if st := e.do(t, "admin", "POST", "/v1/renew", &RenewRequest{CN: "prov"}, nil); st != http.StatusForbidden {
+		t.Fatalf("renew prov: exp 403, saw %d", st)
+	}
+	if _, err := e.d.Find("ghost"); err == nil {
+		t.Fatalf("ghost was issued")
+	}
+
+	req := &IssueRequest{Profile: "user", CN: "bob", Signer: "ica"}
+	if st := e.do(t, "admin", "POST", "/v1/issue", req, nil); st != http.StatusCreated {
+		t.Fatalf("issue bob: status %d", st)
+	}
+	if st := e.do(t, "admin", "POST", "/v1/renew", &RenewRequest{CN: "admin"}, nil); st != http.StatusOK {
+		t.Fatalf("renew admin: status %d", st)
+	}
+}
+
+func TestRead(t *testing.T) {
+	e := newTestEnv(t)
+
+	var certs []CertInfo
+	if st := e.do(t, "reader", "GET", "/v1/certs", nil, &certs); st != http.StatusOK {
+		t.Fatalf("list: status %d", st)
+	}
+	if len(certs) != 6 {
+		t.Fatalf("list: exp 6 certs, saw %d", len(certs))
+	}
+
+	var resp CertResponse
+	if st := e.do(t, "reader", "GET", "/v1/certs/api.example.com", nil, &resp); st != http.StatusOK {
+		t.Fatalf("get: status %d", st)
+	}
+	if resp.CN != "api.example.com" || len(resp.Key) > 0 {
+		t.Fatalf("get: bad response %+v", resp.CertInfo)
+	}
+
+	var chain []byte
+	if st := e.do(t, "reader", "GET", "/v1/certs/ica/chain", nil, &chain); st != http.StatusOK {
+		t.Fatalf("chain: status %d", st)
+	}
+	if n := len(pemBlocks(string(chain))); n != 2 {
+		t.Fatalf("chain: exp 2 certs, saw %d", n)
+	}
+
+	if st := e.do(t, "reader", "GET", "/v1/certs/nope", nil, nil); st != http.StatusNotFound {
+		t.Fatalf("get: exp 404, saw %d", st)
+	}
+	if st := e.do(t, "nobody", "GET", "/v1/certs", nil, nil); st != http.StatusForbidden {
+		t.Fatalf("nobody: exp 403, saw %d", st)
+	}
+
+	var crl []byte
+	if st := e.do(t, "nobody", "GET", "/v1/crl?format=pem", nil, &crl); st != http.StatusOK {
+		t.Fatalf("crl: status %d", st)
+	}
+	if blk, _ := pem.Decode(crl); blk == nil || blk.Type != "X509 CRL" {
+		t.Fatalf("crl: not PEM")
+	}
+}
+
+func TestRevokedClient(t *testing.T) {
+	e := newTestEnv(t)
+
+	// keep the revoked client's cert around to present it
+	crt, key, err := e.d.CertPEM("reader", false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := e.d.Revoke("reader"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+
+	kp, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	hc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{kp},
+				RootCAs:      e.cas,
+				ServerName:   "api.example.com",
+			},
+		},
+	}
+
+	resp, err := hc.Get(e.srv.URL + "/v1/certs")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked client: exp 401, saw %d", resp.StatusCode)
+	}
+}
+
+func TestACLMatch(t *testing.T) {
+	id := "spiffe://td/ns/x/sa/y"
+	tests := []struct {
+		pat string
+		ok  bool
+	}{
+		{"*", true},
+		{"spiffe://td/*", true},
+		{"spiffe://td/ns/*/sa/y", true},
+		{"spiffe://*/ns/x/sa/y", true},
+		{"spiffe://other/*", false},
+		{"spiffe://td/ns/*/sa/z", false},
+		{"*.example.com", false},
+	}
+
+	for _, x := range tests {
+		if ok := match([]string{x.pat}, id); ok != x.ok {
+			t.Fatalf("%s: exp %v, saw %v", x.pat, x.ok, ok)
+		}
+	}
+}
+
+func TestLoadACLErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := []string{
+		"clients:\n  - ops: [read]\n",
+		"clients:\n  - cn: a\n  - cn: a\n",
+		"clients:\n  - cn: a\n    ops: [delete]\n",
+		"clients:\n  - cn: a\n    ips: [10.0.0.1]\n",
+		"clients:\n  - cn: a\n    names: [\"[a\"]\n",
+		"clients:\n  - cn: a\n    colour: blue\n",
+		"clients:\n  - cn: a\n    password: s3cret\n",
+	}
+
+	for i, s := range bad {
+		fn := filepath.Join(dir, "acl.yaml")
+		if err := os.WriteFile(fn, []byte(s), 0600); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := LoadACL(fn); err == nil {
+			t.Fatalf("%d: loaded a bad ACL:\n%s", i, s)
+		}
+	}
+}
+
+// return the DER bytes of all the PEM blocks in 's'
+func pemBlocks(s string) [][]byte {
+	var v [][]byte
+	b := []byte(s)
+	for {
+		var blk *pem.Block
+		blk, b = pem.Decode(b)
+		if blk == nil {
+			return v
+		}
+		v = append(v, blk.Bytes)
+	}
+}
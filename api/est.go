@@ -0,0 +1,384 @@
+// est.go -- RFC 7030 Enrollment over Secure Transport
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+)
+
+const (
+	estPrefix = "/.well-known/est"
+
+	p7Type      = "application/pkcs7-mime"
+	p7CertsType = "application/pkcs7-mime; smime-type=certs-only"
+	csrType     = "application/pkcs10"
+	csrAttrType = "application/csrattrs"
+)
+
+// the signature algorithm we ask EST clients to use for CSRs
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// EST is an http.Handler serving the RFC 7030 EST endpoints for a DB:
+// cacerts, simpleenroll, simplereenroll and csrattrs. The optional
+// label of an EST URL is the CN of the signing CA.
+//
+// Initial enrollment needs an ACL entry with the enroll op; clients
+// authenticate with HTTP basic auth or a bootstrap cert from the DB.
+// Re-enrollment is authenticated by the cert being renewed.
+type EST struct {
+	// Log is called for every cert issued; the default discards the
+	// messages.
+	Log func(format string, v ...any)
+
+	db  *ops.DB
+	acl *ACL
+	mux *http.ServeMux
+
+	kind     string
+	signer   string
+	validity time.Duration
+
+	// ops.DB isn't safe for concurrent use
+	sync.Mutex
+}
+
+// ESTOpts describes the certs issued by EST enrollment
+type ESTOpts struct {
+	// Kind of certs to issue: server, peer, user or spiffe for
+	// X509-SVIDs
+	Kind string
+
+	// CN of the CA that signs certs when the URL has no label; the
+	// default is the root CA
+	Signer string
+
+	// Validity of new certs; the default is that of the cert kind
+	// and re-enrolled certs keep their validity
+	Validity time.Duration
+}
+
+// NewEST returns an EST server for the open DB 'd' authorizing
+// initial enrollment with 'acl'
+func NewEST(d *ops.DB, acl *ACL, o *ESTOpts) (*EST, error) {
+	if o == nil {
+		o = &ESTOpts{Kind: ops.KindUser}
+	}
+
+	switch o.Kind {
+	case ops.KindServer, ops.KindPeer, ops.KindUser, ops.ProfileSPIFFE:
+	default:
+		return nil, fmt.Errorf("est: can't enroll %s certs", o.Kind)
+	}
+
+	signer := o.Signer
+	if len(signer) == 0 {
+		signer = d.CA.Subject.CommonName
+	}
+
+	e := &EST{
+		db:       d,
+		acl:      acl,
+		mux:      http.NewServeMux(),
+		kind:     o.Kind,
+		signer:   signer,
+		validity: o.Validity,
+	}
+
+	if _, err := e.ca(signer); err != nil {
+		return nil, err
+	}
+
+	for _, p := range []string{estPrefix, estPrefix + "/{label}"} {
+		e.mux.HandleFunc("GET "+p+"/cacerts", e.cacerts)
+		e.mux.HandleFunc("GET "+p+"/csrattrs", e.csrattrs)
+		e.mux.HandleFunc("POST "+p+"/simpleenroll", e.enroll)
+		e.mux.HandleFunc("POST "+p+"/simplereenroll", e.reenroll)
+	}
+	return e, nil
+}
+
+// TLSConfig returns a server TLS config using the server cert 'cn'
+// from the DB; its private key must not be encrypted. Client certs
+// are optional and are verified against the CAs in the DB.
+func (e *EST) TLSConfig(cn string) (*tls.Config, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	return tlsConfig(e.db, cn, tls.VerifyClientCertIfGiven)
+}
+
+func (e *EST) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.mux.ServeHTTP(w, r)
+}
+
+// the CA chain of the signer
+func (e *EST) cacerts(w http.ResponseWriter, r *http.Request) {
+	signer, ok := e.label(w, r)
+	if !ok {
+		return
+	}
+
+	certs, err := e.db.Chain(signer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeP7(w, p7Type, certs)
+}
+
+func (e *EST) csrattrs(w http.ResponseWriter, r *http.Request) {
+	if _, ok := e.label(w, r); !ok {
+		return
+	}
+
+	der, err := asn1.Marshal([]asn1.ObjectIdentifier{oidECDSAWithSHA256})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", csrAttrType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write(encodeBase64(der))
+}
+
+// initial enrollment: issue a new cert for the CSR
+func (e *EST) enroll(w http.ResponseWriter, r *http.Request) {
+	signer, ok := e.label(w, r)
+	if !ok {
+		return
+	}
+
+	who, c := e.client(r)
+	if len(who) == 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="certik EST"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if !c.Can(OpEnroll) {
+		http.Error(w, fmt.Sprintf("%s: %s not allowed", who, OpEnroll), http.StatusForbidden)
+		return
+	}
+
+	csr, ok := readCSR(w, r)
+	if !ok {
+		return
+	}
+
+	cn := csr.Subject.CommonName
+	if len(cn) == 0 {
+		http.Error(w, "CSR has no CommonName", http.StatusBadRequest)
+		return
+	}
+
+	o := &ops.CertOpts{
+		Signer:         signer,
+		Validity:       e.validity,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		PublicKey:      csr.PublicKey,
+	}
+
+	if err := e.acl.allow(c, newCertReq(e.db, e.kind, cn, o)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	crt, err := issue(e.db, e.kind, cn, o)
+	if err != nil {
+		http.Error(w, err.Error(), issueStatus(err))
+		return
+	}
+
+	e.log("est: %s: enrolled %s %s", c.CN, e.kind, cn)
+	writeP7(w, p7CertsType, []*x509.Certificate{crt})
+}
+
+// re-enrollment: renew the client cert with the key in the CSR
+func (e *EST) reenroll(w http.ResponseWriter, r *http.Request) {
+	signer, ok := e.label(w, r)
+	if !ok {
+		return
+	}
+
+	cn, err := certClient(e.db, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	csr, ok := readCSR(w, r)
+	if !ok {
+		return
+	}
+
+	if csr.Subject.CommonName != cn {
+		http.Error(w, fmt.Sprintf("CSR CN %s doesn't match %s", csr.Subject.CommonName, cn), http.StatusBadRequest)
+		return
+	}
+
+	old, err := e.db.Find(cn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if old.Issuer.CommonName != signer {
+		http.Error(w, fmt.Sprintf("%s isn't signed by %s", cn, signer), http.StatusBadRequest)
+		return
+	}
+
+	o := &ops.CertOpts{
+		Validity:  e.validity,
+		PublicKey: csr.PublicKey,
+	}
+	crt, err := e.db.Renew(cn, o)
+	if err != nil {
+		http.Error(w, err.Error(), issueStatus(err))
+		return
+	}
+
+	e.log("est: re-enrolled %s %s", old.Kind, cn)
+	writeP7(w, p7CertsType, []*x509.Certificate{crt})
+}
+
+// Authenticate the client of an initial enrollment and return its name
+// and ACL entry: a bootstrap cert from the DB takes precedence over
+// HTTP basic auth.
+func (e *EST) client(r *http.Request) (string, *Client) {
+	if cn, err := certClient(e.db, r); err == nil {
+		return cn, e.acl.client(cn)
+	}
+
+	if user, pw, ok := r.BasicAuth(); ok {
+		if c := e.acl.basicAuth(user, pw); c != nil {
+			return user, c
+		}
+	}
+	return "", nil
+}
+
+// return the signing CA named by the label of the request
+func (e *EST) label(w http.ResponseWriter, r *http.Request) (string, bool) {
+	signer := r.PathValue("label")
+	if len(signer) == 0 {
+		return e.signer, true
+	}
+
+	if _, err := e.ca(signer); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return "", false
+	}
+	return signer, true
+}
+
+// return the CA 'cn'
+func (e *EST) ca(cn string) (*ops.Cert, error) {
+	c, err := e.db.Find(cn)
+	if c == nil || (c.Kind != ops.KindCA && c.Kind != ops.KindRoot) {
+		return nil, fmt.Errorf("est: can't find CA %s", cn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("est: %s: %w", cn, err)
+	}
+	return c, nil
+}
+
+func (e *EST) log(f string, v ...any) {
+	if e.Log != nil {
+		e.Log(f, v...)
+	}
+}
+
+// read and verify the base64 encoded CSR of an enrollment request
+func readCSR(w http.ResponseWriter, r *http.Request) (*x509.CertificateRequest, bool) {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != csrType {
+		http.Error(w, "expected "+csrType, http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	der, err := decodeBase64(b)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("CSR: %s", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	csr, err := checkCSR(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return csr, true
+}
+
+// write 'certs' as a base64 encoded certs-only PKCS#7
+func writeP7(w http.ResponseWriter, ctype string, certs []*x509.Certificate) {
+	der, err := ops.PKCS7Certs(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write(encodeBase64(der))
+}
+
+// base64 with 64 column lines
+func encodeBase64(der []byte) []byte {
+	s := base64.StdEncoding.EncodeToString(der)
+
+	var b bytes.Buffer
+	for len(s) > 64 {
+		b.WriteString(s[:64])
+		b.WriteString("\r\n")
+		s = s[64:]
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// decode base64 that may be broken into lines
+func decodeBase64(b []byte) ([]byte, error) {
+	b = bytes.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, b)
+	if len(b) == 0 {
+		return nil, errors.New("empty body")
+	}
+	return base64.StdEncoding.DecodeString(string(b))
+}
@@ -0,0 +1,374 @@
+// est_test.go -- tests for the EST server
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencoff/certik/ops"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testESTACL = `
+clients:
+  - cn: factory
+    password: "%s"
+    ops: [enroll]
+    signers: [ica]
+    profiles: [user]
+    names: ["*.devices.example.com"]
+  - cn: boot
+    ops: [enroll]
+    signers: [ica, test-ca]
+    profiles: [user]
+    names: ["*.devices.example.com"]
+`
+
+type estEnv struct {
+	d   *ops.DB
+	srv *httptest.Server
+	cas *x509.CertPool
+}
+
+func newESTEnv(t *testing.T) *estEnv {
+	t.Helper()
+
+	dir := t.TempDir()
+	d, err := ops.Init(filepath.Join(dir, "test.db"), "test-ca", &ops.InitOpts{Passwd: "test-pw"})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	d.Warn = t.Logf
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewServer("est.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	for _, cn := range []string{"boot", "nobody"} {
+		if _, err := d.NewUser(cn, nil); err != nil {
+			t.Fatalf("user: %s", err)
+		}
+	}
+
+	pw, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %s", err)
+	}
+	fn := filepath.Join(dir, "acl.yaml")
+	acl := strings.Replace(testESTACL, "%s", string(pw), 1)
+	if err := os.WriteFile(fn, []byte(acl), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	a, err := LoadACL(fn)
+	if err != nil {
+		t.Fatalf("acl: %s", err)
+	}
+
+	e, err := NewEST(d, a, &ESTOpts{Kind: ops.KindUser, Signer: "ica"})
+	if err != nil {
+		t.Fatalf("est: %s", err)
+	}
+	e.Log = t.Logf
+	cfg, err := e.TLSConfig("est.example.com")
+	if err != nil {
+		t.Fatalf("tls: %s", err)
+	}
+
+	srv := httptest.NewUnstartedServer(e)
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	bundle, err := d.TrustBundle("")
+	if err != nil {
+		t.Fatalf("bundle: %s", err)
+	}
+	cas := x509.NewCertPool()
+	cas.AppendCertsFromPEM(bundle)
+
+	return &estEnv{d, srv, cas}
+}
+
+// an EST client: a client cert or HTTP basic auth or neither
+type estClient struct {
+	cert     *tls.Certificate
+	user, pw string
+}
+
+// the client cert 'cn' from the DB
+func (e *estEnv) dbClient(t *testing.T, cn string) *estClient {
+	crt, key, err := e.d.CertPEM(cn, false)
+	if err != nil {
+		t.Fatalf("%s: %s", cn, err)
+	}
+	kp, err := tls.X509KeyPair(crt, key)
+	if err != nil {
+		t.Fatalf("%s: %s", cn, err)
+	}
+	return &estClient{cert: &kp}
+}
+
+// make an EST request; return the status and the decoded body
+func (e *estEnv) do(t *testing.T, c *estClient, method, op string, body []byte) (int, []byte) {
+	t.Helper()
+
+	tc := &tls.Config{
+		RootCAs:    e.cas,
+		ServerName: "est.example.com",
+	}
+	if c != nil && c.cert != nil {
+		tc.Certificates = []tls.Certificate{*c.cert}
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(encodeBase64(body))
+	}
+	hr, err := http.NewRequest(method, e.srv.URL+estPrefix+op, rd)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if body != nil {
+		hr.Header.Set("Content-Type", csrType)
+	}
+	if c != nil && len(c.user) > 0 {
+		hr.SetBasicAuth(c.user, c.pw)
+	}
+
+	resp, err := hc.Do(hr)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, op, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Logf("%s %s: %s: %s", method, op, resp.Status, b)
+		return resp.StatusCode, nil
+	}
+
+	der, err := decodeBase64(b)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, op, err)
+	}
+	return resp.StatusCode, der
+}
+
+// return a DER CSR for 'cn' and its key
+func newCSR(t *testing.T, cn string, dns ...string) ([]byte, crypto.Signer) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: dns,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, sk)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return der, sk
+}
+
+// return the certs in a certs-only PKCS#7
+func p7Certs(t *testing.T, der []byte) []*x509.Certificate {
+	t.Helper()
+
+	var ci struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatalf("pkcs7: %s", err)
+	}
+
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("pkcs7: %s", err)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatalf("pkcs7: %s", err)
+	}
+	return certs
+}
+
+func TestESTCACerts(t *testing.T) {
+	e := newESTEnv(t)
+
+	st, der := e.do(t, nil, "GET", "/cacerts", nil)
+	if st != http.StatusOK {
+		t.Fatalf("cacerts: %d", st)
+	}
+	certs := p7Certs(t, der)
+	if len(certs) != 2 || certs[0].Subject.CommonName != "ica" || certs[1].Subject.CommonName != "test-ca" {
+		t.Fatalf("cacerts: wrong chain %d", len(certs))
+	}
+
+	// the label selects the CA
+	st, der = e.do(t, nil, "GET", "/test-ca/cacerts", nil)
+	if st != http.StatusOK {
+		t.Fatalf("cacerts: %d", st)
+	}
+	if certs := p7Certs(t, der); len(certs) != 1 || certs[0].Subject.CommonName != "test-ca" {
+		t.Fatalf("cacerts: wrong root chain")
+	}
+
+	for _, lbl := range []string{"nobody", "unknown"} {
+		if st, _ := e.do(t, nil, "GET", "/"+lbl+"/cacerts", nil); st != http.StatusNotFound {
+			t.Fatalf("%s: exp 404, saw %d", lbl, st)
+		}
+	}
+
+	st, der = e.do(t, nil, "GET", "/csrattrs", nil)
+	if st != http.StatusOK {
+		t.Fatalf("csrattrs: %d", st)
+	}
+	var attrs []asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(der, &attrs); err != nil || len(attrs) == 0 {
+		t.Fatalf("csrattrs: %v %v", attrs, err)
+	}
+}
+
+func TestESTEnroll(t *testing.T) {
+	e := newESTEnv(t)
+
+	factory := &estClient{user: "factory", pw: "s3cret"}
+	csr, sk := newCSR(t, "d1.devices.example.com", "d1.devices.example.com")
+
+	tests := []struct {
+		name string
+		c    *estClient
+		st   int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"bad password", &estClient{user: "factory", pw: "wrong"}, http.StatusUnauthorized},
+		{"no password", &estClient{user: "boot", pw: ""}, http.StatusUnauthorized},
+		{"no acl", e.dbClient(t, "nobody"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if st, _ := e.do(t, tt.c, "POST", "/simpleenroll", csr); st != tt.st {
+			t.Fatalf("%s: exp %d, saw %d", tt.name, tt.st, st)
+		}
+	}
+
+	st, der := e.do(t, factory, "POST", "/simpleenroll", csr)
+	if st != http.StatusOK {
+		t.Fatalf("enroll: %d", st)
+	}
+	certs := p7Certs(t, der)
+	if len(certs) != 1 {
+		t.Fatalf("enroll: %d certs", len(certs))
+	}
+	crt := certs[0]
+	if crt.Issuer.CommonName != "ica" || !crt.PublicKey.(*ecdsa.PublicKey).Equal(sk.Public()) {
+		t.Fatalf("enroll: wrong cert")
+	}
+
+	c, err := e.d.Find("d1.devices.example.com")
+	if err != nil || c.Kind != ops.KindUser || !bytes.Equal(c.Raw, crt.Raw) {
+		t.Fatalf("enroll: cert not in DB: %v", err)
+	}
+
+	// names outside the ACL
+	bad, _ := newCSR(t, "d2.example.com")
+	if st, _ := e.do(t, factory, "POST", "/simpleenroll", bad); st != http.StatusForbidden {
+		t.Fatalf("bad name: exp 403, saw %d", st)
+	}
+
+	// a bootstrap cert and a label
+	csr2, _ := newCSR(t, "d2.devices.example.com")
+	st, der = e.do(t, e.dbClient(t, "boot"), "POST", "/test-ca/simpleenroll", csr2)
+	if st != http.StatusOK {
+		t.Fatalf("bootstrap: %d", st)
+	}
+	if certs := p7Certs(t, der); certs[0].Issuer.CommonName != "test-ca" {
+		t.Fatalf("bootstrap: wrong signer %s", certs[0].Issuer.CommonName)
+	}
+
+	// factory can't use the root CA
+	csr3, _ := newCSR(t, "d3.devices.example.com")
+	if st, _ := e.do(t, factory, "POST", "/test-ca/simpleenroll", csr3); st != http.StatusForbidden {
+		t.Fatalf("signer: exp 403, saw %d", st)
+	}
+}
+
+func TestESTReenroll(t *testing.T) {
+	e := newESTEnv(t)
+
+	cn := "d1.devices.example.com"
+	csr, sk := newCSR(t, cn)
+	st, der := e.do(t, &estClient{user: "factory", pw: "s3cret"}, "POST", "/simpleenroll", csr)
+	if st != http.StatusOK {
+		t.Fatalf("enroll: %d", st)
+	}
+	old := p7Certs(t, der)[0]
+
+	dev := &estClient{cert: &tls.Certificate{
+		Certificate: [][]byte{old.Raw},
+		PrivateKey:  sk,
+	}}
+
+	csr2, sk2 := newCSR(t, cn)
+	if st, _ := e.do(t, nil, "POST", "/simplereenroll", csr2); st != http.StatusUnauthorized {
+		t.Fatalf("anonymous: exp 401, saw %d", st)
+	}
+	if st, _ := e.do(t, e.dbClient(t, "boot"), "POST", "/simplereenroll", csr2); st != http.StatusBadRequest {
+		t.Fatalf("other cn: exp 400, saw %d", st)
+	}
+	if st, _ := e.do(t, dev, "POST", "/test-ca/simplereenroll", csr2); st != http.StatusBadRequest {
+		t.Fatalf("other signer: exp 400, saw %d", st)
+	}
+
+	st, der = e.do(t, dev, "POST", "/simplereenroll", csr2)
+	if st != http.StatusOK {
+		t.Fatalf("reenroll: %d", st)
+	}
+	crt := p7Certs(t, der)[0]
+	if crt.Subject.CommonName != cn || crt.SerialNumber.Cmp(old.SerialNumber) == 0 ||
+		!crt.PublicKey.(*ecdsa.PublicKey).Equal(sk2.Public()) {
+		t.Fatalf("reenroll: wrong cert")
+	}
+
+	// the old cert is revoked
+	csr3, _ := newCSR(t, cn)
+	if st, _ := e.do(t, dev, "POST", "/simplereenroll", csr3); st != http.StatusUnauthorized {
+		t.Fatalf("old cert: exp 401, saw %d", st)
+	}
+}
@@ -0,0 +1,429 @@
+// apply.go -- reconcile the DB with a manifest of certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencoff/go-pki"
+	"gopkg.in/yaml.v3"
+)
+
+// A Manifest declares the intermediate CAs, servers, peers and users
+// that should exist in the DB.
+type Manifest struct {
+	// Renew certs that expire within this duration
+	RenewBefore string `yaml:"renew-before"`
+
+	// Default validity of certs that don't specify one
+	Validity string `yaml:"validity"`
+
+	// Revoke servers, peers and users that are not in the manifest
+	Prune bool `yaml:"prune"`
+
+	Intermediates []ManifestEntry `yaml:"intermediates"`
+	Servers       []ManifestEntry `yaml:"servers"`
+	Peers         []ManifestEntry `yaml:"peers"`
+	Users         []ManifestEntry `yaml:"users"`
+}
+
+// ManifestEntry is a single cert in the manifest
+type ManifestEntry struct {
+	CN       string   `yaml:"cn"`
+	Signer   string   `yaml:"signer"`
+	Validity string   `yaml:"validity"`
+	Profile  string   `yaml:"profile"`
+	DNS      []string `yaml:"dns"`
+	IP       []string `yaml:"ip"`
+	Email    []string `yaml:"email"`
+	URI      []string `yaml:"uri"`
+
+	// openssl style subject fields that replace the signer's
+	Subject string `yaml:"subject"`
+
+	// Write the cert & key to Out.crt and Out.key
+	Out string `yaml:"out"`
+
+	// filled in when the manifest is loaded
+	kind     string
+	ips      []net.IP
+	uris     []*url.URL
+	validity time.Duration
+	subject  pkix.Name
+}
+
+// Issuance profiles that can be named in a manifest; an entry may
+// also name the default profile of its kind (e.g. 'server').
+var profiles = map[string]bool{
+	ProfileSPIFFE:   true,
+	ProfileSMIME:    true,
+	ProfileCodeSign: true,
+	ProfileTSA:      true,
+	ProfileSCEP:     true,
+}
+
+// plan operations
+const (
+	OpNone   = "ok"
+	OpCreate = "create"
+	OpRenew  = "renew"
+	OpRevoke = "revoke"
+)
+
+// PlanStep is a single step in the reconciliation plan
+type PlanStep struct {
+	Op   string
+	Why  string
+	CN   string
+	Kind string
+
+	// nil for certs that are revoked because they aren't in the
+	// manifest
+	Entry *ManifestEntry
+}
+
+func (p *PlanStep) String() string {
+	s := fmt.Sprintf("%-7s %-7s %s", p.Op, p.Kind, p.CN)
+	if len(p.Why) > 0 {
+		s += fmt.Sprintf(" (%s)", p.Why)
+	}
+	return s
+}
+
+// ApplyOpts control how a manifest is applied
+type ApplyOpts struct {
+	// Renew certs that expire within this duration; overrides the
+	// manifest if set
+	RenewBefore time.Duration
+
+	// Revoke servers, peers and users that are not in the manifest
+	Prune bool
+
+	// Don't issue certs that have lint errors
+	Strict bool
+
+	// Keep renewed certs valid until they expire
+	KeepOld bool
+}
+
+// LoadManifest reads and validates the YAML manifest in 'fn'
+func LoadManifest(fn string) (*Manifest, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	m := &Manifest{
+		RenewBefore: "30d",
+		Validity:    "2y",
+	}
+
+	dec := yaml.NewDecoder(fd)
+	dec.KnownFields(true)
+	if err := dec.Decode(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	if _, err := ParseValidity(m.RenewBefore, 'd'); err != nil {
+		return nil, fmt.Errorf("%s: renew-before: %w", fn, err)
+	}
+
+	seen := make(map[string]bool)
+	check := func(v []ManifestEntry, kind string) error {
+		for i := range v {
+			e := &v[i]
+			e.kind = kind
+
+			if len(e.CN) == 0 {
+				return fmt.Errorf("%s: %s #%d has no cn", fn, kind, i+1)
+			}
+			if seen[e.CN] {
+				return fmt.Errorf("%s: duplicate cn %s", fn, e.CN)
+			}
+			seen[e.CN] = true
+
+			if e.Profile == kind {
+				e.Profile = ""
+			}
+			if len(e.Profile) > 0 && !profiles[e.Profile] {
+				return fmt.Errorf("%s: %s: unknown profile %s", fn, e.CN, e.Profile)
+			}
+			if len(e.Validity) == 0 {
+				e.Validity = m.Validity
+			}
+
+			d, err := ParseValidity(e.Validity, 'y')
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", fn, e.CN, err)
+			}
+			e.validity = d
+
+			if len(e.Subject) > 0 {
+				n, err := ParseSubject(e.Subject)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", fn, e.CN, err)
+				}
+				e.subject = n
+			}
+
+			for _, s := range e.IP {
+				ip := net.ParseIP(s)
+				if ip == nil {
+					return fmt.Errorf("%s: %s: invalid IP address %s", fn, e.CN, s)
+				}
+				e.ips = append(e.ips, ip)
+			}
+
+			for _, s := range e.URI {
+				u, err := ParseURI(s)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", fn, e.CN, err)
+				}
+				e.uris = append(e.uris, u)
+			}
+
+			// same defaults as NewServer(), NewPeer() and NewUser()
+			switch kind {
+			case KindServer, KindPeer:
+				if strings.Index(e.CN, ".") > 0 && !slices.Contains(e.DNS, e.CN) {
+					e.DNS = append(e.DNS, e.CN)
+				}
+			case KindUser:
+				if len(e.Email) == 0 && strings.Index(e.CN, "@") > 0 {
+					e.Email = []string{e.CN}
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := check(m.Intermediates, KindCA); err != nil {
+		return nil, err
+	}
+	if err := check(m.Servers, KindServer); err != nil {
+		return nil, err
+	}
+	if err := check(m.Peers, KindPeer); err != nil {
+		return nil, err
+	}
+	if err := check(m.Users, KindUser); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Plan computes the steps needed to reconcile the DB with the manifest
+func (d *DB) Plan(m *Manifest, o *ApplyOpts) ([]*PlanStep, error) {
+	var plan []*PlanStep
+
+	renewBefore := o.RenewBefore
+	if renewBefore == 0 {
+		var err error
+		renewBefore, err = ParseValidity(m.RenewBefore, 'd')
+		if err != nil {
+			return nil, fmt.Errorf("renew-before: %w", err)
+		}
+	}
+
+	ca := d.CA
+	now := time.Now().UTC()
+	cas := make(map[string]bool)
+	declare := func(v []ManifestEntry) error {
+		for i := range v {
+			e := &v[i]
+			if e.kind == KindCA {
+				cas[e.CN] = true
+			}
+
+			if len(e.Signer) > 0 && !cas[e.Signer] {
+				if _, err := ca.FindCA(e.Signer); err != nil {
+					return fmt.Errorf("%s: unknown signer %s", e.CN, e.Signer)
+				}
+			}
+
+			step := func(op, why string) {
+				plan = append(plan, &PlanStep{Op: op, Why: why, CN: e.CN, Kind: e.kind, Entry: e})
+			}
+
+			c, err := d.Find(e.CN)
+			if c == nil {
+				step(OpCreate, "")
+				continue
+			}
+
+			switch {
+			case err != nil:
+				step(OpRenew, err.Error())
+			case c.NotAfter.Sub(now) < renewBefore:
+				step(OpRenew, fmt.Sprintf("expires %s", c.NotAfter.Format(time.RFC3339)))
+			case e.kind != KindCA && e.drifted(c.Certificate):
+				step(OpRenew, "names changed")
+			default:
+				step(OpNone, "")
+			}
+		}
+		return nil
+	}
+
+	for _, v := range [][]ManifestEntry{m.Intermediates, m.Servers, m.Peers, m.Users} {
+		if err := declare(v); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range plan {
+		// we can't reissue a CA without orphaning everything it signed
+		if p.Op == OpRenew && p.Kind == KindCA {
+			d.warn("intermediate CA %s needs renewal (%s); not renewing", p.CN, p.Why)
+			p.Op = OpNone
+		}
+	}
+
+	if !o.Prune && !m.Prune {
+		return plan, nil
+	}
+
+	want := make(map[string]bool)
+	for _, v := range [][]ManifestEntry{m.Servers, m.Peers, m.Users} {
+		for i := range v {
+			want[v[i].CN] = true
+		}
+	}
+
+	srv, err := ca.GetServers()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch servers: %w", err)
+	}
+	users, err := ca.GetClients()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch users: %w", err)
+	}
+
+	var certs []*Cert
+	for _, v := range [][]*pki.Cert{srv, users} {
+		for _, c := range v {
+			certs = append(certs, d.cert(c))
+		}
+	}
+
+	minted, err := d.st.active()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch certs: %w", err)
+	}
+	certs = append(certs, minted...)
+
+	for _, c := range certs {
+		cn := c.Subject.CommonName
+		if !want[cn] {
+			plan = append(plan, &PlanStep{Op: OpRevoke, CN: cn, Kind: c.Kind})
+		}
+	}
+	return plan, nil
+}
+
+// return true if the names in 'c' differ from the manifest entry
+func (e *ManifestEntry) drifted(c *x509.Certificate) bool {
+	same := func(a, b []string) bool {
+		a = slices.Sorted(slices.Values(a))
+		b = slices.Sorted(slices.Values(b))
+		return slices.Equal(a, b)
+	}
+
+	var ips []string
+	for _, ip := range c.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	var want []string
+	for _, ip := range e.ips {
+		want = append(want, ip.String())
+	}
+
+	var uris, wantURIs []string
+	for _, u := range c.URIs {
+		uris = append(uris, u.String())
+	}
+	for _, u := range e.uris {
+		wantURIs = append(wantURIs, u.String())
+	}
+
+	return !same(e.DNS, c.DNSNames) || !same(want, ips) || !same(e.Email, c.EmailAddresses) ||
+		!same(wantURIs, uris)
+}
+
+// Apply executes a single step of the plan
+func (d *DB) Apply(p *PlanStep, o *ApplyOpts) error {
+	switch p.Op {
+	case OpNone:
+		// (re)write exports that went missing
+		if p.Entry.Out != "" {
+			if _, err := os.Stat(p.Entry.Out + ".crt"); err != nil {
+				return d.writeOut(p.Entry)
+			}
+		}
+		return nil
+
+	case OpRevoke:
+		return d.Revoke(p.CN)
+	}
+
+	e := p.Entry
+	co := &CertOpts{
+		Signer:         e.Signer,
+		Validity:       e.validity,
+		DNSNames:       e.DNS,
+		IPAddresses:    e.ips,
+		EmailAddresses: e.Email,
+		URIs:           e.uris,
+		Profile:        e.Profile,
+		Subject:        e.subject,
+		Strict:         o.Strict,
+	}
+
+	// check the new cert before we revoke the old one
+	pc, err := d.prepare(e.kind, e.CN, co)
+	if err != nil {
+		return err
+	}
+
+	if p.Op == OpRenew {
+		_, err = d.replace(p.CN, o.KeepOld, pc)
+	} else {
+		_, err = d.sign(pc)
+	}
+	if err != nil {
+		return err
+	}
+
+	if e.Out != "" {
+		return d.writeOut(e)
+	}
+	return nil
+}
+
+// write the cert & key of a manifest entry to its output files
+func (d *DB) writeOut(e *ManifestEntry) error {
+	crt, key, err := d.CertPEM(e.CN, e.kind == KindCA)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(e.Out+".crt", crt, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(e.Out+".key", key, 0600)
+}
@@ -0,0 +1,327 @@
+// apply_test.go -- tests for applying manifests
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testManifest = `
+validity: 90d
+intermediates:
+  - cn: web-ca
+servers:
+  - cn: www.example.com
+    signer: web-ca
+    dns: [example.com]
+    ip: [10.0.0.1]
+    out: %s
+users:
+  - cn: alice@example.com
+`
+
+// write a manifest to a temp file and load it
+func loadTestManifest(t *testing.T, dir, body string) *Manifest {
+	t.Helper()
+
+	fn := filepath.Join(dir, "certs.yaml")
+	if err := os.WriteFile(fn, []byte(body), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	m, err := LoadManifest(fn)
+	if err != nil {
+		t.Fatalf("manifest: %s", err)
+	}
+	return m
+}
+
+// plan and apply 'm'; return the plan
+func apply(t *testing.T, d *DB, m *Manifest, o *ApplyOpts) []*PlanStep {
+	t.Helper()
+
+	plan, err := d.Plan(m, o)
+	if err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+
+	for _, p := range plan {
+		if err := d.Apply(p, o); err != nil {
+			t.Fatalf("%s: %s", p, err)
+		}
+	}
+	return plan
+}
+
+// return the plan as a map of CN to op
+func planOps(plan []*PlanStep) map[string]string {
+	m := make(map[string]string)
+	for _, p := range plan {
+		m[p.CN] = p.Op
+	}
+	return m
+}
+
+func TestApply(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "www")
+
+	m := loadTestManifest(t, dir, fmt.Sprintf(testManifest, out))
+	plan := apply(t, d, m, &ApplyOpts{})
+
+	exp := map[string]string{
+		"web-ca":            OpCreate,
+		"www.example.com":   OpCreate,
+		"alice@example.com": OpCreate,
+	}
+	if v := planOps(plan); !maps.Equal(v, exp) {
+		t.Fatalf("plan: exp %v, saw %v", exp, v)
+	}
+
+	c, err := d.Find("www.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if c.Issuer.CommonName != "web-ca" {
+		t.Fatalf("www: exp signer web-ca, saw %s", c.Issuer.CommonName)
+	}
+	if v := c.NotAfter.Sub(c.NotBefore); v > 91*24*time.Hour {
+		t.Fatalf("www: exp 90d validity, saw %s", v)
+	}
+	if len(c.DNSNames) != 2 || len(c.IPAddresses) != 1 {
+		t.Fatalf("www: bad names %v %v", c.DNSNames, c.IPAddresses)
+	}
+
+	for _, ext := range []string{".crt", ".key"} {
+		if _, err := os.Stat(out + ext); err != nil {
+			t.Fatalf("www: %s", err)
+		}
+	}
+
+	a, err := d.Find("alice@example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if len(a.EmailAddresses) != 1 || a.EmailAddresses[0] != "alice@example.com" {
+		t.Fatalf("alice: bad email %v", a.EmailAddresses)
+	}
+
+	// applying again is a no-op
+	plan = apply(t, d, m, &ApplyOpts{})
+	for _, p := range plan {
+		if p.Op != OpNone {
+			t.Fatalf("reapply: %s", p)
+		}
+	}
+
+	// renew certs that expire soon
+	plan = apply(t, d, m, &ApplyOpts{RenewBefore: 100 * 24 * time.Hour})
+	exp = map[string]string{
+		"web-ca":            OpNone,
+		"www.example.com":   OpRenew,
+		"alice@example.com": OpRenew,
+	}
+	if v := planOps(plan); !maps.Equal(v, exp) {
+		t.Fatalf("renew: exp %v, saw %v", exp, v)
+	}
+
+	z, err := d.Find("www.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if z.SerialNumber.Cmp(c.SerialNumber) == 0 {
+		t.Fatalf("renew: www wasn't reissued")
+	}
+}
+
+func TestApplyDrift(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+
+	m := loadTestManifest(t, dir, "servers:\n  - cn: www.example.com\n    validity: 90d\n")
+	apply(t, d, m, &ApplyOpts{})
+
+	m = loadTestManifest(t, dir, "servers:\n  - cn: www.example.com\n    validity: 90d\n    dns: [example.com]\n")
+	plan := apply(t, d, m, &ApplyOpts{})
+	if len(plan) != 1 || plan[0].Op != OpRenew {
+		t.Fatalf("drift: exp renew, saw %v", plan)
+	}
+
+	c, err := d.Find("www.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if len(c.DNSNames) != 2 {
+		t.Fatalf("drift: names not updated: %v", c.DNSNames)
+	}
+}
+
+func TestApplyPrune(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+
+	for _, cn := range []string{"a.example.com", "b.example.com"} {
+		if _, err := d.NewServer(cn, nil); err != nil {
+			t.Fatalf("server: %s", err)
+		}
+	}
+	if _, err := d.NewUser("u@example.com", &CertOpts{NotBefore: time.Now()}); err != nil {
+		t.Fatalf("minted user: %s", err)
+	}
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	m := loadTestManifest(t, dir, "validity: 90d\nservers:\n  - cn: a.example.com\n")
+
+	// without prune, extra certs are left alone
+	plan, err := d.Plan(m, &ApplyOpts{})
+	if err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+	if len(plan) != 1 {
+		t.Fatalf("plan: exp 1 step, saw %v", plan)
+	}
+
+	plan = apply(t, d, m, &ApplyOpts{Prune: true})
+	exp := map[string]string{
+		"a.example.com": OpNone,
+		"b.example.com": OpRevoke,
+		"u@example.com": OpRevoke,
+	}
+	if v := planOps(plan); !maps.Equal(v, exp) {
+		t.Fatalf("prune: exp %v, saw %v", exp, v)
+	}
+
+	for cn, op := range exp {
+		_, err := d.Find(cn)
+		if (op == OpRevoke) != (err != nil) {
+			t.Fatalf("prune: %s: exp %s, saw err %v", cn, op, err)
+		}
+	}
+
+	// CAs are never pruned
+	if _, err := d.Find("ica"); err != nil {
+		t.Fatalf("prune: revoked a CA: %s", err)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := []string{
+		"servers:\n  - dns: [a.example.com]\n",
+		"servers:\n  - cn: a\nusers:\n  - cn: a\n",
+		"servers:\n  - cn: a\n    validity: forever\n",
+		"servers:\n  - cn: a\n    ip: [not-an-ip]\n",
+		"servers:\n  - cn: a\n    profile: nope\n",
+		"servers:\n  - cn: a\n    colour: blue\n",
+		"renew-before: soon\n",
+		"servers:\n  - cn: a\n    subject: /X=1\n",
+		"servers:\n  - cn: a\n    uri: [not/a/uri]\n",
+	}
+
+	for i, s := range bad {
+		fn := filepath.Join(dir, "bad.yaml")
+		if err := os.WriteFile(fn, []byte(s), 0600); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := LoadManifest(fn); err == nil {
+			t.Fatalf("%d: loaded a bad manifest:\n%s", i, s)
+		}
+	}
+
+	d := newTestDB(t)
+	m := loadTestManifest(t, dir, "servers:\n  - cn: a.example.com\n    signer: nope\n")
+	if _, err := d.Plan(m, &ApplyOpts{}); err == nil {
+		t.Fatalf("planned a cert with an unknown signer")
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+
+	m := loadTestManifest(t, dir, "servers:\n  - cn: www.example.com\n    validity: 90d\n")
+	apply(t, d, m, &ApplyOpts{})
+
+	if err := d.SetPolicy("", &Policy{MaxValidity: "30d"}); err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+
+	// a renewal that violates the policy keeps the old cert
+	m = loadTestManifest(t, dir, "servers:\n  - cn: www.example.com\n    validity: 90d\n    dns: [example.com]\n")
+	plan, err := d.Plan(m, &ApplyOpts{})
+	if err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+	if len(plan) != 1 || plan[0].Op != OpRenew {
+		t.Fatalf("plan: exp renew, saw %v", plan)
+	}
+	if err := d.Apply(plan[0], &ApplyOpts{}); !errors.Is(err, ErrPolicy) {
+		t.Fatalf("apply: exp policy violation, saw %v", err)
+	}
+	if _, err := d.Find("www.example.com"); err != nil {
+		t.Fatalf("apply: failed renewal revoked the cert: %s", err)
+	}
+}
+
+func TestApplyPeers(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+
+	body := "prune: true\npeers:\n  - cn: kafka-1.example.com\n    ip: [10.0.0.1]\n"
+	apply(t, d, loadTestManifest(t, dir, body), &ApplyOpts{})
+
+	c, err := d.Find("kafka-1.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if c.Kind != KindPeer || len(c.DNSNames) != 1 {
+		t.Fatalf("apply: bad peer %s %v", c.Kind, c.DNSNames)
+	}
+
+	// peers in the manifest aren't pruned
+	plan := apply(t, d, loadTestManifest(t, dir, body), &ApplyOpts{})
+	if v := planOps(plan); len(v) != 1 || v["kafka-1.example.com"] != OpNone {
+		t.Fatalf("prune: exp no change, saw %v", v)
+	}
+}
+
+func TestApplySPIFFE(t *testing.T) {
+	d := newTestDB(t)
+	dir := t.TempDir()
+	if err := d.SetPolicy("", &Policy{TrustDomain: "example.org"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	body := "servers:\n  - cn: web\n    profile: spiffe\n    uri: [spiffe://example.org/web]\n"
+	apply(t, d, loadTestManifest(t, dir, body), &ApplyOpts{})
+
+	c, err := d.Find("web")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if !isSVID(c.Certificate) || c.URIs[0].String() != "spiffe://example.org/web" {
+		t.Fatalf("apply: bad URIs %v", c.URIs)
+	}
+
+	// a new SPIFFE ID renews the cert
+	body = "servers:\n  - cn: web\n    profile: spiffe\n    uri: [spiffe://example.org/api]\n"
+	plan := apply(t, d, loadTestManifest(t, dir, body), &ApplyOpts{})
+	if v := planOps(plan); v["web"] != OpRenew {
+		t.Fatalf("drift: exp renew, saw %v", v)
+	}
+}
@@ -0,0 +1,182 @@
+// backup.go -- encrypted backup and restore of the whole DB
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var backupMagic = []byte("certik-backup-v1\n")
+
+// the version of the backup contents
+const backupVersion = 1
+
+// the contents of a backup: the main DB as a go-pki JSON dump, the
+// decrypted contents of the companion store and a snapshot of the
+// request queue
+type backup struct {
+	Version int                                   `json:"version"`
+	Created time.Time                             `json:"created"`
+	CA      string                                `json:"ca"`
+	PKI     json.RawMessage                       `json:"pki"`
+	Store   map[string]map[string]json.RawMessage `json:"store"`
+	Queue   []byte                                `json:"queue,omitempty"`
+}
+
+// BackupInfo describes a verified backup
+type BackupInfo struct {
+	Version int
+	Created time.Time
+
+	// CommonName of the root CA
+	CA string
+
+	// number of entries in each bucket of the companion store
+	Entries map[string]int
+
+	// size of the request queue snapshot in bytes
+	Queue int
+}
+
+// Backup writes an encrypted backup of the whole DB to 'w'; the key
+// 'k' is independent of the DB passphrase.
+func (d *DB) Backup(w io.Writer, k *SealKey) error {
+	var dump bytes.Buffer
+	if err := d.CA.ExportJSON(&dump); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	st, err := d.st.dump()
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	q, err := snapshotQueue(d.fn)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	js, err := json.Marshal(&backup{
+		Version: backupVersion,
+		Created: time.Now().UTC(),
+		CA:      d.CA.Subject.CommonName,
+		PKI:     bytes.TrimSpace(dump.Bytes()),
+		Store:   st,
+		Queue:   q,
+	})
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	b, err := seal(backupMagic, k, js)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// VerifyBackup decrypts the backup 'b' in memory and checks its
+// contents; nothing is written.
+func VerifyBackup(b []byte, k *SealKey) (*BackupInfo, error) {
+	bk, err := openBackup(b, k)
+	if err != nil {
+		return nil, err
+	}
+
+	bi := &BackupInfo{
+		Version: bk.Version,
+		Created: bk.Created,
+		CA:      bk.CA,
+		Entries: map[string]int{},
+		Queue:   len(bk.Queue),
+	}
+	for name, kv := range bk.Store {
+		bi.Entries[name] = len(kv)
+	}
+	return bi, nil
+}
+
+// Restore creates the DB 'fn' with the passphrase 'pw' from the
+// backup 'b'; 'fn' and its companion files must not exist.
+func Restore(fn, pw string, b []byte, k *SealKey) (*DB, error) {
+	bk, err := openBackup(b, k)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range []string{fn, fn + storeSuffix, fn + queueSuffix} {
+		if _, err := os.Stat(f); err == nil {
+			return nil, fmt.Errorf("restore: %s already exists", f)
+		}
+	}
+
+	d, err := restore(fn, pw, bk)
+	if err != nil {
+		// don't leave a half restored DB behind
+		for _, f := range []string{fn, fn + storeSuffix, fn + queueSuffix} {
+			os.Remove(f)
+		}
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+	return d, nil
+}
+
+// recreate the DB files in 'fn' from the backup 'bk'
+func restore(fn, pw string, bk *backup) (*DB, error) {
+	d, err := InitFromJSON(fn, pw, string(bk.PKI))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.st.load(bk.Store); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	if len(bk.Queue) > 0 {
+		if err := os.WriteFile(fn+queueSuffix, bk.Queue, 0600); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// decrypt the backup 'b' and check its contents
+func openBackup(b []byte, k *SealKey) (*backup, error) {
+	js, err := unseal(backupMagic, k, b)
+	if err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+
+	var bk backup
+	if err := json.Unmarshal(js, &bk); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+
+	if bk.Version < 1 || bk.Version > backupVersion {
+		return nil, fmt.Errorf("backup: unsupported version %d", bk.Version)
+	}
+
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal(bk.PKI, &dump); err != nil {
+		return nil, fmt.Errorf("backup: main DB: %w", err)
+	}
+
+	if err := checkStore(bk.Store); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	return &bk, nil
+}
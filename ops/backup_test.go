@@ -0,0 +1,177 @@
+// backup_test.go -- tests for backup and restore
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewServer("web.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1.example.com"}, Owner: "bob"}); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	if _, err := d.Renew("etcd-1", &CertOpts{KeepOld: true}); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+
+	q, err := OpenQueue(d.fn)
+	if err != nil {
+		t.Fatalf("queue: %s", err)
+	}
+	if err := q.Submit(&Request{Kind: "user", CN: "alice", Requester: "alice", Justification: "laptop"}); err != nil {
+		t.Fatalf("submit: %s", err)
+	}
+	q.Close()
+
+	bk := &SealKey{Passwd: "backup-pw"}
+	var b bytes.Buffer
+	if err := d.Backup(&b, bk); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+
+	bi, err := VerifyBackup(b.Bytes(), bk)
+	if err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+	if bi.CA != "test-ca" || bi.Entries["certs"] != 1 || bi.Entries["superseded"] != 1 || bi.Queue == 0 {
+		t.Fatalf("verify: bad info %+v", bi)
+	}
+
+	if _, err := VerifyBackup(b.Bytes(), &SealKey{Passwd: testPw}); err == nil {
+		t.Fatalf("verified with the DB passphrase")
+	}
+	bad := bytes.Clone(b.Bytes())
+	bad[len(bad)-10] ^= 1
+	if _, err := VerifyBackup(bad, bk); err == nil {
+		t.Fatalf("verified a corrupted backup")
+	}
+
+	// restore with a new DB passphrase
+	fn := filepath.Join(t.TempDir(), "restored.db")
+	e, err := Restore(fn, "new-pw", b.Bytes(), bk)
+	if err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	defer e.Close()
+
+	for _, cn := range []string{"web.example.com", "etcd-1"} {
+		want, _ := d.Find(cn)
+		c, err := e.Find(cn)
+		if err != nil || !c.Equal(want.Certificate) {
+			t.Fatalf("restore: %s: %v %v", cn, c, err)
+		}
+	}
+	if m, _ := e.Meta("etcd-1"); m.Owner != "bob" {
+		t.Fatalf("restore: lost the metadata %+v", m)
+	}
+	if h, err := e.History("etcd-1"); err != nil || len(h) != 2 {
+		t.Fatalf("restore: history %v %v", h, err)
+	}
+
+	rq, err := OpenQueue(fn)
+	if err != nil {
+		t.Fatalf("queue: %s", err)
+	}
+	defer rq.Close()
+	if v, err := rq.List(RequestPending); err != nil || len(v) != 1 || v[0].CN != "alice" {
+		t.Fatalf("restore: queue %v %v", v, err)
+	}
+
+	if _, err := Restore(fn, "new-pw", b.Bytes(), bk); err == nil {
+		t.Fatalf("restored over an existing DB")
+	}
+
+	// backups encrypted to an X25519 key need the private key
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("keygen: %s", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(sk.PublicKey())
+	pub, err := ParseSealKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("public key: %s", err)
+	}
+	der, _ = x509.MarshalPKCS8PrivateKey(sk)
+	priv, err := ParseSealKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("private key: %s", err)
+	}
+
+	b.Reset()
+	if err := d.Backup(&b, pub); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+	if _, err := VerifyBackup(b.Bytes(), pub); err == nil {
+		t.Fatalf("verified without the private key")
+	}
+	if _, err := VerifyBackup(b.Bytes(), priv); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+}
+
+func TestRestoreFailure(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewServer("web.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	var b bytes.Buffer
+	k := &SealKey{Passwd: "backup-pw"}
+	if err := d.Backup(&b, k); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+
+	// a store section that passes the checks but can't be written:
+	// bolt refuses empty keys
+	bk, err := openBackup(b.Bytes(), k)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	bk.Store[string(bucketMeta)] = map[string]json.RawMessage{"": json.RawMessage(`{}`)}
+
+	js, err := json.Marshal(bk)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	bad, err := seal(backupMagic, k, js)
+	if err != nil {
+		t.Fatalf("seal: %s", err)
+	}
+
+	fn := filepath.Join(t.TempDir(), "restored.db")
+	if _, err := Restore(fn, "new-pw", bad, k); err == nil {
+		t.Fatalf("restored a corrupt store")
+	}
+	for _, f := range []string{fn, fn + storeSuffix, fn + queueSuffix} {
+		if _, err := os.Stat(f); err == nil {
+			t.Fatalf("restore left %s behind", f)
+		}
+	}
+
+	// and the same file name can be restored into afterwards
+	e, err := Restore(fn, "new-pw", b.Bytes(), k)
+	if err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	e.Close()
+}
@@ -0,0 +1,138 @@
+// codesign.go -- code signing and time-stamping certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+)
+
+const (
+	// ProfileCodeSign issues user certs for signing code: the
+	// codeSigning extended key usage and no host names.
+	ProfileCodeSign = "codesign"
+
+	// ProfileTSA issues the cert of an RFC 3161 time-stamping
+	// authority: only the timeStamping extended key usage, marked
+	// critical.
+	ProfileTSA = "tsa"
+)
+
+var oidExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+
+// TSA is the cert and key of a time-stamping authority
+type TSA struct {
+	Cert *x509.Certificate
+
+	// the intermediate CAs between the cert and the root CA
+	Chain []*x509.Certificate
+
+	Key crypto.Signer
+}
+
+// TSA returns the time-stamping cert 'cn' and its key; 'o' decrypts a
+// password protected key. If 'cn' doesn't exist, it is issued with the
+// tsa profile and the signer, validity and subject in 'o'.
+func (d *DB) TSA(cn string, o *CertOpts) (*TSA, error) {
+	z := opts(o)
+
+	c, err := d.Find(cn)
+	if c == nil {
+		z.Profile = ProfileTSA
+		if _, err := d.NewUser(cn, &z); err != nil {
+			return nil, err
+		}
+		c, err = d.Find(cn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+	if !isTSACert(c.Certificate) {
+		return nil, fmt.Errorf("%s is not a time-stamping cert", cn)
+	}
+
+	_, kp, err := d.CertPEM(cn, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(kp) == 0 {
+		return nil, fmt.Errorf("%s: no private key", cn)
+	}
+	sk, err := decodeKey(kp, z.Passwd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+
+	cas, err := issuerChain(d.CA, c.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TSA{
+		Cert: c.Certificate,
+		Key:  sk,
+	}
+	for _, ca := range cas {
+		if ca.SerialNumber.Cmp(d.CA.SerialNumber) != 0 {
+			t.Chain = append(t.Chain, ca.Certificate)
+		}
+	}
+	return t, nil
+}
+
+// check a cert with the codesign or tsa profile
+func checkSigner(kind string, o *CertOpts) error {
+	eku := x509.ExtKeyUsageCodeSigning
+	if o.Profile == ProfileTSA {
+		eku = x509.ExtKeyUsageTimeStamping
+	}
+
+	if kind != KindUser {
+		return fmt.Errorf("the %s profile is only for users", o.Profile)
+	}
+	if len(o.DNSNames) > 0 || len(o.IPAddresses) > 0 {
+		return fmt.Errorf("the %s profile doesn't take DNS names or IP addresses", o.Profile)
+	}
+	if len(o.ExtKeyUsage) > 0 && !slices.Contains(o.ExtKeyUsage, eku) {
+		return fmt.Errorf("the %s profile needs the %s extended key usage", o.Profile, EKUNames([]x509.ExtKeyUsage{eku})[0])
+	}
+	if o.Profile == ProfileTSA && len(o.ExtKeyUsage) > 1 {
+		return fmt.Errorf("the %s profile can't have other extended key usages", o.Profile)
+	}
+	return nil
+}
+
+// isTSACert is true if 'c' can sign RFC 3161 time-stamps: its only
+// EKU is timeStamping and the extension is critical.
+func isTSACert(c *x509.Certificate) bool {
+	if !slices.Equal(c.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}) {
+		return false
+	}
+	for _, e := range c.Extensions {
+		if e.Id.Equal(oidExtKeyUsage) {
+			return e.Critical
+		}
+	}
+	return false
+}
+
+// return the critical EKU extension of a time-stamping cert; RFC 3161
+// requires it and x509.CreateCertificate never marks it critical.
+func criticalEKU() (pkix.Extension, error) {
+	oidTimeStamping := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+	b, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTimeStamping})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtKeyUsage, Critical: true, Value: b}, nil
+}
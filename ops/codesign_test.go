@@ -0,0 +1,98 @@
+// codesign_test.go -- tests for code signing and time-stamping certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"slices"
+	"testing"
+)
+
+func TestCodeSign(t *testing.T) {
+	d := newTestDB(t)
+
+	c, err := d.NewUser("builder", &CertOpts{Profile: ProfileCodeSign})
+	if err != nil {
+		t.Fatalf("codesign: %s", err)
+	}
+	eku := []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	if !slices.Equal(c.ExtKeyUsage, eku) || c.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Fatalf("codesign: bad usage %v %x", c.ExtKeyUsage, c.KeyUsage)
+	}
+	if isTSACert(c) {
+		t.Fatalf("codesign: cert is a TSA cert")
+	}
+
+	// code signing certs don't need an email address
+	z, err := d.Find("builder")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	for _, r := range LintCert(z.Certificate, z.Kind, true) {
+		t.Fatalf("codesign: unexpected lint %s: %s", r.Rule, r.Message)
+	}
+
+	bad := map[string]*CertOpts{
+		"dns":  {Profile: ProfileCodeSign, DNSNames: []string{"example.com"}},
+		"eku":  {Profile: ProfileCodeSign, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+		"tsa1": {Profile: ProfileTSA, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}},
+		"tsa2": {Profile: ProfileTSA, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping, x509.ExtKeyUsageCodeSigning}},
+	}
+	for cn, o := range bad {
+		if _, err := d.NewUser(cn, o); err == nil {
+			t.Fatalf("%s: issued a bad cert", cn)
+		}
+	}
+	if _, err := d.NewServer("tsa.example.com", &CertOpts{Profile: ProfileTSA}); err == nil {
+		t.Fatalf("issued a TSA server cert")
+	}
+}
+
+func TestTSACert(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	ta, err := d.TSA("tsa", &CertOpts{Signer: "ica"})
+	if err != nil {
+		t.Fatalf("tsa: %s", err)
+	}
+	if !isTSACert(ta.Cert) || ta.Cert.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Fatalf("tsa: bad usage %v %x", ta.Cert.ExtKeyUsage, ta.Cert.KeyUsage)
+	}
+	if ta.Cert.Issuer.CommonName != "ica" || len(ta.Chain) != 1 {
+		t.Fatalf("tsa: bad chain %v", ta.Chain)
+	}
+
+	// the existing cert is used
+	tb, err := d.TSA("tsa", nil)
+	if err != nil {
+		t.Fatalf("tsa: %s", err)
+	}
+	if tb.Cert.SerialNumber.Cmp(ta.Cert.SerialNumber) != 0 {
+		t.Fatalf("tsa: cert was reissued")
+	}
+
+	if _, err := d.NewUser("builder", &CertOpts{Profile: ProfileCodeSign}); err != nil {
+		t.Fatalf("codesign: %s", err)
+	}
+	if _, err := d.TSA("builder", nil); err == nil {
+		t.Fatalf("used a code signing cert for time-stamps")
+	}
+
+	// renew keeps the profile
+	if _, err := d.Renew("tsa", nil); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if tc, err := d.TSA("tsa", nil); err != nil || tc.Cert.SerialNumber.Cmp(ta.Cert.SerialNumber) == 0 {
+		t.Fatalf("renewed tsa: %v", err)
+	}
+}
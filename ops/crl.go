@@ -0,0 +1,125 @@
+// crl.go -- list revoked certs and generate CRLs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// CRLOpts describes a new CRL
+type CRLOpts struct {
+	// Validity of the CRL; defaults to 1 day
+	Validity time.Duration
+
+	// Return the DER encoded CRL instead of PEM
+	DER bool
+}
+
+// CRL returns a new CRL signed by the root CA with all the revoked
+// certs in the DB.
+func (d *DB) CRL(o *CRLOpts) ([]byte, error) {
+	v := o.Validity
+	if v == 0 {
+		v = 24 * time.Hour
+	}
+
+	rv, err := d.Revoked()
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := d.CA.ListRevoked()
+	if err != nil {
+		return nil, fmt.Errorf("can't list revoked certs: %w", err)
+	}
+
+	var crl []byte
+
+	// go-pki only does CRLs in units of days and doesn't know
+	// about the certs we minted or superseded.
+	if len(rv) == len(all) && v%(24*time.Hour) == 0 {
+		crl, err = d.CA.CRL(int(v / (24 * time.Hour)))
+	} else {
+		crl, err = makeCRL(d.CA, rv, v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if o.DER {
+		blk, _ := pem.Decode(crl)
+		if blk == nil {
+			return nil, fmt.Errorf("can't decode CRL")
+		}
+		crl = blk.Bytes
+	}
+	return crl, nil
+}
+
+// Revoked returns all the revoked certs in the DB
+func (d *DB) Revoked() ([]pki.Revoked, error) {
+	rv, err := d.pkiRevoked()
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := d.st.revoked()
+	if err != nil {
+		return nil, fmt.Errorf("can't list revoked certs: %w", err)
+	}
+
+	for _, z := range srv {
+		rv = append(rv, pki.Revoked{
+			Certificate: z.x,
+			When:        z.Revoked,
+		})
+	}
+	return rv, nil
+}
+
+// Make a CRL signed by 'ca' with the revoked certs 'rv'
+func makeCRL(ca *pki.CA, rv []pki.Revoked, validity time.Duration) ([]byte, error) {
+	var ents []x509.RevocationListEntry
+	for _, z := range rv {
+		ents = append(ents, x509.RevocationListEntry{
+			SerialNumber:   z.SerialNumber,
+			RevocationTime: z.When,
+		})
+	}
+
+	sk, err := caSigner(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	tmpl := &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+		RevokedCertificateEntries: ents,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.Certificate, sk)
+	if err != nil {
+		return nil, fmt.Errorf("can't create CRL: %w", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "X509 CRL",
+		Bytes: der,
+	}), nil
+}
@@ -0,0 +1,91 @@
+// crl_test.go -- tests for CRL generation
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCRL(t *testing.T) {
+	d := newTestDB(t)
+
+	a, err := d.NewServer("a.example.com", nil)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	crl, err := d.CRL(&CRLOpts{})
+	if err != nil {
+		t.Fatalf("crl: %s", err)
+	}
+	rl := parseCRL(t, d, crl, false)
+	if n := len(rl.RevokedCertificateEntries); n != 0 {
+		t.Fatalf("crl: exp 0 entries, saw %d", n)
+	}
+
+	// one revoked cert from each of the main DB and the store
+	b, err := d.NewServer("b.example.com", &CertOpts{NotBefore: time.Now()})
+	if err != nil {
+		t.Fatalf("minted server: %s", err)
+	}
+	for _, cn := range []string{"a.example.com", "b.example.com"} {
+		if err := d.Revoke(cn); err != nil {
+			t.Fatalf("revoke %s: %s", cn, err)
+		}
+	}
+
+	o := &CRLOpts{
+		Validity: 12 * time.Hour,
+		DER:      true,
+	}
+	crl, err = d.CRL(o)
+	if err != nil {
+		t.Fatalf("crl: %s", err)
+	}
+	rl = parseCRL(t, d, crl, true)
+
+	if v := rl.NextUpdate.Sub(rl.ThisUpdate); v != 12*time.Hour {
+		t.Fatalf("crl validity: exp 12h, saw %s", v)
+	}
+
+	seen := make(map[string]bool)
+	for _, e := range rl.RevokedCertificateEntries {
+		seen[e.SerialNumber.String()] = true
+	}
+	for _, sn := range []*big.Int{a.SerialNumber, b.SerialNumber} {
+		if !seen[sn.String()] {
+			t.Fatalf("crl: missing serial %#x", sn)
+		}
+	}
+}
+
+func parseCRL(t *testing.T, d *DB, crl []byte, der bool) *x509.RevocationList {
+	t.Helper()
+
+	if !der {
+		blk, _ := pem.Decode(crl)
+		if blk == nil || blk.Type != "X509 CRL" {
+			t.Fatalf("crl: not PEM")
+		}
+		crl = blk.Bytes
+	}
+
+	rl, err := x509.ParseRevocationList(crl)
+	if err != nil {
+		t.Fatalf("crl: %s", err)
+	}
+	if err := rl.CheckSignatureFrom(d.CA.Certificate); err != nil {
+		t.Fatalf("crl: bad signature: %s", err)
+	}
+	return rl
+}
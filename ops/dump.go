@@ -0,0 +1,193 @@
+// dump.go -- encrypted, partial and keyless JSON exports
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var exportMagic = []byte("certik-export-v1\n")
+
+// the key that marks a partial JSON export
+const jsonCertsKey = "certik_certs"
+
+// DumpOpts describes a JSON export of the DB
+type DumpOpts struct {
+	// Only export the certs signed by this CA
+	Signer string
+
+	// Only export the certs of these kinds
+	Kinds []string
+
+	// Leave out the private keys
+	NoKeys bool
+
+	// Encrypt the export with this key
+	Seal *SealKey
+}
+
+// DumpedCert is a cert in a partial JSON export
+type DumpedCert struct {
+	CN        string    `json:"cn"`
+	Kind      string    `json:"kind"`
+	Signer    string    `json:"signer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Meta      *Meta     `json:"meta,omitempty"`
+
+	// PEM encoded cert and private key
+	Cert string `json:"cert"`
+	Key  string `json:"key,omitempty"`
+
+	// the encryption cert and key of a split S/MIME pair
+	EncCert string `json:"enc_cert,omitempty"`
+	EncKey  string `json:"enc_key,omitempty"`
+}
+
+// a partial JSON export
+type certDump struct {
+	Format  int           `json:"certik_certs"`
+	Created time.Time     `json:"created"`
+	CA      string        `json:"ca"`
+	Certs   []*DumpedCert `json:"certs"`
+}
+
+// Dump writes a JSON export of the DB to 'w'. Without a signer, kinds
+// or NoKeys, it is the full dump of ExportJSON (the main DB and the
+// companion store, but not the request queue) that can initialize a
+// new DB. Otherwise, it lists the matching certs with their keys and
+// metadata; CA keys are only in full dumps.
+func (d *DB) Dump(w io.Writer, o *DumpOpts) error {
+	var b bytes.Buffer
+
+	if len(o.Signer) == 0 && len(o.Kinds) == 0 && !o.NoKeys {
+		if err := d.ExportJSON(&b); err != nil {
+			return err
+		}
+	} else {
+		certs, err := d.dumpCerts(o)
+		if err != nil {
+			return err
+		}
+
+		cd := &certDump{
+			Format:  1,
+			Created: time.Now().UTC(),
+			CA:      d.CA.Subject.CommonName,
+			Certs:   certs,
+		}
+		enc := json.NewEncoder(&b)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cd); err != nil {
+			return err
+		}
+	}
+
+	if o.Seal == nil {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+
+	ct, err := seal(exportMagic, o.Seal, b.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(ct)
+	return err
+}
+
+// SealedJSON returns true if 'b' is an encrypted JSON export
+func SealedJSON(b []byte) bool {
+	return isSealed(exportMagic, b)
+}
+
+// OpenJSON decrypts the encrypted JSON export 'b'
+func OpenJSON(b []byte, k *SealKey) ([]byte, error) {
+	js, err := unseal(exportMagic, k, b)
+	if err != nil {
+		return nil, fmt.Errorf("export: %w", err)
+	}
+	return js, nil
+}
+
+// return the certs of a partial export
+func (d *DB) dumpCerts(o *DumpOpts) ([]*DumpedCert, error) {
+	certs, err := d.Query(&Query{Signer: o.Signer, Kinds: o.Kinds, Sort: SortCN})
+	if err != nil {
+		return nil, err
+	}
+
+	var v []*DumpedCert
+	for _, c := range certs {
+		dc := &DumpedCert{
+			CN:        c.Subject.CommonName,
+			Kind:      c.Kind,
+			Signer:    c.Issuer.CommonName,
+			Serial:    fmt.Sprintf("%#x", c.SerialNumber),
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+			Cert: string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: c.Raw,
+			})),
+		}
+		if !c.Meta.Empty() {
+			dc.Meta = &c.Meta
+		}
+		v = append(v, dc)
+
+		if o.NoKeys || c.Kind == KindRoot || c.Kind == KindCA {
+			continue
+		}
+
+		// certs of the main DB, then the ones minted by certik
+		if ck, _ := d.CA.Find(dc.CN); ck != nil {
+			_, key := ck.PEM()
+			dc.Key = string(key)
+			continue
+		}
+
+		sc, err := d.st.get(dc.CN)
+		if err != nil {
+			return nil, err
+		}
+		dc.Key = string(sc.Key)
+		if sc.enc != nil {
+			dc.EncCert = string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: sc.EncCert,
+			}))
+			dc.EncKey = string(sc.EncKey)
+		}
+	}
+	return v, nil
+}
+
+// return an error if 'js' can't initialize a DB
+func checkFullDump(js string) error {
+	if isSealed(exportMagic, []byte(js)) {
+		return errors.New("the JSON export is encrypted")
+	}
+
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(js), &dump); err != nil {
+		return err
+	}
+	if _, ok := dump[jsonCertsKey]; ok {
+		return errors.New("a partial JSON export or one without keys can't initialize a DB")
+	}
+	return nil
+}
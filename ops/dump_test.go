@@ -0,0 +1,117 @@
+// dump_test.go -- tests for encrypted and partial JSON exports
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("server-ca", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewServer("web.example.com", &CertOpts{Signer: "server-ca", Owner: "bob"}); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1.example.com"}}); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	if _, err := d.NewUser("alice", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+
+	dump := func(o *DumpOpts) []byte {
+		t.Helper()
+		var b bytes.Buffer
+		if err := d.Dump(&b, o); err != nil {
+			t.Fatalf("dump %+v: %s", o, err)
+		}
+		return b.Bytes()
+	}
+	certs := func(js []byte) string {
+		t.Helper()
+		var cd certDump
+		if err := json.Unmarshal(js, &cd); err != nil {
+			t.Fatalf("partial dump: %s", err)
+		}
+		var v []string
+		for _, c := range cd.Certs {
+			s := c.CN
+			if len(c.Key) > 0 {
+				s += "+key"
+			}
+			v = append(v, s)
+		}
+		return strings.Join(v, " ")
+	}
+
+	// an encrypted full dump initializes a DB once decrypted
+	pw := &SealKey{Passwd: "export-pw"}
+	b := dump(&DumpOpts{Seal: pw})
+	if !SealedJSON(b) || bytes.Contains(b, []byte("web.example.com")) {
+		t.Fatalf("full dump isn't encrypted")
+	}
+	if _, err := InitFromJSON(filepath.Join(t.TempDir(), "x.db"), testPw, string(b)); err == nil {
+		t.Fatalf("initialized from an encrypted dump")
+	}
+	if _, err := OpenJSON(b, &SealKey{Passwd: "wrong"}); err == nil {
+		t.Fatalf("decrypted with the wrong passphrase")
+	}
+	js, err := OpenJSON(b, pw)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	e, err := InitFromJSON(filepath.Join(t.TempDir(), "copy.db"), testPw, string(js))
+	if err != nil {
+		t.Fatalf("import: %s", err)
+	}
+	defer e.Close()
+	if c, err := e.Find("web.example.com"); err != nil || c.Meta.Owner != "bob" {
+		t.Fatalf("import: %v %v", c, err)
+	}
+
+	// partial dumps list the certs
+	if got := certs(dump(&DumpOpts{Signer: "server-ca"})); got != "web.example.com+key" {
+		t.Fatalf("signer: saw %q", got)
+	}
+	b = dump(&DumpOpts{NoKeys: true})
+	if got := certs(b); got != "alice etcd-1 server-ca test-ca web.example.com" {
+		t.Fatalf("no keys: saw %q", got)
+	}
+	if bytes.Contains(b, []byte("PRIVATE KEY")) {
+		t.Fatalf("no keys: dumped a private key")
+	}
+	if _, err := InitFromJSON(filepath.Join(t.TempDir(), "y.db"), testPw, string(b)); err == nil {
+		t.Fatalf("initialized from a partial dump")
+	}
+
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("keygen: %s", err)
+	}
+	b = dump(&DumpOpts{Kinds: []string{KindPeer, KindUser}, Seal: &SealKey{Public: sk.PublicKey()}})
+	if _, err := OpenJSON(b, pw); err == nil {
+		t.Fatalf("decrypted without the private key")
+	}
+	js, err = OpenJSON(b, &SealKey{Private: sk})
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if got := certs(js); got != "alice+key etcd-1+key" {
+		t.Fatalf("kinds: saw %q", got)
+	}
+}
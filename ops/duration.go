@@ -0,0 +1,180 @@
+// duration.go -- parse validity durations and timestamps
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durUnits = map[byte]time.Duration{
+	'w': 7 * 24 * time.Hour,
+	'd': 24 * time.Hour,
+	'h': time.Hour,
+	'm': time.Minute,
+	's': time.Second,
+}
+
+// ParseValidity parses a validity duration such as "2y", "90d", "12h",
+// "15m" or a combination like "1d12h". Recognized units are y, w, d, h,
+// m (minutes) and s. A bare number is interpreted in units of 'def' -
+// this keeps the older "-V 5" style working.
+func ParseValidity(s string, def byte) (time.Duration, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	if len(str) == 0 {
+		return 0, fmt.Errorf("empty validity")
+	}
+
+	if _, err := strconv.ParseUint(str, 10, 32); err == nil {
+		str += string(def)
+	}
+
+	var d time.Duration
+	for len(str) > 0 {
+		i := 0
+		for i < len(str) && str[i] >= '0' && str[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(str) {
+			return 0, fmt.Errorf("invalid validity '%s'; try 2y, 90d, 12h or 15m", s)
+		}
+
+		n, err := strconv.ParseUint(str[:i], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid validity '%s': %w", s, err)
+		}
+
+		u := str[i]
+		if u == 'y' {
+			d += Years(uint(n))
+		} else if v, ok := durUnits[u]; ok {
+			d += time.Duration(n) * v
+		} else {
+			return 0, fmt.Errorf("invalid validity '%s': unknown unit '%c'", s, u)
+		}
+		str = str[i+1:]
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("validity '%s' must be positive", s)
+	}
+	return d, nil
+}
+
+var timeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTime parses an absolute timestamp; timestamps without a zone
+// are in UTC.
+func ParseTime(s string) (time.Time, error) {
+	for _, f := range timeFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp '%s'; try YYYY-MM-DD or RFC3339", s)
+}
+
+// validity window of a new cert
+type window struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Explicit is true if the caller wants a NotBefore that go-pki can't
+// express.
+func (w *window) Explicit() bool {
+	return !w.NotBefore.IsZero()
+}
+
+// Duration returns the validity of the window relative to now
+func (w *window) Duration() time.Duration {
+	return w.NotAfter.Sub(time.Now().UTC())
+}
+
+// Build the validity window of a new cert from 'o'; 'def' is the
+// validity to use if 'o' doesn't have one.
+func newWindow(o *CertOpts, def time.Duration) (*window, error) {
+	if o.Validity < 0 || o.Skew < 0 {
+		return nil, fmt.Errorf("validity and skew must be positive")
+	}
+	if o.Validity > 0 && !o.NotAfter.IsZero() {
+		return nil, fmt.Errorf("validity and NotAfter are mutually exclusive")
+	}
+
+	now := time.Now().UTC()
+	w := &window{
+		NotBefore: o.NotBefore.UTC(),
+	}
+
+	if o.Skew > 0 {
+		if w.NotBefore.IsZero() {
+			w.NotBefore = now
+		}
+		w.NotBefore = w.NotBefore.Add(-o.Skew)
+	}
+
+	start := now
+	if !w.NotBefore.IsZero() {
+		start = w.NotBefore
+	}
+
+	if !o.NotAfter.IsZero() {
+		w.NotAfter = o.NotAfter.UTC()
+	} else {
+		v := o.Validity
+		if v == 0 {
+			v = def
+		}
+		w.NotAfter = start.Add(v)
+	}
+
+	if !w.NotAfter.After(start) {
+		return nil, fmt.Errorf("NotAfter %s is not after NotBefore %s", w.NotAfter, start)
+	}
+	return w, nil
+}
+
+// Issued certs must never outlive their signer; clamp NotAfter to
+// the signer's NotAfter. It is an error if the signer has already
+// expired.
+func (d *DB) clamp(w *window, signer *x509.Certificate) error {
+	now := time.Now().UTC()
+	if !signer.NotAfter.After(now) {
+		return fmt.Errorf("signer %s expired on %s", signer.Subject.CommonName, signer.NotAfter)
+	}
+
+	if w.NotAfter.After(signer.NotAfter) {
+		d.warn("clamping NotAfter %s to signer %s NotAfter %s",
+			w.NotAfter.Format(time.RFC3339), signer.Subject.CommonName, signer.NotAfter.Format(time.RFC3339))
+		w.NotAfter = signer.NotAfter
+	}
+
+	if w.Explicit() && !w.NotAfter.After(w.NotBefore) {
+		return fmt.Errorf("NotBefore %s is after signer %s NotAfter", w.NotBefore, signer.Subject.CommonName)
+	}
+	return nil
+}
+
+// Years converts a duration in years to time.Duration
+// 365.25 days/year * 24 hours/day
+// .25 days/year = 24 hours / 4 = 6 hrs
+func Years(n uint) time.Duration {
+	day := 24 * time.Hour
+	return (6 * time.Hour) + (time.Duration(n*365) * day)
+}
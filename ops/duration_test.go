@@ -0,0 +1,83 @@
+// duration_test.go -- tests for validity and timestamp parsing
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseValidity(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		s   string
+		def byte
+		exp time.Duration
+	}{
+		{"2y", 'y', Years(2)},
+		{"5", 'y', Years(5)},
+		{"7", 'd', 7 * day},
+		{"90d", 'y', 90 * day},
+		{"2w", 'y', 14 * day},
+		{"12h", 'y', 12 * time.Hour},
+		{"15m", 'y', 15 * time.Minute},
+		{"30s", 'y', 30 * time.Second},
+		{"1d12h", 'y', day + 12*time.Hour},
+		{" 1D ", 'y', day},
+	}
+
+	for _, x := range tests {
+		d, err := ParseValidity(x.s, x.def)
+		if err != nil {
+			t.Fatalf("%q: %s", x.s, err)
+		}
+		if d != x.exp {
+			t.Fatalf("%q: exp %s, saw %s", x.s, x.exp, d)
+		}
+	}
+
+	for _, s := range []string{"", "d", "12", "1x", "0d", "1d2", "-1d"} {
+		def := byte('q')
+		if s == "12" {
+			def = 'x'
+		}
+		if d, err := ParseValidity(s, def); err == nil {
+			t.Fatalf("%q: exp error, saw %s", s, d)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	exp := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		s   string
+		exp time.Time
+	}{
+		{"2030-01-02T03:04:05Z", exp},
+		{"2030-01-02T05:04:05+02:00", exp},
+		{"2030-01-02T03:04:05", exp},
+		{"2030-01-02 03:04:05", exp},
+		{"2030-01-02T03:04", exp.Truncate(time.Minute)},
+		{"2030-01-02", exp.Truncate(24 * time.Hour)},
+	}
+
+	for _, x := range tests {
+		tm, err := ParseTime(x.s)
+		if err != nil {
+			t.Fatalf("%q: %s", x.s, err)
+		}
+		if !tm.Equal(x.exp) || tm.Location() != time.UTC {
+			t.Fatalf("%q: exp %s, saw %s", x.s, x.exp, tm)
+		}
+	}
+
+	if _, err := ParseTime("next tuesday"); err == nil {
+		t.Fatalf("parsed an invalid timestamp")
+	}
+}
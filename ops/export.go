@@ -0,0 +1,273 @@
+// export.go -- Export a certificate & key
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// CertPEM returns the PEM encoded cert and key of 'cn'. If 'chain' is
+// set, the cert is followed by the rest of the CA certs in its chain.
+func (d *DB) CertPEM(cn string, chain bool) ([]byte, []byte, error) {
+	var crt, key []byte
+
+	c, err := d.CA.Find(cn)
+	switch {
+	case c == nil:
+		sc, err := d.st.get(cn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't find server, peer or user %s", cn)
+		}
+		crt, key = sc.PEM()
+	case err != nil:
+		return nil, nil, fmt.Errorf("can't find server, peer or user %s", cn)
+	default:
+		crt, key = c.PEM()
+	}
+
+	if !chain {
+		return crt, key, nil
+	}
+
+	certs, err := d.Chain(cn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cw bytes.Buffer
+	for _, x := range certs {
+		pem.Encode(&cw, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: x.Raw,
+		})
+	}
+	return cw.Bytes(), key, nil
+}
+
+// Chain returns the cert 'cn' followed by the CA certs in its chain
+func (d *DB) Chain(cn string) ([]*x509.Certificate, error) {
+	ca := d.CA
+	c, err := d.Find(cn)
+	if err != nil {
+		return nil, fmt.Errorf("can't find %s: %w", cn, err)
+	}
+
+	var cas []*pki.CA
+	var certs []*x509.Certificate
+
+	if c.Kind == KindCA || c.Kind == KindRoot {
+		pc, err := ca.Find(cn)
+		if pc == nil {
+			return nil, fmt.Errorf("can't find %s: %w", cn, err)
+		}
+
+		// the chain of a CA starts with the CA itself
+		cas, err = ca.ChainFor(pc)
+		if err != nil {
+			return nil, fmt.Errorf("can't find cert chain: %w", err)
+		}
+	} else {
+		cas, err = issuerChain(ca, c.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c.Certificate)
+	}
+
+	for _, z := range cas {
+		certs = append(certs, z.Certificate)
+	}
+	return certs, nil
+}
+
+// Return the PEM encoded chain of CA certs that issued 'cn'
+func (d *DB) chainPEM(cn string) ([]byte, error) {
+	c, err := d.Find(cn)
+	if err != nil {
+		return nil, fmt.Errorf("can't find %s: %w", cn, err)
+	}
+
+	cas, err := issuerChain(d.CA, c.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	for _, z := range cas {
+		b.Write(z.PEM())
+	}
+	return b.Bytes(), nil
+}
+
+// Return the chain of CA certs that issued 'c' starting with its
+// issuer and ending with the root-CA.
+func issuerChain(ca *pki.CA, c *x509.Certificate) ([]*pki.CA, error) {
+	icn := c.Issuer.CommonName
+	if icn == ca.Subject.CommonName {
+		return []*pki.CA{ca}, nil
+	}
+
+	ic, err := ca.Find(icn)
+	if ic == nil {
+		return nil, fmt.Errorf("can't find issuer %s: %w", icn, err)
+	}
+
+	cas, err := ca.ChainFor(ic)
+	if err != nil {
+		return nil, fmt.Errorf("can't find cert chain: %w", err)
+	}
+	return cas, nil
+}
+
+// TrustBundle returns the PEM encoded root-CA and unexpired intermediate
+// CA certs. If 'signer' is set, only return its chain and the CAs below
+// it.
+func (d *DB) TrustBundle(signer string) ([]byte, error) {
+	ca := d.CA
+	cas, err := ca.GetCAs()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch CAs: %w", err)
+	}
+
+	var b bytes.Buffer
+	if len(signer) == 0 {
+		b.Write(ca.PEM())
+		now := time.Now().UTC()
+		for _, c := range cas {
+			if c.SerialNumber.Cmp(ca.SerialNumber) == 0 || now.After(c.NotAfter) {
+				continue
+			}
+			b.Write(c.PEM())
+		}
+		return b.Bytes(), nil
+	}
+
+	sc, err := ca.Find(signer)
+	if err != nil || !sc.IsCA {
+		return nil, fmt.Errorf("can't find CA %s", signer)
+	}
+
+	// the signer and its ancestors
+	chain, err := ca.ChainFor(sc)
+	if err != nil {
+		return nil, fmt.Errorf("can't find cert chain: %w", err)
+	}
+	for _, c := range chain {
+		b.Write(c.PEM())
+	}
+
+	// and every CA that has the signer in its chain
+	now := time.Now().UTC()
+	for _, c := range cas {
+		if c.SerialNumber.Cmp(sc.SerialNumber) == 0 || now.After(c.NotAfter) {
+			continue
+		}
+
+		z, err := ca.Find(c.Subject.CommonName)
+		if err != nil {
+			continue
+		}
+		zc, err := ca.ChainFor(z)
+		if err != nil {
+			return nil, fmt.Errorf("can't find cert chain of %s: %w", c.Subject.CommonName, err)
+		}
+		for _, y := range zc {
+			if y.SerialNumber.Cmp(sc.SerialNumber) == 0 {
+				b.Write(c.PEM())
+				break
+			}
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// ExportBinary returns the cert 'cn' (or the root-CA if 'cn' is empty)
+// in one of the binary formats:
+//
+//   - der: the DER encoded cert
+//   - pkcs8: the DER encoded PKCS#8 private key
+//   - p7b: a certs-only PKCS#7 bundle of the cert and its chain
+func (d *DB) ExportBinary(format, cn string, chain bool) ([]byte, error) {
+	var out []byte
+
+	ca := d.CA
+	rootCA := len(cn) == 0
+
+	switch format {
+	case "der":
+		if chain {
+			return nil, fmt.Errorf("DER holds a single cert; use p7b for the chain")
+		}
+
+		if rootCA {
+			out = ca.Raw
+			break
+		}
+
+		c, err := d.Find(cn)
+		if err != nil {
+			return nil, fmt.Errorf("can't find %s: %w", cn, err)
+		}
+		out = c.Raw
+
+	case "pkcs8":
+		if rootCA {
+			return nil, fmt.Errorf("won't export the root-CA private key")
+		}
+
+		_, kp, err := d.CertPEM(cn, false)
+		if err != nil {
+			return nil, err
+		}
+
+		blk, _ := pem.Decode(kp)
+		if blk == nil {
+			return nil, fmt.Errorf("%s: can't decode private key", cn)
+		}
+		if encryptedKey(blk) {
+			return nil, fmt.Errorf("%s: private key is password protected", cn)
+		}
+
+		sk, err := parseKey(blk.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+		out, err = x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+
+	case "p7b":
+		certs := []*x509.Certificate{ca.Certificate}
+		if !rootCA {
+			var err error
+			certs, err = d.Chain(cn)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		out, err = PKCS7Certs(certs)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown binary format %s", format)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,379 @@
+// export_test.go -- tests for exporting certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decode all the PEM certs in 'b'
+func pemCerts(t *testing.T, b []byte) []*x509.Certificate {
+	t.Helper()
+
+	var certs []*x509.Certificate
+	for {
+		var blk *pem.Block
+		blk, b = pem.Decode(b)
+		if blk == nil {
+			break
+		}
+		if blk.Type != "CERTIFICATE" {
+			t.Fatalf("unexpected PEM block %s", blk.Type)
+		}
+
+		c, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			t.Fatalf("can't parse cert: %s", err)
+		}
+		certs = append(certs, c)
+	}
+	return certs
+}
+
+// return the CNs of 'certs'
+func cns(certs []*x509.Certificate) []string {
+	var v []string
+	for _, c := range certs {
+		v = append(v, c.Subject.CommonName)
+	}
+	return v
+}
+
+// make a DB with a two level hierarchy: root -> ica -> sub-ica
+func newChainDB(t *testing.T) *DB {
+	t.Helper()
+
+	d := newTestDB(t)
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewIntermediate("sub-ica", &CertOpts{Signer: "ica"}); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewServer("a.example.com", &CertOpts{Signer: "sub-ica"}); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	o := &CertOpts{Signer: "sub-ica", NotBefore: time.Now()}
+	if _, err := d.NewServer("b.example.com", o); err != nil {
+		t.Fatalf("minted server: %s", err)
+	}
+	return d
+}
+
+func TestCertPEM(t *testing.T) {
+	d := newChainDB(t)
+
+	for _, cn := range []string{"a.example.com", "b.example.com"} {
+		crt, key, err := d.CertPEM(cn, false)
+		if err != nil {
+			t.Fatalf("%s: %s", cn, err)
+		}
+
+		certs := pemCerts(t, crt)
+		if len(certs) != 1 || certs[0].Subject.CommonName != cn {
+			t.Fatalf("%s: exp a single cert, saw %v", cn, cns(certs))
+		}
+
+		blk, _ := pem.Decode(key)
+		if blk == nil {
+			t.Fatalf("%s: no private key", cn)
+		}
+		sk, err := parseKey(blk.Bytes)
+		if err != nil {
+			t.Fatalf("%s: %s", cn, err)
+		}
+		pk := sk.Public().(*ecdsa.PublicKey)
+		if !pk.Equal(certs[0].PublicKey) {
+			t.Fatalf("%s: key doesn't match cert", cn)
+		}
+
+		crt, _, err = d.CertPEM(cn, true)
+		if err != nil {
+			t.Fatalf("%s: chain: %s", cn, err)
+		}
+
+		exp := []string{cn, "sub-ica", "ica", "test-ca"}
+		if v := cns(pemCerts(t, crt)); !slices.Equal(v, exp) {
+			t.Fatalf("%s: chain: exp %v, saw %v", cn, exp, v)
+		}
+	}
+
+	if _, _, err := d.CertPEM("nope", false); err == nil {
+		t.Fatalf("exported a non-existent cert")
+	}
+}
+
+func TestChain(t *testing.T) {
+	d := newChainDB(t)
+
+	tests := []struct {
+		cn  string
+		exp []string
+	}{
+		{"a.example.com", []string{"a.example.com", "sub-ica", "ica", "test-ca"}},
+		{"sub-ica", []string{"sub-ica", "ica", "test-ca"}},
+		{"ica", []string{"ica", "test-ca"}},
+		{"test-ca", []string{"test-ca"}},
+	}
+
+	for _, x := range tests {
+		certs, err := d.Chain(x.cn)
+		if err != nil {
+			t.Fatalf("%s: %s", x.cn, err)
+		}
+		if v := cns(certs); !slices.Equal(v, x.exp) {
+			t.Fatalf("%s: exp %v, saw %v", x.cn, x.exp, v)
+		}
+	}
+
+	certs, err := d.Chain("b.example.com")
+	if err != nil {
+		t.Fatalf("chain: %s", err)
+	}
+	verifyChain(t, d, certs[0], x509.ExtKeyUsageServerAuth, certs[1:]...)
+}
+
+func TestTrustBundle(t *testing.T) {
+	d := newChainDB(t)
+	if _, err := d.NewIntermediate("other-ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	b, err := d.TrustBundle("")
+	if err != nil {
+		t.Fatalf("bundle: %s", err)
+	}
+	v := cns(pemCerts(t, b))
+	if len(v) != 4 || v[0] != "test-ca" {
+		t.Fatalf("bundle: exp all 4 CAs with the root first, saw %v", v)
+	}
+
+	b, err = d.TrustBundle("ica")
+	if err != nil {
+		t.Fatalf("bundle: %s", err)
+	}
+	exp := []string{"ica", "test-ca", "sub-ica"}
+	if v := cns(pemCerts(t, b)); !slices.Equal(v, exp) {
+		t.Fatalf("bundle: exp %v, saw %v", exp, v)
+	}
+
+	if _, err := d.TrustBundle("a.example.com"); err == nil {
+		t.Fatalf("made a bundle for a non-CA")
+	}
+}
+
+func TestExportBinary(t *testing.T) {
+	d := newChainDB(t)
+
+	der, err := d.ExportBinary("der", "", false)
+	if err != nil {
+		t.Fatalf("der: %s", err)
+	}
+	if !bytes.Equal(der, d.CA.Raw) {
+		t.Fatalf("der: not the root CA")
+	}
+
+	der, err = d.ExportBinary("der", "b.example.com", false)
+	if err != nil {
+		t.Fatalf("der: %s", err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil || c.Subject.CommonName != "b.example.com" {
+		t.Fatalf("der: bad cert: %v", err)
+	}
+
+	if _, err := d.ExportBinary("der", "a.example.com", true); err == nil {
+		t.Fatalf("der: exported a chain")
+	}
+
+	p8, err := d.ExportBinary("pkcs8", "a.example.com", false)
+	if err != nil {
+		t.Fatalf("pkcs8: %s", err)
+	}
+	sk, err := x509.ParsePKCS8PrivateKey(p8)
+	if err != nil {
+		t.Fatalf("pkcs8: %s", err)
+	}
+	a, _ := d.Find("a.example.com")
+	if !sk.(*ecdsa.PrivateKey).PublicKey.Equal(a.PublicKey) {
+		t.Fatalf("pkcs8: key doesn't match cert")
+	}
+
+	if _, err := d.ExportBinary("pkcs8", "", false); err == nil {
+		t.Fatalf("pkcs8: exported the root CA key")
+	}
+
+	p7, err := d.ExportBinary("p7b", "a.example.com", false)
+	if err != nil {
+		t.Fatalf("p7b: %s", err)
+	}
+	exp := []string{"a.example.com", "sub-ica", "ica", "test-ca"}
+	if v := cns(p7Certs(t, p7)); !slices.Equal(v, exp) {
+		t.Fatalf("p7b: exp %v, saw %v", exp, v)
+	}
+
+	if _, err := d.ExportBinary("pfx", "a.example.com", false); err == nil {
+		t.Fatalf("exported an unknown format")
+	}
+}
+
+// decode the certs in a degenerate PKCS#7 bundle
+func p7Certs(t *testing.T, der []byte) []*x509.Certificate {
+	t.Helper()
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatalf("p7b: %s", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("p7b: not signed data: %s", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("p7b: %s", err)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatalf("p7b: %s", err)
+	}
+	return certs
+}
+
+func TestExportK8s(t *testing.T) {
+	d := newChainDB(t)
+
+	decode := func(b []byte) []map[string]any {
+		var objs []map[string]any
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		for {
+			var m map[string]any
+			err := dec.Decode(&m)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("yaml: %s", err)
+			}
+			objs = append(objs, m)
+		}
+		return objs
+	}
+
+	var b bytes.Buffer
+	o := &K8sOpts{
+		Namespace: "web",
+		Labels:    map[string]string{"app": "www"},
+	}
+	if err := d.ExportK8s(&b, "k8s-secret", "a.example.com", o); err != nil {
+		t.Fatalf("k8s-secret: %s", err)
+	}
+
+	objs := decode(b.Bytes())
+	if len(objs) != 1 {
+		t.Fatalf("k8s-secret: exp 1 object, saw %d", len(objs))
+	}
+
+	s := objs[0]
+	meta := s["metadata"].(map[string]any)
+	if s["kind"] != "Secret" || s["type"] != "kubernetes.io/tls" {
+		t.Fatalf("k8s-secret: bad object %v", s)
+	}
+	if meta["name"] != "a.example.com-tls" || meta["namespace"] != "web" {
+		t.Fatalf("k8s-secret: bad metadata %v", meta)
+	}
+
+	data := s["data"].(map[string]any)
+	ca, err := base64.StdEncoding.DecodeString(data["ca.crt"].(string))
+	if err != nil {
+		t.Fatalf("k8s-secret: %s", err)
+	}
+	exp := []string{"sub-ica", "ica", "test-ca"}
+	if v := cns(pemCerts(t, ca)); !slices.Equal(v, exp) {
+		t.Fatalf("k8s-secret: ca.crt: exp %v, saw %v", exp, v)
+	}
+
+	b.Reset()
+	o = &K8sOpts{ClusterIssuer: true, Namespace: "cert-manager"}
+	if err := d.ExportK8s(&b, "cert-manager", "ica", o); err != nil {
+		t.Fatalf("cert-manager: %s", err)
+	}
+
+	objs = decode(b.Bytes())
+	if len(objs) != 2 || objs[0]["kind"] != "Secret" || objs[1]["kind"] != "ClusterIssuer" {
+		t.Fatalf("cert-manager: bad objects %v", objs)
+	}
+	if _, ok := objs[1]["metadata"].(map[string]any)["namespace"]; ok {
+		t.Fatalf("cert-manager: ClusterIssuer is namespaced")
+	}
+
+	if err := d.ExportK8s(&b, "cert-manager", "a.example.com", o); err == nil {
+		t.Fatalf("cert-manager: made an issuer from a server cert")
+	}
+
+	// password protected keys are decrypted for kubernetes
+	if _, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1"}, Passwd: "key-pw"}); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	if err := d.ExportK8s(&b, "k8s-secret", "etcd-1", &K8sOpts{}); err == nil {
+		t.Fatalf("k8s-secret: exported an encrypted key")
+	}
+	b.Reset()
+	if err := d.ExportK8s(&b, "k8s-secret", "etcd-1", &K8sOpts{KeyPasswd: "key-pw"}); err != nil {
+		t.Fatalf("k8s-secret: %s", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(decode(b.Bytes())[0]["data"].(map[string]any)["tls.key"].(string))
+	if err != nil {
+		t.Fatalf("k8s-secret: %s", err)
+	}
+	if blk, _ := pem.Decode(key); blk == nil || blk.Type != "PRIVATE KEY" {
+		t.Fatalf("k8s-secret: tls.key isn't decrypted")
+	}
+
+	b.Reset()
+	if err := d.ExportK8s(&b, "k8s-configmap", "", &K8sOpts{}); err != nil {
+		t.Fatalf("k8s-configmap: %s", err)
+	}
+	objs = decode(b.Bytes())
+	if len(objs) != 1 || objs[0]["kind"] != "ConfigMap" {
+		t.Fatalf("k8s-configmap: bad objects %v", objs)
+	}
+	bundle := objs[0]["data"].(map[string]any)["ca.crt"].(string)
+	if n := len(pemCerts(t, []byte(bundle))); n != 3 {
+		t.Fatalf("k8s-configmap: exp 3 CAs, saw %d", n)
+	}
+}
+
+func TestK8sName(t *testing.T) {
+	tests := map[string]string{
+		"a.example.com":   "a.example.com",
+		"Alice@Example":   "alice-example",
+		"--my CA--":       "my-ca",
+		"web_server.prod": "web-server.prod",
+	}
+
+	for in, exp := range tests {
+		if v := k8sName(in); v != exp {
+			t.Fatalf("%q: exp %q, saw %q", in, exp, v)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// gc.go -- purge expired certs and revoked entries from the DB
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// serial numbers of certs removed by GC; the main DB can't delete
+// certs, so its copies are hidden and kept off the CRL.
+var bucketPurged = []byte("purged")
+
+var archiveMagic = []byte("certik-archive-v1\n")
+
+// where an archived cert was in the DB
+const (
+	fromStore      = "store"
+	fromPKI        = "pki"
+	fromSuperseded = "superseded"
+	fromRevoked    = "revoked"
+	fromPKIRevoked = "pki-revoked"
+
+	// the encryption half of an S/MIME pair goes with its pair
+	fromPair = "pair"
+)
+
+// GCOpts describes what GC removes
+type GCOpts struct {
+	// Remove certs that expired before this time; the default (and
+	// the latest) is now
+	ExpiredBefore time.Time
+
+	// Don't keep the private keys of the removed certs in the archive.
+	// The main DB can't delete keys, so its certs (and the superseded
+	// and revoked copies of them) are kept; see Archive.Kept.
+	Shred bool
+}
+
+// Archive is the record of the certs removed by GC
+type Archive struct {
+	Created       time.Time       `json:"created"`
+	ExpiredBefore time.Time       `json:"expired_before"`
+	Certs         []*ArchivedCert `json:"certs"`
+
+	// expired certs that GC leaves alone because their keys can't be
+	// shredded
+	Kept []*ArchivedCert `json:"-"`
+}
+
+// ArchivedCert is a cert removed by GC
+type ArchivedCert struct {
+	CN         string    `json:"cn"`
+	Kind       string    `json:"kind"`
+	State      string    `json:"state"`
+	Serial     string    `json:"serial"`
+	NotAfter   time.Time `json:"not_after"`
+	Revoked    time.Time `json:"revoked,omitzero"`
+	Superseded time.Time `json:"superseded,omitzero"`
+	Meta       *Meta     `json:"meta,omitempty"`
+
+	// PEM encoded cert and private key
+	Cert string `json:"cert"`
+	Key  string `json:"key,omitempty"`
+
+	from string
+	x    *x509.Certificate
+}
+
+// record of a purged cert
+type purged struct {
+	CN     string    `json:"cn"`
+	Purged time.Time `json:"purged"`
+}
+
+// GCPlan returns the certs that GC would remove: the server, peer and
+// user certs, the superseded certs and the revoked entries that
+// expired before o.ExpiredBefore. CAs are never removed. The DB isn't
+// changed.
+func (d *DB) GCPlan(o *GCOpts) (*Archive, error) {
+	now := time.Now().UTC()
+	before := o.ExpiredBefore
+	if before.IsZero() || before.After(now) {
+		before = now
+	}
+
+	a := &Archive{
+		Created:       now,
+		ExpiredBefore: before,
+	}
+
+	// serials of the certs whose keys are in the main DB
+	inPKI := map[string]bool{}
+	if o.Shred {
+		rv, err := d.CA.ListRevoked()
+		if err != nil {
+			return nil, fmt.Errorf("can't list revoked certs: %w", err)
+		}
+		for _, z := range rv {
+			inPKI[z.SerialNumber.Text(16)] = true
+		}
+	}
+
+	add := func(c *Cert, from string, key []byte) {
+		if o.Shred {
+			key = nil
+		}
+		z := &ArchivedCert{
+			CN:         c.Subject.CommonName,
+			Kind:       c.Kind,
+			State:      c.State(),
+			Serial:     fmt.Sprintf("%#x", c.SerialNumber),
+			NotAfter:   c.NotAfter,
+			Revoked:    c.Revoked,
+			Superseded: c.Superseded,
+			Cert: string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: c.Raw,
+			})),
+			Key:  string(key),
+			from: from,
+			x:    c.Certificate,
+		}
+		if !c.Meta.Empty() {
+			z.Meta = &c.Meta
+		}
+
+		if o.Shred && (from == fromPKI || from == fromPKIRevoked || inPKI[c.SerialNumber.Text(16)]) {
+			a.Kept = append(a.Kept, z)
+			return
+		}
+		a.Certs = append(a.Certs, z)
+	}
+	expired := func(c *x509.Certificate) bool {
+		return c.NotAfter.Before(before)
+	}
+
+	certs, err := d.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		if c.Kind == KindRoot || c.Kind == KindCA || !expired(c.Certificate) {
+			continue
+		}
+
+		cn := c.Subject.CommonName
+		if ck, _ := d.CA.Find(cn); ck != nil {
+			_, key := ck.PEM()
+			add(c, fromPKI, key)
+			continue
+		}
+
+		sc, err := d.st.get(cn)
+		if err != nil {
+			return nil, err
+		}
+		add(c, fromStore, sc.Key)
+		if sc.enc != nil {
+			add(&Cert{Certificate: sc.enc, Kind: sc.Kind}, fromPair, sc.EncKey)
+		}
+	}
+
+	old, err := d.st.list(bucketSuperseded)
+	if err != nil {
+		return nil, fmt.Errorf("can't list superseded certs: %w", err)
+	}
+	for _, sc := range old {
+		if !expired(sc.x) {
+			continue
+		}
+
+		c := sc.cert()
+		c.Superseded = sc.Superseded
+		add(c, fromSuperseded, sc.Key)
+		if sc.enc != nil {
+			add(&Cert{Certificate: sc.enc, Kind: sc.Kind, Superseded: sc.Superseded}, fromPair, sc.EncKey)
+		}
+	}
+
+	srv, err := d.st.revoked()
+	if err != nil {
+		return nil, fmt.Errorf("can't list revoked certs: %w", err)
+	}
+	for _, sc := range srv {
+		if expired(sc.x) {
+			c := sc.cert()
+			c.Revoked = sc.Revoked
+			add(c, fromRevoked, sc.Key)
+		}
+	}
+
+	rv, err := d.pkiRevoked()
+	if err != nil {
+		return nil, err
+	}
+	for _, z := range rv {
+		if expired(z.Certificate) {
+			add(&Cert{Certificate: z.Certificate, Kind: certKind(z.Certificate), Revoked: z.When}, fromPKIRevoked, nil)
+		}
+	}
+	return a, nil
+}
+
+// GC removes the certs in 'a' from the DB and compacts the companion
+// store so that nothing of them is left in its free pages. Certs in
+// the main DB are revoked there and hidden; revoked entries are
+// dropped from future CRLs.
+func (d *DB) GC(a *Archive) error {
+	now := time.Now().UTC()
+	for _, z := range a.Certs {
+		k := z.x.SerialNumber.Text(16)
+
+		var err error
+		switch z.from {
+		case fromStore:
+			err = d.st.del(bucketCerts, z.CN)
+		case fromSuperseded:
+			err = d.st.del(bucketSuperseded, k)
+		case fromRevoked:
+			err = d.st.del(bucketRevoked, k)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%s: %s: %w", z.CN, z.Serial, err)
+		}
+
+		// superseded and revoked certs may also be in the main DB
+		if z.from != fromStore && z.from != fromPair {
+			if err := d.st.putJSON(bucketPurged, k, &purged{CN: z.CN, Purged: now}); err != nil {
+				return err
+			}
+		}
+
+		if z.from == fromPKI {
+			if err := d.revoke(z.CN); err != nil {
+				return fmt.Errorf("%s: %w", z.CN, err)
+			}
+		}
+		if z.from == fromStore || z.from == fromPKI {
+			if err := d.delMeta(z.CN); err != nil {
+				return err
+			}
+		}
+
+		if err := d.unindex(z.x); err != nil {
+			return err
+		}
+	}
+	return d.st.compact()
+}
+
+// Seal encrypts the archive with a key derived from 'pw'
+func (a *Archive) Seal(pw string) ([]byte, error) {
+	js, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return seal(archiveMagic, &SealKey{Passwd: pw}, js)
+}
+
+// OpenArchive decrypts an archive written by Seal
+func OpenArchive(b []byte, pw string) (*Archive, error) {
+	js, err := unseal(archiveMagic, &SealKey{Passwd: pw}, b)
+	if err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+
+	var a Archive
+	if err := json.Unmarshal(js, &a); err != nil {
+		return nil, fmt.Errorf("archive: %w", err)
+	}
+	return &a, nil
+}
+
+// remove the cert 'c' from the serial number and fingerprint index
+func (d *DB) unindex(c *x509.Certificate) error {
+	for _, e := range []struct {
+		b []byte
+		k string
+	}{
+		{bucketSerial, c.SerialNumber.Text(16)},
+		{bucketFingerprint, hex.EncodeToString(Fingerprint(c))},
+	} {
+		if err := d.st.del(e.b, e.k); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
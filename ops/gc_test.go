@@ -0,0 +1,159 @@
+// gc_test.go -- tests for purging expired certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	d := newTestDB(t)
+
+	now := time.Now()
+	past := &CertOpts{
+		NotBefore: now.Add(-60 * 24 * time.Hour),
+		NotAfter:  now.Add(-30 * 24 * time.Hour),
+		Owner:     "bob",
+	}
+
+	// expired certs in the companion store and in the main DB
+	if _, err := d.NewServer("old.example.com", past); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewUser("carol", past); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if err := d.Revoke("carol"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	if _, err := d.NewUser("dave", &CertOpts{Validity: time.Second}); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := d.NewUser("erin", &CertOpts{Validity: time.Second}); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if err := d.Revoke("erin"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	if _, err := d.NewServer("www.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	// nothing expired before then
+	a, err := d.GCPlan(&GCOpts{ExpiredBefore: now.Add(-90 * 24 * time.Hour)})
+	if err != nil || len(a.Certs) != 0 {
+		t.Fatalf("plan: %v %v", a, err)
+	}
+
+	a, err = d.GCPlan(&GCOpts{})
+	if err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+	var cns []string
+	for _, z := range a.Certs {
+		cns = append(cns, z.CN+":"+z.State)
+		if len(z.Key) == 0 && z.CN != "erin" {
+			t.Fatalf("%s: no key in the archive", z.CN)
+		}
+	}
+	slices.Sort(cns)
+	if got := strings.Join(cns, " "); got != "carol:revoked dave:expired erin:revoked old.example.com:expired" {
+		t.Fatalf("plan: saw %q", got)
+	}
+	if n := crlSerials(t, d); len(n) != 2 {
+		t.Fatalf("CRL: exp 2, saw %d", len(n))
+	}
+
+	b, err := a.Seal(testPw)
+	if err != nil {
+		t.Fatalf("seal: %s", err)
+	}
+	if strings.Contains(string(b), "PRIVATE KEY") {
+		t.Fatalf("archive isn't encrypted")
+	}
+
+	if err := d.GC(a); err != nil {
+		t.Fatalf("gc: %s", err)
+	}
+
+	certs, err := d.Query(&Query{})
+	if err != nil {
+		t.Fatalf("query: %s", err)
+	}
+	for _, c := range certs {
+		if c.Kind != KindRoot && c.Subject.CommonName != "www.example.com" {
+			t.Fatalf("gc left %s", c.Subject.CommonName)
+		}
+	}
+	for _, cn := range []string{"old.example.com", "carol", "dave", "erin"} {
+		if _, err := d.History(cn); err == nil {
+			t.Fatalf("gc left the history of %s", cn)
+		}
+	}
+	if _, err := d.FindSerial(a.Certs[0].x.SerialNumber); err == nil {
+		t.Fatalf("found a purged serial")
+	}
+	if rv, err := d.Revoked(); err != nil || len(rv) != 0 {
+		t.Fatalf("revoked: %v %v", rv, err)
+	}
+	if n := crlSerials(t, d); len(n) != 0 {
+		t.Fatalf("CRL: %v", n)
+	}
+	if m, _ := d.meta("old.example.com"); !m.Empty() {
+		t.Fatalf("gc left metadata %+v", m)
+	}
+
+	// the compacted DB works and purged CNs can be issued again
+	if _, err := d.NewUser("dave", nil); err != nil {
+		t.Fatalf("reissue: %s", err)
+	}
+	if _, err := d.NewServer("old.example.com", &CertOpts{NotBefore: now}); err != nil {
+		t.Fatalf("reissue: %s", err)
+	}
+	if a, err := d.GCPlan(&GCOpts{}); err != nil || len(a.Certs) != 0 {
+		t.Fatalf("plan: %v %v", a, err)
+	}
+
+	z, err := OpenArchive(b, testPw)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if len(z.Certs) != 4 {
+		t.Fatalf("open: exp 4 certs, saw %d", len(z.Certs))
+	}
+	for _, c := range z.Certs {
+		if c.CN == "old.example.com" && (c.Meta == nil || c.Meta.Owner != "bob") {
+			t.Fatalf("open: lost the metadata of %s", c.CN)
+		}
+	}
+	if _, err := OpenArchive(b, "wrong"); err == nil {
+		t.Fatalf("opened the archive with the wrong password")
+	}
+
+	// shredding keeps the keys out of the archive; the main DB
+	// can't delete its keys, so its certs stay
+	if _, err := d.NewUser("frank", &CertOpts{Validity: time.Second}); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := d.NewUser("gina", past); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	a, err = d.GCPlan(&GCOpts{Shred: true})
+	if err != nil || len(a.Certs) != 1 || a.Certs[0].CN != "gina" || len(a.Certs[0].Key) != 0 {
+		t.Fatalf("shred: %v %v", a, err)
+	}
+	if len(a.Kept) != 1 || a.Kept[0].CN != "frank" {
+		t.Fatalf("shred: kept %v", a.Kept)
+	}
+}
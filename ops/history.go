@@ -0,0 +1,261 @@
+// history.go -- every generation of the cert of a CN
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// superseded certs keyed by serial number
+var bucketSuperseded = []byte("superseded")
+
+// states of a cert generation
+const (
+	StateActive     = "active"
+	StateSuperseded = "superseded"
+	StateExpired    = "expired"
+	StateRevoked    = "revoked"
+)
+
+// State returns the state of the cert generation 'c'
+func (c *Cert) State() string {
+	switch {
+	case !c.Revoked.IsZero():
+		return StateRevoked
+	case time.Now().After(c.NotAfter):
+		return StateExpired
+	case !c.Superseded.IsZero():
+		return StateSuperseded
+	}
+	return StateActive
+}
+
+// History returns every generation of the cert 'cn' oldest first: the
+// superseded and revoked certs and the current cert.
+func (d *DB) History(cn string) ([]*Cert, error) {
+	certs, err := d.named(cn)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: %w", cn, ErrNotFound)
+	}
+
+	slices.SortStableFunc(certs, func(a, b *Cert) int {
+		if n := a.NotBefore.Compare(b.NotBefore); n != 0 {
+			return n
+		}
+		if n := retired(a).Compare(retired(b)); n != 0 {
+			return n
+		}
+		return a.SerialNumber.Cmp(b.SerialNumber)
+	})
+	return certs, nil
+}
+
+// return when 'c' stopped being the current cert of its CN; certs
+// issued in the same second are ordered by it.
+func retired(c *Cert) time.Time {
+	switch {
+	case !c.Superseded.IsZero():
+		return c.Superseded
+	case !c.Revoked.IsZero():
+		return c.Revoked
+	}
+	return c.NotAfter.AddDate(100, 0, 0)
+}
+
+// RevokeSerial revokes the generation with the serial number 'sn';
+// for the current cert of a CN, it is the same as Revoke.
+func (d *DB) RevokeSerial(sn *big.Int) error {
+	c, err := d.FindSerial(sn)
+	if err != nil {
+		return err
+	}
+
+	cn := c.Subject.CommonName
+	switch {
+	case !c.Revoked.IsZero():
+		return fmt.Errorf("%s: %#x is already revoked", cn, sn)
+	case c.Superseded.IsZero():
+		return d.Revoke(cn)
+	}
+
+	k := sn.Text(16)
+	var sc storedCert
+	if err := d.st.getJSON(bucketSuperseded, k, &sc); err != nil {
+		return fmt.Errorf("%s: %#x: %w", cn, sn, err)
+	}
+	if err := sc.parse(); err != nil {
+		return err
+	}
+
+	sc.Revoked = time.Now().UTC()
+	if err := d.st.putJSON(bucketRevoked, k, &sc); err != nil {
+		return err
+	}
+	if sc.enc != nil {
+		ec := &storedCert{
+			Kind:    sc.Kind,
+			Signer:  sc.Signer,
+			Profile: sc.Profile,
+			Cert:    sc.EncCert,
+			Revoked: sc.Revoked,
+		}
+		if err := d.st.putJSON(bucketRevoked, sc.enc.SerialNumber.Text(16), ec); err != nil {
+			return err
+		}
+	}
+	return d.st.del(bucketSuperseded, k)
+}
+
+// GenerationPEM is like CertPEM for the generation with the serial
+// number 'sn'; revoked certs can't be exported.
+func (d *DB) GenerationPEM(sn *big.Int, chain bool) ([]byte, []byte, error) {
+	c, err := d.FindSerial(sn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cn := c.Subject.CommonName
+	if !c.Revoked.IsZero() {
+		return nil, nil, fmt.Errorf("%s: %#x is revoked", cn, sn)
+	}
+
+	if c.Superseded.IsZero() {
+		if z, _ := d.Find(cn); z == nil || !z.Equal(c.Certificate) {
+			return nil, nil, fmt.Errorf("%s: %#x is an S/MIME encryption cert; export it with PKCS#12", cn, sn)
+		}
+		return d.CertPEM(cn, chain)
+	}
+
+	var sc storedCert
+	if err := d.st.getJSON(bucketSuperseded, sn.Text(16), &sc); err != nil {
+		return nil, nil, fmt.Errorf("%s: %#x: %w", cn, sn, err)
+	}
+	crt, key := sc.PEM()
+	if !chain {
+		return crt, key, nil
+	}
+
+	cas, err := issuerChain(d.CA, c.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := bytes.NewBuffer(crt)
+	for _, z := range cas {
+		pem.Encode(b, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: z.Raw,
+		})
+	}
+	return b.Bytes(), key, nil
+}
+
+// Move the current cert 'cn' out of the way without revoking it. The
+// main DB only has one cert per CN, so its certs are revoked there
+// and kept off the CRL.
+func (d *DB) supersede(cn string) error {
+	now := time.Now().UTC()
+
+	c, err := d.CA.Find(cn)
+	if c == nil {
+		sc, err := d.st.get(cn)
+		if err != nil {
+			return err
+		}
+
+		sc.Superseded = now
+		if err := d.st.putJSON(bucketSuperseded, sc.x.SerialNumber.Text(16), sc); err != nil {
+			return err
+		}
+		return d.st.del(bucketCerts, cn)
+	}
+
+	if err != nil && !errors.Is(err, pki.ErrExpired) {
+		return err
+	}
+
+	_, key := c.PEM()
+	sc := &storedCert{
+		Kind:       d.cert(c).Kind,
+		Signer:     c.Issuer.CommonName,
+		Cert:       c.Raw,
+		Key:        key,
+		Superseded: now,
+	}
+	if err := d.st.putJSON(bucketSuperseded, c.SerialNumber.Text(16), sc); err != nil {
+		return err
+	}
+
+	if c.IsServer {
+		return d.CA.RevokeServer(cn)
+	}
+	return d.CA.RevokeClient(cn)
+}
+
+// return the superseded certs
+func (d *DB) superseded() ([]*Cert, error) {
+	all, err := d.st.list(bucketSuperseded)
+	if err != nil {
+		return nil, fmt.Errorf("can't list superseded certs: %w", err)
+	}
+
+	certs := make([]*Cert, 0, len(all))
+	for _, sc := range all {
+		z := sc.cert()
+		z.Superseded = sc.Superseded
+		certs = append(certs, z)
+	}
+	return certs, nil
+}
+
+// return the certs revoked in the main DB, except for the superseded
+// ones and those revoked after they were superseded (the companion
+// store has these) and the ones purged by GC.
+func (d *DB) pkiRevoked() ([]pki.Revoked, error) {
+	rv, err := d.CA.ListRevoked()
+	if err != nil {
+		return nil, fmt.Errorf("can't list revoked certs: %w", err)
+	}
+
+	known := map[string]bool{}
+
+	// certs put back after a failed renewal
+	cur, err := d.st.all()
+	if err != nil {
+		return nil, fmt.Errorf("can't list revoked certs: %w", err)
+	}
+	for _, sc := range cur {
+		known[sc.x.SerialNumber.Text(16)] = true
+	}
+
+	for _, b := range [][]byte{bucketSuperseded, bucketRevoked, bucketPurged} {
+		err := d.st.forEach(b, func(k string, _ []byte) error {
+			known[k] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't list revoked certs: %w", err)
+		}
+	}
+
+	return slices.DeleteFunc(rv, func(z pki.Revoked) bool {
+		return known[z.SerialNumber.Text(16)]
+	}), nil
+}
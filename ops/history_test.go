@@ -0,0 +1,154 @@
+// history_test.go -- tests for cert generations
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	d := newTestDB(t)
+
+	// go-pki minted servers and peers from the companion store
+	web, err := d.NewServer("web.example.com", nil)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	etcd, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1.example.com"}})
+	if err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+
+	states := func(cn string) string {
+		t.Helper()
+		certs, err := d.History(cn)
+		if err != nil {
+			t.Fatalf("history %s: %s", cn, err)
+		}
+		var v []string
+		for _, c := range certs {
+			v = append(v, c.State())
+		}
+		return strings.Join(v, " ")
+	}
+
+	for _, old := range []*x509.Certificate{web, etcd} {
+		cn := old.Subject.CommonName
+		c, err := d.Renew(cn, &CertOpts{KeepOld: true})
+		if err != nil {
+			t.Fatalf("renew %s: %s", cn, err)
+		}
+		if got := states(cn); got != "superseded active" {
+			t.Fatalf("%s: saw %q", cn, got)
+		}
+		if z, _ := d.Find(cn); z == nil || !z.Equal(c) {
+			t.Fatalf("%s: the new cert isn't current", cn)
+		}
+
+		// the old cert is still valid and can be exported
+		z, err := d.FindSerial(old.SerialNumber)
+		if err != nil || z.Superseded.IsZero() || !z.Equal(old) {
+			t.Fatalf("%s: serial %v %v", cn, z, err)
+		}
+		crt, key, err := d.GenerationPEM(old.SerialNumber, true)
+		if err != nil || len(key) == 0 {
+			t.Fatalf("%s: export: %v", cn, err)
+		}
+		if blk, rest := pem.Decode(crt); blk == nil || !old.Equal(mustParse(t, blk.Bytes)) || len(rest) == 0 {
+			t.Fatalf("%s: exported the wrong cert or no chain", cn)
+		}
+	}
+
+	// superseded certs aren't revoked or on the CRL
+	rv, err := d.Revoked()
+	if err != nil || len(rv) != 0 {
+		t.Fatalf("revoked: %v %v", rv, err)
+	}
+	if n := crlSerials(t, d); len(n) != 0 {
+		t.Fatalf("CRL: %v", n)
+	}
+
+	// until they are revoked by serial
+	if err := d.RevokeSerial(web.SerialNumber); err != nil {
+		t.Fatalf("revoke serial: %s", err)
+	}
+	if err := d.RevokeSerial(web.SerialNumber); err == nil {
+		t.Fatalf("revoked a serial twice")
+	}
+	if _, _, err := d.GenerationPEM(web.SerialNumber, false); err == nil {
+		t.Fatalf("exported a revoked cert")
+	}
+	if got := states("web.example.com"); got != "revoked active" {
+		t.Fatalf("web: saw %q", got)
+	}
+	if n := crlSerials(t, d); len(n) != 1 || n[0].Cmp(web.SerialNumber) != 0 {
+		t.Fatalf("CRL: %v", n)
+	}
+
+	// a normal renewal revokes the current cert
+	cur, _ := d.Find("etcd-1")
+	if _, err := d.Renew("etcd-1", nil); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if got := states("etcd-1"); got != "superseded revoked active" {
+		t.Fatalf("etcd-1: saw %q", got)
+	}
+	if rv, _ := d.Revoked(); len(rv) != 2 {
+		t.Fatalf("revoked: exp 2, saw %d", len(rv))
+	}
+
+	// revoking the current cert by serial is a normal revocation
+	now, _ := d.Find("etcd-1")
+	if err := d.RevokeSerial(now.SerialNumber); err != nil {
+		t.Fatalf("revoke serial: %s", err)
+	}
+	if z, _ := d.Find("etcd-1"); z != nil {
+		t.Fatalf("etcd-1 is still current")
+	}
+	if z, err := d.FindSerial(cur.SerialNumber); err != nil || z.Revoked.IsZero() {
+		t.Fatalf("serial: %v %v", z, err)
+	}
+	if _, err := d.History("nobody"); err == nil {
+		t.Fatalf("history of a missing cert")
+	}
+	if err := d.RevokeSerial(big.NewInt(42)); err == nil {
+		t.Fatalf("revoked a bogus serial")
+	}
+}
+
+// return the serial numbers on the CRL of 'd'
+func crlSerials(t *testing.T, d *DB) []*big.Int {
+	t.Helper()
+	der, err := d.CRL(&CRLOpts{DER: true})
+	if err != nil {
+		t.Fatalf("crl: %s", err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatalf("crl: %s", err)
+	}
+	var v []*big.Int
+	for _, e := range crl.RevokedCertificateEntries {
+		v = append(v, e.SerialNumber)
+	}
+	return v
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	return c
+}
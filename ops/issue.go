@@ -0,0 +1,489 @@
+// issue.go -- issue, renew and revoke certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// CertOpts describes a new cert
+type CertOpts struct {
+	// CommonName of the signing CA; defaults to the root CA
+	Signer string
+
+	// Validity of the cert starting at NotBefore (or now); it is
+	// mutually exclusive with NotAfter. The default is 2 years for
+	// servers and users and 5 years for intermediate CAs.
+	Validity time.Duration
+
+	// Explicit validity window; certs with a NotBefore are minted
+	// by certik and kept in the companion store.
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// Backdate NotBefore by Skew to allow for clock skew
+	Skew time.Duration
+
+	// Subject fields that replace the signer's; the CommonName
+	// is ignored
+	Subject pkix.Name
+
+	DNSNames       []string
+	IPAddresses    []net.IP
+	EmailAddresses []string
+
+	// URI SANs; certs with URIs are minted by certik and kept in
+	// the companion store.
+	URIs []*url.URL
+
+	// Issuance profile: "spiffe" issues an X509-SVID, "smime" an
+	// email cert, "codesign" a code signing cert, "tsa" the cert
+	// of a time-stamping authority and "scep" the RA cert of a
+	// SCEP server
+	Profile string
+
+	// Key usage and extended key usages that replace the defaults of
+	// the cert kind; such certs are minted by certik and kept in the
+	// companion store.
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// Issue separate signing and encryption key pairs; only for the
+	// smime profile
+	SplitKeys bool
+
+	// Encrypt the private key with this password
+	Passwd string
+
+	// Issue the cert for this public key instead of a new key pair;
+	// the private key stays with the caller. Such certs are minted
+	// by certik and kept in the companion store.
+	PublicKey crypto.PublicKey
+
+	// the private key of PublicKey if certik generated it; it is
+	// stored like any other generated key
+	key crypto.Signer
+
+	// Don't issue the cert if it has lint errors
+	Strict bool
+
+	// Renew keeps the old cert valid as a superseded generation
+	// instead of revoking it
+	KeepOld bool
+
+	// Metadata kept with the cert in the DB
+	Owner  string
+	Note   string
+	Labels map[string]string
+}
+
+// NewServer issues a server cert for 'cn'. A CN that looks like a
+// hostname is added to the DNS names.
+func (d *DB) NewServer(cn string, o *CertOpts) (*x509.Certificate, error) {
+	z := opts(o)
+	if strings.Index(cn, ".") > 0 && !slices.Contains(z.DNSNames, cn) {
+		z.DNSNames = append(z.DNSNames, cn)
+	}
+
+	if len(z.IPAddresses) == 0 && len(z.DNSNames) == 0 && len(z.URIs) == 0 {
+		d.warn("No server IP or hostnames specified; TLS Hostname verification may not be possible")
+	}
+	return d.issue(KindServer, cn, &z)
+}
+
+// NewUser issues a user (client) cert for 'cn'. A CN that looks like
+// an email address is used as the email address if 'o' doesn't have
+// one.
+func (d *DB) NewUser(cn string, o *CertOpts) (*x509.Certificate, error) {
+	z := opts(o)
+	if len(z.EmailAddresses) == 0 && strings.Index(cn, "@") > 0 {
+		z.EmailAddresses = []string{cn}
+	}
+	return d.issue(KindUser, cn, &z)
+}
+
+// NewPeer issues a peer cert for 'cn': a server cert that is also a
+// client cert. Peers need at least one DNS name or IP address; a CN
+// that looks like a hostname is added to the DNS names.
+func (d *DB) NewPeer(cn string, o *CertOpts) (*x509.Certificate, error) {
+	z := opts(o)
+	if strings.Index(cn, ".") > 0 && !slices.Contains(z.DNSNames, cn) {
+		z.DNSNames = append(z.DNSNames, cn)
+	}
+	return d.issue(KindPeer, cn, &z)
+}
+
+// Issue issues a leaf cert for 'cn' with the extended key usages in
+// 'o'. It is a server cert if they include serverAuth and a user cert
+// otherwise; the defaults of NewServer() and NewUser() apply.
+func (d *DB) Issue(cn string, o *CertOpts) (*x509.Certificate, error) {
+	if o == nil || len(o.ExtKeyUsage) == 0 {
+		return nil, fmt.Errorf("%s: needs at least one extended key usage", cn)
+	}
+
+	if slices.Contains(o.ExtKeyUsage, x509.ExtKeyUsageServerAuth) {
+		return d.NewServer(cn, o)
+	}
+	return d.NewUser(cn, o)
+}
+
+// NewIntermediate issues an intermediate CA named 'cn'
+func (d *DB) NewIntermediate(cn string, o *CertOpts) (*x509.Certificate, error) {
+	z := opts(o)
+	return d.issue(KindCA, cn, &z)
+}
+
+// Renew revokes the server, peer or user cert 'cn' and issues a new one. Names
+// and signer not set in 'o' are carried over from the current cert; so
+// is its lifetime if 'o' has no validity.
+func (d *DB) Renew(cn string, o *CertOpts) (*x509.Certificate, error) {
+	c, err := d.Find(cn)
+	if c == nil {
+		return nil, fmt.Errorf("can't find %s: %w", cn, err)
+	}
+
+	// we can't reissue a CA without orphaning everything it signed
+	if c.Kind == KindRoot || c.Kind == KindCA {
+		return nil, fmt.Errorf("%s: can't renew a CA", cn)
+	}
+
+	z := opts(o)
+	if len(z.DNSNames) == 0 && len(z.IPAddresses) == 0 && len(z.EmailAddresses) == 0 && len(z.URIs) == 0 {
+		z.DNSNames = c.DNSNames
+		z.IPAddresses = c.IPAddresses
+		z.EmailAddresses = c.EmailAddresses
+		z.URIs = c.URIs
+	}
+	if len(z.Profile) == 0 && isSVID(c.Certificate) {
+		z.Profile = ProfileSPIFFE
+	}
+
+	// S/MIME, code signing, TSA and RA certs are always minted by certik
+	if sc, err := d.st.get(cn); err == nil && len(z.Profile) == 0 {
+		switch sc.Profile {
+		case ProfileSMIME:
+			z.SplitKeys = z.SplitKeys || sc.enc != nil
+			fallthrough
+		case ProfileCodeSign, ProfileTSA, ProfileSCEP:
+			z.Profile = sc.Profile
+		}
+	}
+
+	// carry over key usages that aren't the defaults of the cert kind
+	if len(z.ExtKeyUsage) == 0 && !slices.Equal(c.ExtKeyUsage, leafEKU(c.Kind, &z)) {
+		z.ExtKeyUsage = c.ExtKeyUsage
+		if z.KeyUsage == 0 && c.KeyUsage != leafKeyUsage(&z) {
+			z.KeyUsage = c.KeyUsage
+		}
+	}
+	if len(z.Signer) == 0 {
+		z.Signer = c.Issuer.CommonName
+	}
+	if z.Validity == 0 && z.NotAfter.IsZero() {
+		z.Validity = c.NotAfter.Sub(c.NotBefore)
+	}
+
+	// check the new cert before we revoke the old one
+	p, err := d.prepare(c.Kind, cn, &z)
+	if err != nil {
+		return nil, err
+	}
+	return d.replace(cn, z.KeepOld, p)
+}
+
+// Revoke or supersede the cert 'cn' and sign its replacement 'p'; the
+// old cert is put back if the new one can't be signed.
+func (d *DB) replace(cn string, keep bool, p *pending) (*x509.Certificate, error) {
+	old, err := d.stored(cn)
+	if err != nil {
+		return nil, err
+	}
+
+	if keep {
+		err = d.supersede(cn)
+	} else {
+		err = d.revoke(cn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	crt, err := d.sign(p)
+	if err != nil {
+		if e := d.restore(cn, old); e != nil {
+			return nil, fmt.Errorf("%w; can't restore the old cert: %w", err, e)
+		}
+		return nil, err
+	}
+	return crt, nil
+}
+
+// return the current cert 'cn' of the main DB or the companion store
+// as a stored cert
+func (d *DB) stored(cn string) (*storedCert, error) {
+	c, err := d.CA.Find(cn)
+	if c == nil {
+		return d.st.get(cn)
+	}
+	if err != nil && !errors.Is(err, pki.ErrExpired) {
+		return nil, err
+	}
+
+	_, key := c.PEM()
+	sc := &storedCert{
+		Kind:   d.cert(c).Kind,
+		Signer: c.Issuer.CommonName,
+		Cert:   c.Raw,
+		Key:    key,
+	}
+	return sc, sc.parse()
+}
+
+// Put back the cert 'old' after its renewal failed. Certs revoked in
+// the main DB can't be restored there; the companion store keeps them
+// instead and they stay off the CRL.
+func (d *DB) restore(cn string, old *storedCert) error {
+	// the new cert was issued after all
+	if z, _ := d.find(cn); z != nil {
+		return nil
+	}
+
+	for _, x := range []*x509.Certificate{old.x, old.enc} {
+		if x == nil {
+			continue
+		}
+		for _, b := range [][]byte{bucketRevoked, bucketSuperseded} {
+			err := d.st.del(b, x.SerialNumber.Text(16))
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+	}
+
+	old.Revoked = time.Time{}
+	old.Superseded = time.Time{}
+	return d.st.put(cn, old)
+}
+
+// Revoke the cert 'cn' and remove its metadata
+func (d *DB) Revoke(cn string) error {
+	if err := d.revoke(cn); err != nil {
+		return err
+	}
+	return d.delMeta(cn)
+}
+
+// Revoke the cert 'cn' in the main DB or the companion store; peers
+// and the other certs minted by certik are only in the latter.
+func (d *DB) revoke(cn string) error {
+	ca := d.CA
+	ck, err := ca.Find(cn)
+	if ck == nil {
+		return d.st.revoke(cn)
+	}
+
+	if err != nil && !errors.Is(err, pki.ErrExpired) {
+		return err
+	}
+
+	switch {
+	case ck.IsServer:
+		return ca.RevokeServer(cn)
+	case ck.IsCA:
+		return ca.RevokeCA(cn)
+	default:
+		return ca.RevokeClient(cn)
+	}
+}
+
+// issue a cert of the given kind
+func (d *DB) issue(kind, cn string, o *CertOpts) (*x509.Certificate, error) {
+	p, err := d.prepare(kind, cn, o)
+	if err != nil {
+		return nil, err
+	}
+	return d.sign(p)
+}
+
+// a new cert that has passed every check and is ready to be signed
+type pending struct {
+	kind   string
+	signer *pki.CA
+	ci     *pki.CertInfo
+	w      *window
+	o      *CertOpts
+}
+
+// Check a new cert of the given kind against the signer, its policy
+// and the linter without changing the DB.
+func (d *DB) prepare(kind, cn string, o *CertOpts) (*pending, error) {
+	signer, err := d.Signer(o.Signer)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := d.policies(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the default validity never exceeds the policy
+	def := Years(2)
+	if kind == KindCA {
+		def = Years(5)
+	}
+	if max := pc.maxValidity(); max > 0 && def > max {
+		def = max
+	}
+
+	w, err := newWindow(o, def)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.clamp(w, signer.Certificate); err != nil {
+		return nil, err
+	}
+
+	if kind == KindCA && needsMint(kind, w, o) {
+		return nil, fmt.Errorf("%s: intermediate CAs can't have an explicit NotBefore, public key, URIs, profile or key usages", cn)
+	}
+	if kind != KindCA {
+		if err := checkUsage(kind, o); err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+	}
+	if kind == KindPeer && len(o.DNSNames) == 0 && len(o.IPAddresses) == 0 {
+		return nil, fmt.Errorf("%s: peer certs need at least one DNS name or IP address", cn)
+	}
+
+	if err := optsMeta(o).Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+
+	if o.SplitKeys && o.Profile != ProfileSMIME {
+		return nil, fmt.Errorf("%s: only the %s profile can split keys", cn, ProfileSMIME)
+	}
+
+	td := pc.trustDomain()
+	switch o.Profile {
+	case "":
+		// SPIFFE IDs outside a profile still need the right trust domain
+		for _, u := range o.URIs {
+			if u.Scheme == "spiffe" && len(td) > 0 && u.Host != td {
+				return nil, fmt.Errorf("%w: %s: SPIFFE ID %s is not in trust domain %s", ErrPolicy, cn, u, td)
+			}
+		}
+	case ProfileSPIFFE:
+		if err := checkSVID(kind, o, td); err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+	case ProfileSMIME:
+		if err := checkSMIME(kind, o, pc.emailDomains()); err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+	case ProfileCodeSign, ProfileTSA:
+		if err := checkSigner(kind, o); err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+	case ProfileSCEP:
+		if err := checkRA(kind, o); err != nil {
+			return nil, fmt.Errorf("%s: %w", cn, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown profile '%s'", cn, o.Profile)
+	}
+
+	ci := &pki.CertInfo{
+		Subject:        MergeSubject(signer.Subject, o.Subject),
+		DNSNames:       o.DNSNames,
+		IPAddresses:    o.IPAddresses,
+		EmailAddresses: o.EmailAddresses,
+	}
+	ci.Subject.CommonName = cn
+
+	if err := pc.check(kind, ci, w, o); err != nil {
+		return nil, err
+	}
+
+	if err := d.preLint(kind, ci, w, o); err != nil {
+		return nil, err
+	}
+
+	p := &pending{
+		kind:   kind,
+		signer: signer,
+		ci:     ci,
+		w:      w,
+		o:      o,
+	}
+	return p, nil
+}
+
+// sign a prepared cert and keep its metadata and index entries
+func (d *DB) sign(p *pending) (*x509.Certificate, error) {
+	var crt *x509.Certificate
+
+	if p.kind != KindCA {
+		var err error
+		if crt, err = issueLeaf(p.signer, d.st, p.kind, p.ci, p.w, p.o); err != nil {
+			return nil, err
+		}
+	} else {
+		p.ci.Validity = p.w.Duration()
+		ica, err := p.signer.NewIntermediateCA(p.ci)
+		if err != nil {
+			return nil, err
+		}
+		crt = ica.Certificate
+	}
+
+	cn := p.ci.Subject.CommonName
+	if m := optsMeta(p.o); !m.Empty() {
+		if err := d.setMeta(cn, m); err != nil {
+			return nil, err
+		}
+	}
+
+	// the index is rebuilt when a lookup misses
+	idx := []*x509.Certificate{crt}
+	if sc, err := d.st.get(cn); err == nil && sc.enc != nil {
+		idx = append(idx, sc.enc)
+	}
+	if err := d.index(cn, idx...); err != nil {
+		d.warn("%s: can't index cert: %s", cn, err)
+	}
+	return crt, nil
+}
+
+// return a copy of 'o' that is safe to modify
+func opts(o *CertOpts) CertOpts {
+	if o == nil {
+		return CertOpts{}
+	}
+
+	z := *o
+	z.DNSNames = slices.Clone(o.DNSNames)
+	z.EmailAddresses = slices.Clone(o.EmailAddresses)
+	z.URIs = slices.Clone(o.URIs)
+	z.ExtKeyUsage = slices.Clone(o.ExtKeyUsage)
+	z.Labels = maps.Clone(o.Labels)
+	return z
+}
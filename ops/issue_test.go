@@ -0,0 +1,527 @@
+// issue_test.go -- tests for issuing, renewing and revoking certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+	d := newTestDB(t)
+
+	o := &CertOpts{
+		DNSNames:    []string{"www.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		Validity:    90 * 24 * time.Hour,
+	}
+	c, err := d.NewServer("example.com", o)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	if !slices.Contains(c.DNSNames, "example.com") || !slices.Contains(c.DNSNames, "www.example.com") {
+		t.Fatalf("DNS names: saw %v", c.DNSNames)
+	}
+	if len(o.DNSNames) != 1 {
+		t.Fatalf("NewServer modified the caller's options")
+	}
+	if len(c.IPAddresses) != 1 || !c.IPAddresses[0].Equal(o.IPAddresses[0]) {
+		t.Fatalf("IP addresses: saw %v", c.IPAddresses)
+	}
+	if v := c.NotAfter.Sub(time.Now()); v > 90*24*time.Hour {
+		t.Fatalf("validity: exp 90d, saw %s", v)
+	}
+
+	verifyChain(t, d, c, x509.ExtKeyUsageServerAuth)
+
+	z, err := d.Find("example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if z.Kind != KindServer {
+		t.Fatalf("kind: exp %s, saw %s", KindServer, z.Kind)
+	}
+
+	if _, err := d.NewServer("example.com", nil); err == nil {
+		t.Fatalf("issued a duplicate server cert")
+	}
+}
+
+func TestNewUser(t *testing.T) {
+	d := newTestDB(t)
+
+	c, err := d.NewUser("alice@example.com", nil)
+	if err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if !slices.Equal(c.EmailAddresses, []string{"alice@example.com"}) {
+		t.Fatalf("email: saw %v", c.EmailAddresses)
+	}
+
+	c, err = d.NewUser("bob", &CertOpts{EmailAddresses: []string{"bob@example.com"}})
+	if err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if !slices.Equal(c.EmailAddresses, []string{"bob@example.com"}) {
+		t.Fatalf("email: saw %v", c.EmailAddresses)
+	}
+
+	verifyChain(t, d, c, x509.ExtKeyUsageClientAuth)
+
+	z, err := d.Find("bob")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if z.Kind != KindUser {
+		t.Fatalf("kind: exp %s, saw %s", KindUser, z.Kind)
+	}
+}
+
+func TestNewPeer(t *testing.T) {
+	d := newTestDB(t)
+
+	ips := []net.IP{net.ParseIP("10.0.0.1")}
+	c, err := d.NewPeer("etcd-1.example.com", &CertOpts{IPAddresses: ips})
+	if err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+
+	eku := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if !slices.Equal(c.ExtKeyUsage, eku) {
+		t.Fatalf("peer: bad EKU %v", c.ExtKeyUsage)
+	}
+	if !slices.Equal(c.DNSNames, []string{"etcd-1.example.com"}) || len(c.IPAddresses) != 1 {
+		t.Fatalf("peer: bad names %v %v", c.DNSNames, c.IPAddresses)
+	}
+
+	z, err := d.Find("etcd-1.example.com")
+	if err != nil || z.Kind != KindPeer {
+		t.Fatalf("peer: not a peer cert (%v)", err)
+	}
+	if _, _, err := d.CertPEM("etcd-1.example.com", true); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+
+	// renewals keep the kind and names
+	c, err = d.Renew("etcd-1.example.com", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	z, err = d.Find("etcd-1.example.com")
+	if err != nil || z.Kind != KindPeer || !slices.Equal(c.ExtKeyUsage, eku) || len(c.IPAddresses) != 1 {
+		t.Fatalf("renew: not the same peer cert (%v)", err)
+	}
+
+	if err := d.Revoke("etcd-1.example.com"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	if _, err := d.Find("etcd-1.example.com"); err == nil {
+		t.Fatalf("found the peer after revoking it")
+	}
+
+	if _, err := d.NewPeer("etcd-2", nil); err == nil {
+		t.Fatalf("issued a peer without names")
+	}
+	o := &CertOpts{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if _, err := d.NewPeer("etcd-3.example.com", o); err == nil {
+		t.Fatalf("issued a peer without clientAuth")
+	}
+}
+
+func TestIntermediate(t *testing.T) {
+	d := newTestDB(t)
+
+	ic, err := d.NewIntermediate("ica", nil)
+	if err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if !ic.IsCA {
+		t.Fatalf("intermediate is not a CA")
+	}
+	if ic.Issuer.CommonName != d.CA.Subject.CommonName {
+		t.Fatalf("intermediate issuer: saw %s", ic.Issuer.CommonName)
+	}
+
+	// NotAfter is clamped to the root CA
+	if ic.NotAfter.After(d.CA.NotAfter) {
+		t.Fatalf("intermediate outlives the root CA")
+	}
+
+	c, err := d.NewServer("a.example.com", &CertOpts{Signer: "ica"})
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if c.Issuer.CommonName != "ica" {
+		t.Fatalf("server issuer: exp ica, saw %s", c.Issuer.CommonName)
+	}
+	verifyChain(t, d, c, x509.ExtKeyUsageServerAuth, ic)
+
+	z, err := d.Find("ica")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if z.Kind != KindCA {
+		t.Fatalf("kind: exp %s, saw %s", KindCA, z.Kind)
+	}
+
+	o := &CertOpts{NotBefore: time.Now().Add(time.Hour)}
+	if _, err := d.NewIntermediate("ica2", o); err == nil {
+		t.Fatalf("issued an intermediate CA with an explicit NotBefore")
+	}
+
+	if _, err := d.NewServer("b.example.com", &CertOpts{Signer: "nope"}); err == nil {
+		t.Fatalf("issued a cert with an unknown signer")
+	}
+}
+
+func TestExplicitWindow(t *testing.T) {
+	d := newTestDB(t)
+
+	nb := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Second)
+	na := nb.Add(7 * 24 * time.Hour)
+	o := &CertOpts{
+		NotBefore: nb,
+		NotAfter:  na,
+	}
+
+	c, err := d.NewServer("a.example.com", o)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if !c.NotBefore.Equal(nb) || !c.NotAfter.Equal(na) {
+		t.Fatalf("window: exp %s - %s, saw %s - %s", nb, na, c.NotBefore, c.NotAfter)
+	}
+	verifyChainAt(t, d, c, nb.Add(time.Hour))
+
+	// minted certs are in the companion store
+	sc, err := d.st.get("a.example.com")
+	if err != nil {
+		t.Fatalf("store: %s", err)
+	}
+	if sc.Kind != KindServer || sc.x.SerialNumber.Cmp(c.SerialNumber) != 0 {
+		t.Fatalf("store has the wrong cert")
+	}
+
+	z, err := d.Find("a.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if z.Kind != KindServer {
+		t.Fatalf("kind: exp %s, saw %s", KindServer, z.Kind)
+	}
+
+	// CNs are unique across the main DB and the store
+	if _, err := d.NewServer("a.example.com", nil); err == nil {
+		t.Fatalf("issued a duplicate of a minted cert")
+	}
+	if _, err := d.NewServer("b.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewServer("b.example.com", o); err == nil {
+		t.Fatalf("minted a duplicate of a go-pki cert")
+	}
+}
+
+func verifyChainAt(t *testing.T, d *DB, c *x509.Certificate, when time.Time) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(d.CA.Certificate)
+
+	opt := x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: when,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := c.Verify(opt); err != nil {
+		t.Fatalf("%s: can't verify: %s", c.Subject.CommonName, err)
+	}
+}
+
+func TestSkew(t *testing.T) {
+	d := newTestDB(t)
+
+	now := time.Now().UTC()
+	o := &CertOpts{
+		Skew:     10 * time.Minute,
+		Validity: time.Hour,
+	}
+	c, err := d.NewUser("u@example.com", o)
+	if err != nil {
+		t.Fatalf("user: %s", err)
+	}
+
+	if nb := c.NotBefore; nb.After(now.Add(-9*time.Minute)) || nb.Before(now.Add(-11*time.Minute)) {
+		t.Fatalf("NotBefore not backdated by 10m: %s", nb)
+	}
+	if d := c.NotAfter.Sub(c.NotBefore); d > time.Hour+time.Second {
+		t.Fatalf("validity: exp 1h, saw %s", d)
+	}
+}
+
+func TestWindowErrors(t *testing.T) {
+	d := newTestDB(t)
+	now := time.Now().UTC()
+
+	bad := []*CertOpts{
+		{Validity: time.Hour, NotAfter: now.Add(2 * time.Hour)},
+		{Validity: -time.Hour},
+		{NotBefore: now, NotAfter: now.Add(-time.Hour)},
+		{NotBefore: d.CA.NotAfter.Add(time.Hour)},
+	}
+
+	for i, o := range bad {
+		if _, err := d.NewServer("a.example.com", o); err == nil {
+			t.Fatalf("%d: issued a cert with a bad window", i)
+		}
+	}
+
+	// NotAfter is clamped to the signer
+	o := &CertOpts{NotBefore: now, NotAfter: d.CA.NotAfter.Add(24 * time.Hour)}
+	c, err := d.NewServer("a.example.com", o)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if !c.NotAfter.Equal(d.CA.NotAfter) {
+		t.Fatalf("NotAfter not clamped: exp %s, saw %s", d.CA.NotAfter, c.NotAfter)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	d := newTestDB(t)
+
+	// a wildcard in the wrong place is a lint error
+	o := &CertOpts{
+		DNSNames: []string{"a.*.example.com"},
+		Strict:   true,
+	}
+	if _, err := d.NewServer("a.example.com", o); err == nil {
+		t.Fatalf("issued a cert with lint errors")
+	}
+
+	var warned int
+	d.Warn = func(f string, v ...any) {
+		warned++
+	}
+
+	o.Strict = false
+	if _, err := d.NewServer("a.example.com", o); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if warned == 0 {
+		t.Fatalf("lint errors were not reported")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewServer("a.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewUser("u@example.com", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	o := &CertOpts{NotBefore: time.Now().UTC()}
+	if _, err := d.NewServer("b.example.com", o); err != nil {
+		t.Fatalf("minted server: %s", err)
+	}
+
+	for _, cn := range []string{"a.example.com", "u@example.com", "ica", "b.example.com"} {
+		if err := d.Revoke(cn); err != nil {
+			t.Fatalf("revoke %s: %s", cn, err)
+		}
+		if _, err := d.Find(cn); err == nil {
+			t.Fatalf("found %s after revoking it", cn)
+		}
+	}
+
+	if err := d.Revoke("nope"); err == nil {
+		t.Fatalf("revoked a non-existent cert")
+	}
+
+	rv, err := d.Revoked()
+	if err != nil {
+		t.Fatalf("revoked: %s", err)
+	}
+	if len(rv) != 4 {
+		t.Fatalf("revoked: exp 4, saw %d", len(rv))
+	}
+
+	// revoked CNs can be issued again
+	if _, err := d.NewServer("b.example.com", o); err != nil {
+		t.Fatalf("reissue: %s", err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	o := &CertOpts{
+		Signer:   "ica",
+		DNSNames: []string{"www.example.com"},
+		Validity: 30 * 24 * time.Hour,
+	}
+	old, err := d.NewServer("example.com", o)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	c, err := d.Renew("example.com", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+
+	if c.SerialNumber.Cmp(old.SerialNumber) == 0 {
+		t.Fatalf("renew didn't issue a new cert")
+	}
+	if c.Issuer.CommonName != "ica" {
+		t.Fatalf("renew changed the signer to %s", c.Issuer.CommonName)
+	}
+	if !slices.Equal(slices.Sorted(slices.Values(c.DNSNames)), []string{"example.com", "www.example.com"}) {
+		t.Fatalf("renew changed the names: %v", c.DNSNames)
+	}
+	if v := c.NotAfter.Sub(c.NotBefore); v > 31*24*time.Hour {
+		t.Fatalf("renew changed the lifetime to %s", v)
+	}
+
+	rv, err := d.Revoked()
+	if err != nil {
+		t.Fatalf("revoked: %s", err)
+	}
+	if len(rv) != 1 || rv[0].SerialNumber.Cmp(old.SerialNumber) != 0 {
+		t.Fatalf("old cert not revoked")
+	}
+
+	if _, err := d.Renew("ica", nil); err == nil {
+		t.Fatalf("renewed a CA")
+	}
+	if _, err := d.Renew("nope", nil); err == nil {
+		t.Fatalf("renewed a non-existent cert")
+	}
+}
+
+func TestRenewFailure(t *testing.T) {
+	d := newTestDB(t)
+
+	srv, err := d.NewServer("a.example.com", nil)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	kept, err := d.NewServer("b.example.com", nil)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	peer, err := d.NewPeer("etcd-0", &CertOpts{DNSNames: []string{"etcd-0.example.com"}})
+	if err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+
+	// a public key that can't be signed fails after the old cert is retired
+	bad := struct{}{}
+	tests := []struct {
+		cn  string
+		old *x509.Certificate
+		o   *CertOpts
+	}{
+		{"a.example.com", srv, &CertOpts{PublicKey: bad}},
+		{"b.example.com", kept, &CertOpts{PublicKey: bad, KeepOld: true}},
+		{"etcd-0", peer, &CertOpts{PublicKey: bad}},
+	}
+
+	for _, x := range tests {
+		if _, err := d.Renew(x.cn, x.o); err == nil {
+			t.Fatalf("%s: renewed with a bad key", x.cn)
+		}
+
+		c, err := d.Find(x.cn)
+		if err != nil {
+			t.Fatalf("%s: old cert is gone: %s", x.cn, err)
+		}
+		if c.SerialNumber.Cmp(x.old.SerialNumber) != 0 || !c.Revoked.IsZero() || !c.Superseded.IsZero() {
+			t.Fatalf("%s: old cert isn't current", x.cn)
+		}
+	}
+
+	rv, err := d.Revoked()
+	if err != nil {
+		t.Fatalf("revoked: %s", err)
+	}
+	if len(rv) != 0 {
+		t.Fatalf("old certs revoked: %d", len(rv))
+	}
+
+	// the restored cert can be renewed
+	c, err := d.Renew("a.example.com", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if c.SerialNumber.Cmp(srv.SerialNumber) == 0 {
+		t.Fatalf("renew didn't issue a new cert")
+	}
+	if rv, _ := d.Revoked(); len(rv) != 1 || rv[0].SerialNumber.Cmp(srv.SerialNumber) != 0 {
+		t.Fatalf("old cert not revoked")
+	}
+}
+
+func TestFindNotFound(t *testing.T) {
+	d := newTestDB(t)
+
+	c, err := d.Find("nope")
+	if c != nil || err == nil {
+		t.Fatalf("found a non-existent cert")
+	}
+	if _, err := d.st.get("nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("store: exp ErrNotFound, saw %v", err)
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	d := newTestDB(t)
+
+	c, err := d.NewPeer("etcd-0", &CertOpts{DNSNames: []string{"etcd-0.example.com"}, Passwd: "key-pw"})
+	if err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	sc, err := d.st.get("etcd-0")
+	if err != nil {
+		t.Fatalf("store: %s", err)
+	}
+
+	// keys are encrypted as PKCS#8 rather than with legacy PEM encryption
+	blk, _ := pem.Decode(sc.Key)
+	if blk == nil || blk.Type != "ENCRYPTED PRIVATE KEY" || len(blk.Headers) > 0 {
+		t.Fatalf("key isn't encrypted PKCS#8")
+	}
+
+	key, err := decodeKey(sc.Key, "key-pw")
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if pk, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pk.Equal(c.PublicKey) {
+		t.Fatalf("decode: key doesn't match the cert")
+	}
+	if _, err := decodeKey(sc.Key, "wrong"); err == nil {
+		t.Fatalf("decoded the key with the wrong password")
+	}
+}
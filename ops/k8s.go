@@ -0,0 +1,245 @@
+// k8s.go -- export certs as Kubernetes and cert-manager manifests
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// K8sOpts are the options for the kubernetes export formats
+type K8sOpts struct {
+	// Object name; derived from the CN if empty
+	Name      string
+	Namespace string
+	Labels    map[string]string
+
+	// Emit a cert-manager ClusterIssuer instead of an Issuer
+	ClusterIssuer bool
+
+	// Decrypts a password protected private key; kubernetes needs
+	// it unencrypted
+	KeyPasswd string
+}
+
+type k8sMeta struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMeta           `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	Spec       any               `yaml:"spec,omitempty"`
+}
+
+type caIssuerSpec struct {
+	CA struct {
+		SecretName string `yaml:"secretName"`
+	} `yaml:"ca"`
+}
+
+// ExportK8s writes 'cn' (or the CA trust bundle if 'cn' is empty) to
+// 'w' in one of the kubernetes formats:
+//
+//   - k8s-secret: a kubernetes.io/tls Secret with tls.crt, tls.key and
+//     ca.crt
+//   - k8s-configmap: a ConfigMap with the CA chain of 'cn' or all the
+//     CA certs in ca.crt
+//   - cert-manager: a Secret and a cert-manager Issuer for the
+//     intermediate CA 'cn'
+func (d *DB) ExportK8s(w io.Writer, format, cn string, o *K8sOpts) error {
+	var objs []*k8sObject
+
+	ca := d.CA
+
+	meta := func(suffix string) k8sMeta {
+		name := o.Name
+		if len(name) == 0 {
+			name = k8sName(cn)
+			if len(cn) == 0 {
+				name = k8sName(ca.Subject.CommonName)
+			}
+			name += suffix
+		}
+		return k8sMeta{
+			Name:      name,
+			Namespace: o.Namespace,
+			Labels:    o.Labels,
+		}
+	}
+
+	switch format {
+	case "k8s-secret":
+		if len(cn) == 0 {
+			return fmt.Errorf("k8s-secret needs a CommonName")
+		}
+
+		crt, key, err := d.CertPEM(cn, false)
+		if err != nil {
+			return err
+		}
+		if key, err = plainKey(cn, key, o.KeyPasswd); err != nil {
+			return err
+		}
+		chain, err := d.chainPEM(cn)
+		if err != nil {
+			return err
+		}
+
+		objs = append(objs, tlsSecret(meta("-tls"), crt, key, chain))
+
+	case "k8s-configmap":
+		var bundle []byte
+		var err error
+
+		if len(cn) > 0 {
+			bundle, err = d.chainPEM(cn)
+		} else {
+			bundle, err = d.TrustBundle("")
+		}
+		if err != nil {
+			return err
+		}
+
+		objs = append(objs, &k8sObject{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Metadata:   meta("-ca"),
+			Data: map[string]string{
+				"ca.crt": string(bundle),
+			},
+		})
+
+	case "cert-manager":
+		if len(cn) == 0 {
+			return fmt.Errorf("cert-manager needs the CommonName of an intermediate CA")
+		}
+
+		c, err := ca.Find(cn)
+		if err != nil {
+			return fmt.Errorf("can't find %s: %w", cn, err)
+		}
+		if !c.IsCA {
+			return fmt.Errorf("%s is not a CA", cn)
+		}
+
+		crt, key, err := d.CertPEM(cn, true)
+		if err != nil {
+			return err
+		}
+		if key, err = plainKey(cn, key, o.KeyPasswd); err != nil {
+			return err
+		}
+
+		sm := meta("-ca")
+		spec := &caIssuerSpec{}
+		spec.CA.SecretName = sm.Name
+
+		kind := "Issuer"
+		im := meta("")
+		if o.ClusterIssuer {
+			// ClusterIssuers are not namespaced; cert-manager
+			// looks for the secret in its own namespace.
+			kind = "ClusterIssuer"
+			im.Namespace = ""
+		}
+
+		objs = append(objs, tlsSecret(sm, crt, key, crt))
+		objs = append(objs, &k8sObject{
+			APIVersion: "cert-manager.io/v1",
+			Kind:       kind,
+			Metadata:   im,
+			Spec:       spec,
+		})
+
+	default:
+		return fmt.Errorf("unknown kubernetes format %s", format)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	for _, o := range objs {
+		if err := enc.Encode(o); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// return the private key 'kp' of 'cn' unencrypted
+func plainKey(cn string, kp []byte, pw string) ([]byte, error) {
+	blk, _ := pem.Decode(kp)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: can't decode private key", cn)
+	}
+	if !encryptedKey(blk) {
+		return kp, nil
+	}
+	if len(pw) == 0 {
+		return nil, fmt.Errorf("%s: private key is password protected; kubernetes needs its password to decrypt it", cn)
+	}
+
+	sk, err := decodeKey(kp, pw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), nil
+}
+
+func tlsSecret(m k8sMeta, crt, key, ca []byte) *k8sObject {
+	b64 := base64.StdEncoding.EncodeToString
+	return &k8sObject{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   m,
+		Type:       "kubernetes.io/tls",
+		Data: map[string]string{
+			"tls.crt": b64(crt),
+			"tls.key": b64(key),
+			"ca.crt":  b64(ca),
+		},
+	}
+}
+
+// make a valid kubernetes object name (RFC 1123 subdomain) from 's'
+func k8sName(s string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	n := strings.Trim(b.String(), "-.")
+	if len(n) > 240 {
+		n = n[:240]
+	}
+	return n
+}
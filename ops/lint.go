@@ -0,0 +1,359 @@
+// lint.go -- lint certificates for common mistakes
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// LintLevel is the severity of a lint finding
+type LintLevel int
+
+const (
+	LintNotice LintLevel = iota
+	LintWarn
+	LintError
+)
+
+func (l LintLevel) String() string {
+	switch l {
+	case LintNotice:
+		return "notice"
+	case LintWarn:
+		return "warn"
+	case LintError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func (l LintLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// LintResult is a finding from a single lint rule
+type LintResult struct {
+	Rule    string    `json:"rule"`
+	Level   LintLevel `json:"level"`
+	Message string    `json:"message"`
+}
+
+// LintReport has the lint results for a single certificate
+type LintReport struct {
+	CN       string       `json:"cn"`
+	Kind     string       `json:"kind"`
+	Serial   string       `json:"serial,omitempty"`
+	Findings []LintResult `json:"findings"`
+}
+
+// A lint rule is modeled after zlint: the name prefix denotes the
+// default severity (e_, w_, n_). Rules marked 'issued' need a fully
+// formed certificate (key, signature, extensions) and are skipped
+// when we lint a template prior to issuance.
+type lintRule struct {
+	name   string
+	level  LintLevel
+	issued bool
+	check  func(c *x509.Certificate, kind string) (string, bool)
+}
+
+var lintRules = []lintRule{
+	{"e_sub_cert_cn_not_in_san", LintError, false, lintCNNotInSAN},
+	{"w_cn_is_ip_address", LintWarn, false, lintCNIsIP},
+	{"e_dns_name_invalid", LintError, false, lintBadDNSName},
+	{"e_dns_wildcard_not_leftmost", LintError, false, lintWildcardPos},
+	{"e_dns_wildcard_too_broad", LintError, false, lintWildcardBroad},
+	{"e_wildcard_on_non_server", LintError, false, lintWildcardNonServer},
+	{"e_validity_negative", LintError, false, lintValidityNegative},
+	{"w_server_validity_too_long", LintWarn, false, lintServerValidity},
+	{"n_user_no_email", LintNotice, false, lintUserNoEmail},
+	{"e_rsa_key_too_small", LintError, true, lintRSAKeySize},
+	{"e_ec_weak_curve", LintError, true, lintECCurve},
+	{"e_sig_weak_hash", LintError, true, lintWeakSig},
+	{"w_sub_cert_missing_eku", LintWarn, true, lintMissingEKU},
+	{"e_ca_missing_cert_sign", LintError, true, lintCAKeyUsage},
+	{"n_cert_expired", LintNotice, true, lintExpired},
+}
+
+// browsers refuse TLS server certs valid for longer than this
+const maxServerValidity = 398 * 24 * time.Hour
+
+// LintCert runs all applicable lint rules on 'c' of the given kind; if
+// 'issued' is false, 'c' is a template of a cert yet to be issued.
+func LintCert(c *x509.Certificate, kind string, issued bool) []LintResult {
+	var res []LintResult
+
+	for i := range lintRules {
+		r := &lintRules[i]
+		if r.issued && !issued {
+			continue
+		}
+
+		if msg, bad := r.check(c, kind); bad {
+			res = append(res, LintResult{r.name, r.level, msg})
+		}
+	}
+	return res
+}
+
+// Lint the cert described by 'ci' and valid for the window 'w' before
+// it is issued. Findings are reported as warnings; if o.Strict is set,
+// error level findings abort the issuance.
+func (d *DB) preLint(kind string, ci *pki.CertInfo, w *window, o *CertOpts) error {
+	nb := w.NotBefore
+	if nb.IsZero() {
+		nb = time.Now().UTC()
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:        ci.Subject,
+		NotBefore:      nb,
+		NotAfter:       w.NotAfter,
+		DNSNames:       ci.DNSNames,
+		IPAddresses:    ci.IPAddresses,
+		EmailAddresses: ci.EmailAddresses,
+		URIs:           o.URIs,
+		IsCA:           kind == KindCA || kind == KindRoot,
+	}
+	if !tmpl.IsCA {
+		tmpl.ExtKeyUsage = leafEKU(kind, o)
+	}
+
+	res := LintCert(tmpl, kind, false)
+	errs := 0
+	for _, r := range res {
+		d.warn("lint %s: %s %s: %s", ci.Subject.CommonName, r.Level, r.Rule, r.Message)
+		if r.Level == LintError {
+			errs++
+		}
+	}
+
+	if o.Strict && errs > 0 {
+		return fmt.Errorf("%s: %d lint errors; not issuing cert", ci.Subject.CommonName, errs)
+	}
+	return nil
+}
+
+// Lint runs all the lint rules on 'certs'
+func Lint(certs ...*Cert) []LintReport {
+	reports := make([]LintReport, 0, len(certs))
+	for _, c := range certs {
+		reports = append(reports, LintReport{
+			CN:       c.Subject.CommonName,
+			Kind:     c.Kind,
+			Serial:   fmt.Sprintf("%#x", c.SerialNumber),
+			Findings: LintCert(c.Certificate, c.Kind, true),
+		})
+	}
+	return reports
+}
+
+// Errors returns the number of error findings in the report; if
+// 'warn' is set, warnings count as errors.
+func (r *LintReport) Errors(warn bool) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Level == LintError || (warn && f.Level == LintWarn) {
+			n++
+		}
+	}
+	return n
+}
+
+// -- lint rules --
+
+func lintCNNotInSAN(c *x509.Certificate, kind string) (string, bool) {
+	cn := c.Subject.CommonName
+	if (kind != KindServer && kind != KindPeer) || len(cn) == 0 {
+		return "", false
+	}
+
+	for _, d := range c.DNSNames {
+		if strings.EqualFold(d, cn) {
+			return "", false
+		}
+	}
+	for _, ip := range c.IPAddresses {
+		if ip.String() == cn {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("CommonName '%s' is not in the DNS or IP SANs", cn), true
+}
+
+func lintCNIsIP(c *x509.Certificate, kind string) (string, bool) {
+	if ip := net.ParseIP(c.Subject.CommonName); ip != nil {
+		return "CommonName is an IP address; use an IP SAN instead", true
+	}
+	return "", false
+}
+
+func lintBadDNSName(c *x509.Certificate, kind string) (string, bool) {
+	for _, d := range c.DNSNames {
+		if !validDNSName(strings.TrimPrefix(d, "*.")) {
+			return fmt.Sprintf("DNS SAN '%s' is not a valid hostname", d), true
+		}
+	}
+	return "", false
+}
+
+func lintWildcardPos(c *x509.Certificate, kind string) (string, bool) {
+	for _, d := range c.DNSNames {
+		i := strings.LastIndex(d, "*")
+		if i > 0 || (i == 0 && !strings.HasPrefix(d, "*.")) {
+			return fmt.Sprintf("wildcard in '%s' must be the entire left most label", d), true
+		}
+	}
+	return "", false
+}
+
+func lintWildcardBroad(c *x509.Certificate, kind string) (string, bool) {
+	for _, d := range c.DNSNames {
+		if strings.HasPrefix(d, "*.") && strings.Count(d, ".") < 2 {
+			return fmt.Sprintf("wildcard '%s' covers an entire top level domain", d), true
+		}
+	}
+	return "", false
+}
+
+func lintWildcardNonServer(c *x509.Certificate, kind string) (string, bool) {
+	// peers are servers too
+	if kind == KindServer || kind == KindPeer {
+		return "", false
+	}
+
+	names := append([]string{c.Subject.CommonName}, c.DNSNames...)
+	for _, d := range names {
+		if strings.Contains(d, "*") {
+			return fmt.Sprintf("wildcard name '%s' on a %s cert", d, kind), true
+		}
+	}
+	return "", false
+}
+
+func lintValidityNegative(c *x509.Certificate, kind string) (string, bool) {
+	if !c.NotAfter.After(c.NotBefore) {
+		return fmt.Sprintf("NotAfter %s is not after NotBefore %s", c.NotAfter, c.NotBefore), true
+	}
+	return "", false
+}
+
+func lintServerValidity(c *x509.Certificate, kind string) (string, bool) {
+	if kind != KindServer {
+		return "", false
+	}
+
+	if d := c.NotAfter.Sub(c.NotBefore); d > maxServerValidity {
+		return fmt.Sprintf("validity of %d days exceeds the 398 days accepted by browsers", d/(24*time.Hour)), true
+	}
+	return "", false
+}
+
+func lintUserNoEmail(c *x509.Certificate, kind string) (string, bool) {
+	// code signing and time-stamping certs don't need one
+	auth := len(c.ExtKeyUsage) == 0 || slices.Contains(c.ExtKeyUsage, x509.ExtKeyUsageClientAuth) ||
+		slices.Contains(c.ExtKeyUsage, x509.ExtKeyUsageEmailProtection)
+	if kind == KindUser && auth && len(c.EmailAddresses) == 0 && len(c.URIs) == 0 {
+		return "user cert has no email address or URI SAN", true
+	}
+	return "", false
+}
+
+func lintRSAKeySize(c *x509.Certificate, kind string) (string, bool) {
+	if pk, ok := c.PublicKey.(*rsa.PublicKey); ok && pk.N.BitLen() < 2048 {
+		return fmt.Sprintf("RSA key size %d is less than 2048 bits", pk.N.BitLen()), true
+	}
+	return "", false
+}
+
+func lintECCurve(c *x509.Certificate, kind string) (string, bool) {
+	if pk, ok := c.PublicKey.(*ecdsa.PublicKey); ok {
+		switch pk.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return fmt.Sprintf("EC curve %s is not one of P-256, P-384 or P-521", pk.Curve.Params().Name), true
+		}
+	}
+	return "", false
+}
+
+func lintWeakSig(c *x509.Certificate, kind string) (string, bool) {
+	switch c.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return fmt.Sprintf("weak signature algorithm %s", c.SignatureAlgorithm), true
+	}
+	return "", false
+}
+
+func lintMissingEKU(c *x509.Certificate, kind string) (string, bool) {
+	if kind == KindRoot || kind == KindCA {
+		return "", false
+	}
+
+	if len(c.ExtKeyUsage) == 0 && len(c.UnknownExtKeyUsage) == 0 {
+		return "leaf cert has no extended key usage", true
+	}
+	return "", false
+}
+
+func lintCAKeyUsage(c *x509.Certificate, kind string) (string, bool) {
+	if kind != KindRoot && kind != KindCA {
+		return "", false
+	}
+
+	if !c.IsCA || !c.BasicConstraintsValid {
+		return "CA cert is missing the CA basic constraint", true
+	}
+	if c.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return "CA cert is missing the certSign key usage", true
+	}
+	return "", false
+}
+
+func lintExpired(c *x509.Certificate, kind string) (string, bool) {
+	if time.Now().After(c.NotAfter) {
+		return fmt.Sprintf("expired on %s", c.NotAfter), true
+	}
+	return "", false
+}
+
+// return true if 's' is a syntactically valid hostname
+func validDNSName(s string) bool {
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+
+	for _, l := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return false
+		}
+		if l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, r := range l {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
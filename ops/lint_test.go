@@ -0,0 +1,135 @@
+// lint_test.go -- tests for the lint rules
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLintRules(t *testing.T) {
+	now := time.Now().UTC()
+	mk := func(cn string, dns ...string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:   pkix.Name{CommonName: cn},
+			NotBefore: now,
+			NotAfter:  now.Add(90 * 24 * time.Hour),
+			DNSNames:  dns,
+		}
+	}
+
+	tests := []struct {
+		name string
+		kind string
+		c    *x509.Certificate
+		rule string
+	}{
+		{"cn not in san", KindServer, mk("a.example.com", "b.example.com"), "e_sub_cert_cn_not_in_san"},
+		{"bad dns", KindServer, mk("a_b", "a..b"), "e_dns_name_invalid"},
+		{"wildcard pos", KindServer, mk("a.example.com", "a.example.com", "a.*.example.com"), "e_dns_wildcard_not_leftmost"},
+		{"wildcard broad", KindServer, mk("x.com", "x.com", "*.com"), "e_dns_wildcard_too_broad"},
+		{"wildcard user", KindUser, mk("*.example.com"), "e_wildcard_on_non_server"},
+		{"user email", KindUser, mk("bob"), "n_user_no_email"},
+	}
+
+	has := func(res []LintResult, rule string) bool {
+		for _, r := range res {
+			if r.Rule == rule {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, x := range tests {
+		res := LintCert(x.c, x.kind, false)
+		if !has(res, x.rule) {
+			t.Fatalf("%s: missing %s in %v", x.name, x.rule, res)
+		}
+	}
+
+	c := mk("etcd.example.com", "etcd.example.com", "*.etcd.example.com")
+	if res := LintCert(c, KindPeer, false); has(res, "e_wildcard_on_non_server") {
+		t.Fatalf("wildcard peer: saw %v", res)
+	}
+
+	c = mk("1.2.3.4")
+	c.IPAddresses = []net.IP{net.ParseIP("1.2.3.4")}
+	if res := LintCert(c, KindServer, false); !has(res, "w_cn_is_ip_address") {
+		t.Fatalf("cn is ip: missing finding in %v", res)
+	}
+
+	c = mk("a.example.com", "a.example.com")
+	c.NotAfter = now.Add(2 * 365 * 24 * time.Hour)
+	if res := LintCert(c, KindServer, false); !has(res, "w_server_validity_too_long") {
+		t.Fatalf("validity: missing finding in %v", res)
+	}
+
+	c.NotAfter = now.Add(-time.Hour)
+	if res := LintCert(c, KindServer, false); !has(res, "e_validity_negative") {
+		t.Fatalf("negative validity: missing finding in %v", res)
+	}
+
+	c = mk("a.example.com", "a.example.com")
+	if res := LintCert(c, KindServer, false); len(res) != 0 {
+		t.Fatalf("clean cert: saw %v", res)
+	}
+
+	// rules that need an issued cert are skipped for templates
+	if res := LintCert(c, KindServer, true); !has(res, "w_sub_cert_missing_eku") {
+		t.Fatalf("issued cert: missing eku finding in %v", res)
+	}
+}
+
+func TestLint(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewServer("a.example.com", &CertOpts{Validity: 90 * 24 * time.Hour}); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewServer("b.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	a, err := d.Find("a.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	b, err := d.Find("b.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+
+	reports := Lint(a, b)
+	if len(reports) != 2 {
+		t.Fatalf("reports: exp 2, saw %d", len(reports))
+	}
+
+	if n := reports[0].Errors(true); n != 0 {
+		t.Fatalf("%s: exp no errors, saw %v", reports[0].CN, reports[0].Findings)
+	}
+
+	// the 2y default is too long for browsers
+	if reports[1].Errors(false) != 0 || reports[1].Errors(true) == 0 {
+		t.Fatalf("%s: exp a warning, saw %v", reports[1].CN, reports[1].Findings)
+	}
+
+	all, err := d.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	for _, r := range Lint(all...) {
+		if n := r.Errors(false); n != 0 {
+			t.Fatalf("%s: exp no errors, saw %v", r.CN, r.Findings)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// list.go -- list the certs in the DB
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"fmt"
+
+	"github.com/opencoff/go-pki"
+)
+
+// List returns all the unrevoked certs in the DB and their metadata:
+// the root CA first, followed by the servers, peers, users and
+// intermediate CAs.
+func (d *DB) List() ([]*Cert, error) {
+	ca := d.CA
+	certs := []*Cert{{Certificate: ca.Certificate, Kind: KindRoot}}
+
+	srv, err := ca.GetServers()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch servers: %w", err)
+	}
+
+	users, err := ca.GetClients()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch users: %w", err)
+	}
+
+	minted, err := d.st.active()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch certs: %w", err)
+	}
+
+	// certs minted by certik go with the others of their kind
+	leaves := map[string][]*Cert{}
+	for _, v := range [][]*pki.Cert{srv, users} {
+		for _, c := range v {
+			z := d.cert(c)
+			leaves[z.Kind] = append(leaves[z.Kind], z)
+		}
+	}
+	for _, z := range minted {
+		leaves[z.Kind] = append(leaves[z.Kind], z)
+	}
+	for _, k := range []string{KindServer, KindPeer, KindUser} {
+		certs = append(certs, leaves[k]...)
+	}
+
+	cas, err := ca.GetCAs()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch CAs: %w", err)
+	}
+
+	for _, c := range cas {
+		if c.SerialNumber.Cmp(ca.SerialNumber) == 0 {
+			continue
+		}
+		certs = append(certs, &Cert{Certificate: c.Certificate, Kind: KindCA})
+	}
+
+	all, err := d.metas()
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch metadata: %w", err)
+	}
+	for _, c := range certs {
+		if m, ok := all[c.Subject.CommonName]; ok {
+			c.Meta = *m
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,85 @@
+// list_test.go -- tests for listing certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewServer("a.example.com", &CertOpts{Signer: "ica"}); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewUser("u@example.com", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := d.NewUser("v@example.com", &CertOpts{NotBefore: time.Now()}); err != nil {
+		t.Fatalf("minted user: %s", err)
+	}
+	if _, err := d.NewPeer("p.example.com", nil); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	if _, err := d.NewUser("gone@example.com", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if err := d.Revoke("gone@example.com"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+
+	certs, err := d.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+
+	exp := map[string]string{
+		"test-ca":       KindRoot,
+		"ica":           KindCA,
+		"a.example.com": KindServer,
+		"p.example.com": KindPeer,
+		"u@example.com": KindUser,
+		"v@example.com": KindUser,
+	}
+
+	if len(certs) != len(exp) {
+		t.Fatalf("list: exp %d certs, saw %d", len(exp), len(certs))
+	}
+	if certs[0].Kind != KindRoot {
+		t.Fatalf("list: root CA is not first")
+	}
+
+	// the certs are grouped by kind
+	var kinds []string
+	for _, c := range certs {
+		if len(kinds) == 0 || kinds[len(kinds)-1] != c.Kind {
+			kinds = append(kinds, c.Kind)
+		}
+	}
+	if !slices.Equal(kinds, []string{KindRoot, KindServer, KindPeer, KindUser, KindCA}) {
+		t.Fatalf("list: bad order %v", kinds)
+	}
+
+	for _, c := range certs {
+		cn := c.Subject.CommonName
+		kind, ok := exp[cn]
+		if !ok {
+			t.Fatalf("list: unexpected cert %s", cn)
+		}
+		if kind != c.Kind {
+			t.Fatalf("%s: exp kind %s, saw %s", cn, kind, c.Kind)
+		}
+		delete(exp, cn)
+	}
+}
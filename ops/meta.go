@@ -0,0 +1,122 @@
+// meta.go -- owner, note and labels of the certs in the DB
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// metadata keyed by the CN of the cert
+var bucketMeta = []byte("meta")
+
+// Meta is what the DB knows about a cert beyond the X.509 data. It
+// belongs to the CN: renewing a cert keeps it and revoking the cert
+// removes it.
+type Meta struct {
+	Owner  string            `json:"owner,omitempty"`
+	Note   string            `json:"note,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Empty returns true if 'm' has no metadata
+func (m *Meta) Empty() bool {
+	return len(m.Owner) == 0 && len(m.Note) == 0 && len(m.Labels) == 0
+}
+
+// Match returns true if 'm' has all the labels in 'want'
+func (m *Meta) Match(want map[string]string) bool {
+	for k, v := range want {
+		if x, ok := m.Labels[k]; !ok || x != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the label names of 'm'
+func (m *Meta) Validate() error {
+	for k := range m.Labels {
+		if len(k) == 0 || strings.ContainsAny(k, "=, \t\r\n") {
+			return fmt.Errorf("invalid label name '%s'", k)
+		}
+	}
+	return nil
+}
+
+// Meta returns the metadata of the cert 'cn'
+func (d *DB) Meta(cn string) (*Meta, error) {
+	if c, err := d.find(cn); c == nil {
+		return nil, fmt.Errorf("can't find %s: %w", cn, err)
+	}
+	return d.meta(cn)
+}
+
+// SetMeta replaces the metadata of the cert 'cn' with 'm'
+func (d *DB) SetMeta(cn string, m *Meta) error {
+	if c, err := d.find(cn); c == nil {
+		return fmt.Errorf("can't find %s: %w", cn, err)
+	}
+	return d.setMeta(cn, m)
+}
+
+func (d *DB) meta(cn string) (*Meta, error) {
+	var m Meta
+	err := d.st.getJSON(bucketMeta, cn, &m)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (d *DB) setMeta(cn string, m *Meta) error {
+	if err := m.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", cn, err)
+	}
+
+	if m.Empty() {
+		return d.delMeta(cn)
+	}
+	return d.st.putJSON(bucketMeta, cn, m)
+}
+
+func (d *DB) delMeta(cn string) error {
+	err := d.st.del(bucketMeta, cn)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// return the metadata of every cert keyed by CN
+func (d *DB) metas() (map[string]*Meta, error) {
+	all := map[string]*Meta{}
+
+	err := d.st.forEach(bucketMeta, func(k string, v []byte) error {
+		var m Meta
+		if err := json.Unmarshal(v, &m); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		all[k] = &m
+		return nil
+	})
+	return all, err
+}
+
+// return the metadata in the cert options 'o'
+func optsMeta(o *CertOpts) *Meta {
+	return &Meta{
+		Owner:  o.Owner,
+		Note:   o.Note,
+		Labels: maps.Clone(o.Labels),
+	}
+}
@@ -0,0 +1,111 @@
+// meta_test.go -- tests for the cert metadata
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeta(t *testing.T) {
+	d := newTestDB(t)
+
+	o := &CertOpts{
+		Owner:  "bob",
+		Note:   "OPS-1234",
+		Labels: map[string]string{"team": "infra", "env": "prod"},
+	}
+	if _, err := d.NewServer("web.example.com", o); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1.example.com"}, Labels: map[string]string{"team": "db"}}); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	if _, err := d.NewUser("alice", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := d.NewUser("carol", &CertOpts{Labels: map[string]string{"bad label": "x"}}); err == nil {
+		t.Fatalf("issued a cert with a bad label")
+	}
+	if c, _ := d.Find("carol"); c != nil {
+		t.Fatalf("issued carol despite the bad label")
+	}
+
+	c, err := d.Find("web.example.com")
+	if err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if c.Meta.Owner != "bob" || c.Meta.Note != "OPS-1234" || !c.Meta.Match(map[string]string{"team": "infra"}) {
+		t.Fatalf("find: bad metadata %+v", c.Meta)
+	}
+
+	certs, err := d.List()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	var infra []string
+	for _, c := range certs {
+		if c.Meta.Match(map[string]string{"team": "infra"}) {
+			infra = append(infra, c.Subject.CommonName)
+		}
+	}
+	if len(infra) != 1 || infra[0] != "web.example.com" {
+		t.Fatalf("list: wrong certs with team=infra: %v", infra)
+	}
+
+	// renewing keeps the metadata unless it is replaced
+	if _, err := d.Renew("web.example.com", nil); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if m, _ := d.Meta("web.example.com"); m.Owner != "bob" || len(m.Labels) != 2 {
+		t.Fatalf("renew: lost metadata %+v", m)
+	}
+	if _, err := d.Renew("etcd-1", &CertOpts{Owner: "dave"}); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if m, _ := d.Meta("etcd-1"); m.Owner != "dave" || len(m.Labels) != 0 {
+		t.Fatalf("renew: metadata not replaced %+v", m)
+	}
+
+	if err := d.SetMeta("alice", &Meta{Note: "laptop"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if err := d.SetMeta("nobody", &Meta{Note: "x"}); err == nil {
+		t.Fatalf("annotated a missing cert")
+	}
+	if err := d.SetMeta("alice", &Meta{Labels: map[string]string{"a=b": "c"}}); err == nil {
+		t.Fatalf("set a bad label")
+	}
+
+	// export and import keep the metadata
+	var b bytes.Buffer
+	if err := d.ExportJSON(&b); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	e, err := InitFromJSON(filepath.Join(t.TempDir(), "copy.db"), testPw, b.String())
+	if err != nil {
+		t.Fatalf("import: %s", err)
+	}
+	defer e.Close()
+	if m, err := e.Meta("alice"); err != nil || m.Note != "laptop" {
+		t.Fatalf("import: bad metadata %+v %v", m, err)
+	}
+
+	// revoking removes it; a new cert starts afresh
+	if err := d.Revoke("alice"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	if _, err := d.NewUser("alice", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if m, _ := d.Meta("alice"); !m.Empty() {
+		t.Fatalf("revoke: metadata left %+v", m)
+	}
+}
@@ -0,0 +1,328 @@
+// ops.go -- certik operations as a library
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package ops implements the certik commands as a library. Every
+// operation works on an open DB and returns errors instead of exiting;
+// the certik command line tool is a thin wrapper around this package.
+package ops
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// the kinds of certs in the DB
+const (
+	KindRoot   = "root-CA"
+	KindCA     = "CA"
+	KindServer = "server"
+	KindUser   = "user"
+
+	// servers that are also clients of each other, e.g. etcd or
+	// Kafka peers; only certik mints these.
+	KindPeer = "peer"
+)
+
+// DB is an open CA database and its companion store
+type DB struct {
+	// The root CA
+	CA *pki.CA
+
+	// Warn is called with non-fatal diagnostics such as lint
+	// findings and clamped validity; the default discards them.
+	Warn func(format string, v ...any)
+
+	fn string
+	st *store
+}
+
+// Cert is a certificate in the DB along with its kind
+type Cert struct {
+	*x509.Certificate
+
+	Kind string
+
+	// Owner, note and labels from the DB
+	Meta Meta
+
+	// non-zero if revoked
+	Revoked time.Time
+
+	// non-zero if a newer cert replaced it
+	Superseded time.Time
+}
+
+// InitOpts describes a new root CA
+type InitOpts struct {
+	// DB encryption password
+	Passwd string
+
+	Country          string
+	Organization     string
+	OrganizationUnit string
+
+	// More subject fields; the fields above take precedence and the
+	// CommonName is ignored
+	Subject pkix.Name
+
+	// Validity of the root CA cert; defaults to 5 years
+	Validity time.Duration
+}
+
+// Init creates a new DB in 'fn' with a root CA named 'cn'
+func Init(fn, cn string, o *InitOpts) (*DB, error) {
+	v := o.Validity
+	if v == 0 {
+		v = Years(5)
+	}
+
+	p := pki.Config{
+		Passwd:   o.Passwd,
+		Validity: v,
+
+		Subject: MergeSubject(o.Subject, pkix.Name{
+			Country:            nonEmpty(o.Country),
+			Organization:       nonEmpty(o.Organization),
+			OrganizationalUnit: nonEmpty(o.OrganizationUnit),
+		}),
+	}
+	p.Subject.CommonName = cn
+
+	ca, err := pki.New(&p, fn, true)
+	if err != nil {
+		return nil, err
+	}
+	return newDB(fn, o.Passwd, ca)
+}
+
+// InitFromJSON creates a new DB in 'fn' from the JSON dump 'js'; the
+// companion store in a dump written by ExportJSON is restored too.
+func InitFromJSON(fn, pw, js string) (*DB, error) {
+	if err := checkFullDump(js); err != nil {
+		return nil, err
+	}
+
+	cfg := &pki.Config{
+		Passwd: pw,
+	}
+
+	ca, err := pki.NewFromJSON(cfg, fn, js)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := newDB(fn, pw, ca)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.importJSON(js); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// ExportJSON writes a JSON dump of the DB to 'w': the dump of the main
+// DB and the contents of the companion store (the certs minted by
+// certik, the superseded, revoked and purged certs, the metadata etc.).
+// The request queue isn't part of it.
+func (d *DB) ExportJSON(w io.Writer) error {
+	var b bytes.Buffer
+	if err := d.CA.ExportJSON(&b); err != nil {
+		return err
+	}
+
+	st, err := d.st.dump()
+	if err != nil {
+		return err
+	}
+	if len(st) == 0 {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal(b.Bytes(), &dump); err != nil {
+		return fmt.Errorf("can't add the companion store to the JSON dump: %w", err)
+	}
+	if dump[jsonStoreKey], err = json.Marshal(st); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(dump)
+}
+
+// restore the companion store in the JSON dump 'js'
+func (d *DB) importJSON(js string) error {
+	var dump struct {
+		Store map[string]map[string]json.RawMessage `json:"certik_store"`
+
+		// dumps of older versions only have the metadata
+		Meta map[string]*Meta `json:"certik_meta"`
+	}
+	if err := json.Unmarshal([]byte(js), &dump); err != nil {
+		return err
+	}
+
+	if len(dump.Store) > 0 {
+		if err := checkStore(dump.Store); err != nil {
+			return err
+		}
+		if err := d.st.load(dump.Store); err != nil {
+			return err
+		}
+	}
+
+	for cn, m := range dump.Meta {
+		if err := d.setMeta(cn, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open an existing DB
+func Open(fn, pw string) (*DB, error) {
+	p := pki.Config{
+		Passwd: pw,
+	}
+
+	ca, err := pki.New(&p, fn, false)
+	if err != nil {
+		return nil, err
+	}
+	return newDB(fn, pw, ca)
+}
+
+// return 's' as a single valued attribute unless it is empty
+func nonEmpty(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return []string{s}
+}
+
+func newDB(fn, pw string, ca *pki.CA) (*DB, error) {
+	st, err := openStore(fn, pw)
+	if err != nil {
+		ca.Close()
+		return nil, err
+	}
+
+	d := &DB{
+		CA: ca,
+		fn: fn,
+		st: st,
+	}
+	return d, nil
+}
+
+// Close the DB
+func (d *DB) Close() error {
+	err := d.st.Close()
+	if e := d.CA.Close(); e != nil {
+		return e
+	}
+	return err
+}
+
+// Rekey re-encrypts the DB with a new password. The main DB is
+// rekeyed inside the companion store's transaction so that a failure
+// leaves both under the old password.
+func (d *DB) Rekey(newpw string) error {
+	oldpw := d.st.pw
+	rekeyed := false
+	err := d.st.rekey(newpw, func() error {
+		if err := d.CA.Rekey(newpw); err != nil {
+			return err
+		}
+		rekeyed = true
+		return nil
+	})
+	if err != nil && rekeyed {
+		if e := d.CA.Rekey(oldpw); e != nil {
+			return fmt.Errorf("%w; can't restore the old password of the main DB: %w", err, e)
+		}
+	}
+	return err
+}
+
+// Signer returns the CA named 'cn'; an empty name denotes the root CA
+func (d *DB) Signer(cn string) (*pki.CA, error) {
+	if len(cn) == 0 || cn == d.CA.Subject.CommonName {
+		return d.CA, nil
+	}
+
+	ica, err := d.CA.FindCA(cn)
+	if err != nil {
+		return nil, fmt.Errorf("can't find signer %s: %w", cn, err)
+	}
+	return ica, nil
+}
+
+// Find the cert named 'cn' and its metadata in the main DB or the
+// companion store. An expired cert is returned along with
+// pki.ErrExpired.
+func (d *DB) Find(cn string) (*Cert, error) {
+	z, err := d.find(cn)
+	if z == nil {
+		return nil, err
+	}
+
+	m, merr := d.meta(cn)
+	if merr != nil {
+		return nil, merr
+	}
+	z.Meta = *m
+	return z, err
+}
+
+func (d *DB) find(cn string) (*Cert, error) {
+	c, err := d.CA.Find(cn)
+	if c != nil {
+		return d.cert(c), err
+	}
+
+	sc, serr := d.st.get(cn)
+	if serr != nil {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	return sc.cert(), nil
+}
+
+// return the Cert view of a go-pki cert
+func (d *DB) cert(c *pki.Cert) *Cert {
+	var kind string
+
+	switch {
+	case c.IsCA && c.SerialNumber.Cmp(d.CA.SerialNumber) == 0:
+		kind = KindRoot
+	case c.IsCA:
+		kind = KindCA
+	case c.IsServer:
+		kind = KindServer
+	default:
+		kind = KindUser
+	}
+	return &Cert{Certificate: c.Certificate, Kind: kind}
+}
+
+func (d *DB) warn(f string, v ...any) {
+	if d.Warn != nil {
+		d.Warn(f, v...)
+	}
+}
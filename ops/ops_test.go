@@ -0,0 +1,225 @@
+// ops_test.go -- test harness for the ops package
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPw = "hunter2"
+
+// create a new DB with a root CA in a temp dir
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "test.db")
+	d, err := Init(fn, "test-ca", &InitOpts{
+		Passwd:       testPw,
+		Country:      "US",
+		Organization: "certik",
+	})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	d.Warn = t.Logf
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+// verify that 'c' chains to the root CA of 'd' via 'inter'
+func verifyChain(t *testing.T, d *DB, c *x509.Certificate, eku x509.ExtKeyUsage, inter ...*x509.Certificate) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(d.CA.Certificate)
+
+	ip := x509.NewCertPool()
+	for _, z := range inter {
+		ip.AddCert(z)
+	}
+
+	opt := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: ip,
+		KeyUsages:     []x509.ExtKeyUsage{eku},
+	}
+	if _, err := c.Verify(opt); err != nil {
+		t.Fatalf("%s: can't verify: %s", c.Subject.CommonName, err)
+	}
+}
+
+func TestInitOpen(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.db")
+	d, err := Init(fn, "root", &InitOpts{
+		Passwd:   testPw,
+		Validity: 90 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	if cn := d.CA.Subject.CommonName; cn != "root" {
+		t.Fatalf("root CN: exp root, saw %s", cn)
+	}
+	if !d.CA.IsCA {
+		t.Fatalf("root is not a CA")
+	}
+	if v := d.CA.NotAfter.Sub(d.CA.NotBefore); v > 91*24*time.Hour {
+		t.Fatalf("root validity: exp 90d, saw %s", v)
+	}
+
+	serial := d.CA.SerialNumber
+	if err := d.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	d, err = Open(fn, testPw)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer d.Close()
+
+	if d.CA.SerialNumber.Cmp(serial) != 0 {
+		t.Fatalf("reopen: root serial changed")
+	}
+
+	c, err := d.Find("root")
+	if err != nil {
+		t.Fatalf("find root: %s", err)
+	}
+	if c.Kind != KindRoot {
+		t.Fatalf("root kind: exp %s, saw %s", KindRoot, c.Kind)
+	}
+}
+
+func TestSigner(t *testing.T) {
+	d := newTestDB(t)
+
+	ca, err := d.Signer("")
+	if err != nil || ca != d.CA {
+		t.Fatalf("default signer is not the root CA: %v", err)
+	}
+
+	if _, err := d.Signer("nope"); err == nil {
+		t.Fatalf("found a non-existent signer")
+	}
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	ica, err := d.Signer("ica")
+	if err != nil {
+		t.Fatalf("signer: %s", err)
+	}
+	if cn := ica.Subject.CommonName; cn != "ica" {
+		t.Fatalf("signer CN: exp ica, saw %s", cn)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.db")
+	d, err := Init(fn, "root", &InitOpts{Passwd: testPw})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	// one cert in each of the main DB and the companion store
+	if _, err := d.NewServer("a.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	o := &CertOpts{
+		NotBefore: time.Now().UTC().Add(-time.Hour),
+		Validity:  24 * time.Hour,
+	}
+	if _, err := d.NewServer("b.example.com", o); err != nil {
+		t.Fatalf("minted server: %s", err)
+	}
+
+	if err := d.Rekey("new-pw"); err != nil {
+		t.Fatalf("rekey: %s", err)
+	}
+	d.Close()
+
+	if d, err := Open(fn, testPw); err == nil {
+		d.Close()
+		t.Fatalf("opened with the old password")
+	}
+
+	d, err = Open(fn, "new-pw")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer d.Close()
+
+	for _, cn := range []string{"a.example.com", "b.example.com"} {
+		if _, err := d.Find(cn); err != nil {
+			t.Fatalf("find %s after rekey: %s", cn, err)
+		}
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	d := newTestDB(t)
+
+	// certs in the companion store: a peer, a revoked minted server
+	// and a superseded server
+	if _, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1.example.com"}}); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	o := &CertOpts{
+		NotBefore: time.Now().UTC().Add(-time.Hour),
+		Validity:  24 * time.Hour,
+	}
+	if _, err := d.NewServer("a.example.com", o); err != nil {
+		t.Fatalf("minted server: %s", err)
+	}
+	if err := d.Revoke("a.example.com"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	if _, err := d.NewServer("b.example.com", nil); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.Renew("b.example.com", &CertOpts{KeepOld: true}); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+
+	var b bytes.Buffer
+	if err := d.ExportJSON(&b); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	e, err := InitFromJSON(filepath.Join(t.TempDir(), "copy.db"), testPw, b.String())
+	if err != nil {
+		t.Fatalf("import: %s", err)
+	}
+	defer e.Close()
+
+	if _, err := e.Find("etcd-1"); err != nil {
+		t.Fatalf("import: lost the peer: %s", err)
+	}
+	if h, err := e.History("b.example.com"); err != nil || len(h) != 2 {
+		t.Fatalf("import: lost the superseded cert: %v %v", h, err)
+	}
+
+	rv, _ := d.Revoked()
+	erv, err := e.Revoked()
+	if err != nil || len(erv) != 1 || len(erv) != len(rv) {
+		t.Fatalf("import: revoked: exp %d, saw %d (%v)", len(rv), len(erv), err)
+	}
+	if a, b := crlSerials(t, d), crlSerials(t, e); len(a) != 1 || len(b) != 1 || a[0].Cmp(b[0]) != 0 {
+		t.Fatalf("import: CRL: exp %v, saw %v", a, b)
+	}
+}
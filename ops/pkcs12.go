@@ -0,0 +1,109 @@
+// pkcs12.go -- PKCS#12 export of certs and keys
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// P12Opts control the PKCS#12 export of a cert
+type P12Opts struct {
+	// Encrypt the PKCS#12 file with this password; it also decrypts
+	// a password protected private key.
+	Passwd string
+
+	// Use 3DES and SHA-1 instead of AES-256 and SHA-256 for mail
+	// clients that can't read anything newer
+	Legacy bool
+}
+
+// PKCS12 returns the cert 'cn', its private key and its chain as a
+// PKCS#12 file. The second file holds the encryption cert and key of
+// an S/MIME cert with split keys; it is nil otherwise.
+func (d *DB) PKCS12(cn string, o *P12Opts) ([]byte, []byte, error) {
+	cas, err := d.Chain(cn)
+	if err != nil {
+		return nil, nil, err
+	}
+	cas = cas[1:]
+
+	c, err := d.Find(cn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't find %s: %w", cn, err)
+	}
+	if c.Kind == KindCA || c.Kind == KindRoot {
+		return nil, nil, fmt.Errorf("%s: won't export a CA private key", cn)
+	}
+
+	_, kp, err := d.CertPEM(cn, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := pkcs12.Modern2023
+	if o.Legacy {
+		enc = pkcs12.LegacyDES
+	}
+
+	sign, err := encodeP12(enc, c.Certificate, kp, cas, o.Passwd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", cn, err)
+	}
+
+	sc, err := d.st.get(cn)
+	if err != nil || sc.enc == nil {
+		return sign, nil, nil
+	}
+
+	crypt, err := encodeP12(enc, sc.enc, sc.EncKey, cas, o.Passwd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: encryption key: %w", cn, err)
+	}
+	return sign, crypt, nil
+}
+
+// encode a cert, its PEM encoded private key and CA chain as PKCS#12
+func encodeP12(enc *pkcs12.Encoder, c *x509.Certificate, kp []byte, cas []*x509.Certificate, pw string) ([]byte, error) {
+	if len(kp) == 0 {
+		return nil, fmt.Errorf("no private key; the cert was issued for a CSR")
+	}
+
+	sk, err := decodeKey(kp, pw)
+	if err != nil {
+		return nil, err
+	}
+	return enc.Encode(sk, c, cas, pw)
+}
+
+// decode a PEM encoded private key; 'pw' decrypts an encrypted key
+func decodeKey(kp []byte, pw string) (crypto.Signer, error) {
+	blk, _ := pem.Decode(kp)
+	if blk == nil {
+		return nil, fmt.Errorf("can't decode private key")
+	}
+
+	der := blk.Bytes
+	var err error
+	switch {
+	case blk.Type == encryptedKeyType:
+		der, err = decryptPKCS8(der, pw)
+	case x509.IsEncryptedPEMBlock(blk):
+		// keys written by older versions
+		der, err = x509.DecryptPEMBlock(blk, []byte(pw))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt private key: %w", err)
+	}
+	return parseKey(der)
+}
@@ -0,0 +1,81 @@
+// pkcs7.go -- certs-only PKCS#7 bundles
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+var (
+	oidData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// RFC 2315 ContentInfo
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+// RFC 2315 SignedData
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue   `asn1:"optional"`
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+// PKCS7Certs returns a DER encoded "degenerate" PKCS#7 SignedData that
+// only carries 'certs' (RFC 2315 §9.1); this is the .p7b format.
+func PKCS7Certs(certs []*x509.Certificate) ([]byte, error) {
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo: contentInfo{
+			ContentType: oidData,
+		},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      raw,
+		},
+		SignerInfos: []asn1.RawValue{},
+	}
+
+	der, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+
+	ci := contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      der,
+		},
+	}
+
+	der, err = asn1.Marshal(ci)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs7: %w", err)
+	}
+	return der, nil
+}
@@ -0,0 +1,162 @@
+// pkcs8.go -- password protected PKCS#8 private keys
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// PEM type of an encrypted PKCS#8 private key
+const encryptedKeyType = "ENCRYPTED PRIVATE KEY"
+
+// PBKDF2 iterations for new keys
+const pbkdf2Iter = 600000
+
+// PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC (RFC 8018); this is
+// what 'openssl pkcs8 -topk8' writes.
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt   []byte
+	Iter   int
+	KeyLen int                      `asn1:"optional"`
+	PRF    pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// encrypt the PKCS#8 key 'der' with 'pw'
+func encryptPKCS8(der []byte, pw string) (*pem.Block, error) {
+	salt := randBytes(16)
+	iv := randBytes(aes.BlockSize)
+
+	key, err := pbkdf2.Key(sha256.New, pw, salt, pbkdf2Iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	n := aes.BlockSize - len(der)%aes.BlockSize
+	ct := append(bytes.Clone(der), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(blk, iv).CryptBlocks(ct, ct)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt: salt,
+		Iter: pbkdf2Iter,
+		PRF:  pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivb, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Scheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivb}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: ct,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: encryptedKeyType, Bytes: b}, nil
+}
+
+// decrypt an encrypted PKCS#8 key written by encryptPKCS8
+func decryptPKCS8(b []byte, pw string) ([]byte, error) {
+	var ek encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(b, &ek); err != nil {
+		return nil, err
+	}
+	if !ek.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s", ek.Algo.Algorithm)
+	}
+
+	var p pbes2Params
+	if _, err := asn1.Unmarshal(ek.Algo.Parameters.FullBytes, &p); err != nil {
+		return nil, err
+	}
+	if !p.KDF.Algorithm.Equal(oidPBKDF2) || !p.Scheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, errors.New("unsupported PBES2 parameters")
+	}
+
+	var kp pbkdf2Params
+	if _, err := asn1.Unmarshal(p.KDF.Parameters.FullBytes, &kp); err != nil {
+		return nil, err
+	}
+	if !kp.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, errors.New("unsupported PBKDF2 PRF")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(p.Scheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(ek.Data) == 0 || len(ek.Data)%aes.BlockSize != 0 {
+		return nil, errors.New("corrupted private key")
+	}
+
+	key, err := pbkdf2.Key(sha256.New, pw, kp.Salt, kp.Iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pt := bytes.Clone(ek.Data)
+	cipher.NewCBCDecrypter(blk, iv).CryptBlocks(pt, pt)
+
+	n := int(pt[len(pt)-1])
+	if n == 0 || n > aes.BlockSize || !bytes.Equal(pt[len(pt)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errors.New("wrong password")
+	}
+	return pt[:len(pt)-n], nil
+}
+
+// return true if the PEM block 'blk' is a password protected key
+func encryptedKey(blk *pem.Block) bool {
+	return blk.Type == encryptedKeyType || x509.IsEncryptedPEMBlock(blk)
+}
@@ -0,0 +1,412 @@
+// policy.go -- per-CA issuance policy
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// ErrPolicy is wrapped by every policy violation
+var ErrPolicy = errors.New("policy violation")
+
+// policies keyed by CA CommonName
+var bucketPolicy = []byte("policy")
+
+// Policy restricts the certs a CA may issue. Every rule is optional;
+// an empty allow list permits anything and deny rules win over allow
+// rules. The policy of a CA also applies to the CAs below it.
+type Policy struct {
+	// DNS names must be one of, or a subdomain of, these
+	DNSSuffixes     []string `yaml:"dns-suffixes,omitempty" json:"dns_suffixes,omitempty"`
+	DenyDNSSuffixes []string `yaml:"deny-dns-suffixes,omitempty" json:"deny_dns_suffixes,omitempty"`
+
+	// DNS names must match one of these regular expressions
+	DNSRegexes     []string `yaml:"dns-regexes,omitempty" json:"dns_regexes,omitempty"`
+	DenyDNSRegexes []string `yaml:"deny-dns-regexes,omitempty" json:"deny_dns_regexes,omitempty"`
+
+	// IP addresses must be in one of these networks
+	IPNets []string `yaml:"ip-nets,omitempty" json:"ip_nets,omitempty"`
+
+	// Email addresses must be in one of these domains or their subdomains
+	EmailDomains []string `yaml:"email-domains,omitempty" json:"email_domains,omitempty"`
+
+	// Longest validity of an issued cert, e.g. 90d
+	MaxValidity string `yaml:"max-validity,omitempty" json:"max_validity,omitempty"`
+
+	// Subject fields that must be set: C, O, OU, L, ST, street,
+	// postalCode, serialNumber
+	RequireSubject []string `yaml:"require-subject,omitempty" json:"require_subject,omitempty"`
+
+	// Allowed key types: ecdsa-p256, ecdsa-p384, ecdsa-p521,
+	// ed25519 and rsa-N (RSA keys of at least N bits)
+	KeyTypes []string `yaml:"key-types,omitempty" json:"key_types,omitempty"`
+
+	// SPIFFE trust domain of the CA; SPIFFE IDs must be in it. The
+	// nearest CA with a trust domain sets it for the CAs below.
+	TrustDomain string `yaml:"trust-domain,omitempty" json:"trust_domain,omitempty"`
+}
+
+// the type of the keys generated by certik and go-pki
+const genKeyType = "ecdsa-p256"
+
+// subject fields that a policy can require
+var subjectFields = map[string]func(n *pkix.Name) bool{
+	"C":            func(n *pkix.Name) bool { return len(n.Country) > 0 },
+	"O":            func(n *pkix.Name) bool { return len(n.Organization) > 0 },
+	"OU":           func(n *pkix.Name) bool { return len(n.OrganizationalUnit) > 0 },
+	"L":            func(n *pkix.Name) bool { return len(n.Locality) > 0 },
+	"ST":           func(n *pkix.Name) bool { return len(n.Province) > 0 },
+	"street":       func(n *pkix.Name) bool { return len(n.StreetAddress) > 0 },
+	"postalCode":   func(n *pkix.Name) bool { return len(n.PostalCode) > 0 },
+	"serialNumber": func(n *pkix.Name) bool { return len(n.SerialNumber) > 0 },
+}
+
+// Empty is true if the policy has no rules
+func (p *Policy) Empty() bool {
+	return len(p.DNSSuffixes) == 0 && len(p.DenyDNSSuffixes) == 0 &&
+		len(p.DNSRegexes) == 0 && len(p.DenyDNSRegexes) == 0 &&
+		len(p.IPNets) == 0 && len(p.EmailDomains) == 0 &&
+		len(p.MaxValidity) == 0 && len(p.RequireSubject) == 0 &&
+		len(p.KeyTypes) == 0 && len(p.TrustDomain) == 0
+}
+
+// Validate returns an error if any rule of the policy is malformed
+func (p *Policy) Validate() error {
+	for _, s := range append(append([]string{}, p.DNSRegexes...), p.DenyDNSRegexes...) {
+		if _, err := regexp.Compile(s); err != nil {
+			return fmt.Errorf("bad DNS regex %q: %w", s, err)
+		}
+	}
+
+	for _, s := range p.IPNets {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return fmt.Errorf("bad IP network %q: %w", s, err)
+		}
+	}
+
+	if len(p.MaxValidity) > 0 {
+		if _, err := ParseValidity(p.MaxValidity, 'd'); err != nil {
+			return fmt.Errorf("bad max validity: %w", err)
+		}
+	}
+
+	for _, f := range p.RequireSubject {
+		if _, ok := subjectFields[f]; !ok {
+			return fmt.Errorf("unknown subject field %s", f)
+		}
+	}
+
+	for _, k := range p.KeyTypes {
+		if !validKeyType(k) {
+			return fmt.Errorf("unknown key type %s", k)
+		}
+	}
+
+	if len(p.TrustDomain) > 0 && !trustDomainRe.MatchString(p.TrustDomain) {
+		return fmt.Errorf("bad SPIFFE trust domain %q", p.TrustDomain)
+	}
+	return nil
+}
+
+// Policy returns the policy of the CA 'cn'; a CA without a policy
+// has an empty policy.
+func (d *DB) Policy(cn string) (*Policy, error) {
+	ca, err := d.Signer(cn)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	err = d.st.getJSON(bucketPolicy, ca.Subject.CommonName, p)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetPolicy replaces the policy of the CA 'cn'; an empty policy
+// removes it.
+func (d *DB) SetPolicy(cn string, p *Policy) error {
+	ca, err := d.Signer(cn)
+	if err != nil {
+		return err
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	cn = ca.Subject.CommonName
+	if p.Empty() {
+		err := d.st.del(bucketPolicy, cn)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	return d.st.putJSON(bucketPolicy, cn, p)
+}
+
+// the policy of the CA 'ca'
+type caPolicy struct {
+	ca string
+	p  *Policy
+}
+
+// the policies of a signer and every CA above it
+type policyChain []caPolicy
+
+// Return the policies that apply to certs issued by 'signer'
+func (d *DB) policies(signer *pki.CA) (policyChain, error) {
+	var pc policyChain
+
+	certs, err := d.Chain(signer.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range certs {
+		cn := c.Subject.CommonName
+		p := &Policy{}
+		err := d.st.getJSON(bucketPolicy, cn, p)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pc = append(pc, caPolicy{cn, p})
+	}
+	return pc, nil
+}
+
+// maxValidity returns the shortest max validity of the chain; zero
+// if there is none.
+func (pc policyChain) maxValidity() time.Duration {
+	var max time.Duration
+	for _, x := range pc {
+		if len(x.p.MaxValidity) == 0 {
+			continue
+		}
+		v, err := ParseValidity(x.p.MaxValidity, 'd')
+		if err == nil && (max == 0 || v < max) {
+			max = v
+		}
+	}
+	return max
+}
+
+// trustDomain returns the SPIFFE trust domain of the nearest CA that
+// has one
+func (pc policyChain) trustDomain() string {
+	for _, x := range pc {
+		if len(x.p.TrustDomain) > 0 {
+			return x.p.TrustDomain
+		}
+	}
+	return ""
+}
+
+// emailDomains is true if any CA in the chain restricts the email
+// domains
+func (pc policyChain) emailDomains() bool {
+	for _, x := range pc {
+		if len(x.p.EmailDomains) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// check a new cert against every policy in the chain
+func (pc policyChain) check(kind string, ci *pki.CertInfo, w *window, o *CertOpts) error {
+	for _, x := range pc {
+		if err := x.p.check(kind, ci, w, o); err != nil {
+			return fmt.Errorf("%w: CA %s: %s: %w", ErrPolicy, x.ca, ci.Subject.CommonName, err)
+		}
+	}
+	return nil
+}
+
+// check a new cert against the policy
+func (p *Policy) check(kind string, ci *pki.CertInfo, w *window, o *CertOpts) error {
+	if len(p.MaxValidity) > 0 {
+		max, err := ParseValidity(p.MaxValidity, 'd')
+		if err != nil {
+			return err
+		}
+
+		start := time.Now().UTC()
+		if w.Explicit() {
+			start = w.NotBefore
+		}
+		if v := w.NotAfter.Sub(start) - o.Skew; v > max+time.Minute {
+			return fmt.Errorf("validity of %s exceeds the maximum of %s", v.Round(time.Hour), p.MaxValidity)
+		}
+	}
+
+	for _, f := range p.RequireSubject {
+		if !subjectFields[f](&ci.Subject) {
+			return fmt.Errorf("subject field %s is required", f)
+		}
+	}
+
+	if len(p.KeyTypes) > 0 && kind != KindCA {
+		kt := genKeyType
+		if o.PublicKey != nil {
+			kt = keyType(o.PublicKey)
+		}
+		if !p.allowKey(o.PublicKey, kt) {
+			return fmt.Errorf("key type %s not allowed; allowed: %s", kt, strings.Join(p.KeyTypes, ", "))
+		}
+	}
+
+	for _, nm := range ci.DNSNames {
+		if err := p.checkDNS(nm); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range ci.IPAddresses {
+		if err := p.checkIP(ip); err != nil {
+			return err
+		}
+	}
+
+	for _, em := range ci.EmailAddresses {
+		if err := p.checkEmail(em); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Policy) checkDNS(nm string) error {
+	nm = strings.ToLower(nm)
+	for _, s := range p.DenyDNSSuffixes {
+		if hasSuffix(nm, s) {
+			return fmt.Errorf("DNS name %s is denied by suffix %s", nm, s)
+		}
+	}
+	for _, s := range p.DenyDNSRegexes {
+		if regexp.MustCompile(s).MatchString(nm) {
+			return fmt.Errorf("DNS name %s is denied by regex %s", nm, s)
+		}
+	}
+
+	if len(p.DNSSuffixes) == 0 && len(p.DNSRegexes) == 0 {
+		return nil
+	}
+	for _, s := range p.DNSSuffixes {
+		if hasSuffix(nm, s) {
+			return nil
+		}
+	}
+	for _, s := range p.DNSRegexes {
+		if regexp.MustCompile(s).MatchString(nm) {
+			return nil
+		}
+	}
+	return fmt.Errorf("DNS name %s is not allowed", nm)
+}
+
+func (p *Policy) checkIP(ip net.IP) error {
+	if len(p.IPNets) == 0 {
+		return nil
+	}
+	for _, s := range p.IPNets {
+		_, n, err := net.ParseCIDR(s)
+		if err == nil && n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP address %s is not in %s", ip, strings.Join(p.IPNets, ", "))
+}
+
+func (p *Policy) checkEmail(em string) error {
+	if len(p.EmailDomains) == 0 {
+		return nil
+	}
+
+	i := strings.LastIndex(em, "@")
+	dom := strings.ToLower(em[i+1:])
+	for _, s := range p.EmailDomains {
+		if hasSuffix(dom, s) {
+			return nil
+		}
+	}
+	return fmt.Errorf("email address %s is not in %s", em, strings.Join(p.EmailDomains, ", "))
+}
+
+// return true if 'nm' is the domain 'suffix' or a subdomain of it
+func hasSuffix(nm, suffix string) bool {
+	suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+	return nm == suffix || strings.HasSuffix(nm, "."+suffix)
+}
+
+// return true if the key 'pk' of type 'kt' is allowed
+func (p *Policy) allowKey(pk crypto.PublicKey, kt string) bool {
+	for _, k := range p.KeyTypes {
+		if k == kt {
+			return true
+		}
+
+		// rsa-N allows RSA keys of at least N bits
+		if bits, ok := rsaBits(k); ok {
+			if rk, ok := pk.(*rsa.PublicKey); ok && rk.N.BitLen() >= bits {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// return the policy name of the type of key 'pk'
+func keyType(pk crypto.PublicKey) string {
+	switch k := pk.(type) {
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.ReplaceAll(k.Curve.Params().Name, "-", ""))
+	case ed25519.PublicKey:
+		return "ed25519"
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", k.N.BitLen())
+	default:
+		return fmt.Sprintf("%T", pk)
+	}
+}
+
+func validKeyType(k string) bool {
+	switch k {
+	case "ecdsa-p256", "ecdsa-p384", "ecdsa-p521", "ed25519":
+		return true
+	}
+	_, ok := rsaBits(k)
+	return ok
+}
+
+func rsaBits(k string) (int, bool) {
+	s, ok := strings.CutPrefix(k, "rsa-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && n >= 1024
+}
@@ -0,0 +1,213 @@
+// policy_test.go -- tests for per-CA issuance policy
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	d := newTestDB(t)
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	p := &Policy{
+		DNSSuffixes:     []string{"example.com"},
+		DenyDNSSuffixes: []string{"bad.example.com"},
+		IPNets:          []string{"10.0.0.0/8"},
+		EmailDomains:    []string{"example.com"},
+		MaxValidity:     "90d",
+	}
+	if err := d.SetPolicy("ica", p); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	z, err := d.Policy("ica")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if z.MaxValidity != "90d" || len(z.DNSSuffixes) != 1 {
+		t.Fatalf("get: exp %+v, saw %+v", p, z)
+	}
+
+	// the default validity is capped to the policy
+	c, err := d.NewServer("a.example.com", &CertOpts{Signer: "ica", IPAddresses: []net.IP{net.ParseIP("10.1.1.1")}})
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if v := c.NotAfter.Sub(c.NotBefore); v > 91*24*time.Hour {
+		t.Fatalf("server: exp 90d validity, saw %s", v)
+	}
+
+	if _, err := d.NewUser("alice@eng.example.com", &CertOpts{Signer: "ica"}); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+
+	// the root CA has no policy
+	if _, err := d.NewServer("a.example.org", nil); err != nil {
+		t.Fatalf("root: %s", err)
+	}
+
+	bad := map[string]*CertOpts{
+		"b.example.org":     {},
+		"x.bad.example.com": {},
+		"c.example.com":     {IPAddresses: []net.IP{net.ParseIP("192.168.1.1")}},
+		"d.example.com":     {Validity: Years(1)},
+		"e.example.com":     {DNSNames: []string{"e.example.net"}},
+		"f.example.com":     {NotBefore: time.Now(), Validity: 100 * 24 * time.Hour},
+		"bob@example.net":   {},
+		"carol@example.com": {EmailAddresses: []string{"carol@example.org"}},
+	}
+	for cn, o := range bad {
+		o.Signer = "ica"
+
+		var err error
+		if strings.Contains(cn, "@") {
+			_, err = d.NewUser(cn, o)
+		} else {
+			_, err = d.NewServer(cn, o)
+		}
+		if !errors.Is(err, ErrPolicy) {
+			t.Fatalf("%s: exp policy violation, saw %v", cn, err)
+		}
+		if _, err := d.Find(cn); err == nil {
+			t.Fatalf("%s: issued despite the policy", cn)
+		}
+	}
+
+	// the policy of a CA applies to the CAs below it
+	if _, err := d.NewIntermediate("sub-ica", &CertOpts{Signer: "ica"}); err != nil {
+		t.Fatalf("sub-ca: %s", err)
+	}
+	_, err = d.NewServer("g.example.org", &CertOpts{Signer: "sub-ica"})
+	if !errors.Is(err, ErrPolicy) || !strings.Contains(err.Error(), "CA ica") {
+		t.Fatalf("sub-ca: exp violation of the ica policy, saw %v", err)
+	}
+
+	// tightening the policy applies to renewals
+	p.MaxValidity = "30d"
+	if err := d.SetPolicy("ica", p); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, err := d.Renew("a.example.com", nil); !errors.Is(err, ErrPolicy) {
+		t.Fatalf("renew: exp policy violation, saw %v", err)
+	}
+	if _, err := d.Find("a.example.com"); err != nil {
+		t.Fatalf("renew: failed renewal revoked the cert: %s", err)
+	}
+	if _, err := d.Renew("a.example.com", &CertOpts{Validity: 30 * 24 * time.Hour}); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+
+	// an empty policy removes it
+	if err := d.SetPolicy("ica", &Policy{}); err != nil {
+		t.Fatalf("clear: %s", err)
+	}
+	if _, err := d.NewServer("b.example.org", &CertOpts{Signer: "ica"}); err != nil {
+		t.Fatalf("cleared: %s", err)
+	}
+
+	if _, err := d.Policy("nope"); err == nil {
+		t.Fatalf("got the policy of a non-existent CA")
+	}
+}
+
+func TestPolicyRoot(t *testing.T) {
+	d := newTestDB(t)
+
+	p := &Policy{
+		DenyDNSRegexes: []string{`^internal\.`},
+		RequireSubject: []string{"C", "O"},
+	}
+	if err := d.SetPolicy("", p); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if _, err := d.NewServer("www.example.com", &CertOpts{Signer: "ica"}); err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if _, err := d.NewServer("internal.example.com", &CertOpts{Signer: "ica"}); !errors.Is(err, ErrPolicy) {
+		t.Fatalf("regex: exp policy violation, saw %v", err)
+	}
+
+	// the test CA has no locality
+	p.RequireSubject = []string{"L"}
+	if err := d.SetPolicy("test-ca", p); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, err := d.NewUser("u@example.com", nil); !errors.Is(err, ErrPolicy) {
+		t.Fatalf("subject: exp policy violation, saw %v", err)
+	}
+}
+
+func TestPolicyKeyType(t *testing.T) {
+	d := newTestDB(t)
+	if err := d.SetPolicy("", &Policy{KeyTypes: []string{"ed25519"}}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	if _, err := d.NewServer("a.example.com", nil); !errors.Is(err, ErrPolicy) {
+		t.Fatalf("generated key: exp policy violation, saw %v", err)
+	}
+
+	pk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	c, err := d.NewServer("a.example.com", &CertOpts{PublicKey: pk})
+	if err != nil {
+		t.Fatalf("ed25519: %s", err)
+	}
+	if !pk.Equal(c.PublicKey) {
+		t.Fatalf("ed25519: cert isn't for the public key")
+	}
+
+	rk, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	p := &Policy{KeyTypes: []string{"rsa-2048"}}
+	if p.allowKey(&rk.PublicKey, keyType(&rk.PublicKey)) {
+		t.Fatalf("rsa-2048 allowed a 1024 bit key")
+	}
+	p.KeyTypes = []string{"rsa-1024"}
+	if !p.allowKey(&rk.PublicKey, keyType(&rk.PublicKey)) {
+		t.Fatalf("rsa-1024 denied a 1024 bit key")
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	bad := []*Policy{
+		{DNSRegexes: []string{"(a"}},
+		{DenyDNSRegexes: []string{"[a"}},
+		{IPNets: []string{"10.0.0.1"}},
+		{MaxValidity: "forever"},
+		{RequireSubject: []string{"X"}},
+		{KeyTypes: []string{"dsa"}},
+		{KeyTypes: []string{"rsa-512"}},
+	}
+
+	d := newTestDB(t)
+	for i, p := range bad {
+		if err := d.SetPolicy("", p); err == nil {
+			t.Fatalf("%d: set a bad policy %+v", i, p)
+		}
+	}
+}
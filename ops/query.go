@@ -0,0 +1,442 @@
+// query.go -- find certs by their fields, serial number or fingerprint
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// certs keyed by serial number and by SHA-256 fingerprint
+var (
+	bucketSerial      = []byte("serial")
+	bucketFingerprint = []byte("fingerprint")
+)
+
+// the orders of Query.Sort
+const (
+	SortCN        = "cn"
+	SortNotBefore = "notBefore"
+	SortNotAfter  = "notAfter"
+	SortSerial    = "serial"
+	SortKind      = "kind"
+)
+
+// Query selects certs from the DB; a cert must match every field
+// that is set.
+type Query struct {
+	// Exact CommonNames
+	CNs []string
+
+	// Cert kinds: root-CA, CA, server, peer or user
+	Kinds []string
+
+	// CommonName of the issuing CA
+	Signer string
+
+	// NotAfter is before ExpiresBefore and after ExpiresAfter
+	ExpiresBefore time.Time
+	ExpiresAfter  time.Time
+
+	// Glob patterns ('*' and '?') matched against the whole name or
+	// substrings; Name is matched against the CN and SANs, SAN only
+	// against the SANs. Case is ignored.
+	Name string
+	SAN  string
+
+	// Only revoked certs; by default only unrevoked certs are
+	// listed. Lookups by serial number or fingerprint find both.
+	Revoked bool
+
+	// The cert with this serial number or SHA-256 fingerprint of
+	// its DER encoding
+	Serial      *big.Int
+	Fingerprint []byte
+
+	// Metadata; see Meta
+	Owner  string
+	Labels map[string]string
+
+	// Order of the result; the default is that of List
+	Sort string
+
+	// Return at most Limit certs if non-zero
+	Limit int
+}
+
+// Query returns the certs in the DB that match 'q'. Lookups by serial
+// number and fingerprint use an index instead of reading every cert.
+func (d *DB) Query(q *Query) ([]*Cert, error) {
+	var certs []*Cert
+
+	name, err := namePattern(q.Name)
+	if err != nil {
+		return nil, err
+	}
+	san, err := namePattern(q.SAN)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortCerts(nil, q.Sort); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case q.Serial != nil:
+		certs, err = d.bySerial(q.Serial)
+	case len(q.Fingerprint) > 0:
+		certs, err = d.byFingerprint(q.Fingerprint)
+	case len(q.CNs) > 0 && !q.Revoked:
+		// CNs that aren't in the DB match nothing
+		for _, cn := range q.CNs {
+			if c, _ := d.Find(cn); c != nil {
+				certs = append(certs, c)
+			}
+		}
+	case q.Revoked:
+		certs, err = d.revokedCerts()
+	default:
+		certs, err = d.List()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certs = slices.DeleteFunc(certs, func(c *Cert) bool {
+		return !q.match(c, name, san)
+	})
+
+	sortCerts(certs, q.Sort)
+	if q.Limit > 0 && len(certs) > q.Limit {
+		certs = certs[:q.Limit]
+	}
+	return certs, nil
+}
+
+// FindSerial returns the cert with the serial number 'sn'; it may be
+// revoked.
+func (d *DB) FindSerial(sn *big.Int) (*Cert, error) {
+	certs, err := d.bySerial(sn)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("serial %#x: %w", sn, ErrNotFound)
+	}
+	return certs[0], nil
+}
+
+// FindFingerprint returns the cert with the SHA-256 fingerprint 'fp';
+// it may be revoked.
+func (d *DB) FindFingerprint(fp []byte) (*Cert, error) {
+	certs, err := d.byFingerprint(fp)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("fingerprint %x: %w", fp, ErrNotFound)
+	}
+	return certs[0], nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the cert 'c'
+func Fingerprint(c *x509.Certificate) []byte {
+	h := sha256.Sum256(c.Raw)
+	return h[:]
+}
+
+// ParseSerial parses a serial number in hex with a 0x prefix or with
+// colons (e.g. 0x1f2e, 1f:2e), or in decimal.
+func ParseSerial(s string) (*big.Int, error) {
+	n := new(big.Int)
+	if strings.Contains(s, ":") {
+		if _, ok := n.SetString(strings.ReplaceAll(s, ":", ""), 16); ok {
+			return n, nil
+		}
+	} else if _, ok := n.SetString(s, 0); ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid serial number '%s'", s)
+}
+
+// ParseFingerprint parses a hex SHA-256 fingerprint; colons are
+// optional.
+func ParseFingerprint(s string) ([]byte, error) {
+	fp, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 fingerprint '%s'", s)
+	}
+	return fp, nil
+}
+
+// compile the name pattern 'pat'. A pattern with '*' or '?' is a glob
+// matched against the whole name; any other pattern matches a
+// substring. Case is ignored and an empty pattern matches anything.
+func namePattern(pat string) (*regexp.Regexp, error) {
+	if len(pat) == 0 {
+		return nil, nil
+	}
+
+	re := regexp.QuoteMeta(pat)
+	if strings.ContainsAny(pat, "*?") {
+		re = strings.ReplaceAll(re, `\*`, ".*")
+		re = strings.ReplaceAll(re, `\?`, ".")
+		re = "^" + re + "$"
+	}
+	return regexp.Compile("(?i)" + re)
+}
+
+// match the cert 'c' against 'q' and the compiled name and SAN patterns
+func (q *Query) match(c *Cert, name, san *regexp.Regexp) bool {
+	if q.Revoked && c.Revoked.IsZero() {
+		return false
+	}
+	if len(q.CNs) > 0 && !slices.Contains(q.CNs, c.Subject.CommonName) {
+		return false
+	}
+	if len(q.Kinds) > 0 && !slices.Contains(q.Kinds, c.Kind) {
+		return false
+	}
+	if len(q.Signer) > 0 && c.Issuer.CommonName != q.Signer {
+		return false
+	}
+	if !q.ExpiresBefore.IsZero() && !c.NotAfter.Before(q.ExpiresBefore) {
+		return false
+	}
+	if !q.ExpiresAfter.IsZero() && !c.NotAfter.After(q.ExpiresAfter) {
+		return false
+	}
+	if len(q.Owner) > 0 && c.Meta.Owner != q.Owner {
+		return false
+	}
+	if !c.Meta.Match(q.Labels) {
+		return false
+	}
+
+	sans := sanNames(c.Certificate)
+	if name != nil && !slices.ContainsFunc(append(sans, c.Subject.CommonName), name.MatchString) {
+		return false
+	}
+	if san != nil && !slices.ContainsFunc(sans, san.MatchString) {
+		return false
+	}
+	return true
+}
+
+// return the DNS names, IP addresses, email addresses and URIs of 'c'
+func sanNames(c *x509.Certificate) []string {
+	v := slices.Clone(c.DNSNames)
+	for _, ip := range c.IPAddresses {
+		v = append(v, ip.String())
+	}
+	v = append(v, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		v = append(v, u.String())
+	}
+	return v
+}
+
+// sort 'certs' in the order 'by'
+func sortCerts(certs []*Cert, by string) error {
+	var fp func(a, b *Cert) int
+
+	switch by {
+	case "":
+		return nil
+	case SortCN:
+		fp = func(a, b *Cert) int { return strings.Compare(a.Subject.CommonName, b.Subject.CommonName) }
+	case SortNotBefore:
+		fp = func(a, b *Cert) int { return a.NotBefore.Compare(b.NotBefore) }
+	case SortNotAfter:
+		fp = func(a, b *Cert) int { return a.NotAfter.Compare(b.NotAfter) }
+	case SortSerial:
+		fp = func(a, b *Cert) int { return a.SerialNumber.Cmp(b.SerialNumber) }
+	case SortKind:
+		fp = func(a, b *Cert) int { return cmp.Compare(a.Kind, b.Kind) }
+	default:
+		return fmt.Errorf("can't sort by '%s'; try cn, notBefore, notAfter, serial or kind", by)
+	}
+	slices.SortStableFunc(certs, fp)
+	return nil
+}
+
+// return all the revoked certs in the DB
+func (d *DB) revokedCerts() ([]*Cert, error) {
+	rv, err := d.pkiRevoked()
+	if err != nil {
+		return nil, err
+	}
+
+	srv, err := d.st.revoked()
+	if err != nil {
+		return nil, fmt.Errorf("can't list revoked certs: %w", err)
+	}
+
+	certs := make([]*Cert, 0, len(rv)+len(srv))
+	for _, z := range rv {
+		certs = append(certs, &Cert{Certificate: z.Certificate, Kind: certKind(z.Certificate), Revoked: z.When})
+	}
+	for _, sc := range srv {
+		z := sc.cert()
+		z.Revoked = sc.Revoked
+		certs = append(certs, z)
+	}
+	return certs, nil
+}
+
+// guess the kind of a revoked go-pki cert
+func certKind(c *x509.Certificate) string {
+	switch {
+	case c.IsCA:
+		return KindCA
+	case slices.Contains(c.ExtKeyUsage, x509.ExtKeyUsageServerAuth):
+		return KindServer
+	}
+	return KindUser
+}
+
+// -- serial number and fingerprint index --
+
+// index entries point at the CN of the cert
+type indexEntry struct {
+	CN     string `json:"cn"`
+	Serial string `json:"serial"`
+}
+
+// add the certs 'v' of 'cn' to the index
+func (d *DB) index(cn string, v ...*x509.Certificate) error {
+	for _, c := range v {
+		e := &indexEntry{
+			CN:     cn,
+			Serial: c.SerialNumber.Text(16),
+		}
+		if err := d.st.putJSON(bucketSerial, e.Serial, e); err != nil {
+			return err
+		}
+		if err := d.st.putJSON(bucketFingerprint, hex.EncodeToString(Fingerprint(c)), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index every cert in the DB
+func (d *DB) reindex() error {
+	certs, err := d.List()
+	if err != nil {
+		return err
+	}
+
+	rv, err := d.revokedCerts()
+	if err != nil {
+		return err
+	}
+	certs = append(certs, rv...)
+
+	old, err := d.superseded()
+	if err != nil {
+		return err
+	}
+	certs = append(certs, old...)
+
+	all, err := d.st.all()
+	if err != nil {
+		return err
+	}
+	for _, sc := range all {
+		if sc.enc != nil {
+			certs = append(certs, &Cert{Certificate: sc.enc})
+		}
+	}
+
+	for _, c := range certs {
+		if err := d.index(c.Subject.CommonName, c.Certificate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// look up the key 'k' in the index 'bucket'; the index is rebuilt if
+// it doesn't have the key, e.g. for certs issued before it existed.
+func (d *DB) lookup(bucket []byte, k string, match func(c *Cert) bool) ([]*Cert, error) {
+	for i := range 2 {
+		var e indexEntry
+		err := d.st.getJSON(bucket, k, &e)
+		if err == nil {
+			certs, err := d.named(e.CN)
+			if err != nil {
+				return nil, err
+			}
+			certs = slices.DeleteFunc(certs, func(c *Cert) bool { return !match(c) })
+			if len(certs) > 0 {
+				return certs, nil
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+
+		if i == 0 {
+			if err := d.reindex(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (d *DB) bySerial(sn *big.Int) ([]*Cert, error) {
+	return d.lookup(bucketSerial, sn.Text(16), func(c *Cert) bool {
+		return c.SerialNumber.Cmp(sn) == 0
+	})
+}
+
+func (d *DB) byFingerprint(fp []byte) ([]*Cert, error) {
+	return d.lookup(bucketFingerprint, hex.EncodeToString(fp), func(c *Cert) bool {
+		return slices.Equal(Fingerprint(c.Certificate), fp)
+	})
+}
+
+// return every cert, current or revoked, named 'cn'
+func (d *DB) named(cn string) ([]*Cert, error) {
+	var certs []*Cert
+
+	if c, _ := d.Find(cn); c != nil {
+		certs = append(certs, c)
+
+		// the encryption half of an S/MIME pair
+		if sc, err := d.st.get(cn); err == nil && sc.enc != nil {
+			certs = append(certs, &Cert{Certificate: sc.enc, Kind: sc.Kind, Meta: c.Meta})
+		}
+	}
+
+	rv, err := d.revokedCerts()
+	if err != nil {
+		return nil, err
+	}
+	old, err := d.superseded()
+	if err != nil {
+		return nil, err
+	}
+	for _, z := range append(rv, old...) {
+		if z.Subject.CommonName == cn {
+			certs = append(certs, z)
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,132 @@
+// query_test.go -- tests for cert queries and the serial index
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("server-ca", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	for i, v := range []time.Duration{90, 30, 60} {
+		cn := fmt.Sprintf("web%d.corp.example.com", i)
+		o := &CertOpts{
+			Signer:   "server-ca",
+			Validity: v * 24 * time.Hour,
+			DNSNames: []string{cn, "www.example.org"},
+		}
+		if _, err := d.NewServer(cn, o); err != nil {
+			t.Fatalf("server: %s", err)
+		}
+	}
+	if _, err := d.NewPeer("etcd-1", &CertOpts{DNSNames: []string{"etcd-1.corp.example.com"}}); err != nil {
+		t.Fatalf("peer: %s", err)
+	}
+	if _, err := d.NewUser("alice", &CertOpts{EmailAddresses: []string{"alice@example.com"}, Labels: map[string]string{"team": "ops"}}); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+
+	cns := func(q *Query) string {
+		t.Helper()
+		certs, err := d.Query(q)
+		if err != nil {
+			t.Fatalf("query %+v: %s", q, err)
+		}
+		var v []string
+		for _, c := range certs {
+			v = append(v, c.Subject.CommonName)
+		}
+		return strings.Join(v, " ")
+	}
+
+	tests := []struct {
+		q   Query
+		exp string
+	}{
+		{Query{Kinds: []string{KindServer}, Sort: SortNotAfter}, "web1.corp.example.com web2.corp.example.com web0.corp.example.com"},
+		{Query{Signer: "server-ca", Sort: SortCN, Limit: 2}, "web0.corp.example.com web1.corp.example.com"},
+		{Query{Kinds: []string{KindServer}, ExpiresBefore: time.Now().Add(45 * 24 * time.Hour)}, "web1.corp.example.com"},
+		{Query{Kinds: []string{KindServer, KindPeer}, ExpiresAfter: time.Now().Add(45 * 24 * time.Hour), Sort: SortCN}, "etcd-1 web0.corp.example.com web2.corp.example.com"},
+		{Query{SAN: "*.CORP.example.com", Sort: SortCN}, "etcd-1 web0.corp.example.com web1.corp.example.com web2.corp.example.com"},
+		{Query{SAN: "etcd", Sort: SortCN}, "etcd-1"},
+		{Query{SAN: "etcd-?"}, ""},
+		{Query{Name: "etcd-?"}, "etcd-1"},
+		{Query{Name: "@example.com"}, "alice"},
+		{Query{Labels: map[string]string{"team": "ops"}}, "alice"},
+		{Query{CNs: []string{"alice", "nobody", "etcd-1"}, Kinds: []string{KindUser}}, "alice"},
+		{Query{Kinds: []string{KindCA, KindRoot}, Sort: SortKind}, "server-ca test-ca"},
+	}
+	for i, tc := range tests {
+		if got := cns(&tc.q); got != tc.exp {
+			t.Fatalf("%d: exp %q, saw %q", i, tc.exp, got)
+		}
+	}
+
+	if _, err := d.Query(&Query{Sort: "color"}); err == nil {
+		t.Fatalf("sorted by an unknown field")
+	}
+
+	// lookups by serial and fingerprint find revoked certs too
+	web, _ := d.Find("web1.corp.example.com")
+	if err := d.Revoke("web1.corp.example.com"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	etcd, _ := d.Find("etcd-1")
+	if err := d.Revoke("etcd-1"); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+	if got := cns(&Query{Revoked: true, Sort: SortCN}); got != "etcd-1 web1.corp.example.com" {
+		t.Fatalf("revoked: saw %q", got)
+	}
+	if got := cns(&Query{Kinds: []string{KindServer}, Sort: SortCN}); got != "web0.corp.example.com web2.corp.example.com" {
+		t.Fatalf("servers: saw %q", got)
+	}
+
+	for _, want := range []*Cert{web, etcd} {
+		c, err := d.FindSerial(want.SerialNumber)
+		if err != nil || !c.Equal(want.Certificate) || c.Revoked.IsZero() {
+			t.Fatalf("serial %#x: %v %v", want.SerialNumber, c, err)
+		}
+		c, err = d.FindFingerprint(Fingerprint(want.Certificate))
+		if err != nil || !c.Equal(want.Certificate) {
+			t.Fatalf("fingerprint: %v %v", c, err)
+		}
+	}
+
+	// the index is rebuilt for certs it doesn't know about
+	alice, _ := d.Find("alice")
+	if err := d.st.del(bucketSerial, alice.SerialNumber.Text(16)); err != nil {
+		t.Fatalf("del: %s", err)
+	}
+	if c, err := d.FindSerial(alice.SerialNumber); err != nil || !c.Equal(alice.Certificate) {
+		t.Fatalf("serial after reindex: %v %v", c, err)
+	}
+	if _, err := d.FindSerial(new(big.Int).Lsh(alice.SerialNumber, 1)); err == nil {
+		t.Fatalf("found a bogus serial")
+	}
+
+	sn, err := ParseSerial("0x1f2e")
+	if err != nil || sn.Int64() != 0x1f2e {
+		t.Fatalf("parse serial: %v %v", sn, err)
+	}
+	if sn, err = ParseSerial("1f:2e"); err != nil || sn.Int64() != 0x1f2e {
+		t.Fatalf("parse serial: %v %v", sn, err)
+	}
+	if _, err := ParseFingerprint("ab:cd"); err == nil {
+		t.Fatalf("parsed a short fingerprint")
+	}
+}
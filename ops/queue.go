@@ -0,0 +1,382 @@
+// queue.go -- pending cert requests and their approval
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const queueSuffix = ".queue"
+
+// requests keyed by their big-endian ID
+var bucketRequests = []byte("requests")
+
+// the label with the request ID of certs issued from the queue
+const requestLabel = "request"
+
+// states of a request
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestRejected = "rejected"
+)
+
+// Request asks for a server, peer or user cert. It waits in the queue
+// of the DB until a CA officer approves or rejects it; decided
+// requests stay in the queue.
+type Request struct {
+	ID     uint64 `json:"id"`
+	Status string `json:"status"`
+
+	Kind     string        `json:"kind"`
+	CN       string        `json:"cn"`
+	Signer   string        `json:"signer,omitempty"`
+	Validity time.Duration `json:"validity,omitempty"`
+	Profile  string        `json:"profile,omitempty"`
+
+	DNSNames       []string `json:"dns,omitempty"`
+	IPAddresses    []net.IP `json:"ip,omitempty"`
+	EmailAddresses []string `json:"email,omitempty"`
+	URIs           []string `json:"uri,omitempty"`
+
+	// PEM encoded CSR; without one, the key pair is generated when
+	// the request is approved.
+	CSR string `json:"csr,omitempty"`
+
+	Requester     string    `json:"requester"`
+	Justification string    `json:"justification"`
+	Submitted     time.Time `json:"submitted"`
+
+	// filled in when the request is approved or rejected
+	Officer string    `json:"officer,omitempty"`
+	Decided time.Time `json:"decided"`
+	Reason  string    `json:"reason,omitempty"`
+
+	// serial number of the issued cert
+	Serial string `json:"serial,omitempty"`
+}
+
+// Queue holds the requests of a DB in a bolt DB next to it
+// ("DB.queue"). Unlike the rest of the DB it isn't encrypted:
+// requests carry nothing secret and are submitted without the DB
+// passphrase.
+type Queue struct {
+	fn string
+	db *bolt.DB
+}
+
+// OpenQueue opens the request queue of the existing DB 'dbfile'; the
+// queue is created if needed.
+func OpenQueue(dbfile string) (*Queue, error) {
+	if _, err := os.Stat(dbfile); err != nil {
+		return nil, err
+	}
+
+	fn := dbfile + queueSuffix
+	db, err := bolt.Open(fn, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("queue %s: %w", fn, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketRequests)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("queue %s: %w", fn, err)
+	}
+	return &Queue{fn: fn, db: db}, nil
+}
+
+// return a consistent copy of the request queue of 'dbfile'; nil if
+// there is no queue
+func snapshotQueue(dbfile string) ([]byte, error) {
+	fn := dbfile + queueSuffix
+	if _, err := os.Stat(fn); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	db, err := bolt.Open(fn, 0600, &bolt.Options{Timeout: 2 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("queue %s: %w", fn, err)
+	}
+	defer db.Close()
+
+	var b bytes.Buffer
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(&b)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("queue %s: %w", fn, err)
+	}
+	return b.Bytes(), nil
+}
+
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Submit checks the request 'r' and adds it to the queue as a pending
+// request; its ID and submission time are filled in.
+func (q *Queue) Submit(r *Request) error {
+	switch r.Kind {
+	case "server", "peer", "user":
+	default:
+		return fmt.Errorf("request: can't request a '%s' cert", r.Kind)
+	}
+
+	if len(r.Profile) > 0 && !profiles[r.Profile] {
+		return fmt.Errorf("request: unknown profile '%s'", r.Profile)
+	}
+
+	if len(r.CSR) > 0 {
+		csr, err := r.csr()
+		if err != nil {
+			return err
+		}
+
+		if len(r.CN) == 0 {
+			r.CN = csr.Subject.CommonName
+		}
+		if r.CN != csr.Subject.CommonName {
+			return fmt.Errorf("request: CSR CN %s doesn't match %s", csr.Subject.CommonName, r.CN)
+		}
+		if len(r.DNSNames)+len(r.IPAddresses)+len(r.EmailAddresses)+len(r.URIs) == 0 {
+			r.DNSNames = csr.DNSNames
+			r.IPAddresses = csr.IPAddresses
+			r.EmailAddresses = csr.EmailAddresses
+			for _, u := range csr.URIs {
+				r.URIs = append(r.URIs, u.String())
+			}
+		}
+	}
+
+	if len(r.CN) == 0 {
+		return fmt.Errorf("request: no CommonName")
+	}
+	if len(r.Requester) == 0 {
+		return fmt.Errorf("request: no requester")
+	}
+	if len(r.Justification) == 0 {
+		return fmt.Errorf("request: no justification")
+	}
+	if _, err := r.uris(); err != nil {
+		return err
+	}
+
+	r.Status = RequestPending
+	r.Submitted = time.Now().UTC()
+	r.Officer, r.Decided, r.Reason, r.Serial = "", time.Time{}, "", ""
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRequests)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		r.ID = id
+		return q.put(b, r)
+	})
+}
+
+// Get returns the request 'id'
+func (q *Queue) Get(id uint64) (*Request, error) {
+	var r *Request
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = q.get(tx.Bucket(bucketRequests), id)
+		return err
+	})
+	return r, err
+}
+
+// List returns the requests in state 'status', or all of them if
+// 'status' is empty, in the order they were submitted.
+func (q *Queue) List(status string) ([]*Request, error) {
+	var reqs []*Request
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRequests).ForEach(func(k, v []byte) error {
+			var r Request
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("queue %s: request %d: %w", q.fn, binary.BigEndian.Uint64(k), err)
+			}
+			if len(status) == 0 || r.Status == status {
+				reqs = append(reqs, &r)
+			}
+			return nil
+		})
+	})
+	return reqs, err
+}
+
+// mark the pending request 'id' as decided by 'officer'; 'fp' issues
+// the cert of an approved request.
+func (q *Queue) decide(id uint64, status, officer, reason string, fp func(r *Request) (*x509.Certificate, error)) (*x509.Certificate, error) {
+	var crt *x509.Certificate
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRequests)
+		r, err := q.get(b, id)
+		if err != nil {
+			return err
+		}
+		if r.Status != RequestPending {
+			return fmt.Errorf("request %d is already %s", id, r.Status)
+		}
+
+		if fp != nil {
+			if crt, err = fp(r); err != nil {
+				return fmt.Errorf("request %d: %w", id, err)
+			}
+			r.Serial = fmt.Sprintf("%#x", crt.SerialNumber)
+		}
+
+		r.Status = status
+		r.Officer = officer
+		r.Reason = reason
+		r.Decided = time.Now().UTC()
+		return q.put(b, r)
+	})
+	return crt, err
+}
+
+func (q *Queue) get(b *bolt.Bucket, id uint64) (*Request, error) {
+	v := b.Get(binary.BigEndian.AppendUint64(nil, id))
+	if v == nil {
+		return nil, fmt.Errorf("request %d: %w", id, ErrNotFound)
+	}
+
+	var r Request
+	if err := json.Unmarshal(v, &r); err != nil {
+		return nil, fmt.Errorf("queue %s: request %d: %w", q.fn, id, err)
+	}
+	return &r, nil
+}
+
+func (q *Queue) put(b *bolt.Bucket, r *Request) error {
+	js, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put(binary.BigEndian.AppendUint64(nil, r.ID), js)
+}
+
+// Approve issues the cert of the pending request 'id' in 'q' and
+// marks the request as approved by 'officer'. The requester owns the
+// cert, the justification is its note and its "request" label is the
+// request ID. The request is checked against the policy of its signer
+// like any other cert; if the cert can't be issued, the request stays
+// pending. If the cert was issued but the queue couldn't be updated,
+// approving the request again records that cert.
+func (d *DB) Approve(q *Queue, id uint64, officer, reason string) (*x509.Certificate, error) {
+	return q.decide(id, RequestApproved, officer, reason, d.issueRequest)
+}
+
+// Reject marks the pending request 'id' in 'q' as rejected by
+// 'officer' for 'reason'.
+func (d *DB) Reject(q *Queue, id uint64, officer, reason string) error {
+	_, err := q.decide(id, RequestRejected, officer, reason, nil)
+	return err
+}
+
+// issue the cert asked for by 'r'
+func (d *DB) issueRequest(r *Request) (*x509.Certificate, error) {
+	id := strconv.FormatUint(r.ID, 10)
+
+	// an earlier approval issued it
+	if c, _ := d.Find(r.CN); c != nil && c.Meta.Labels[requestLabel] == id {
+		return c.Certificate, nil
+	}
+
+	uris, err := r.uris()
+	if err != nil {
+		return nil, err
+	}
+
+	o := &CertOpts{
+		Signer:         r.Signer,
+		Validity:       r.Validity,
+		Profile:        r.Profile,
+		DNSNames:       r.DNSNames,
+		IPAddresses:    r.IPAddresses,
+		EmailAddresses: r.EmailAddresses,
+		URIs:           uris,
+		Owner:          r.Requester,
+		Note:           r.Justification,
+		Labels:         map[string]string{requestLabel: id},
+	}
+
+	if len(r.CSR) > 0 {
+		csr, err := r.csr()
+		if err != nil {
+			return nil, err
+		}
+		o.PublicKey = csr.PublicKey
+	}
+
+	switch r.Kind {
+	case "server":
+		return d.NewServer(r.CN, o)
+	case "peer":
+		return d.NewPeer(r.CN, o)
+	case "user":
+		return d.NewUser(r.CN, o)
+	}
+	return nil, fmt.Errorf("can't issue a '%s' cert", r.Kind)
+}
+
+// parse and verify the CSR of 'r'
+func (r *Request) csr() (*x509.CertificateRequest, error) {
+	blk, _ := pem.Decode([]byte(r.CSR))
+	if blk == nil {
+		return nil, fmt.Errorf("request: CSR is not PEM encoded")
+	}
+
+	csr, err := x509.ParseCertificateRequest(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("request: CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("request: CSR: %w", err)
+	}
+	return csr, nil
+}
+
+// parse the URIs of 'r'
+func (r *Request) uris() ([]*url.URL, error) {
+	var uris []*url.URL
+	for _, s := range r.URIs {
+		u, err := ParseURI(s)
+		if err != nil {
+			return nil, fmt.Errorf("request: %w", err)
+		}
+		uris = append(uris, u)
+	}
+	return uris, nil
+}
@@ -0,0 +1,218 @@
+// queue_test.go -- tests for the request queue
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func newTestQueue(t *testing.T, d *DB) *Queue {
+	t.Helper()
+
+	q, err := OpenQueue(d.fn)
+	if err != nil {
+		t.Fatalf("queue: %s", err)
+	}
+	t.Cleanup(func() {
+		q.Close()
+	})
+	return q
+}
+
+func TestQueue(t *testing.T) {
+	d := newTestDB(t)
+	q := newTestQueue(t, d)
+
+	if err := d.SetPolicy("test-ca", &Policy{DNSSuffixes: []string{"example.com"}}); err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+
+	bad := []*Request{
+		{Kind: "intermediate", CN: "ica", Requester: "bob", Justification: "x"},
+		{Kind: "server", Requester: "bob", Justification: "x"},
+		{Kind: "server", CN: "a.example.com", Justification: "x"},
+		{Kind: "server", CN: "a.example.com", Requester: "bob"},
+		{Kind: "server", CN: "a.example.com", Requester: "bob", Justification: "x", Profile: "nope"},
+		{Kind: "server", CN: "a.example.com", Requester: "bob", Justification: "x", CSR: "junk"},
+	}
+	for i, r := range bad {
+		if err := q.Submit(r); err == nil {
+			t.Fatalf("%d: submitted a bad request %+v", i, r)
+		}
+	}
+
+	r1 := &Request{
+		Kind:          "server",
+		CN:            "web.example.com",
+		DNSNames:      []string{"web.example.com"},
+		Requester:     "bob",
+		Justification: "new web tier",
+	}
+	r2 := &Request{
+		Kind:          "server",
+		CN:            "web.example.org",
+		DNSNames:      []string{"web.example.org"},
+		Requester:     "bob",
+		Justification: "outside the policy",
+	}
+	csr, sk := testCSR(t, "carol")
+	r3 := &Request{
+		Kind:          "user",
+		Requester:     "carol",
+		Justification: "laptop",
+		CSR:           csr,
+	}
+	for _, r := range []*Request{r1, r2, r3} {
+		if err := q.Submit(r); err != nil {
+			t.Fatalf("submit: %s", err)
+		}
+	}
+	if r1.ID != 1 || r3.ID != 3 || r3.CN != "carol" || r3.Status != RequestPending {
+		t.Fatalf("submit: bad requests %+v %+v", r1, r3)
+	}
+
+	crt, err := d.Approve(q, r1.ID, "alice", "ok")
+	if err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	if c, _ := d.Find("web.example.com"); c == nil || !c.Equal(crt) {
+		t.Fatalf("approve: cert not in DB")
+	}
+	if m, _ := d.Meta("web.example.com"); m.Owner != "bob" || m.Note != "new web tier" || m.Labels["request"] != "1" {
+		t.Fatalf("approve: bad metadata %+v", m)
+	}
+	if _, err := d.Approve(q, r1.ID, "alice", ""); err == nil {
+		t.Fatalf("approved a request twice")
+	}
+
+	// the policy still applies; the request stays pending
+	if _, err := d.Approve(q, r2.ID, "alice", ""); err == nil {
+		t.Fatalf("approved a request outside the policy")
+	}
+	if err := d.Reject(q, r2.ID, "alice", "wrong domain"); err != nil {
+		t.Fatalf("reject: %s", err)
+	}
+	if err := d.Reject(q, r2.ID, "alice", ""); err == nil {
+		t.Fatalf("rejected a request twice")
+	}
+
+	crt, err = d.Approve(q, r3.ID, "alice", "")
+	if err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	if crt.Subject.CommonName != "carol" || !sk.PublicKey.Equal(crt.PublicKey) {
+		t.Fatalf("approve: cert doesn't have the CSR key")
+	}
+
+	g, err := q.Get(r1.ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if g.Status != RequestApproved || g.Officer != "alice" || g.Reason != "ok" || g.Decided.IsZero() || g.Serial == "" {
+		t.Fatalf("get: bad request %+v", g)
+	}
+	if _, err := q.Get(9); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get: %v", err)
+	}
+
+	all, err := q.List("")
+	if err != nil || len(all) != 3 {
+		t.Fatalf("list: %v %v", all, err)
+	}
+	rej, err := q.List(RequestRejected)
+	if err != nil || len(rej) != 1 || rej[0].ID != r2.ID || rej[0].Reason != "wrong domain" {
+		t.Fatalf("list: %v %v", rej, err)
+	}
+
+	// the queue is opened without the DB passphrase
+	q.Close()
+	q = newTestQueue(t, d)
+	if v, _ := q.List(RequestApproved); len(v) != 2 {
+		t.Fatalf("reopen: %v", v)
+	}
+	if _, err := OpenQueue(d.fn + ".missing"); err == nil {
+		t.Fatalf("opened the queue of a missing DB")
+	}
+}
+
+func TestApproveRetry(t *testing.T) {
+	d := newTestDB(t)
+	q := newTestQueue(t, d)
+
+	var reqs []*Request
+	for range 2 {
+		r := &Request{
+			Kind:          "server",
+			CN:            "web.example.com",
+			DNSNames:      []string{"web.example.com"},
+			Requester:     "bob",
+			Justification: "new web tier",
+		}
+		if err := q.Submit(r); err != nil {
+			t.Fatalf("submit: %s", err)
+		}
+		reqs = append(reqs, r)
+	}
+
+	// the cert was issued but the queue wasn't updated
+	crt, err := d.issueRequest(reqs[0])
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	// another request for the same name doesn't claim it
+	if _, err := d.Approve(q, reqs[1].ID, "alice", ""); err == nil {
+		t.Fatalf("approved a request with the cert of another")
+	}
+
+	c, err := d.Approve(q, reqs[0].ID, "alice", "")
+	if err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	if !c.Equal(crt) {
+		t.Fatalf("approve: issued a second cert")
+	}
+	g, err := q.Get(reqs[0].ID)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if g.Status != RequestApproved || g.Serial != fmt.Sprintf("%#x", crt.SerialNumber) {
+		t.Fatalf("get: bad request %+v", g)
+	}
+	if rv, _ := d.Revoked(); len(rv) != 0 {
+		t.Fatalf("approve: revoked %d certs", len(rv))
+	}
+}
+
+// return a PEM encoded CSR for 'cn' and its key
+func testCSR(t *testing.T, cn string) (string, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %s", err)
+	}
+
+	tmpl := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, sk)
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), sk
+}
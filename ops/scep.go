@@ -0,0 +1,262 @@
+// scep.go -- SCEP registration authority and challenge passwords
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ProfileSCEP issues the RA cert of a SCEP server: a user cert for a
+// new RSA key that signs SCEP responses and decrypts requests. SCEP
+// clients can only encrypt to RSA keys.
+const ProfileSCEP = "scep"
+
+// the size of the RSA keys generated for RA certs
+const raKeyBits = 2048
+
+// challenge passwords keyed by ID
+var bucketChallenge = []byte("challenge")
+
+// DefaultChallengeValidity is the lifetime of a challenge password
+// without an explicit one
+const DefaultChallengeValidity = 7 * 24 * time.Hour
+
+// SCEP is the RA cert and key of a SCEP server
+type SCEP struct {
+	Cert *x509.Certificate
+
+	// the CAs that issued the cert starting with its signer and
+	// ending with the root CA
+	CAs []*x509.Certificate
+
+	Key *rsa.PrivateKey
+}
+
+// Challenge is a SCEP challenge password. Only the SHA-256 hash of the
+// password is kept; certik generates the passwords and they are long
+// enough that a fast hash is safe.
+type Challenge struct {
+	// the first 16 hex digits of the hash
+	ID string `json:"id"`
+
+	// hex SHA-256 of the password
+	Hash string `json:"hash"`
+
+	// CommonName of the CA that may issue certs with this
+	// challenge; any CA if empty
+	Signer string `json:"signer,omitempty"`
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	// a reusable challenge isn't removed when it is used
+	Reusable bool `json:"reusable,omitempty"`
+}
+
+// SCEP returns the RA cert 'cn' and its key; 'o' decrypts a password
+// protected key. If 'cn' doesn't exist, it is issued with the scep
+// profile and the signer, validity and subject in 'o'.
+func (d *DB) SCEP(cn string, o *CertOpts) (*SCEP, error) {
+	z := opts(o)
+
+	c, err := d.Find(cn)
+	if c == nil {
+		z.Profile = ProfileSCEP
+		if _, err := d.NewUser(cn, &z); err != nil {
+			return nil, err
+		}
+		c, err = d.Find(cn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+	if c.KeyUsage&x509.KeyUsageKeyEncipherment == 0 || !isRSA(c.PublicKey) {
+		return nil, fmt.Errorf("%s is not a SCEP RA cert", cn)
+	}
+
+	_, kp, err := d.CertPEM(cn, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(kp) == 0 {
+		return nil, fmt.Errorf("%s: no private key", cn)
+	}
+	sk, err := decodeKey(kp, z.Passwd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+
+	cas, err := issuerChain(d.CA, c.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	rk, ok := sk.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", cn)
+	}
+
+	s := &SCEP{
+		Cert: c.Certificate,
+		Key:  rk,
+	}
+	for _, ca := range cas {
+		s.CAs = append(s.CAs, ca.Certificate)
+	}
+	return s, nil
+}
+
+// check a cert with the scep profile; a new RSA key pair is generated
+// unless 'o' has a public key.
+func checkRA(kind string, o *CertOpts) error {
+	if kind != KindUser {
+		return fmt.Errorf("the %s profile is only for users", ProfileSCEP)
+	}
+	if len(o.DNSNames) > 0 || len(o.IPAddresses) > 0 || len(o.URIs) > 0 {
+		return fmt.Errorf("the %s profile doesn't take DNS names, IP addresses or URIs", ProfileSCEP)
+	}
+	if o.KeyUsage != 0 && o.KeyUsage&(x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment) != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		return fmt.Errorf("the %s profile needs the digitalSignature and keyEncipherment key usages", ProfileSCEP)
+	}
+
+	if o.PublicKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, raKeyBits)
+		if err != nil {
+			return fmt.Errorf("can't generate key: %w", err)
+		}
+		o.key = key
+		o.PublicKey = &key.PublicKey
+	}
+	if !isRSA(o.PublicKey) {
+		return fmt.Errorf("the %s profile needs an RSA key", ProfileSCEP)
+	}
+	return nil
+}
+
+// NewChallenge generates a new challenge password valid for 'validity'
+// and returns it along with its entry. 'c' has the signer and
+// reusability of the challenge.
+func (d *DB) NewChallenge(c *Challenge, validity time.Duration) (string, *Challenge, error) {
+	if len(c.Signer) > 0 {
+		if _, err := d.Signer(c.Signer); err != nil {
+			return "", nil, err
+		}
+	}
+	if validity <= 0 {
+		validity = DefaultChallengeValidity
+	}
+
+	pw := hex.EncodeToString(randBytes(16))
+	h := challengeHash(pw)
+
+	z := *c
+	z.ID = h[:16]
+	z.Hash = h
+	z.Created = time.Now().UTC()
+	z.Expires = z.Created.Add(validity)
+	if err := d.st.putJSON(bucketChallenge, z.ID, &z); err != nil {
+		return "", nil, err
+	}
+	return pw, &z, nil
+}
+
+// DelChallenge removes the challenge 'id'
+func (d *DB) DelChallenge(id string) error {
+	err := d.st.del(bucketChallenge, strings.ToLower(id))
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("no challenge %s", id)
+	}
+	return err
+}
+
+// Challenges returns the challenge passwords sorted by expiry
+func (d *DB) Challenges() ([]*Challenge, error) {
+	var v []*Challenge
+	err := d.st.forEach(bucketChallenge, func(k string, b []byte) error {
+		c := &Challenge{}
+		if err := json.Unmarshal(b, c); err != nil {
+			return fmt.Errorf("challenge %s: %w", k, err)
+		}
+		v = append(v, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(v, func(a, b *Challenge) int {
+		return a.Expires.Compare(b.Expires)
+	})
+	return v, nil
+}
+
+// UseChallenge checks the challenge password 'pw' for a cert signed by
+// 'signer' and removes it unless it is reusable.
+func (d *DB) UseChallenge(pw, signer string) error {
+	c, err := d.CheckChallenge(pw, signer)
+	if err != nil {
+		return err
+	}
+	return d.ConsumeChallenge(c)
+}
+
+// CheckChallenge checks the challenge password 'pw' for a cert signed
+// by 'signer' without using it up; ConsumeChallenge does that once the
+// cert is issued.
+func (d *DB) CheckChallenge(pw, signer string) (*Challenge, error) {
+	h := challengeHash(pw)
+
+	var c Challenge
+	if err := d.st.getJSON(bucketChallenge, h[:16], &c); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("wrong challenge password")
+		}
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Hash), []byte(h)) != 1 {
+		return nil, fmt.Errorf("wrong challenge password")
+	}
+	if time.Now().After(c.Expires) {
+		return nil, fmt.Errorf("challenge %s expired on %s", c.ID, c.Expires.Format(time.RFC1123))
+	}
+	if len(c.Signer) > 0 && c.Signer != signer {
+		return nil, fmt.Errorf("challenge %s is not valid for %s", c.ID, signer)
+	}
+	return &c, nil
+}
+
+// ConsumeChallenge removes the challenge 'c' unless it is reusable
+func (d *DB) ConsumeChallenge(c *Challenge) error {
+	if c.Reusable {
+		return nil
+	}
+
+	// a concurrent request may have used it first
+	if err := d.st.del(bucketChallenge, c.ID); err != nil {
+		return fmt.Errorf("challenge %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+func challengeHash(pw string) string {
+	h := sha256.Sum256([]byte(pw))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,127 @@
+// scep_test.go -- tests for SCEP RA certs and challenge passwords
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSCEPRA(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	ra, err := d.SCEP("scep-ra", &CertOpts{Signer: "ica"})
+	if err != nil {
+		t.Fatalf("scep: %s", err)
+	}
+	if ra.Key.N.BitLen() != raKeyBits || !ra.Key.PublicKey.Equal(ra.Cert.PublicKey) {
+		t.Fatalf("scep: bad key")
+	}
+	if ra.Cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Fatalf("scep: bad usage %x", ra.Cert.KeyUsage)
+	}
+	if len(ra.CAs) != 2 || ra.CAs[0].Subject.CommonName != "ica" || ra.CAs[1].Subject.CommonName != "test-ca" {
+		t.Fatalf("scep: bad chain %v", ra.CAs)
+	}
+
+	// the existing cert is used
+	rb, err := d.SCEP("scep-ra", nil)
+	if err != nil {
+		t.Fatalf("scep: %s", err)
+	}
+	if !rb.Cert.Equal(ra.Cert) || !rb.Key.Equal(ra.Key) {
+		t.Fatalf("scep: cert was reissued")
+	}
+
+	if _, err := d.NewUser("alice", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if _, err := d.SCEP("alice", nil); err == nil {
+		t.Fatalf("used a user cert as an RA")
+	}
+	if _, err := d.NewServer("ra.example.com", &CertOpts{Profile: ProfileSCEP}); err == nil {
+		t.Fatalf("issued an RA server cert")
+	}
+
+	// renew keeps the profile with a new RSA key
+	if _, err := d.Renew("scep-ra", nil); err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	rc, err := d.SCEP("scep-ra", nil)
+	if err != nil {
+		t.Fatalf("renewed scep: %s", err)
+	}
+	if rc.Cert.Equal(ra.Cert) || rc.Key.Equal(ra.Key) || rc.Cert.Issuer.CommonName != "ica" {
+		t.Fatalf("renewed scep: same cert or key")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	d := newTestDB(t)
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	once, c1, err := d.NewChallenge(&Challenge{}, 0)
+	if err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+	if len(once) != 32 || strings.Contains(c1.Hash, once) || c1.Expires.Sub(c1.Created) != DefaultChallengeValidity {
+		t.Fatalf("challenge: bad entry %+v", c1)
+	}
+
+	many, _, err := d.NewChallenge(&Challenge{Signer: "ica", Reusable: true}, time.Hour)
+	if err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+	if _, _, err := d.NewChallenge(&Challenge{Signer: "nope"}, 0); err == nil {
+		t.Fatalf("challenge for an unknown signer")
+	}
+
+	v, err := d.Challenges()
+	if err != nil || len(v) != 2 || !v[0].Reusable {
+		t.Fatalf("challenges: %v %v", v, err)
+	}
+
+	if err := d.UseChallenge("wrong", "ica"); err == nil {
+		t.Fatalf("used a wrong challenge")
+	}
+	if err := d.UseChallenge(many, "test-ca"); err == nil {
+		t.Fatalf("used a challenge for the wrong signer")
+	}
+	for range 2 {
+		if err := d.UseChallenge(many, "ica"); err != nil {
+			t.Fatalf("reusable challenge: %s", err)
+		}
+	}
+
+	if err := d.UseChallenge(once, "ica"); err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+	if err := d.UseChallenge(once, "ica"); err == nil {
+		t.Fatalf("used a challenge twice")
+	}
+
+	if err := d.DelChallenge(strings.ToUpper(v[0].ID)); err != nil {
+		t.Fatalf("del: %s", err)
+	}
+	if err := d.DelChallenge(v[0].ID); err == nil {
+		t.Fatalf("deleted a challenge twice")
+	}
+	if v, _ := d.Challenges(); len(v) != 0 {
+		t.Fatalf("challenges left: %v", v)
+	}
+}
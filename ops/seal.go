@@ -0,0 +1,176 @@
+// seal.go -- encrypt archives, backups and exports
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// how a sealed file is encrypted
+const (
+	sealPassphrase = 'p'
+	sealX25519     = 'x'
+)
+
+// SealKey encrypts files with a passphrase or to an X25519 public key.
+// Opening them needs the passphrase or the matching private key.
+type SealKey struct {
+	Passwd string
+
+	Public  *ecdh.PublicKey
+	Private *ecdh.PrivateKey
+}
+
+// ParseSealKey parses a PEM encoded X25519 public key (PKIX) or
+// private key (PKCS#8), e.g. from 'openssl genpkey -algorithm x25519'.
+func ParseSealKey(b []byte) (*SealKey, error) {
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+
+	switch blk.Type {
+	case "PUBLIC KEY":
+		pk, err := x509.ParsePKIXPublicKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if z, ok := pk.(*ecdh.PublicKey); ok && z.Curve() == ecdh.X25519() {
+			return &SealKey{Public: z}, nil
+		}
+	case "PRIVATE KEY":
+		sk, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if z, ok := sk.(*ecdh.PrivateKey); ok && z.Curve() == ecdh.X25519() {
+			return &SealKey{Public: z.PublicKey(), Private: z}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown key type %s", blk.Type)
+	}
+	return nil, errors.New("not an X25519 key")
+}
+
+// return true if 'b' was sealed with 'magic'
+func isSealed(magic, b []byte) bool {
+	return bytes.HasPrefix(b, magic)
+}
+
+// encrypt 'pt' with 'k'; the output is 'magic', the mode, the salt
+// (or the ephemeral X25519 public key), a nonce and the sealed 'pt'.
+// The header is authenticated along with 'pt'.
+func seal(magic []byte, k *SealKey, pt []byte) ([]byte, error) {
+	hdr := append([]byte{}, magic...)
+
+	var key []byte
+	if k.Public != nil {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := eph.ECDH(k.Public)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = x25519Key(magic, shared, eph.PublicKey(), k.Public); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, sealX25519)
+		hdr = append(hdr, eph.PublicKey().Bytes()...)
+	} else {
+		salt := randBytes(32)
+		key = kdf(k.Passwd, salt)
+		hdr = append(hdr, sealPassphrase)
+		hdr = append(hdr, salt...)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := randBytes(aead.NonceSize())
+	out := append(hdr, nonce...)
+	return aead.Seal(out, nonce, pt, hdr), nil
+}
+
+// decrypt the output of seal
+func unseal(magic []byte, k *SealKey, b []byte) ([]byte, error) {
+	n := len(magic) + 1 + 32
+	if len(b) < n || !isSealed(magic, b) {
+		return nil, errors.New("unknown format")
+	}
+	hdr, param := b[:n], b[len(magic)+1:n]
+
+	var key []byte
+	switch b[len(magic)] {
+	case sealPassphrase:
+		key = kdf(k.Passwd, param)
+	case sealX25519:
+		if k.Private == nil {
+			return nil, errors.New("encrypted to an X25519 key; needs the private key")
+		}
+		eph, err := ecdh.X25519().NewPublicKey(param)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := k.Private.ECDH(eph)
+		if err != nil {
+			return nil, err
+		}
+		if key, err = x25519Key(magic, shared, eph, k.Private.PublicKey()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown encryption")
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b = b[n:]
+	if len(b) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("truncated")
+	}
+
+	ns := aead.NonceSize()
+	pt, err := aead.Open(nil, b[:ns], b[ns:], hdr)
+	if err != nil {
+		return nil, errors.New("wrong key or corrupted")
+	}
+	return pt, nil
+}
+
+// derive the key from the X25519 secret shared by the ephemeral key
+// 'eph' and the recipient 'rcpt'
+func x25519Key(magic, shared []byte, eph, rcpt *ecdh.PublicKey) ([]byte, error) {
+	salt := append(eph.Bytes(), rcpt.Bytes()...)
+	return hkdf.Key(sha256.New, shared, salt, string(magic), 32)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
@@ -0,0 +1,274 @@
+// sign.go -- mint certs that go-pki can't express
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/opencoff/go-pki"
+)
+
+// Netscape cert type extension; go-pki marks server and client certs
+// with it and so do we.
+var oidNsCertType = asn1.ObjectIdentifier{2, 16, 840, 1, 113730, 1, 1}
+
+// Return the private key of the CA 'ca'
+func caSigner(ca *pki.CA) (crypto.Signer, error) {
+	cn := ca.Subject.CommonName
+	c, err := ca.Find(cn)
+	if err != nil {
+		return nil, fmt.Errorf("can't find CA %s: %w", cn, err)
+	}
+
+	_, kp := c.PEM()
+	blk, _ := pem.Decode(kp)
+	if blk == nil {
+		return nil, fmt.Errorf("CA %s: can't decode private key", cn)
+	}
+
+	return parseKey(blk.Bytes)
+}
+
+// parse a PKCS#8 or SEC 1 private key
+func parseKey(der []byte) (crypto.Signer, error) {
+	if k, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		sk, ok := k.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %T", k)
+		}
+		return sk, nil
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// Issue a leaf cert of the given kind with go-pki unless it needs
+// something only certik can mint. Certs minted by certik are put in
+// the companion store.
+func issueLeaf(ca *pki.CA, st *store, kind string, ci *pki.CertInfo, w *window, o *CertOpts) (*x509.Certificate, error) {
+	cn := ci.Subject.CommonName
+	if _, err := st.get(cn); err == nil {
+		return nil, fmt.Errorf("%s already exists", cn)
+	}
+
+	if !needsMint(kind, w, o) {
+		var c *pki.Cert
+		var err error
+
+		ci.Validity = w.Duration()
+		switch kind {
+		case KindServer:
+			c, err = ca.NewServerCert(ci, o.Passwd)
+		default:
+			c, err = ca.NewClientCert(ci, o.Passwd)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.Certificate, nil
+	}
+
+	if c, _ := ca.Find(cn); c != nil {
+		return nil, fmt.Errorf("%s already exists", cn)
+	}
+
+	sc, err := mintCert(ca, kind, ci, w, o)
+	if err != nil {
+		return nil, err
+	}
+	if o.SplitKeys {
+		if err := mintEncryption(ca, sc, ci, w, o); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := st.put(cn, sc); err != nil {
+		return nil, err
+	}
+	return sc.Certificate(), nil
+}
+
+// Mint a new leaf cert of the given kind described by 'ci' and
+// valid for the window 'w'. The cert is issued for o.PublicKey if set;
+// otherwise for a new key pair. Generated private keys are optionally
+// encrypted with o.Passwd.
+func mintCert(ca *pki.CA, kind string, ci *pki.CertInfo, w *window, o *CertOpts) (*storedCert, error) {
+	sk, err := caSigner(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	key, pub := o.key, o.PublicKey
+	if pub == nil {
+		ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("can't generate key: %w", err)
+		}
+		key, pub = ek, &ek.PublicKey
+	}
+
+	tmpl, err := leafTemplate(kind, ci, w, o)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := sk.(*ecdsa.PrivateKey); ok {
+		tmpl.SignatureAlgorithm = x509.ECDSAWithSHA512
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Certificate, pub, sk)
+	if err != nil {
+		return nil, fmt.Errorf("can't sign cert: %w", err)
+	}
+
+	var kp []byte
+	if key != nil {
+		kp, err = encodeKey(key, o.Passwd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sc := &storedCert{
+		Kind:    kind,
+		Signer:  ca.Subject.CommonName,
+		Profile: o.Profile,
+		Cert:    der,
+		Key:     kp,
+	}
+	if err := sc.parse(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// go-pki can't issue peer certs or certs with an explicit window, a
+// caller's public key, URI SANs, a profile or their own key usages
+func needsMint(kind string, w *window, o *CertOpts) bool {
+	return kind == KindPeer || w.Explicit() || o.PublicKey != nil || len(o.URIs) > 0 || len(o.Profile) > 0 ||
+		len(o.ExtKeyUsage) > 0 || o.KeyUsage != 0
+}
+
+// build the template for a leaf cert
+func leafTemplate(kind string, ci *pki.CertInfo, w *window, o *CertOpts) (*x509.Certificate, error) {
+	sn, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	if kind != KindServer && kind != KindPeer && kind != KindUser {
+		return nil, fmt.Errorf("can't mint certs of type %s", kind)
+	}
+
+	eku := leafEKU(kind, o)
+	ku := leafKeyUsage(o)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               ci.Subject,
+		NotBefore:             w.NotBefore,
+		NotAfter:              w.NotAfter,
+		DNSNames:              ci.DNSNames,
+		IPAddresses:           ci.IPAddresses,
+		EmailAddresses:        ci.EmailAddresses,
+		URIs:                  o.URIs,
+		BasicConstraintsValid: true,
+		KeyUsage:              ku,
+		ExtKeyUsage:           eku,
+	}
+
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().UTC()
+	}
+
+	ns, err := nsCertTypeFor(eku)
+	if err != nil {
+		return nil, err
+	}
+	if ns != nil {
+		tmpl.ExtraExtensions = []pkix.Extension{
+			{Id: oidNsCertType, Value: ns},
+		}
+	}
+	if o.Profile == ProfileTSA {
+		e, err := criticalEKU()
+		if err != nil {
+			return nil, err
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, e)
+	}
+	return tmpl, nil
+}
+
+// PEM encode a private key; optionally encrypted with 'pw'. EC keys
+// are SEC 1 encoded and the rest PKCS#8.
+func encodeKey(key crypto.Signer, pw string) ([]byte, error) {
+	var der []byte
+	var err error
+
+	typ := "PRIVATE KEY"
+	if ek, ok := key.(*ecdsa.PrivateKey); ok {
+		typ = "EC PRIVATE KEY"
+		der, err = x509.MarshalECPrivateKey(ek)
+	} else {
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blk := &pem.Block{
+		Type:  typ,
+		Bytes: der,
+	}
+
+	// password protected keys are always PKCS#8
+	if len(pw) > 0 {
+		if der, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			return nil, err
+		}
+		if blk, err = encryptPKCS8(der, pw); err != nil {
+			return nil, err
+		}
+	}
+	return pem.EncodeToMemory(blk), nil
+}
+
+// 128 bit random serial number
+func newSerial() (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)
+	sn, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return nil, fmt.Errorf("can't generate serial number: %w", err)
+	}
+	return sn, nil
+}
+
+// PEM returns the PEM encoded cert and key
+func (sc *storedCert) PEM() (crt, key []byte) {
+	crt = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: sc.Cert,
+	})
+	return crt, sc.Key
+}
+
+// Return the Cert view of this cert
+func (sc *storedCert) cert() *Cert {
+	return &Cert{Certificate: sc.x, Kind: sc.Kind}
+}
@@ -0,0 +1,67 @@
+// smime.go -- S/MIME email certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"fmt"
+	"slices"
+
+	"github.com/opencoff/go-pki"
+)
+
+// ProfileSMIME issues user certs for signing and encrypting email:
+// only email SANs, the emailProtection extended key usage and, with
+// CertOpts.SplitKeys, separate signing and encryption key pairs.
+const ProfileSMIME = "smime"
+
+// the key usage of the encryption cert of a split S/MIME pair; the
+// keys generated by certik are EC keys.
+const smimeEncryptUsage = x509.KeyUsageKeyAgreement
+
+// check a cert with the smime profile; 'domains' is true if the
+// policy of the signer restricts the email domains.
+func checkSMIME(kind string, o *CertOpts, domains bool) error {
+	if kind != KindUser {
+		return fmt.Errorf("the %s profile is only for users", ProfileSMIME)
+	}
+	if len(o.EmailAddresses) == 0 {
+		return fmt.Errorf("the %s profile needs at least one email address", ProfileSMIME)
+	}
+	if len(o.DNSNames) > 0 || len(o.IPAddresses) > 0 || len(o.URIs) > 0 {
+		return fmt.Errorf("the %s profile only takes email addresses", ProfileSMIME)
+	}
+	if len(o.ExtKeyUsage) > 0 && !slices.Contains(o.ExtKeyUsage, x509.ExtKeyUsageEmailProtection) {
+		return fmt.Errorf("the %s profile needs the emailProtection extended key usage", ProfileSMIME)
+	}
+	if o.SplitKeys && o.PublicKey != nil {
+		return fmt.Errorf("can't split the keys of a cert for a given public key")
+	}
+	if !domains {
+		return fmt.Errorf("signer has no email domains; set them with 'policy set --email-domain'")
+	}
+	return nil
+}
+
+// Mint the encryption half of a split S/MIME pair for the signing
+// cert 'sc'; both have the same subject, names and lifetime.
+func mintEncryption(ca *pki.CA, sc *storedCert, ci *pki.CertInfo, w *window, o *CertOpts) error {
+	z := *o
+	z.KeyUsage = smimeEncryptUsage
+	z.SplitKeys = false
+
+	ec, err := mintCert(ca, KindUser, ci, w, &z)
+	if err != nil {
+		return err
+	}
+
+	sc.EncCert = ec.Cert
+	sc.EncKey = ec.Key
+	return sc.parse()
+}
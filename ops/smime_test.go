@@ -0,0 +1,142 @@
+// smime_test.go -- tests for S/MIME certs and PKCS#12 export
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"errors"
+	"slices"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestSMIME(t *testing.T) {
+	d := newTestDB(t)
+
+	o := &CertOpts{Profile: ProfileSMIME}
+
+	// the CA must restrict the email domains
+	if _, err := d.NewUser("alice@example.com", o); err == nil {
+		t.Fatalf("issued S/MIME without email domains")
+	}
+	if err := d.SetPolicy("", &Policy{EmailDomains: []string{"example.com"}}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	c, err := d.NewUser("alice@example.com", o)
+	if err != nil {
+		t.Fatalf("smime: %s", err)
+	}
+	eku := []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	if !slices.Equal(c.ExtKeyUsage, eku) || c.KeyUsage != defaultKeyUsage {
+		t.Fatalf("smime: bad usage %v %x", c.ExtKeyUsage, c.KeyUsage)
+	}
+	if !slices.Equal(c.EmailAddresses, []string{"alice@example.com"}) {
+		t.Fatalf("smime: bad email %v", c.EmailAddresses)
+	}
+
+	_, err = d.NewUser("eve@example.net", &CertOpts{Profile: ProfileSMIME})
+	if !errors.Is(err, ErrPolicy) {
+		t.Fatalf("domain: exp policy violation, saw %v", err)
+	}
+
+	bad := map[string]*CertOpts{
+		"dns@example.com":   {Profile: ProfileSMIME, DNSNames: []string{"example.com"}},
+		"eku@example.com":   {Profile: ProfileSMIME, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+		"split@example.com": {SplitKeys: true},
+		"noemail":           {Profile: ProfileSMIME},
+	}
+	for cn, o := range bad {
+		if _, err := d.NewUser(cn, o); err == nil {
+			t.Fatalf("%s: issued a bad S/MIME cert", cn)
+		}
+	}
+	if _, err := d.NewServer("smime.example.com", &CertOpts{Profile: ProfileSMIME}); err == nil {
+		t.Fatalf("issued an S/MIME server cert")
+	}
+}
+
+func TestSMIMESplit(t *testing.T) {
+	d := newTestDB(t)
+	if err := d.SetPolicy("", &Policy{EmailDomains: []string{"example.com"}}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	o := &CertOpts{Profile: ProfileSMIME, SplitKeys: true, Passwd: "key-pw"}
+	c, err := d.NewUser("bob@example.com", o)
+	if err != nil {
+		t.Fatalf("smime: %s", err)
+	}
+	if c.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Fatalf("sign: bad usage %x", c.KeyUsage)
+	}
+
+	sc, err := d.st.get("bob@example.com")
+	if err != nil || sc.enc == nil {
+		t.Fatalf("smime: no encryption cert (%v)", err)
+	}
+	ec := sc.enc
+	if ec.KeyUsage != smimeEncryptUsage || !slices.Equal(ec.ExtKeyUsage, c.ExtKeyUsage) {
+		t.Fatalf("encrypt: bad usage %v %x", ec.ExtKeyUsage, ec.KeyUsage)
+	}
+	if ec.Subject.String() != c.Subject.String() || !slices.Equal(ec.EmailAddresses, c.EmailAddresses) {
+		t.Fatalf("encrypt: bad subject %s", ec.Subject)
+	}
+
+	sign, crypt, err := d.PKCS12("bob@example.com", &P12Opts{Passwd: "key-pw"})
+	if err != nil {
+		t.Fatalf("p12: %s", err)
+	}
+	for _, z := range []struct {
+		p12 []byte
+		c   *x509.Certificate
+	}{{sign, c}, {crypt, ec}} {
+		key, x, cas, err := pkcs12.DecodeChain(z.p12, "key-pw")
+		if err != nil {
+			t.Fatalf("p12: %s", err)
+		}
+		if key == nil || x.SerialNumber.Cmp(z.c.SerialNumber) != 0 {
+			t.Fatalf("p12: bad cert %#x", x.SerialNumber)
+		}
+		if len(cas) != 1 || !cas[0].Equal(d.CA.Certificate) {
+			t.Fatalf("p12: bad chain")
+		}
+	}
+	if _, _, err := d.PKCS12("bob@example.com", &P12Opts{Passwd: "wrong"}); err == nil {
+		t.Fatalf("p12: decrypted the key with the wrong password")
+	}
+	if _, _, err := d.PKCS12("bob@example.com", &P12Opts{Passwd: "key-pw", Legacy: true}); err != nil {
+		t.Fatalf("p12: legacy: %s", err)
+	}
+
+	// renewals keep both key pairs
+	c, err = d.Renew("bob@example.com", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if sc, err = d.st.get("bob@example.com"); err != nil || sc.enc == nil || sc.Profile != ProfileSMIME {
+		t.Fatalf("renew: lost the encryption cert (%v)", err)
+	}
+
+	// both halves of the old pair are revoked
+	rv, err := d.Revoked()
+	if err != nil {
+		t.Fatalf("revoked: %s", err)
+	}
+	seen := 0
+	for _, r := range rv {
+		if r.SerialNumber.Cmp(ec.SerialNumber) == 0 {
+			seen++
+		}
+	}
+	if len(rv) != 2 || seen != 1 {
+		t.Fatalf("revoked: exp both old certs, saw %d", len(rv))
+	}
+}
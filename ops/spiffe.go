@@ -0,0 +1,208 @@
+// spiffe.go -- SPIFFE workload identities and trust bundles
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ProfileSPIFFE issues X509-SVIDs: certs with exactly one SPIFFE ID
+// URI SAN in the trust domain of the signing CA.
+const ProfileSPIFFE = "spiffe"
+
+// a SPIFFE trust domain name
+var trustDomainRe = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// a path segment of a SPIFFE ID
+var spiffeSegRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ParseURI parses an absolute URI for a URI SAN
+func ParseURI(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad URI %s: %w", s, err)
+	}
+	if !u.IsAbs() || (len(u.Host) == 0 && len(u.Opaque) == 0) {
+		return nil, fmt.Errorf("URI %s must be absolute", s)
+	}
+	return u, nil
+}
+
+// ParseSPIFFEID parses and validates a SPIFFE ID such as
+// spiffe://example.org/ns/web/sa/frontend
+func ParseSPIFFEID(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("SPIFFE ID %s: %w", s, err)
+	}
+	if err := checkSPIFFEID(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// check that 'u' is a well formed SPIFFE ID
+func checkSPIFFEID(u *url.URL) error {
+	bad := func(why string) error {
+		return fmt.Errorf("SPIFFE ID %s: %s", u, why)
+	}
+
+	switch {
+	case u.Scheme != "spiffe":
+		return bad("scheme is not spiffe")
+	case u.User != nil || len(u.Port()) > 0:
+		return bad("can't have a user or port")
+	case len(u.RawQuery) > 0 || u.ForceQuery || len(u.Fragment) > 0:
+		return bad("can't have a query or fragment")
+	case !trustDomainRe.MatchString(u.Host):
+		return bad("invalid trust domain")
+	case len(u.Path) == 0 || u.Path == "/":
+		return bad("no workload path")
+	}
+
+	for _, seg := range strings.Split(u.Path[1:], "/") {
+		if seg == "." || seg == ".." || !spiffeSegRe.MatchString(seg) {
+			return bad(fmt.Sprintf("invalid path segment '%s'", seg))
+		}
+	}
+	return nil
+}
+
+// check a cert with the spiffe profile; 'td' is the trust domain of
+// the signer.
+func checkSVID(kind string, o *CertOpts, td string) error {
+	if kind != KindServer && kind != KindPeer && kind != KindUser {
+		return fmt.Errorf("the %s profile is only for servers, peers and users", ProfileSPIFFE)
+	}
+	if len(o.URIs) != 1 {
+		return fmt.Errorf("the %s profile needs exactly one SPIFFE ID; saw %d URIs", ProfileSPIFFE, len(o.URIs))
+	}
+
+	u := o.URIs[0]
+	if err := checkSPIFFEID(u); err != nil {
+		return err
+	}
+	if len(td) == 0 {
+		return fmt.Errorf("signer has no SPIFFE trust domain; set one with 'policy set --trust-domain'")
+	}
+	if u.Host != td {
+		return fmt.Errorf("%w: SPIFFE ID %s is not in trust domain %s", ErrPolicy, u, td)
+	}
+	return nil
+}
+
+// isSVID is true if 'c' has a single SPIFFE ID
+func isSVID(c *x509.Certificate) bool {
+	return len(c.URIs) == 1 && c.URIs[0].Scheme == "spiffe"
+}
+
+// jwk is a JSON Web Key for a CA cert in a SPIFFE bundle
+type jwk struct {
+	Kty string   `json:"kty"`
+	Use string   `json:"use"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+// SPIFFEBundle returns the trust bundle of TrustBundle() as a SPIFFE
+// bundle: a JWK set with an x509-svid key for every CA.
+func (d *DB) SPIFFEBundle(signer string) ([]byte, error) {
+	certs, err := d.TrustCerts(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []jwk
+	for _, c := range certs {
+		k, err := certJWK(c)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	js := struct {
+		Keys []jwk `json:"keys"`
+	}{keys}
+	return json.MarshalIndent(&js, "", "  ")
+}
+
+// TrustCerts returns the certs of TrustBundle()
+func (d *DB) TrustCerts(signer string) ([]*x509.Certificate, error) {
+	b, err := d.TrustBundle(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var blk *pem.Block
+		if blk, b = pem.Decode(b); blk == nil {
+			break
+		}
+
+		c, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, nil
+}
+
+// return the x509-svid JWK of the CA cert 'c'
+func certJWK(c *x509.Certificate) (jwk, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	k := jwk{
+		Use: "x509-svid",
+		X5c: []string{base64.StdEncoding.EncodeToString(c.Raw)},
+	}
+
+	switch pk := c.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		p := pk.Curve.Params()
+		n := (p.BitSize + 7) / 8
+		k.Kty = "EC"
+		k.Crv = p.Name
+		k.X = b64(pad(pk.X, n))
+		k.Y = b64(pad(pk.Y, n))
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = b64(pk.N.Bytes())
+		k.E = b64(big.NewInt(int64(pk.E)).Bytes())
+	case ed25519.PublicKey:
+		k.Kty = "OKP"
+		k.Crv = "Ed25519"
+		k.X = b64(pk)
+	default:
+		return k, fmt.Errorf("%s: unsupported key type %T", c.Subject.CommonName, pk)
+	}
+	return k, nil
+}
+
+// return 'x' as a big endian integer of 'n' bytes
+func pad(x *big.Int, n int) []byte {
+	b := make([]byte, n)
+	return x.FillBytes(b)
+}
@@ -0,0 +1,242 @@
+// spiffe_test.go -- tests for URI SANs and SPIFFE identities
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestURISAN(t *testing.T) {
+	d := newTestDB(t)
+
+	u, err := ParseURI("https://example.com/svc")
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	c, err := d.NewServer("a.example.com", &CertOpts{URIs: []*url.URL{u}})
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	if len(c.URIs) != 1 || c.URIs[0].String() != u.String() {
+		t.Fatalf("server: bad URIs %v", c.URIs)
+	}
+	if !slices.Equal(c.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+		t.Fatalf("server: bad EKU %v", c.ExtKeyUsage)
+	}
+
+	// renewals keep the URIs
+	c, err = d.Renew("a.example.com", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if len(c.URIs) != 1 || c.URIs[0].String() != u.String() {
+		t.Fatalf("renew: bad URIs %v", c.URIs)
+	}
+
+	for _, s := range []string{"example.com/svc", "/svc", "::"} {
+		if _, err := ParseURI(s); err == nil {
+			t.Fatalf("parsed bad URI %q", s)
+		}
+	}
+
+	if _, err := d.NewIntermediate("ica", &CertOpts{URIs: []*url.URL{u}}); err == nil {
+		t.Fatalf("issued a CA with URIs")
+	}
+}
+
+func TestSPIFFEID(t *testing.T) {
+	good := []string{
+		"spiffe://example.org/web",
+		"spiffe://example.org/ns/prod/sa/web-1",
+	}
+	for _, s := range good {
+		if _, err := ParseSPIFFEID(s); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+	}
+
+	bad := []string{
+		"https://example.org/web",
+		"spiffe://example.org",
+		"spiffe://example.org/",
+		"spiffe://example.org/web/",
+		"spiffe://example.org/a/../b",
+		"spiffe://example.org/a/./b",
+		"spiffe://Example.org/web",
+		"spiffe://example.org:8080/web",
+		"spiffe://u@example.org/web",
+		"spiffe://example.org/web?x=1",
+		"spiffe://example.org/web#x",
+		"spiffe://example.org/a%20b",
+	}
+	for _, s := range bad {
+		if _, err := ParseSPIFFEID(s); err == nil {
+			t.Fatalf("parsed bad SPIFFE ID %q", s)
+		}
+	}
+}
+
+func TestSPIFFEProfile(t *testing.T) {
+	d := newTestDB(t)
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	id := func(s string) []*url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		return []*url.URL{u}
+	}
+
+	o := &CertOpts{
+		Signer:  "ica",
+		URIs:    id("spiffe://example.org/web"),
+		Profile: ProfileSPIFFE,
+	}
+
+	// the CA needs a trust domain
+	if _, err := d.NewServer("web", o); err == nil {
+		t.Fatalf("issued an SVID without a trust domain")
+	}
+
+	// the root's trust domain applies to the CAs below it
+	if err := d.SetPolicy("", &Policy{TrustDomain: "example.org"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	c, err := d.NewServer("web", o)
+	if err != nil {
+		t.Fatalf("svid: %s", err)
+	}
+	if !isSVID(c) {
+		t.Fatalf("svid: bad URIs %v", c.URIs)
+	}
+	eku := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if !slices.Equal(c.ExtKeyUsage, eku) {
+		t.Fatalf("svid: bad EKU %v", c.ExtKeyUsage)
+	}
+
+	// a renewal is still an SVID
+	c, err = d.Renew("web", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if !slices.Equal(c.ExtKeyUsage, eku) {
+		t.Fatalf("renew: bad EKU %v", c.ExtKeyUsage)
+	}
+
+	bad := map[string]*CertOpts{
+		"no-uri":   {},
+		"two-uris": {URIs: append(id("spiffe://example.org/a"), id("spiffe://example.org/b")...)},
+		"https":    {URIs: id("https://example.org/a")},
+		"dotdot":   {URIs: id("spiffe://example.org/a/../b")},
+		"other-td": {URIs: id("spiffe://example.net/a")},
+	}
+	for cn, o := range bad {
+		o.Signer = "ica"
+		o.Profile = ProfileSPIFFE
+		if _, err := d.NewUser(cn, o); err == nil {
+			t.Fatalf("%s: issued a bad SVID", cn)
+		}
+	}
+
+	_, err = d.NewUser("x", &CertOpts{URIs: id("spiffe://example.net/x"), Profile: ProfileSPIFFE})
+	if !errors.Is(err, ErrPolicy) {
+		t.Fatalf("trust domain: exp policy violation, saw %v", err)
+	}
+
+	// the nearest trust domain wins
+	if err := d.SetPolicy("ica", &Policy{TrustDomain: "prod.example.org"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+	if _, err := d.NewUser("db", &CertOpts{Signer: "ica", URIs: id("spiffe://prod.example.org/db"), Profile: ProfileSPIFFE}); err != nil {
+		t.Fatalf("nearest: %s", err)
+	}
+
+	// SPIFFE IDs outside the profile must be in the trust domain too
+	_, err = d.NewServer("y.example.com", &CertOpts{URIs: id("spiffe://example.net/y")})
+	if !errors.Is(err, ErrPolicy) {
+		t.Fatalf("no profile: exp policy violation, saw %v", err)
+	}
+
+	if _, err := d.NewServer("z", &CertOpts{Profile: "nope"}); err == nil {
+		t.Fatalf("issued with an unknown profile")
+	}
+	if _, err := d.NewIntermediate("ica2", &CertOpts{URIs: id("spiffe://example.org/ca"), Profile: ProfileSPIFFE}); err == nil {
+		t.Fatalf("issued a CA SVID")
+	}
+	if err := d.SetPolicy("", &Policy{TrustDomain: "Bad Domain"}); err == nil {
+		t.Fatalf("set a bad trust domain")
+	}
+}
+
+func TestSPIFFEBundle(t *testing.T) {
+	d := newTestDB(t)
+	ica, err := d.NewIntermediate("ica", nil)
+	if err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	b, err := d.SPIFFEBundle("")
+	if err != nil {
+		t.Fatalf("bundle: %s", err)
+	}
+
+	var js struct {
+		Keys []struct {
+			Kty string   `json:"kty"`
+			Use string   `json:"use"`
+			Crv string   `json:"crv"`
+			X   string   `json:"x"`
+			Y   string   `json:"y"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &js); err != nil {
+		t.Fatalf("json: %s", err)
+	}
+	if len(js.Keys) != 2 {
+		t.Fatalf("bundle: exp 2 keys, saw %d", len(js.Keys))
+	}
+
+	seen := map[string]bool{}
+	for _, k := range js.Keys {
+		if k.Use != "x509-svid" || k.Kty != "EC" || k.Crv != "P-256" || len(k.X) == 0 || len(k.Y) == 0 {
+			t.Fatalf("bundle: bad key %+v", k)
+		}
+		if len(k.X5c) != 1 {
+			t.Fatalf("bundle: exp 1 cert, saw %d", len(k.X5c))
+		}
+
+		der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+		if err != nil {
+			t.Fatalf("x5c: %s", err)
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("x5c: %s", err)
+		}
+		if !c.IsCA {
+			t.Fatalf("x5c: %s is not a CA", c.Subject.CommonName)
+		}
+		seen[c.Subject.CommonName] = true
+	}
+	if !seen["test-ca"] || !seen[ica.Subject.CommonName] {
+		t.Fatalf("bundle: missing CAs; saw %v", seen)
+	}
+}
@@ -0,0 +1,603 @@
+// store.go -- companion store for certs minted by certik
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/argon2"
+)
+
+const storeSuffix = ".certik"
+
+// the key of the companion store in a JSON dump of the DB
+const jsonStoreKey = "certik_store"
+
+var (
+	bucketConfig = []byte("config")
+	bucketCerts  = []byte("certs")
+
+	// revoked certs keyed by serial number
+	bucketRevoked = []byte("revoked")
+
+	keySalt  = []byte("salt")
+	keyCheck = []byte("check")
+
+	checkMagic = []byte("certik-store-v1")
+)
+
+var ErrNotFound = errors.New("not found")
+
+// go-pki decides the shape of every cert it issues. Certs that need
+// something go-pki can't express (e.g., an explicit NotBefore) are
+// signed by certik with the CA key and kept in a companion bolt DB
+// next to the main DB ("DB.certik"). Like the main DB, every value is
+// encrypted with a key derived from the DB passphrase.
+type store struct {
+	fn string
+	pw string
+	db *bolt.DB
+
+	// AEAD key derived from the passphrase
+	key []byte
+}
+
+// A cert minted by certik
+type storedCert struct {
+	Kind    string `json:"kind"`
+	Signer  string `json:"signer"`
+	Profile string `json:"profile,omitempty"`
+
+	// DER encoded cert and PEM encoded private key
+	Cert []byte `json:"cert"`
+	Key  []byte `json:"key"`
+
+	// the encryption cert and key of a split S/MIME pair
+	EncCert []byte `json:"enc_cert,omitempty"`
+	EncKey  []byte `json:"enc_key,omitempty"`
+
+	// non-zero if revoked
+	Revoked time.Time `json:"revoked"`
+
+	// non-zero if a newer cert replaced it
+	Superseded time.Time `json:"superseded,omitempty"`
+
+	x   *x509.Certificate
+	enc *x509.Certificate
+}
+
+// Open the companion store of 'dbfile'. The store is created lazily
+// on the first write; until then it behaves as an empty store.
+func openStore(dbfile, pw string) (*store, error) {
+	s := &store{
+		fn: dbfile + storeSuffix,
+		pw: pw,
+	}
+
+	if _, err := os.Stat(s.fn); err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open the bolt DB and derive the encryption key; creates a new DB
+// if needed
+func (s *store) open() error {
+	db, err := bolt.Open(s.fn, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return fmt.Errorf("store %s: %w", s.fn, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketConfig)
+		if err != nil {
+			return err
+		}
+
+		salt := b.Get(keySalt)
+		if salt == nil {
+			salt = randBytes(32)
+			s.key = kdf(s.pw, salt)
+
+			chk, err := s.seal(bucketConfig, keyCheck, checkMagic)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(keySalt, salt); err != nil {
+				return err
+			}
+			return b.Put(keyCheck, chk)
+		}
+
+		s.key = kdf(s.pw, salt)
+		chk, err := s.open1(bucketConfig, keyCheck, b.Get(keyCheck))
+		if err != nil || subtle.ConstantTimeCompare(chk, checkMagic) != 1 {
+			return fmt.Errorf("store %s: wrong password", s.fn)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+// Rewrite the store without its free pages
+func (s *store) compact() error {
+	if s.db == nil {
+		return nil
+	}
+
+	tmp := s.fn + ".tmp"
+	db, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return fmt.Errorf("store %s: %w", tmp, err)
+	}
+
+	if err := bolt.Compact(db, s.db, 1<<20); err != nil {
+		db.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("store %s: can't compact: %w", s.fn, err)
+	}
+	if err := db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	s.db = nil
+
+	if err := os.Rename(tmp, s.fn); err != nil {
+		os.Remove(tmp)
+		if e := s.open(); e != nil {
+			return e
+		}
+		return err
+	}
+	return s.open()
+}
+
+func (s *store) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Put the cert named 'cn' into the store
+func (s *store) put(cn string, sc *storedCert) error {
+	return s.putJSON(bucketCerts, cn, sc)
+}
+
+// Get the cert named 'cn' from the store
+func (s *store) get(cn string) (*storedCert, error) {
+	var sc storedCert
+	if err := s.getJSON(bucketCerts, cn, &sc); err != nil {
+		return nil, err
+	}
+	if err := sc.parse(); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// Revoke the cert named 'cn'; revoked certs are moved out of the way
+// so that the CN can be issued again.
+func (s *store) revoke(cn string) error {
+	sc, err := s.get(cn)
+	if err != nil {
+		return err
+	}
+
+	sc.Revoked = time.Now().UTC()
+	if err := s.putJSON(bucketRevoked, sc.x.SerialNumber.Text(16), sc); err != nil {
+		return err
+	}
+
+	// the encryption half of an S/MIME pair goes on the CRL too
+	if sc.enc != nil {
+		ec := &storedCert{
+			Kind:    sc.Kind,
+			Signer:  sc.Signer,
+			Profile: sc.Profile,
+			Cert:    sc.EncCert,
+			Revoked: sc.Revoked,
+		}
+		if err := s.putJSON(bucketRevoked, sc.enc.SerialNumber.Text(16), ec); err != nil {
+			return err
+		}
+	}
+	return s.del(bucketCerts, cn)
+}
+
+// Return all the revoked certs in the store
+func (s *store) revoked() ([]*storedCert, error) {
+	return s.list(bucketRevoked)
+}
+
+// Return all the certs in the store
+func (s *store) all() ([]*storedCert, error) {
+	return s.list(bucketCerts)
+}
+
+func (s *store) list(bucket []byte) ([]*storedCert, error) {
+	var certs []*storedCert
+
+	err := s.forEach(bucket, func(k string, v []byte) error {
+		var sc storedCert
+		if err := json.Unmarshal(v, &sc); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		if err := sc.parse(); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		certs = append(certs, &sc)
+		return nil
+	})
+	return certs, err
+}
+
+// Return all the unrevoked certs in the store
+func (s *store) active() ([]*Cert, error) {
+	all, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+
+	certs := make([]*Cert, 0, len(all))
+	for _, sc := range all {
+		certs = append(certs, sc.cert())
+	}
+	return certs, nil
+}
+
+// Re-encrypt the store with a key derived from 'newpw'; 'commit' runs
+// last in the same transaction and its error rolls back the rekey.
+func (s *store) rekey(newpw string, commit func() error) error {
+	if s.db == nil {
+		if err := commit(); err != nil {
+			return err
+		}
+		s.pw = newpw
+		return nil
+	}
+
+	salt := randBytes(32)
+	nkey := kdf(newpw, salt)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == string(bucketConfig) {
+				return nil
+			}
+
+			kv := make(map[string][]byte)
+			err := b.ForEach(func(k, v []byte) error {
+				pt, err := s.open1(name, k, v)
+				if err != nil {
+					return err
+				}
+				kv[string(k)] = pt
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			okey := s.key
+			s.key = nkey
+			defer func() {
+				s.key = okey
+			}()
+			for k, pt := range kv {
+				ct, err := s.seal(name, []byte(k), pt)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(k), ct); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		okey := s.key
+		s.key = nkey
+		chk, err := s.seal(bucketConfig, keyCheck, checkMagic)
+		s.key = okey
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket(bucketConfig)
+		if err := b.Put(keySalt, salt); err != nil {
+			return err
+		}
+		if err := b.Put(keyCheck, chk); err != nil {
+			return err
+		}
+		return commit()
+	})
+	if err != nil {
+		return err
+	}
+
+	s.pw = newpw
+	s.key = nkey
+	return nil
+}
+
+// -- generic encrypted K/V helpers --
+
+func (s *store) putJSON(bucket []byte, k string, v any) error {
+	if s.db == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ct, err := s.seal(bucket, []byte(k), js)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(k), ct)
+	})
+}
+
+func (s *store) getJSON(bucket []byte, k string, v any) error {
+	if s.db == nil {
+		return ErrNotFound
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return ErrNotFound
+		}
+
+		ct := b.Get([]byte(k))
+		if ct == nil {
+			return ErrNotFound
+		}
+
+		pt, err := s.open1(bucket, []byte(k), ct)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(pt, v)
+	})
+}
+
+func (s *store) del(bucket []byte, k string) error {
+	if s.db == nil {
+		return ErrNotFound
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil || b.Get([]byte(k)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(k))
+	})
+}
+
+// return the decrypted values of every bucket but the config
+func (s *store) dump() (map[string]map[string]json.RawMessage, error) {
+	all := map[string]map[string]json.RawMessage{}
+	if s.db == nil {
+		return all, nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == string(bucketConfig) {
+				return nil
+			}
+
+			kv := map[string]json.RawMessage{}
+			err := b.ForEach(func(k, v []byte) error {
+				pt, err := s.open1(name, k, v)
+				if err != nil {
+					return err
+				}
+				kv[string(k)] = pt
+				return nil
+			})
+			all[string(name)] = kv
+			return err
+		})
+	})
+	return all, err
+}
+
+// check the contents of a store as returned by dump
+func checkStore(all map[string]map[string]json.RawMessage) error {
+	for name, kv := range all {
+		if name == string(bucketConfig) {
+			return errors.New("unexpected config bucket")
+		}
+
+		// the certs must parse
+		if !slices.Contains([]string{string(bucketCerts), string(bucketRevoked), string(bucketSuperseded)}, name) {
+			continue
+		}
+		for k, v := range kv {
+			var sc storedCert
+			if err := json.Unmarshal(v, &sc); err != nil {
+				return fmt.Errorf("%s/%s: %w", name, k, err)
+			}
+			if err := sc.parse(); err != nil {
+				return fmt.Errorf("%s/%s: %w", name, k, err)
+			}
+		}
+	}
+	return nil
+}
+
+// encrypt and write the values in 'all' (as returned by dump)
+func (s *store) load(all map[string]map[string]json.RawMessage) error {
+	if s.db == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for name, kv := range all {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+
+			for k, v := range kv {
+				ct, err := s.seal([]byte(name), []byte(k), v)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(k), ct); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// call 'fp' with the decrypted value of every key in 'bucket'
+func (s *store) forEach(bucket []byte, fp func(k string, v []byte) error) error {
+	if s.db == nil {
+		return nil
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			pt, err := s.open1(bucket, k, v)
+			if err != nil {
+				return err
+			}
+			return fp(string(k), pt)
+		})
+	})
+}
+
+// encrypt 'pt' bound to its bucket and key
+func (s *store) seal(bucket, k, pt []byte) ([]byte, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := randBytes(aead.NonceSize())
+	return aead.Seal(nonce, nonce, pt, aad(bucket, k)), nil
+}
+
+// decrypt 'ct' bound to its bucket and key
+func (s *store) open1(bucket, k, ct []byte) ([]byte, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	n := aead.NonceSize()
+	if len(ct) < n+aead.Overhead() {
+		return nil, fmt.Errorf("store: %s/%s: value too small", bucket, k)
+	}
+
+	pt, err := aead.Open(nil, ct[:n], ct[n:], aad(bucket, k))
+	if err != nil {
+		return nil, fmt.Errorf("store: %s/%s: %w", bucket, k, err)
+	}
+	return pt, nil
+}
+
+func (s *store) aead() (cipher.AEAD, error) {
+	return newGCM(s.key)
+}
+
+func aad(bucket, k []byte) []byte {
+	a := make([]byte, 0, len(bucket)+len(k)+1)
+	a = append(a, bucket...)
+	a = append(a, '/')
+	return append(a, k...)
+}
+
+func kdf(pw string, salt []byte) []byte {
+	return argon2.IDKey([]byte(pw), salt, 1, 64*1024, 4, 32)
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("can't read random bytes: %s", err))
+	}
+	return b
+}
+
+// decode the DER certs
+func (sc *storedCert) parse() error {
+	x, err := x509.ParseCertificate(sc.Cert)
+	if err != nil {
+		return err
+	}
+	sc.x = x
+
+	if len(sc.EncCert) > 0 {
+		if sc.enc, err = x509.ParseCertificate(sc.EncCert); err != nil {
+			return fmt.Errorf("encryption cert: %w", err)
+		}
+	}
+	return nil
+}
+
+// Certificate returns the parsed cert
+func (sc *storedCert) Certificate() *x509.Certificate {
+	return sc.x
+}
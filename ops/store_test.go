@@ -0,0 +1,128 @@
+// store_test.go -- tests for the companion store
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := openStore(fn, testPw)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	// the store is created lazily
+	if _, err := os.Stat(s.fn); !os.IsNotExist(err) {
+		t.Fatalf("store created before the first write")
+	}
+	if _, err := s.get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get: exp ErrNotFound, saw %v", err)
+	}
+
+	v := map[string]string{"secret": "s3kr1t-value"}
+	if err := s.putJSON(bucketCerts, "a", v); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	s.Close()
+
+	// values are encrypted at rest
+	raw, err := os.ReadFile(s.fn)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if bytes.Contains(raw, []byte("s3kr1t-value")) {
+		t.Fatalf("store has plaintext values")
+	}
+
+	if _, err := openStore(fn, "wrong"); err == nil {
+		t.Fatalf("opened the store with the wrong password")
+	}
+
+	s, err = openStore(fn, testPw)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	var z map[string]string
+	if err := s.getJSON(bucketCerts, "a", &z); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if z["secret"] != v["secret"] {
+		t.Fatalf("get: exp %v, saw %v", v, z)
+	}
+
+	// a failed commit leaves the old key in place
+	if err := s.rekey("new-pw", func() error { return errors.New("nope") }); err == nil {
+		t.Fatalf("rekey: exp an error")
+	}
+	z = nil
+	if err := s.getJSON(bucketCerts, "a", &z); err != nil || z["secret"] != v["secret"] {
+		t.Fatalf("get after failed rekey: %v %v", z, err)
+	}
+
+	if err := s.rekey("new-pw", func() error { return nil }); err != nil {
+		t.Fatalf("rekey: %s", err)
+	}
+	s.Close()
+
+	if _, err := openStore(fn, testPw); err == nil {
+		t.Fatalf("opened the store with the old password")
+	}
+
+	s, err = openStore(fn, "new-pw")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer s.Close()
+
+	z = nil
+	if err := s.getJSON(bucketCerts, "a", &z); err != nil {
+		t.Fatalf("get after rekey: %s", err)
+	}
+	if z["secret"] != v["secret"] {
+		t.Fatalf("get after rekey: exp %v, saw %v", v, z)
+	}
+}
+
+func TestStoreTamper(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.db")
+
+	s, err := openStore(fn, testPw)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer s.Close()
+
+	if err := s.putJSON(bucketCerts, "a", "value-a"); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	// values are bound to their key; swapping them is detected
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketCerts)
+		return b.Put([]byte("b"), b.Get([]byte("a")))
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	var z string
+	if err := s.getJSON(bucketCerts, "b", &z); err == nil {
+		t.Fatalf("read a value moved to a different key")
+	}
+}
@@ -0,0 +1,102 @@
+// subject.go -- parse and merge cert subjects
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"strings"
+)
+
+// subject attributes by their short name; the keys are lower case
+var subjectAttrs = map[string]func(n *pkix.Name, v string){
+	"c":            func(n *pkix.Name, v string) { n.Country = append(n.Country, v) },
+	"o":            func(n *pkix.Name, v string) { n.Organization = append(n.Organization, v) },
+	"ou":           func(n *pkix.Name, v string) { n.OrganizationalUnit = append(n.OrganizationalUnit, v) },
+	"l":            func(n *pkix.Name, v string) { n.Locality = append(n.Locality, v) },
+	"st":           func(n *pkix.Name, v string) { n.Province = append(n.Province, v) },
+	"street":       func(n *pkix.Name, v string) { n.StreetAddress = append(n.StreetAddress, v) },
+	"postalcode":   func(n *pkix.Name, v string) { n.PostalCode = append(n.PostalCode, v) },
+	"serialnumber": func(n *pkix.Name, v string) { n.SerialNumber = v },
+	"cn":           func(n *pkix.Name, v string) { n.CommonName = v },
+}
+
+// ParseSubject parses an openssl style subject such as
+// "/C=DE/O=Acme/OU=Ops/OU=Dev/L=Berlin/ST=BE/CN=www.example.com".
+// The attributes are C, O, OU, L, ST, street, postalCode,
+// serialNumber and CN; repeated attributes are multi-valued and a
+// '/' in a value is escaped as '\/'.
+func ParseSubject(s string) (pkix.Name, error) {
+	var n pkix.Name
+
+	if !strings.HasPrefix(s, "/") {
+		return n, fmt.Errorf("subject '%s' must start with '/'", s)
+	}
+
+	for _, rdn := range splitSubject(s[1:]) {
+		if len(rdn) == 0 {
+			continue
+		}
+
+		k, v, ok := strings.Cut(rdn, "=")
+		if !ok || len(v) == 0 {
+			return n, fmt.Errorf("subject: malformed attribute '%s'", rdn)
+		}
+
+		set, ok := subjectAttrs[strings.ToLower(strings.TrimSpace(k))]
+		if !ok {
+			return n, fmt.Errorf("subject: unknown attribute '%s'", k)
+		}
+		set(&n, v)
+	}
+	return n, nil
+}
+
+// split 's' at unescaped '/'
+func splitSubject(s string) []string {
+	var v []string
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case s[i] == '/':
+			v = append(v, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return append(v, b.String())
+}
+
+// MergeSubject returns 'def' with every field that is set in 'n'
+// replaced; the CommonName of 'def' is left alone.
+func MergeSubject(def, n pkix.Name) pkix.Name {
+	z := def
+	repl := func(dst *[]string, src []string) {
+		if len(src) > 0 {
+			*dst = src
+		}
+	}
+
+	repl(&z.Country, n.Country)
+	repl(&z.Organization, n.Organization)
+	repl(&z.OrganizationalUnit, n.OrganizationalUnit)
+	repl(&z.Locality, n.Locality)
+	repl(&z.Province, n.Province)
+	repl(&z.StreetAddress, n.StreetAddress)
+	repl(&z.PostalCode, n.PostalCode)
+	if len(n.SerialNumber) > 0 {
+		z.SerialNumber = n.SerialNumber
+	}
+	return z
+}
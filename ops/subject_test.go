@@ -0,0 +1,119 @@
+// subject_test.go -- tests for cert subjects
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509/pkix"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseSubject(t *testing.T) {
+	n, err := ParseSubject(`/C=DE/O=Acme\/Widgets/OU=Ops/OU=Dev/L=Berlin/ST=BE/street=Main St 1/postalCode=10115/serialNumber=42/CN=www.example.com`)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	exp := pkix.Name{
+		Country:            []string{"DE"},
+		Organization:       []string{"Acme/Widgets"},
+		OrganizationalUnit: []string{"Ops", "Dev"},
+		Locality:           []string{"Berlin"},
+		Province:           []string{"BE"},
+		StreetAddress:      []string{"Main St 1"},
+		PostalCode:         []string{"10115"},
+		SerialNumber:       "42",
+		CommonName:         "www.example.com",
+	}
+	if !reflect.DeepEqual(n, exp) {
+		t.Fatalf("parse: exp %+v, saw %+v", exp, n)
+	}
+
+	bad := []string{
+		"C=DE",
+		"/C",
+		"/C=",
+		"/X=1",
+	}
+	for _, s := range bad {
+		if _, err := ParseSubject(s); err == nil {
+			t.Fatalf("parsed a bad subject %q", s)
+		}
+	}
+}
+
+func TestSubjectOverride(t *testing.T) {
+	d := newTestDB(t)
+
+	o := &CertOpts{
+		Subject: pkix.Name{
+			OrganizationalUnit: []string{"Ops", "Dev"},
+			Locality:           []string{"Berlin"},
+			CommonName:         "ignored",
+		},
+	}
+	c, err := d.NewServer("a.example.com", o)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	s := c.Subject
+	if s.CommonName != "a.example.com" {
+		t.Fatalf("CN: exp a.example.com, saw %s", s.CommonName)
+	}
+
+	// multi-valued attributes are a DER SET; their order isn't kept
+	ou := slices.Sorted(slices.Values(s.OrganizationalUnit))
+	if !slices.Equal(ou, []string{"Dev", "Ops"}) || !slices.Equal(s.Locality, o.Subject.Locality) {
+		t.Fatalf("override: bad subject %s", s)
+	}
+
+	// fields that aren't overridden come from the CA
+	if !slices.Equal(s.Country, []string{"US"}) || !slices.Equal(s.Organization, []string{"certik"}) {
+		t.Fatalf("defaults: bad subject %s", s)
+	}
+
+	// and the same for certs minted by certik
+	o.Subject = pkix.Name{Country: []string{"DE"}}
+	o.NotBefore = d.CA.NotBefore
+	c, err = d.NewUser("u@example.com", o)
+	if err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if !slices.Equal(c.Subject.Country, []string{"DE"}) || !slices.Equal(c.Subject.Organization, []string{"certik"}) {
+		t.Fatalf("minted: bad subject %s", c.Subject)
+	}
+}
+
+func TestInitSubject(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "test.db")
+	d, err := Init(fn, "test-ca", &InitOpts{
+		Passwd:       testPw,
+		Organization: "certik",
+		Subject: pkix.Name{
+			Organization: []string{"ignored"},
+			Locality:     []string{"Berlin"},
+			SerialNumber: "7",
+		},
+	})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	defer d.Close()
+
+	s := d.CA.Subject
+	if s.CommonName != "test-ca" || s.SerialNumber != "7" || len(s.Country) != 0 {
+		t.Fatalf("init: bad subject %s", s)
+	}
+	if !slices.Equal(s.Organization, []string{"certik"}) || !slices.Equal(s.Locality, []string{"Berlin"}) {
+		t.Fatalf("init: bad subject %s", s)
+	}
+}
@@ -0,0 +1,238 @@
+// usage.go -- key usage and extended key usage of leaf certs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// extended key usages by name
+var ekuNames = []struct {
+	name string
+	eku  x509.ExtKeyUsage
+}{
+	{"serverAuth", x509.ExtKeyUsageServerAuth},
+	{"clientAuth", x509.ExtKeyUsageClientAuth},
+	{"codeSigning", x509.ExtKeyUsageCodeSigning},
+	{"emailProtection", x509.ExtKeyUsageEmailProtection},
+	{"timeStamping", x509.ExtKeyUsageTimeStamping},
+	{"OCSPSigning", x509.ExtKeyUsageOCSPSigning},
+}
+
+// key usages by name; the CA usages keyCertSign and cRLSign aren't
+// allowed on leaf certs.
+var kuNames = []struct {
+	name string
+	ku   x509.KeyUsage
+}{
+	{"digitalSignature", x509.KeyUsageDigitalSignature},
+	{"contentCommitment", x509.KeyUsageContentCommitment},
+	{"keyEncipherment", x509.KeyUsageKeyEncipherment},
+	{"dataEncipherment", x509.KeyUsageDataEncipherment},
+	{"keyAgreement", x509.KeyUsageKeyAgreement},
+	{"encipherOnly", x509.KeyUsageEncipherOnly},
+	{"decipherOnly", x509.KeyUsageDecipherOnly},
+}
+
+// EKUs that are only meaningful on their own
+var soloEKUs = []x509.ExtKeyUsage{
+	x509.ExtKeyUsageTimeStamping,
+	x509.ExtKeyUsageOCSPSigning,
+}
+
+// ParseEKU parses extended key usage names such as serverAuth or
+// clientAuth; the names are case-insensitive.
+func ParseEKU(names []string) ([]x509.ExtKeyUsage, error) {
+	var v []x509.ExtKeyUsage
+
+outer:
+	for _, nm := range names {
+		for _, e := range ekuNames {
+			if strings.EqualFold(nm, e.name) {
+				if !slices.Contains(v, e.eku) {
+					v = append(v, e.eku)
+				}
+				continue outer
+			}
+		}
+		return nil, fmt.Errorf("unknown extended key usage '%s'; try %s", nm, strings.Join(EKUNames(nil), ", "))
+	}
+	return v, nil
+}
+
+// ParseKeyUsage parses key usage names such as digitalSignature or
+// keyEncipherment; the names are case-insensitive and
+// nonRepudiation is an alias for contentCommitment.
+func ParseKeyUsage(names []string) (x509.KeyUsage, error) {
+	var ku x509.KeyUsage
+
+outer:
+	for _, nm := range names {
+		if strings.EqualFold(nm, "nonRepudiation") {
+			nm = "contentCommitment"
+		}
+		for _, k := range kuNames {
+			if strings.EqualFold(nm, k.name) {
+				ku |= k.ku
+				continue outer
+			}
+		}
+		return 0, fmt.Errorf("unknown key usage '%s'; try %s", nm, strings.Join(KeyUsageNames(0), ", "))
+	}
+	return ku, nil
+}
+
+// EKUNames returns the names of 'eku'; all the known names if 'eku'
+// is nil.
+func EKUNames(eku []x509.ExtKeyUsage) []string {
+	var v []string
+	for _, e := range ekuNames {
+		if eku == nil || slices.Contains(eku, e.eku) {
+			v = append(v, e.name)
+		}
+	}
+	return v
+}
+
+// KeyUsageNames returns the names of 'ku'; all the known names if 'ku'
+// is zero.
+func KeyUsageNames(ku x509.KeyUsage) []string {
+	var v []string
+	for _, k := range kuNames {
+		if ku == 0 || ku&k.ku != 0 {
+			v = append(v, k.name)
+		}
+	}
+	return v
+}
+
+// check the key usage and extended key usage of a new leaf cert of
+// the given kind
+func checkUsage(kind string, o *CertOpts) error {
+	eku, ku := o.ExtKeyUsage, leafKeyUsage(o)
+
+	for _, e := range soloEKUs {
+		if slices.Contains(eku, e) && len(eku) > 1 {
+			return fmt.Errorf("extended key usage %s can't be combined with others", EKUNames([]x509.ExtKeyUsage{e})[0])
+		}
+	}
+
+	if kind == KindServer && len(eku) > 0 && !slices.Contains(eku, x509.ExtKeyUsageServerAuth) {
+		return fmt.Errorf("server certs need the serverAuth extended key usage")
+	}
+	if kind == KindPeer && len(eku) > 0 && !(slices.Contains(eku, x509.ExtKeyUsageServerAuth) && slices.Contains(eku, x509.ExtKeyUsageClientAuth)) {
+		return fmt.Errorf("peer certs need the serverAuth and clientAuth extended key usages")
+	}
+	if o.Profile == ProfileSPIFFE && ku&x509.KeyUsageDigitalSignature == 0 {
+		return fmt.Errorf("the %s profile needs the digitalSignature key usage", ProfileSPIFFE)
+	}
+
+	// everything but S/MIME with RSA key transport signs with the key
+	for _, e := range eku {
+		if e != x509.ExtKeyUsageEmailProtection && ku&x509.KeyUsageDigitalSignature == 0 {
+			return fmt.Errorf("extended key usage %s needs the digitalSignature key usage", EKUNames([]x509.ExtKeyUsage{e})[0])
+		}
+	}
+
+	if ku&(x509.KeyUsageEncipherOnly|x509.KeyUsageDecipherOnly) != 0 && ku&x509.KeyUsageKeyAgreement == 0 {
+		return fmt.Errorf("encipherOnly and decipherOnly need the keyAgreement key usage")
+	}
+	if ku&x509.KeyUsageEncipherOnly != 0 && ku&x509.KeyUsageDecipherOnly != 0 {
+		return fmt.Errorf("encipherOnly and decipherOnly are mutually exclusive")
+	}
+
+	// only RSA keys can encrypt; the scep profile makes sure of it
+	if !isRSA(o.PublicKey) && o.Profile != ProfileSCEP && ku&(x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment) != 0 {
+		return fmt.Errorf("keyEncipherment and dataEncipherment need an RSA key")
+	}
+	return nil
+}
+
+// the key usage of the leaf certs minted by certik
+const defaultKeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+
+// return the key usage of a new leaf cert
+func leafKeyUsage(o *CertOpts) x509.KeyUsage {
+	switch {
+	case o.KeyUsage != 0:
+		return o.KeyUsage
+	case o.Profile == ProfileCodeSign || o.Profile == ProfileTSA:
+		return x509.KeyUsageDigitalSignature
+	case o.Profile == ProfileSMIME && o.SplitKeys:
+		// the signing half of a split pair
+		return x509.KeyUsageDigitalSignature
+	case o.Profile == ProfileSCEP:
+		// RAs sign responses and decrypt requests
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	case o.Profile == ProfileSMIME && isRSA(o.PublicKey):
+		// RSA keys encrypt email with key transport
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	default:
+		return defaultKeyUsage
+	}
+}
+
+// return the extended key usages of a new leaf cert of the given kind
+func leafEKU(kind string, o *CertOpts) []x509.ExtKeyUsage {
+	switch {
+	case len(o.ExtKeyUsage) > 0:
+		return o.ExtKeyUsage
+	case o.Profile == ProfileSMIME:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	case o.Profile == ProfileCodeSign:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	case o.Profile == ProfileTSA:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}
+	case o.Profile == ProfileSPIFFE || kind == KindPeer:
+		// X509-SVIDs and peers authenticate both ends of a connection
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	case kind == KindServer:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	default:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+}
+
+// Netscape cert type bits that match the extended key usages
+var nsCertBits = map[x509.ExtKeyUsage]byte{
+	x509.ExtKeyUsageClientAuth:      0x80,
+	x509.ExtKeyUsageServerAuth:      0x40,
+	x509.ExtKeyUsageEmailProtection: 0x20,
+	x509.ExtKeyUsageCodeSigning:     0x10,
+}
+
+// return the DER encoded Netscape cert type for 'eku'; nil if none of
+// the EKUs has a cert type.
+func nsCertTypeFor(eku []x509.ExtKeyUsage) ([]byte, error) {
+	var b byte
+	for _, e := range eku {
+		b |= nsCertBits[e]
+	}
+	if b == 0 {
+		return nil, nil
+	}
+
+	// a DER BIT STRING drops the trailing zero bits
+	n := 8
+	for b&(1<<(8-n)) == 0 {
+		n--
+	}
+	return asn1.Marshal(asn1.BitString{Bytes: []byte{b}, BitLength: n})
+}
+
+func isRSA(pk crypto.PublicKey) bool {
+	_, ok := pk.(*rsa.PublicKey)
+	return ok
+}
@@ -0,0 +1,124 @@
+// usage_test.go -- tests for key usages and extended key usages
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"slices"
+	"testing"
+)
+
+func TestParseUsage(t *testing.T) {
+	eku, err := ParseEKU([]string{"serverauth", "clientAuth", "serverAuth"})
+	if err != nil {
+		t.Fatalf("eku: %s", err)
+	}
+	want := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if !slices.Equal(eku, want) {
+		t.Fatalf("eku: exp %v, saw %v", want, eku)
+	}
+	if _, err := ParseEKU([]string{"anyAuth"}); err == nil {
+		t.Fatalf("eku: parsed a bad name")
+	}
+
+	ku, err := ParseKeyUsage([]string{"digitalSignature", "nonRepudiation"})
+	if err != nil {
+		t.Fatalf("ku: %s", err)
+	}
+	if ku != x509.KeyUsageDigitalSignature|x509.KeyUsageContentCommitment {
+		t.Fatalf("ku: bad usage %x", ku)
+	}
+	if _, err := ParseKeyUsage([]string{"keyCertSign"}); err == nil {
+		t.Fatalf("ku: parsed a CA usage")
+	}
+
+	if s := KeyUsageNames(ku); !slices.Equal(s, []string{"digitalSignature", "contentCommitment"}) {
+		t.Fatalf("ku: bad names %v", s)
+	}
+	if s := EKUNames(want); !slices.Equal(s, []string{"serverAuth", "clientAuth"}) {
+		t.Fatalf("eku: bad names %v", s)
+	}
+}
+
+func TestExtKeyUsage(t *testing.T) {
+	d := newTestDB(t)
+
+	both := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	c, err := d.Issue("peer.example.com", &CertOpts{DNSNames: []string{"peer.example.com"}, ExtKeyUsage: both})
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	if !slices.Equal(c.ExtKeyUsage, both) || c.KeyUsage != defaultKeyUsage {
+		t.Fatalf("issue: bad usage %v %x", c.ExtKeyUsage, c.KeyUsage)
+	}
+	if z, err := d.Find("peer.example.com"); err != nil || z.Kind != KindServer {
+		t.Fatalf("issue: not a server cert (%v)", err)
+	}
+
+	hasNS := func(c *x509.Certificate) bool {
+		for _, e := range c.Extensions {
+			if e.Id.Equal(oidNsCertType) {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasNS(c) {
+		t.Fatalf("issue: no netscape cert type")
+	}
+
+	// renewals keep the usages
+	c, err = d.Renew("peer.example.com", nil)
+	if err != nil {
+		t.Fatalf("renew: %s", err)
+	}
+	if !slices.Equal(c.ExtKeyUsage, both) {
+		t.Fatalf("renew: bad EKU %v", c.ExtKeyUsage)
+	}
+
+	ocsp := []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	c, err = d.Issue("ocsp", &CertOpts{ExtKeyUsage: ocsp, KeyUsage: x509.KeyUsageDigitalSignature})
+	if err != nil {
+		t.Fatalf("ocsp: %s", err)
+	}
+	if !slices.Equal(c.ExtKeyUsage, ocsp) || c.KeyUsage != x509.KeyUsageDigitalSignature || hasNS(c) {
+		t.Fatalf("ocsp: bad usage %v %x", c.ExtKeyUsage, c.KeyUsage)
+	}
+	if z, err := d.Find("ocsp"); err != nil || z.Kind != KindUser {
+		t.Fatalf("ocsp: not a user cert (%v)", err)
+	}
+
+	if _, err := d.Issue("none", &CertOpts{}); err == nil {
+		t.Fatalf("issued without EKUs")
+	}
+
+	bad := map[string]*CertOpts{
+		"solo":     {ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping, x509.ExtKeyUsageClientAuth}},
+		"nosig":    {ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageKeyAgreement},
+		"keyenc":   {ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		"enconly":  {ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageEncipherOnly},
+		"encdec":   {ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement | x509.KeyUsageEncipherOnly | x509.KeyUsageDecipherOnly},
+		"noserver": {ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+	}
+	for cn, o := range bad {
+		var err error
+		if cn == "noserver" {
+			_, err = d.NewServer(cn, o)
+		} else {
+			_, err = d.Issue(cn, o)
+		}
+		if err == nil {
+			t.Fatalf("%s: issued a cert with bad usages", cn)
+		}
+	}
+
+	if _, err := d.NewIntermediate("ica", &CertOpts{ExtKeyUsage: both}); err == nil {
+		t.Fatalf("issued a CA with key usages")
+	}
+}
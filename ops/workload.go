@@ -0,0 +1,246 @@
+// workload.go -- SPIFFE workload registrations and X509-SVIDs
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registrations keyed by SPIFFE ID
+var bucketWorkload = []byte("workload")
+
+// DefaultSVIDTTL is the lifetime of an X509-SVID whose registration
+// has no TTL
+const DefaultSVIDTTL = time.Hour
+
+// WorkloadEntry registers a SPIFFE ID for the local workloads that
+// match all of its selectors.
+type WorkloadEntry struct {
+	// SPIFFE ID of the workload
+	ID string `json:"id" yaml:"id"`
+
+	// CommonName of the signing CA; defaults to the root CA
+	Signer string `json:"signer,omitempty" yaml:"signer,omitempty"`
+
+	// unix:uid:N, unix:gid:N or unix:path:P
+	Selectors []string `json:"selectors" yaml:"selectors"`
+
+	// Lifetime of the X509-SVIDs, e.g. 1h
+	TTL string `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+}
+
+// SVID is a short-lived X509-SVID; it isn't kept in the DB.
+type SVID struct {
+	ID   string
+	Cert *x509.Certificate
+
+	// the intermediate CAs between the cert and the root CA
+	Chain []*x509.Certificate
+
+	// PKCS#8 DER encoded private key
+	Key []byte
+}
+
+// Validity returns the lifetime of the SVIDs of 'e'
+func (e *WorkloadEntry) Validity() (time.Duration, error) {
+	if len(e.TTL) == 0 {
+		return DefaultSVIDTTL, nil
+	}
+	return ParseValidity(e.TTL, 'h')
+}
+
+// Match is true if every selector of 'e' is in 'sel'
+func (e *WorkloadEntry) Match(sel []string) bool {
+	for _, s := range e.Selectors {
+		if !slices.Contains(sel, s) {
+			return false
+		}
+	}
+	return len(e.Selectors) > 0
+}
+
+// AddWorkload adds or replaces the registration of e.ID
+func (d *DB) AddWorkload(e *WorkloadEntry) error {
+	if len(e.Selectors) == 0 {
+		return fmt.Errorf("%s: needs at least one selector", e.ID)
+	}
+	for _, s := range e.Selectors {
+		if err := checkSelector(s); err != nil {
+			return fmt.Errorf("%s: %w", e.ID, err)
+		}
+	}
+
+	// the registration must be able to issue SVIDs
+	o, err := e.opts()
+	if err != nil {
+		return err
+	}
+	if _, err := d.prepare(KindUser, svidCN(o.URIs[0]), o); err != nil {
+		return err
+	}
+
+	z := *e
+	z.ID = o.URIs[0].String()
+	return d.st.putJSON(bucketWorkload, z.ID, &z)
+}
+
+// DelWorkload removes the registration of the SPIFFE ID 'id'
+func (d *DB) DelWorkload(id string) error {
+	err := d.st.del(bucketWorkload, id)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("no workload registered for %s", id)
+	}
+	return err
+}
+
+// Workloads returns the registrations sorted by SPIFFE ID
+func (d *DB) Workloads() ([]*WorkloadEntry, error) {
+	var v []*WorkloadEntry
+	err := d.st.forEach(bucketWorkload, func(k string, b []byte) error {
+		e := &WorkloadEntry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			return fmt.Errorf("workload %s: %w", k, err)
+		}
+		v = append(v, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(v, func(a, b *WorkloadEntry) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return v, nil
+}
+
+// MatchWorkloads returns the registrations of a workload with the
+// selectors 'sel'
+func (d *DB) MatchWorkloads(sel []string) ([]*WorkloadEntry, error) {
+	all, err := d.Workloads()
+	if err != nil {
+		return nil, err
+	}
+
+	var v []*WorkloadEntry
+	for _, e := range all {
+		if e.Match(sel) {
+			v = append(v, e)
+		}
+	}
+	return v, nil
+}
+
+// NewSVID issues an X509-SVID for the registration 'e'. The SVID
+// passes the same policy checks as any other cert but isn't stored.
+func (d *DB) NewSVID(e *WorkloadEntry) (*SVID, error) {
+	o, err := e.opts()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := d.prepare(KindUser, svidCN(o.URIs[0]), o)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := mintCert(p.signer, p.kind, p.ci, p.w, o)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(sc.Key)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: can't decode private key", e.ID)
+	}
+	sk, err := parseKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+
+	cas, err := issuerChain(d.CA, sc.x)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SVID{
+		ID:   o.URIs[0].String(),
+		Cert: sc.x,
+		Key:  key,
+	}
+	for _, ca := range cas {
+		if ca.SerialNumber.Cmp(d.CA.SerialNumber) != 0 {
+			s.Chain = append(s.Chain, ca.Certificate)
+		}
+	}
+	return s, nil
+}
+
+// the cert options of the SVIDs of 'e'
+func (e *WorkloadEntry) opts() (*CertOpts, error) {
+	u, err := ParseSPIFFEID(e.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := e.Validity()
+	if err != nil {
+		return nil, fmt.Errorf("%s: ttl: %w", e.ID, err)
+	}
+
+	o := &CertOpts{
+		Signer:   e.Signer,
+		Validity: ttl,
+		URIs:     []*url.URL{u},
+		Profile:  ProfileSPIFFE,
+	}
+	return o, nil
+}
+
+// SVIDs are named after the last segment of their SPIFFE ID; the ID
+// itself may be too long for a CommonName.
+func svidCN(u *url.URL) string {
+	return path.Base(u.Path)
+}
+
+// check a workload selector
+func checkSelector(s string) error {
+	v := strings.SplitN(s, ":", 3)
+	if len(v) != 3 || v[0] != "unix" || len(v[2]) == 0 {
+		return fmt.Errorf("bad selector '%s'; try unix:uid:N, unix:gid:N or unix:path:P", s)
+	}
+
+	switch v[1] {
+	case "uid", "gid":
+		if _, err := strconv.ParseUint(v[2], 10, 32); err != nil {
+			return fmt.Errorf("bad selector '%s': %s is not a number", s, v[2])
+		}
+	case "path":
+		if !path.IsAbs(v[2]) {
+			return fmt.Errorf("bad selector '%s': %s is not an absolute path", s, v[2])
+		}
+	default:
+		return fmt.Errorf("unknown selector type '%s'", v[1])
+	}
+	return nil
+}
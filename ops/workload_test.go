@@ -0,0 +1,112 @@
+// workload_test.go -- tests for SPIFFE workload registrations
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ops
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestWorkloads(t *testing.T) {
+	d := newTestDB(t)
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	e := &WorkloadEntry{
+		ID:        "spiffe://example.org/web",
+		Signer:    "ica",
+		Selectors: []string{"unix:uid:1000", "unix:path:/usr/bin/web"},
+		TTL:       "10m",
+	}
+
+	// the signer needs a trust domain
+	if err := d.AddWorkload(e); err == nil {
+		t.Fatalf("added a workload without a trust domain")
+	}
+	if err := d.SetPolicy("", &Policy{TrustDomain: "example.org"}); err != nil {
+		t.Fatalf("set: %s", err)
+	}
+
+	if err := d.AddWorkload(e); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+	if err := d.AddWorkload(&WorkloadEntry{ID: "spiffe://example.org/db", Selectors: []string{"unix:gid:20"}}); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+
+	all, err := d.Workloads()
+	if err != nil {
+		t.Fatalf("list: %s", err)
+	}
+	if len(all) != 2 || all[0].ID != "spiffe://example.org/db" {
+		t.Fatalf("list: bad workloads %+v", all)
+	}
+
+	// every selector of a registration must match
+	m, err := d.MatchWorkloads([]string{"unix:uid:1000", "unix:gid:20"})
+	if err != nil {
+		t.Fatalf("match: %s", err)
+	}
+	if len(m) != 1 || m[0].ID != "spiffe://example.org/db" {
+		t.Fatalf("match: bad workloads %+v", m)
+	}
+
+	m, _ = d.MatchWorkloads([]string{"unix:uid:1000", "unix:gid:1000", "unix:path:/usr/bin/web"})
+	if len(m) != 1 || m[0].ID != e.ID {
+		t.Fatalf("match: bad workloads %+v", m)
+	}
+
+	s, err := d.NewSVID(m[0])
+	if err != nil {
+		t.Fatalf("svid: %s", err)
+	}
+	if s.ID != e.ID || len(s.Cert.URIs) != 1 || s.Cert.URIs[0].String() != e.ID {
+		t.Fatalf("svid: bad cert %v", s.Cert.URIs)
+	}
+	if v := s.Cert.NotAfter.Sub(s.Cert.NotBefore); v > 11*time.Minute {
+		t.Fatalf("svid: exp 10m validity, saw %s", v)
+	}
+	if len(s.Chain) != 1 || s.Chain[0].Subject.CommonName != "ica" {
+		t.Fatalf("svid: bad chain %v", s.Chain)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(s.Key); err != nil {
+		t.Fatalf("svid: key: %s", err)
+	}
+	verifyChain(t, d, s.Cert, x509.ExtKeyUsageClientAuth, s.Chain...)
+
+	// SVIDs aren't kept in the DB
+	if _, err := d.Find("web"); err == nil {
+		t.Fatalf("svid: stored in the DB")
+	}
+
+	if err := d.DelWorkload(e.ID); err != nil {
+		t.Fatalf("del: %s", err)
+	}
+	if err := d.DelWorkload(e.ID); err == nil {
+		t.Fatalf("deleted a workload twice")
+	}
+
+	bad := []*WorkloadEntry{
+		{ID: "spiffe://example.org/a"},
+		{ID: "spiffe://example.org/a", Selectors: []string{"uid:1"}},
+		{ID: "spiffe://example.org/a", Selectors: []string{"unix:uid:x"}},
+		{ID: "spiffe://example.org/a", Selectors: []string{"unix:path:bin/a"}},
+		{ID: "spiffe://example.org/a", Selectors: []string{"unix:pid:1"}},
+		{ID: "spiffe://example.net/a", Selectors: []string{"unix:uid:1"}},
+		{ID: "https://example.org/a", Selectors: []string{"unix:uid:1"}},
+		{ID: "spiffe://example.org/a", Selectors: []string{"unix:uid:1"}, TTL: "soon"},
+	}
+	for i, e := range bad {
+		if err := d.AddWorkload(e); err == nil {
+			t.Fatalf("%d: added a bad workload %+v", i, e)
+		}
+	}
+}
@@ -0,0 +1,740 @@
+// scep.go -- RFC 8894 SCEP messages
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package scep implements an RFC 8894 SCEP server that enrolls client
+// certs of a certik DB. Requests are authorized by challenge passwords
+// kept in the DB. A SCEP message is a CMS SignedData (RFC 5652) whose
+// content is an EnvelopedData encrypted to the RSA key of the other
+// end; the server signs and decrypts with the key of an RA cert.
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+	// SCEP signed attributes
+	oidMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// the message digests a message can use; legacy clients still sign
+// with SHA-1
+var hashes = []struct {
+	oid asn1.ObjectIdentifier
+	h   crypto.Hash
+}{
+	{oidSHA1, crypto.SHA1},
+	{oidSHA256, crypto.SHA256},
+	{oidSHA384, crypto.SHA384},
+	{oidSHA512, crypto.SHA512},
+}
+
+// the content encryption algorithms and their key sizes
+var ciphers = []struct {
+	oid  asn1.ObjectIdentifier
+	size int
+}{
+	{oidAES128CBC, 16},
+	{oidAES256CBC, 32},
+	{oidDESEDE3CBC, 24},
+}
+
+// messageType values
+const (
+	msgCertRep        = "3"
+	msgPKCSReq        = "19"
+	msgGetCertInitial = "20"
+)
+
+var msgNames = map[string]string{
+	msgCertRep:        "CertRep",
+	"17":              "RenewalReq",
+	msgPKCSReq:        "PKCSReq",
+	msgGetCertInitial: "GetCertInitial",
+	"21":              "GetCert",
+	"22":              "GetCRL",
+}
+
+// pkiStatus values
+const (
+	statusSuccess = "0"
+	statusFailure = "2"
+	statusPending = "3"
+)
+
+// failInfo values
+const (
+	failBadAlg          = "0"
+	failBadMessageCheck = "1"
+	failBadRequest      = "2"
+	failBadTime         = "3"
+	failBadCertID       = "4"
+)
+
+var failNames = map[string]string{
+	failBadAlg:          "badAlg",
+	failBadMessageCheck: "badMessageCheck",
+	failBadRequest:      "badRequest",
+	failBadTime:         "badTime",
+	failBadCertID:       "badCertId",
+}
+
+// RFC 5652 ContentInfo
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// RFC 5652 SignedData
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// RFC 5652 EnvelopedData with key transport recipients
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipient `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipient struct {
+	Version                int
+	RID                    issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// the content of a GetCertInitial
+type issuerAndSubject struct {
+	Issuer  asn1.RawValue
+	Subject asn1.RawValue
+}
+
+// a pkiMessage with a verified signature
+type message struct {
+	Type          string
+	TransactionID string
+
+	SenderNonce    []byte
+	RecipientNonce []byte
+
+	// only in a CertRep
+	Status   string
+	FailInfo string
+
+	// the signer cert and digest
+	Signer *x509.Certificate
+	Hash   crypto.Hash
+
+	// DER encoded pkcsPKIEnvelope; empty in a failed or pending
+	// CertRep
+	Envelope []byte
+}
+
+// parse a DER encoded pkiMessage and verify its signature. The signer
+// cert must be in the message.
+func parseMessage(der []byte) (*message, error) {
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("can't parse message: %w", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after message")
+	}
+	if !ci.ContentType.Equal(oidSignedData) || ci.Content.Class != asn1.ClassContextSpecific || ci.Content.Tag != 0 {
+		return nil, errors.New("message isn't a signed-data")
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("can't parse signed-data: %w", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidData) {
+		return nil, fmt.Errorf("message holds a %s", sd.EncapContentInfo.EContentType)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse certs: %w", err)
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("message has %d signers", len(sd.SignerInfos))
+	}
+	si := &sd.SignerInfos[0]
+
+	i := slices.IndexFunc(certs, func(c *x509.Certificate) bool {
+		return bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) && c.SerialNumber.Cmp(si.SID.Serial) == 0
+	})
+	if i < 0 {
+		return nil, errors.New("message doesn't carry the signer cert")
+	}
+
+	m := &message{
+		Signer:   certs[i],
+		Envelope: sd.EncapContentInfo.EContent,
+	}
+	if err := m.verify(si); err != nil {
+		return nil, err
+	}
+	if len(m.Type) == 0 || len(m.TransactionID) == 0 {
+		return nil, errors.New("message has no message type or transaction ID")
+	}
+	return m, nil
+}
+
+// verify the signed attributes and signature of 'si' and fill in the
+// SCEP attributes of 'm'
+func (m *message) verify(si *signerInfo) error {
+	if len(si.SignedAttrs.Bytes) == 0 {
+		return errors.New("message has no signed attributes")
+	}
+
+	// the signature covers the attributes as a SET
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err != nil {
+		return err
+	}
+
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(set, &attrs, "set"); err != nil {
+		return fmt.Errorf("can't parse signed attributes: %w", err)
+	}
+
+	h, ok := hashFor(si.DigestAlgorithm)
+	if !ok {
+		return fmt.Errorf("unsupported digest %s", si.DigestAlgorithm.Algorithm)
+	}
+	m.Hash = h
+
+	var md bool
+	for _, a := range attrs {
+		if len(a.Values) != 1 {
+			return fmt.Errorf("attribute %s has %d values", a.Type, len(a.Values))
+		}
+		v := a.Values[0].FullBytes
+
+		var err error
+		switch {
+		case a.Type.Equal(oidContentType):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(v, &oid); err != nil || !oid.Equal(oidData) {
+				return errors.New("wrong content-type attribute")
+			}
+
+		case a.Type.Equal(oidMessageDigest):
+			var d []byte
+			if _, err := asn1.Unmarshal(v, &d); err != nil || !bytes.Equal(d, digest(h, m.Envelope)) {
+				return errors.New("message digest doesn't match the content")
+			}
+			md = true
+
+		case a.Type.Equal(oidMessageType):
+			_, err = asn1.Unmarshal(v, &m.Type)
+		case a.Type.Equal(oidTransactionID):
+			_, err = asn1.Unmarshal(v, &m.TransactionID)
+		case a.Type.Equal(oidSenderNonce):
+			_, err = asn1.Unmarshal(v, &m.SenderNonce)
+		case a.Type.Equal(oidRecipientNonce):
+			_, err = asn1.Unmarshal(v, &m.RecipientNonce)
+		case a.Type.Equal(oidPKIStatus):
+			_, err = asn1.Unmarshal(v, &m.Status)
+		case a.Type.Equal(oidFailInfo):
+			_, err = asn1.Unmarshal(v, &m.FailInfo)
+		}
+		if err != nil {
+			return fmt.Errorf("can't parse attribute %s: %w", a.Type, err)
+		}
+	}
+	if !md {
+		return errors.New("message has no message-digest attribute")
+	}
+
+	if !validSigAlg(si.SignatureAlgorithm.Algorithm, h) {
+		return fmt.Errorf("unsupported signature algorithm %s", si.SignatureAlgorithm.Algorithm)
+	}
+	pk, ok := m.Signer.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signer doesn't have an RSA key")
+	}
+	if err := rsa.VerifyPKCS1v15(pk, h, digest(h, set), si.Signature); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	return nil
+}
+
+// return true if 'oid' is an RSA signature with digest 'h'
+func validSigAlg(oid asn1.ObjectIdentifier, h crypto.Hash) bool {
+	switch {
+	case oid.Equal(oidRSA):
+		return true
+	case oid.Equal(oidSHA1WithRSA):
+		return h == crypto.SHA1
+	case oid.Equal(oidSHA256WithRSA):
+		return h == crypto.SHA256
+	case oid.Equal(oidSHA384WithRSA):
+		return h == crypto.SHA384
+	case oid.Equal(oidSHA512WithRSA):
+		return h == crypto.SHA512
+	}
+	return false
+}
+
+// marshal 'm' as a pkiMessage signed by 'cert' and 'key'
+func (m *message) marshal(cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, error) {
+	dig, ok := hashAlg(m.Hash)
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest %s", m.Hash)
+	}
+
+	attrs, err := m.signedAttrs()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, m.Hash, digest(m.Hash, attrs))
+	if err != nil {
+		return nil, err
+	}
+
+	// the signed attributes are signed as a SET but go in the
+	// SignerInfo as [0] IMPLICIT
+	var set asn1.RawValue
+	if _, err := asn1.Unmarshal(attrs, &set); err != nil {
+		return nil, err
+	}
+
+	si := signerInfo{
+		Version: 1,
+		SID: issuerAndSerial{
+			Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+			Serial: cert.SerialNumber,
+		},
+		DigestAlgorithm:    dig,
+		SignedAttrs:        ctxTag(0, set.Bytes),
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+		Signature:          sig,
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{dig},
+		EncapContentInfo: encapContentInfo{
+			EContentType: oidData,
+			EContent:     m.Envelope,
+		},
+		Certificates: ctxTag(0, cert.Raw),
+		SignerInfos:  []signerInfo{si},
+	}
+
+	der, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     ctxTag(0, der),
+	})
+}
+
+// return the DER SET of signed attributes of 'm'
+func (m *message) signedAttrs() ([]byte, error) {
+	var attrs []attribute
+
+	add := func(oid asn1.ObjectIdentifier, v any, params string) error {
+		b, err := asn1.MarshalWithParams(v, params)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, attribute{oid, []asn1.RawValue{{FullBytes: b}}})
+		return nil
+	}
+
+	strs := []struct {
+		oid asn1.ObjectIdentifier
+		v   string
+	}{
+		{oidMessageType, m.Type},
+		{oidTransactionID, m.TransactionID},
+		{oidPKIStatus, m.Status},
+		{oidFailInfo, m.FailInfo},
+	}
+	for _, s := range strs {
+		if len(s.v) > 0 {
+			if err := add(s.oid, s.v, "printable"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := add(oidContentType, oidData, ""); err != nil {
+		return nil, err
+	}
+	if err := add(oidMessageDigest, digest(m.Hash, m.Envelope), ""); err != nil {
+		return nil, err
+	}
+	if len(m.SenderNonce) > 0 {
+		if err := add(oidSenderNonce, m.SenderNonce, ""); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.RecipientNonce) > 0 {
+		if err := add(oidRecipientNonce, m.RecipientNonce, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// DER sorts the SET OF
+	return asn1.MarshalWithParams(attrs, "set")
+}
+
+// encrypt 'content' for the RSA key of 'to' with the cipher 'alg' and
+// return the DER encoded EnvelopedData
+func encrypt(content []byte, to *x509.Certificate, alg asn1.ObjectIdentifier) ([]byte, error) {
+	pk, ok := to.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't have an RSA key", to.Subject.CommonName)
+	}
+
+	size, ok := keySize(alg)
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher %s", alg)
+	}
+
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	blk, err := newBlock(alg, key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, blk.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	n := blk.BlockSize() - len(content)%blk.BlockSize()
+	ct := append(slices.Clip(content), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(blk, iv).CryptBlocks(ct, ct)
+
+	ek, err := rsa.EncryptPKCS1v15(rand.Reader, pk, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ivp, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	ed := envelopedData{
+		RecipientInfos: []keyTransRecipient{{
+			RID: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: to.RawIssuer},
+				Serial: to.SerialNumber,
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue},
+			EncryptedKey:           ek,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: ivp}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ct},
+		},
+	}
+
+	der, err := asn1.Marshal(ed)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     ctxTag(0, der),
+	})
+}
+
+// decrypt the DER encoded EnvelopedData 'der' with the key of 'cert'
+// and return the content and its cipher
+func decrypt(der []byte, cert *x509.Certificate, key *rsa.PrivateKey) ([]byte, asn1.ObjectIdentifier, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, nil, fmt.Errorf("can't parse envelope: %w", err)
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) || ci.Content.Class != asn1.ClassContextSpecific || ci.Content.Tag != 0 {
+		return nil, nil, errors.New("envelope isn't an enveloped-data")
+	}
+
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, nil, fmt.Errorf("can't parse enveloped-data: %w", err)
+	}
+
+	i := slices.IndexFunc(ed.RecipientInfos, func(r keyTransRecipient) bool {
+		return bytes.Equal(r.RID.Issuer.FullBytes, cert.RawIssuer) && r.RID.Serial.Cmp(cert.SerialNumber) == 0
+	})
+	if i < 0 {
+		return nil, nil, fmt.Errorf("envelope isn't encrypted for %s", cert.Subject.CommonName)
+	}
+	ri := &ed.RecipientInfos[i]
+	if !ri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSA) {
+		return nil, nil, fmt.Errorf("unsupported key encryption %s", ri.KeyEncryptionAlgorithm.Algorithm)
+	}
+
+	eci := &ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	size, ok := keySize(alg)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported cipher %s", alg)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("can't parse the cipher IV: %w", err)
+	}
+
+	// a random key on a padding error keeps the failures alike
+	ck := make([]byte, size)
+	if _, err := rand.Read(ck); err != nil {
+		return nil, nil, err
+	}
+	if err := rsa.DecryptPKCS1v15SessionKey(nil, key, ri.EncryptedKey, ck); err != nil {
+		return nil, nil, err
+	}
+
+	blk, err := newBlock(alg, ck)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ct, err := encryptedContent(eci.EncryptedContent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bs := blk.BlockSize()
+	if len(iv) != bs || len(ct) == 0 || len(ct)%bs != 0 {
+		return nil, nil, errors.New("bad encrypted content")
+	}
+
+	pt := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(blk, iv).CryptBlocks(pt, ct)
+
+	n := int(pt[len(pt)-1])
+	if n == 0 || n > bs || !bytes.Equal(pt[len(pt)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, nil, errors.New("can't decrypt envelope")
+	}
+	return pt[:len(pt)-n], alg, nil
+}
+
+// return the [0] IMPLICIT encrypted content; BER allows it to be a
+// constructed OCTET STRING
+func encryptedContent(v asn1.RawValue) ([]byte, error) {
+	if v.Class != asn1.ClassContextSpecific || v.Tag != 0 {
+		return nil, errors.New("envelope has no encrypted content")
+	}
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+
+	var ct []byte
+	for b := v.Bytes; len(b) > 0; {
+		var s []byte
+		rest, err := asn1.Unmarshal(b, &s)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse encrypted content: %w", err)
+		}
+		ct = append(ct, s...)
+		b = rest
+	}
+	return ct, nil
+}
+
+// return the block cipher 'alg' with 'key'
+func newBlock(alg asn1.ObjectIdentifier, key []byte) (cipher.Block, error) {
+	if alg.Equal(oidDESEDE3CBC) {
+		return des.NewTripleDESCipher(key)
+	}
+	return aes.NewCipher(key)
+}
+
+// return the key size of the cipher 'alg'
+func keySize(alg asn1.ObjectIdentifier) (int, bool) {
+	for _, c := range ciphers {
+		if c.oid.Equal(alg) {
+			return c.size, true
+		}
+	}
+	return 0, false
+}
+
+// return the hash named by 'ai'
+func hashFor(ai pkix.AlgorithmIdentifier) (crypto.Hash, bool) {
+	for _, v := range hashes {
+		if v.oid.Equal(ai.Algorithm) {
+			return v.h, true
+		}
+	}
+	return 0, false
+}
+
+// return the AlgorithmIdentifier of 'h'
+func hashAlg(h crypto.Hash) (pkix.AlgorithmIdentifier, bool) {
+	for _, v := range hashes {
+		if v.h == h {
+			return pkix.AlgorithmIdentifier{Algorithm: v.oid}, true
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, false
+}
+
+func digest(h crypto.Hash, b []byte) []byte {
+	w := h.New()
+	w.Write(b)
+	return w.Sum(nil)
+}
+
+// return a constructed [n] IMPLICIT value
+func ctxTag(n int, b []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        n,
+		IsCompound: true,
+		Bytes:      b,
+	}
+}
+
+// the challenge password attribute of a CSR
+func challengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version int
+		Subject asn1.RawValue
+		PKInfo  asn1.RawValue
+		Attrs   []attribute `asn1:"optional,tag:0,set"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", fmt.Errorf("can't parse CSR attributes: %w", err)
+	}
+
+	for _, a := range tbs.Attrs {
+		if !a.Type.Equal(oidChallengePassword) || len(a.Values) != 1 {
+			continue
+		}
+
+		var pw string
+		if _, err := asn1.Unmarshal(a.Values[0].FullBytes, &pw); err != nil {
+			return "", fmt.Errorf("can't parse the challenge password: %w", err)
+		}
+		return pw, nil
+	}
+	return "", errors.New("CSR has no challenge password")
+}
+
+func (m *message) String() string {
+	s := msgNames[m.Type]
+	if len(s) == 0 {
+		s = "message type " + m.Type
+	}
+
+	switch m.Status {
+	case statusSuccess:
+		s += ": success"
+	case statusPending:
+		s += ": pending"
+	case statusFailure:
+		f := failNames[m.FailInfo]
+		if len(f) == 0 {
+			f = "failure " + m.FailInfo
+		}
+		s += ": failure (" + f + ")"
+	}
+	return s
+}
@@ -0,0 +1,430 @@
+// scep_test.go -- tests for the SCEP server
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+)
+
+// start a SCEP server for a new DB; return the DB, the RA and the
+// server URL
+func newTestSCEP(t *testing.T) (*ops.DB, *ops.SCEP, string) {
+	t.Helper()
+
+	d, err := ops.Init(filepath.Join(t.TempDir(), "test.db"), "test-ca", &ops.InitOpts{Passwd: "test-pw"})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	d.Warn = t.Logf
+
+	for _, cn := range []string{"ica", "other-ca"} {
+		if _, err := d.NewIntermediate(cn, nil); err != nil {
+			t.Fatalf("intermediate: %s", err)
+		}
+	}
+
+	ra, err := d.SCEP("scep-ra", &ops.CertOpts{Signer: "ica"})
+	if err != nil {
+		t.Fatalf("RA: %s", err)
+	}
+
+	s := New(d, ra)
+	s.Log = t.Logf
+
+	hs := httptest.NewServer(s)
+	t.Cleanup(hs.Close)
+	return d, ra, hs.URL + "/scep"
+}
+
+// a SCEP client with a self-signed cert
+type testClient struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+	url  string
+	ra   *x509.Certificate
+
+	// the recipient of requests; the RA by default
+	to *x509.Certificate
+
+	alg  asn1.ObjectIdentifier
+	hash crypto.Hash
+	get  bool
+}
+
+func newTestClient(t *testing.T, url string, ra *x509.Certificate, cn string) *testClient {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("key: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("self-signed cert: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("self-signed cert: %s", err)
+	}
+
+	return &testClient{
+		key:  key,
+		cert: cert,
+		url:  url,
+		ra:   ra,
+		to:   ra,
+		alg:  oidAES256CBC,
+		hash: crypto.SHA256,
+	}
+}
+
+// return a DER encoded CSR for 'cn' with the challenge password 'pw';
+// x509.CreateCertificateRequest can't add the attribute.
+func (c *testClient) csr(t *testing.T, cn, pw string) []byte {
+	t.Helper()
+
+	pub, err := x509.MarshalPKIXPublicKey(&c.key.PublicKey)
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+	subj, err := asn1.Marshal(pkix.Name{CommonName: cn}.ToRDNSequence())
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+	cp, err := asn1.MarshalWithParams(pw, "printable")
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+
+	tbs := struct {
+		Version int
+		Subject asn1.RawValue
+		PKInfo  asn1.RawValue
+		Attrs   []attribute `asn1:"tag:0,set"`
+	}{
+		Subject: asn1.RawValue{FullBytes: subj},
+		PKInfo:  asn1.RawValue{FullBytes: pub},
+		Attrs:   []attribute{{oidChallengePassword, []asn1.RawValue{{FullBytes: cp}}}},
+	}
+	tder, err := asn1.Marshal(tbs)
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest(crypto.SHA256, tder))
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+
+	der, err := asn1.Marshal(struct {
+		TBS asn1.RawValue
+		Alg pkix.AlgorithmIdentifier
+		Sig asn1.BitString
+	}{
+		TBS: asn1.RawValue{FullBytes: tder},
+		Alg: pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue},
+		Sig: asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	if err != nil {
+		t.Fatalf("csr: %s", err)
+	}
+	return der
+}
+
+// send a request of type 'typ' with 'content' and return the reply
+func (c *testClient) do(t *testing.T, typ string, content []byte) *message {
+	t.Helper()
+
+	env, err := encrypt(content, c.to, c.alg)
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+
+	m := &message{
+		Type:          typ,
+		TransactionID: "tx-" + typ,
+		SenderNonce:   []byte("0123456789abcdef"),
+		Hash:          c.hash,
+		Envelope:      env,
+	}
+	der, err := m.marshal(c.cert, c.key)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+
+	var resp *http.Response
+	if c.get {
+		q := url.Values{"operation": {"PKIOperation"}, "message": {base64.StdEncoding.EncodeToString(der)}}
+		resp, err = http.Get(c.url + "?" + q.Encode())
+	} else {
+		resp, err = http.Post(c.url+"?operation=PKIOperation", pkiMessageType, bytes.NewReader(der))
+	}
+	if err != nil {
+		t.Fatalf("%s: %s", typ, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s: %s", typ, resp.Status, body)
+	}
+
+	rep, err := parseMessage(body)
+	if err != nil {
+		t.Fatalf("%s: reply: %s", typ, err)
+	}
+	if rep.Type != msgCertRep || rep.TransactionID != m.TransactionID || !bytes.Equal(rep.RecipientNonce, m.SenderNonce) {
+		t.Fatalf("%s: wrong reply %s %s %x", typ, rep, rep.TransactionID, rep.RecipientNonce)
+	}
+	if !rep.Signer.Equal(c.ra) || rep.Hash != c.hash {
+		t.Fatalf("%s: reply signed by %s with %s", typ, rep.Signer.Subject.CommonName, rep.Hash)
+	}
+	return rep
+}
+
+// return the cert in a successful reply
+func (c *testClient) cert1(t *testing.T, rep *message) *x509.Certificate {
+	t.Helper()
+
+	if rep.Status != statusSuccess {
+		t.Fatalf("reply: %s", rep)
+	}
+
+	p7, alg, err := decrypt(rep.Envelope, c.cert, c.key)
+	if err != nil {
+		t.Fatalf("decrypt: %s", err)
+	}
+	if !alg.Equal(c.alg) {
+		t.Fatalf("reply encrypted with %s", alg)
+	}
+
+	certs := parseP7(t, p7)
+	if len(certs) != 1 {
+		t.Fatalf("reply has %d certs", len(certs))
+	}
+	return certs[0]
+}
+
+// parse a certs-only PKCS#7
+func parseP7(t *testing.T, der []byte) []*x509.Certificate {
+	t.Helper()
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatalf("pkcs7: %s", err)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("pkcs7: %s", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatalf("pkcs7: %s", err)
+	}
+	return certs
+}
+
+func TestGetCA(t *testing.T) {
+	_, ra, url := newTestSCEP(t)
+
+	resp, err := http.Get(url + "?operation=GetCACaps")
+	if err != nil {
+		t.Fatalf("GetCACaps: %s", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "POSTPKIOperation\n") || !strings.Contains(string(b), "AES\n") {
+		t.Fatalf("GetCACaps: %q", b)
+	}
+
+	resp, err = http.Get(url + "?operation=GetCACert")
+	if err != nil {
+		t.Fatalf("GetCACert: %s", err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != caRAType {
+		t.Fatalf("GetCACert: content-type %s", ct)
+	}
+
+	var names []string
+	for _, c := range parseP7(t, b) {
+		names = append(names, c.Subject.CommonName)
+	}
+	if strings.Join(names, " ") != "scep-ra ica test-ca" {
+		t.Fatalf("GetCACert: %v", names)
+	}
+
+	if ra.Cert.PublicKeyAlgorithm != x509.RSA || ra.Cert.KeyUsage&x509.KeyUsageKeyEncipherment == 0 {
+		t.Fatalf("RA cert can't decrypt")
+	}
+
+	resp, err = http.Get(url + "?operation=Bogus")
+	if err != nil {
+		t.Fatalf("bogus: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bogus: %s", resp.Status)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	d, ra, url := newTestSCEP(t)
+
+	pw, _, err := d.NewChallenge(&ops.Challenge{}, 0)
+	if err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+
+	c := newTestClient(t, url, ra.Cert, "device-1")
+	crt := c.cert1(t, c.do(t, msgPKCSReq, c.csr(t, "device-1", pw)))
+
+	if crt.Subject.CommonName != "device-1" || crt.Issuer.CommonName != "ica" {
+		t.Fatalf("cert %s issued by %s", crt.Subject.CommonName, crt.Issuer.CommonName)
+	}
+	if !c.key.PublicKey.Equal(crt.PublicKey) {
+		t.Fatalf("cert isn't for the CSR key")
+	}
+	if z, err := d.Find("device-1"); err != nil || z.Kind != ops.KindUser {
+		t.Fatalf("find: %v %v", z, err)
+	}
+
+	// polling returns the same cert
+	ias, err := asn1.Marshal(issuerAndSubject{
+		Issuer:  asn1.RawValue{FullBytes: c.cert.RawIssuer},
+		Subject: asn1.RawValue{FullBytes: c.cert.RawSubject},
+	})
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	if z := c.cert1(t, c.do(t, msgGetCertInitial, ias)); !z.Equal(crt) {
+		t.Fatalf("GetCertInitial returned another cert")
+	}
+
+	// but not for another key
+	c2 := newTestClient(t, url, ra.Cert, "device-1")
+	if rep := c2.do(t, msgGetCertInitial, ias); rep.Status != statusFailure || rep.FailInfo != failBadCertID {
+		t.Fatalf("GetCertInitial with another key: %s", rep)
+	}
+
+	// the challenge can't be used again
+	c3 := newTestClient(t, url, ra.Cert, "device-2")
+	if rep := c3.do(t, msgPKCSReq, c3.csr(t, "device-2", pw)); rep.Status != statusFailure || rep.FailInfo != failBadRequest {
+		t.Fatalf("reused challenge: %s", rep)
+	}
+	if v, _ := d.Challenges(); len(v) != 0 {
+		t.Fatalf("challenge wasn't removed: %v", v)
+	}
+}
+
+func TestEnrollLegacy(t *testing.T) {
+	d, ra, url := newTestSCEP(t)
+
+	pw, _, err := d.NewChallenge(&ops.Challenge{Signer: "ica", Reusable: true}, time.Hour)
+	if err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+
+	// GET with 3DES and SHA-1; a reusable challenge
+	for _, cn := range []string{"router-1", "router-2"} {
+		c := newTestClient(t, url, ra.Cert, cn)
+		c.alg, c.hash, c.get = oidDESEDE3CBC, crypto.SHA1, true
+
+		crt := c.cert1(t, c.do(t, msgPKCSReq, c.csr(t, cn, pw)))
+		if crt.Subject.CommonName != cn {
+			t.Fatalf("cert for %s", crt.Subject.CommonName)
+		}
+	}
+}
+
+func TestEnrollFail(t *testing.T) {
+	d, ra, url := newTestSCEP(t)
+
+	other, _, err := d.NewChallenge(&ops.Challenge{Signer: "other-ca"}, 0)
+	if err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+
+	c := newTestClient(t, url, ra.Cert, "device-1")
+	for _, pw := range []string{"wrong", other} {
+		if rep := c.do(t, msgPKCSReq, c.csr(t, "device-1", pw)); rep.Status != statusFailure || rep.FailInfo != failBadRequest {
+			t.Fatalf("challenge %s: %s", pw, rep)
+		}
+	}
+
+	// a failed issuance doesn't use up the challenge
+	once, _, err := d.NewChallenge(&ops.Challenge{}, 0)
+	if err != nil {
+		t.Fatalf("challenge: %s", err)
+	}
+	if _, err := d.NewUser("device-0", nil); err != nil {
+		t.Fatalf("user: %s", err)
+	}
+	if rep := c.do(t, msgPKCSReq, c.csr(t, "device-0", once)); rep.Status != statusFailure || rep.FailInfo != failBadRequest {
+		t.Fatalf("duplicate CN: %s", rep)
+	}
+
+	// the CSR must have the key that signed the message
+	c2 := newTestClient(t, url, ra.Cert, "device-2")
+	if rep := c.do(t, msgPKCSReq, c2.csr(t, "device-2", once)); rep.Status != statusFailure || rep.FailInfo != failBadRequest {
+		t.Fatalf("CSR with another key: %s", rep)
+	}
+	if crt := c2.cert1(t, c2.do(t, msgPKCSReq, c2.csr(t, "device-2", once))); crt.Subject.CommonName != "device-2" {
+		t.Fatalf("cert for %s", crt.Subject.CommonName)
+	}
+
+	// encrypted for someone else
+	c.to = c.cert
+	if rep := c.do(t, msgPKCSReq, nil); rep.Status != statusFailure || rep.FailInfo != failBadMessageCheck {
+		t.Fatalf("wrong recipient: %s", rep)
+	}
+
+	// tampered messages aren't answered
+	env, err := encrypt([]byte("csr"), ra.Cert, oidAES128CBC)
+	if err != nil {
+		t.Fatalf("encrypt: %s", err)
+	}
+	m := &message{Type: msgPKCSReq, TransactionID: "tx", Hash: crypto.SHA256, Envelope: env}
+	der, err := m.marshal(c.cert, c.key)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	i := bytes.Index(der, []byte("tx"))
+	der[i] = 'T'
+	if _, err := New(d, ra).Respond(der); err == nil {
+		t.Fatalf("answered a tampered message")
+	}
+}
@@ -0,0 +1,306 @@
+// server.go -- RFC 8894 SCEP server
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package scep
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+)
+
+const (
+	caRAType       = "application/x-x509-ca-ra-cert"
+	pkiMessageType = "application/x-pki-message"
+
+	// requests carry a CSR and a self-signed cert
+	maxRequest = 64 * 1024
+)
+
+// the capabilities we announce in GetCACaps
+var caps = []string{
+	"AES",
+	"DES3",
+	"POSTPKIOperation",
+	"SCEPStandard",
+	"SHA-1",
+	"SHA-256",
+	"SHA-512",
+}
+
+// Server is an http.Handler that answers SCEP requests on any path.
+// It issues user certs signed by the issuer of the RA cert for CSRs
+// with a valid challenge password. GetCertInitial returns the cert
+// issued for a subject and key if one exists; requests are never left
+// pending.
+type Server struct {
+	// Validity of the issued certs; the default is that of user
+	// certs
+	Validity time.Duration
+
+	// Log is called for every request; the default discards the
+	// messages.
+	Log func(format string, v ...any)
+
+	db *ops.DB
+	ra *ops.SCEP
+
+	// ops.DB isn't safe for concurrent use
+	sync.Mutex
+}
+
+// New returns a Server for the open DB 'd' that signs and decrypts
+// messages with the RA cert 'ra'
+func New(d *ops.DB, ra *ops.SCEP) *Server {
+	return &Server{
+		db: d,
+		ra: ra,
+	}
+}
+
+// ServeHTTP answers the SCEP operation named in the query string
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	op := q.Get("operation")
+
+	if r.Method != http.MethodGet && (r.Method != http.MethodPost || op != "PKIOperation") {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch op {
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Join(caps, "\n")+"\n")
+
+	case "GetCACert":
+		certs := append([]*x509.Certificate{s.ra.Cert}, s.ra.CAs...)
+		der, err := ops.PKCS7Certs(certs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", caRAType)
+		w.Write(der)
+
+	case "PKIOperation":
+		der, err := readMessage(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := s.Respond(der)
+		if err != nil {
+			s.log("scep: %s: %s", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", pkiMessageType)
+		w.Write(resp)
+
+	default:
+		http.Error(w, fmt.Sprintf("unknown operation %q", op), http.StatusBadRequest)
+	}
+}
+
+// read the pkiMessage of a PKIOperation: the body of a POST or the
+// base64 encoded 'message' parameter of a GET
+func readMessage(r *http.Request) ([]byte, error) {
+	if r.Method == http.MethodGet {
+		// a '+' that wasn't escaped is decoded as a space
+		msg := strings.ReplaceAll(r.URL.Query().Get("message"), " ", "+")
+		if len(msg) == 0 {
+			return nil, fmt.Errorf("no message")
+		}
+		return base64.StdEncoding.DecodeString(msg)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequest+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxRequest {
+		return nil, fmt.Errorf("request too large")
+	}
+	return body, nil
+}
+
+// Respond returns the DER encoded CertRep for the DER encoded
+// pkiMessage 'der'. Messages that can't be verified are an error;
+// failed requests get a CertRep with the reason.
+func (s *Server) Respond(der []byte) ([]byte, error) {
+	m, err := parseMessage(der)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	rep := &message{
+		Type:           msgCertRep,
+		TransactionID:  m.TransactionID,
+		RecipientNonce: m.SenderNonce,
+		Hash:           m.Hash,
+		Status:         statusSuccess,
+	}
+
+	rep.SenderNonce = make([]byte, 16)
+	if _, err := rand.Read(rep.SenderNonce); err != nil {
+		return nil, err
+	}
+
+	if fail, why := s.handle(m, rep); len(why) > 0 {
+		s.log("scep: %s %s: failed: %s", msgNames[m.Type], m.TransactionID, why)
+		rep.Status = statusFailure
+		rep.FailInfo = fail
+		rep.Envelope = nil
+	}
+	return rep.marshal(s.ra.Cert, s.ra.Key)
+}
+
+// handle the request 'm' and fill in the envelope of the reply 'rep';
+// return the failInfo and the reason if the request fails.
+func (s *Server) handle(m *message, rep *message) (string, string) {
+	content, alg, err := decrypt(m.Envelope, s.ra.Cert, s.ra.Key)
+	if err != nil {
+		return failBadMessageCheck, err.Error()
+	}
+
+	var crt *x509.Certificate
+	switch m.Type {
+	case msgPKCSReq:
+		crt, err = s.enroll(content, m.Signer)
+	case msgGetCertInitial:
+		crt, err = s.poll(content, m.Signer)
+		if err != nil {
+			return failBadCertID, err.Error()
+		}
+	default:
+		return failBadRequest, fmt.Sprintf("unsupported message type %s", m.Type)
+	}
+	if err != nil {
+		return failBadRequest, err.Error()
+	}
+
+	p7, err := ops.PKCS7Certs([]*x509.Certificate{crt})
+	if err != nil {
+		return failBadRequest, err.Error()
+	}
+
+	rep.Envelope, err = encrypt(p7, m.Signer, alg)
+	if err != nil {
+		return failBadRequest, err.Error()
+	}
+	return "", ""
+}
+
+// issue a user cert for the DER encoded CSR 'der' sent by 'req'. The
+// message must be signed with the key of the CSR (the self-signed cert
+// of a new device): the reply is encrypted to 'req', and only the
+// holder of the CSR key may receive the cert.
+func (s *Server) enroll(der []byte, req *x509.Certificate) (*x509.Certificate, error) {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR: %w", err)
+	}
+
+	cn := csr.Subject.CommonName
+	if len(cn) == 0 {
+		return nil, fmt.Errorf("CSR has no CommonName")
+	}
+
+	pk, ok := csr.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pk.Equal(req.PublicKey) {
+		return nil, fmt.Errorf("%s: message isn't signed with the key of the CSR", cn)
+	}
+
+	pw, err := challengePassword(csr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the challenge is used up only once the cert is issued
+	signer := s.ra.Cert.Issuer.CommonName
+	ch, err := s.db.CheckChallenge(pw, signer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cn, err)
+	}
+
+	o := &ops.CertOpts{
+		Signer:         signer,
+		Validity:       s.Validity,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		PublicKey:      csr.PublicKey,
+	}
+	crt, err := s.db.NewUser(cn, o)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.ConsumeChallenge(ch); err != nil {
+		s.log("scep: %s: %s", cn, err)
+	}
+
+	s.log("scep: enrolled user %s (signer %s)", cn, signer)
+	return crt, nil
+}
+
+// return the cert issued for the subject in the IssuerAndSubject 'der'
+// and the key of the requester 'req'
+func (s *Server) poll(der []byte, req *x509.Certificate) (*x509.Certificate, error) {
+	var ias issuerAndSubject
+	if _, err := asn1.Unmarshal(der, &ias); err != nil {
+		return nil, fmt.Errorf("can't parse GetCertInitial: %w", err)
+	}
+
+	var subj pkix.RDNSequence
+	if _, err := asn1.Unmarshal(ias.Subject.FullBytes, &subj); err != nil {
+		return nil, fmt.Errorf("can't parse subject: %w", err)
+	}
+	var nm pkix.Name
+	nm.FillFromRDNSequence(&subj)
+
+	c, err := s.db.Find(nm.CommonName)
+	if c == nil {
+		return nil, fmt.Errorf("no cert for %s", nm.CommonName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", nm.CommonName, err)
+	}
+
+	pk, ok := c.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pk.Equal(req.PublicKey) || c.Issuer.CommonName != s.ra.Cert.Issuer.CommonName {
+		return nil, fmt.Errorf("no cert for %s with the requester's key", nm.CommonName)
+	}
+	return c.Certificate, nil
+}
+
+func (s *Server) log(f string, v ...any) {
+	if s.Log != nil {
+		s.Log(f, v...)
+	}
+}
@@ -0,0 +1,133 @@
+// annotate.go -- show or edit the metadata of a cert
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'annotate' command
+func Annotate(db string, args []string) {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	fs.Usage = func() {
+		annotateUsage(fs)
+	}
+
+	var unlabel []string
+	var clearAll bool
+	var envpw string
+	var nopw bool
+
+	meta := metaFlags(fs)
+	fs.StringSliceVarP(&unlabel, "unlabel", "", nil, "Remove the label `K`")
+	fs.BoolVarP(&clearAll, "clear", "", false, "Remove all the metadata before applying the other options")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'annotate'\n")
+		fs.Usage()
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	edit := clearAll || len(unlabel) > 0 || fs.Changed("owner") || fs.Changed("note") || fs.Changed("label")
+	for _, cn := range args {
+		m, err := d.Meta(cn)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if !edit {
+			fmt.Printf("%s:\n%s", cn, metaString(m))
+			continue
+		}
+
+		if clearAll {
+			m = &ops.Meta{}
+		}
+		if fs.Changed("owner") {
+			m.Owner = meta.owner
+		}
+		if fs.Changed("note") {
+			m.Note = meta.note
+		}
+		for k, v := range meta.labels {
+			if m.Labels == nil {
+				m.Labels = map[string]string{}
+			}
+			m.Labels[k] = v
+		}
+		for _, k := range unlabel {
+			delete(m.Labels, k)
+		}
+
+		if err := d.SetMeta(cn, m); err != nil {
+			die("%s", err)
+		}
+	}
+}
+
+// return the metadata 'm' as indented lines
+func metaString(m *ops.Meta) string {
+	var b strings.Builder
+	if len(m.Owner) > 0 {
+		fmt.Fprintf(&b, "  Owner: %s\n", m.Owner)
+	}
+	if len(m.Note) > 0 {
+		fmt.Fprintf(&b, "  Note: %s\n", m.Note)
+	}
+	if len(m.Labels) > 0 {
+		fmt.Fprintf(&b, "  Labels: %s\n", labelString(m.Labels))
+	}
+	return b.String()
+}
+
+// return the labels 'l' as sorted K=V pairs
+func labelString(l map[string]string) string {
+	v := make([]string, 0, len(l))
+	for k, x := range l {
+		v = append(v, k+"="+x)
+	}
+	slices.Sort(v)
+	return strings.Join(v, ",")
+}
+
+func annotateUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s annotate: Show or change the owner, note and labels of certificates
+
+Without options, the metadata of each certificate is shown. --owner and
+--note replace the owner and note; an empty value removes them.
+--label adds or replaces labels and --unlabel removes them. Renewing a
+certificate keeps its metadata; deleting it removes the metadata.
+
+Usage: %s DB annotate [options] CN [CN...]
+
+Where 'DB' is the CA Database file name and 'CN' is the CommonName of a
+certificate.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
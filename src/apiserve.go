@@ -0,0 +1,125 @@
+// apiserve.go -- serve the DB over an authenticated REST API
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/opencoff/certik/api"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'api-serve' command
+func APIServe(db string, args []string) {
+	fs := flag.NewFlagSet("api-serve", flag.ExitOnError)
+	fs.Usage = func() {
+		apiServeUsage(fs)
+	}
+
+	var listen, cn, aclfile string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&listen, "listen", "l", ":8443", "Listen for HTTPS requests on `ADDR`")
+	fs.StringVarP(&cn, "cert", "c", "", "Use server cert `CN` from the DB for TLS")
+	fs.StringVarP(&aclfile, "acl", "a", "", "Authorize clients with the YAML ACL in `F`")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(cn) == 0 {
+		warn("api-serve: missing --cert\n")
+		fs.Usage()
+	}
+	if len(aclfile) == 0 {
+		warn("api-serve: missing --acl\n")
+		fs.Usage()
+	}
+
+	acl, err := api.LoadACL(aclfile)
+	if err != nil {
+		die("%s", err)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	s := api.New(d, acl)
+	s.Log = log.Printf
+
+	cfg, err := s.TLSConfig(cn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           s,
+		TLSConfig:         cfg,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.Default(),
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("api-serve: listening on %s with cert %s", listen, cn)
+	err = srv.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		die("%s", err)
+	}
+}
+
+func apiServeUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s api-serve: Serve the DB over an authenticated REST API
+
+This command serves JSON endpoints to issue, renew, revoke, list and
+export certificates and to download the CRL. Clients authenticate with
+a certificate issued from this DB; the ACL decides which operations,
+signers, profiles and names each client certificate may use. The
+server uses the certificate and key of server 'CN' from the DB; its
+key must not be encrypted.
+
+Usage: %s DB api-serve [options] --cert CN --acl ACL
+
+Where 'DB' is the CA Database file name and 'ACL' is a YAML file.
+
+Endpoints:
+    POST /v1/issue              Issue a server or user cert (optionally from a CSR)
+    POST /v1/renew              Renew a cert
+    POST /v1/revoke             Revoke a cert
+    GET  /v1/certs              List all certs
+    GET  /v1/certs/CN           Show cert CN
+    GET  /v1/certs/CN/chain     Export the PEM chain of cert CN
+    GET  /v1/crl                Download the CRL (?format=pem for PEM)
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -0,0 +1,113 @@
+// apply.go -- apply command implementation
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'apply' command
+func ApplyManifest(db string, args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Usage = func() {
+		applyUsage(fs)
+	}
+
+	var dryRun, prune, strict, keep bool
+	var renew string
+	var envpw string
+	var nopw bool
+
+	fs.BoolVarP(&dryRun, "dry-run", "n", false, "Show the plan but don't change anything")
+	fs.BoolVarP(&prune, "prune", "", false, "Revoke servers and users not in the manifest")
+	fs.StringVarP(&renew, "renew-before", "r", "", "Renew certs that expire within `D` [30d]")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't issue certificates that have lint errors")
+	fs.BoolVarP(&keep, "keep-old", "", false, "Keep renewed certificates valid until they expire")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'apply'\n")
+		fs.Usage()
+	}
+
+	m, err := ops.LoadManifest(args[0])
+	if err != nil {
+		die("%s", err)
+	}
+
+	o := &ops.ApplyOpts{
+		Prune:   prune,
+		Strict:  strict,
+		KeepOld: keep,
+	}
+	if len(renew) > 0 {
+		o.RenewBefore = mustValidity(renew, 'd')
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	plan, err := d.Plan(m, o)
+	if err != nil {
+		die("%s", err)
+	}
+
+	for _, p := range plan {
+		fmt.Printf("%s\n", p)
+	}
+
+	if dryRun {
+		return
+	}
+
+	for _, p := range plan {
+		if err := d.Apply(p, o); err != nil {
+			die("%s: %s", p, err)
+		}
+		if p.Op != ops.OpNone {
+			Print("Done: %s\n", p)
+		}
+	}
+}
+
+func applyUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s apply: Reconcile the DB with a manifest
+
+This command reads a YAML manifest of intermediate CAs, servers and
+users and issues the ones that are missing, renews the ones expiring
+soon (or whose names changed) and optionally revokes servers and users
+that are no longer in the manifest. Certs with an 'out' path are
+written to 'out'.crt and 'out'.key.
+
+Renewing revokes the old certificate; with --keep-old, it stays valid
+until it expires so that the new one can be rolled out first. See
+'history' for all the generations of a certificate.
+
+Usage: %s DB apply [options] MANIFEST
+
+Where 'DB' is the CA Database file name and 'MANIFEST' is the YAML
+manifest.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
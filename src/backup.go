@@ -0,0 +1,214 @@
+// backup.go -- encrypted backup and restore of the DB
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/opencoff/certik/ops"
+	"github.com/opencoff/go-utils"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'backup' command
+func Backup(db string, args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	fs.Usage = func() {
+		backupUsage(fs)
+	}
+
+	var to, verify, keyfile, bkpw string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&to, "to", "o", "", "Write the encrypted backup to `F`")
+	fs.StringVarP(&verify, "verify", "", "", "Decrypt and check the backup `F` without writing anything")
+	fs.StringVarP(&keyfile, "key", "k", "", "Encrypt to the X25519 public key in `F` (or decrypt with its private key)")
+	fs.StringVarP(&bkpw, "backup-password", "", "", "Use the backup passphrase from environment variable `E`")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(verify) > 0 {
+		b, err := os.ReadFile(verify)
+		if err != nil {
+			die("%s", err)
+		}
+
+		bi, err := ops.VerifyBackup(b, sealKey(keyfile, bkpw, "backup", false))
+		if err != nil {
+			die("%s: %s", verify, err)
+		}
+
+		fmt.Printf("%s: backup of %s (version %d) created %s\n", verify, bi.CA, bi.Version, bi.Created)
+		names := make([]string, 0, len(bi.Entries))
+		for k := range bi.Entries {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+		for _, k := range names {
+			fmt.Printf("  %-12s %d\n", k, bi.Entries[k])
+		}
+		if bi.Queue > 0 {
+			fmt.Printf("  %-12s %d bytes\n", "queue", bi.Queue)
+		}
+		return
+	}
+
+	if len(to) == 0 {
+		warn("'backup' needs --to or --verify\n")
+		fs.Usage()
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	k := sealKey(keyfile, bkpw, "backup", true)
+	fd := mustOpen(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err := d.Backup(fd, k); err != nil {
+		fd.Close()
+		os.Remove(to)
+		die("%s", err)
+	}
+	if err := fd.Close(); err != nil {
+		die("%s", err)
+	}
+}
+
+// Implement the 'restore' command
+func RestoreCmd(db string, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Usage = func() {
+		restoreUsage(fs)
+	}
+
+	var keyfile, bkpw string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&keyfile, "key", "k", "", "Decrypt with the X25519 private key in `F`")
+	fs.StringVarP(&bkpw, "backup-password", "", "", "Use the backup passphrase from environment variable `E`")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'restore'\n")
+		fs.Usage()
+	}
+
+	b, err := os.ReadFile(args[0])
+	if err != nil {
+		die("%s", err)
+	}
+
+	k := sealKey(keyfile, bkpw, "backup", false)
+	if _, err := ops.VerifyBackup(b, k); err != nil {
+		die("%s: %s", args[0], err)
+	}
+
+	pw := getPass(db, envpw, nopw, true)
+	d, err := ops.Restore(db, pw, b, k)
+	if err != nil {
+		die("%s", err)
+	}
+	defer d.Close()
+
+	Print("Restored CA:\n%s\n", Cert(*d.CA.Certificate))
+}
+
+// return the key to encrypt or decrypt 'what': the X25519 key in
+// 'keyfile' or a passphrase from the environment variable 'envpw' or
+// the terminal
+func sealKey(keyfile, envpw, what string, confirm bool) *ops.SealKey {
+	if len(keyfile) > 0 {
+		b, err := os.ReadFile(keyfile)
+		if err != nil {
+			die("%s", err)
+		}
+		k, err := ops.ParseSealKey(b)
+		if err != nil {
+			die("%s: %s", keyfile, err)
+		}
+		return k
+	}
+
+	if len(envpw) > 0 {
+		pw := os.Getenv(envpw)
+		if len(pw) == 0 {
+			die("%s: no %s passphrase", envpw, what)
+		}
+		return &ops.SealKey{Passwd: pw}
+	}
+
+	pw, err := utils.Askpass(fmt.Sprintf("Enter %s passphrase", what), confirm)
+	if err != nil {
+		die("%s", err)
+	}
+	if len(pw) == 0 {
+		die("the %s passphrase can't be empty", what)
+	}
+	return &ops.SealKey{Passwd: pw}
+}
+
+func backupUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s backup: Write or verify an encrypted backup of the DB
+
+The backup holds the main DB, the companion store (DB.certik) and the
+request queue. It is encrypted and authenticated with a backup
+passphrase, separate from the DB passphrase, or to an X25519 public
+key; e.g.:
+
+    openssl genpkey -algorithm x25519 -out backup.key
+    openssl pkey -in backup.key -pubout -out backup.pub
+
+--verify decrypts a backup in memory and checks its contents without
+writing anything; it needs the passphrase or the private key.
+
+Usage: %s DB backup [options] --to F
+       %s DB backup [options] --verify F
+
+Where 'DB' is the CA Database file name.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
+
+func restoreUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s restore: Restore a DB from an encrypted backup
+
+This command creates the DB and its companion files from a backup
+written by 'backup'; they must not exist. The restored DB is encrypted
+with a new DB passphrase.
+
+Usage: %s DB restore [options] BACKUP
+
+Where 'DB' is the new CA Database file name and 'BACKUP' is the backup
+file.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -0,0 +1,126 @@
+// challenge.go -- manage SCEP challenge passwords
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'challenge' command
+func ChallengeCmd(db string, args []string) {
+	fs := flag.NewFlagSet("challenge", flag.ExitOnError)
+	fs.Usage = func() {
+		challengeUsage(fs)
+	}
+
+	var c ops.Challenge
+	var validity string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&c.Signer, "sign-with", "s", "", "Only allow certs signed by CA `S` [any CA]")
+	fs.BoolVarP(&c.Reusable, "reusable", "r", false, "Allow the challenge to be used more than once")
+	fs.StringVarP(&validity, "validity", "V", "7d", "The challenge expires after `D` (e.g. 12h, 30d)")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'challenge'\n")
+		fs.Usage()
+	}
+
+	cmd := args[0]
+	switch cmd {
+	case "del":
+		if len(args) < 2 {
+			warn("Insufficient arguments to 'challenge del'\n")
+			fs.Usage()
+		}
+	case "add", "list":
+	default:
+		die("unknown challenge command '%s'; try 'add', 'del' or 'list'", cmd)
+	}
+
+	v := mustValidity(validity, 'd')
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	switch cmd {
+	case "add":
+		pw, _, err := d.NewChallenge(&c, v)
+		if err != nil {
+			die("%s", err)
+		}
+		fmt.Println(pw)
+
+	case "del":
+		for _, id := range args[1:] {
+			if err := d.DelChallenge(id); err != nil {
+				die("%s", err)
+			}
+		}
+
+	case "list":
+		ents, err := d.Challenges()
+		if err != nil {
+			die("%s", err)
+		}
+
+		now := time.Now()
+		for _, e := range ents {
+			signer, use := e.Signer, "one-time"
+			if len(signer) == 0 {
+				signer = "any CA"
+			}
+			if e.Reusable {
+				use = "reusable"
+			}
+
+			exp := "expires"
+			if now.After(e.Expires) {
+				exp = "expired"
+			}
+			fmt.Printf("%s  %s, %s; %s %s\n", e.ID, use, signer, exp, e.Expires.Local().Format(time.RFC1123))
+		}
+	}
+}
+
+func challengeUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s challenge: Manage the SCEP challenge passwords
+
+'add' generates a new challenge password and prints it; only its hash
+is kept in the DB. Devices put it in the challengePassword attribute of
+their CSR when they enroll with 'scep-serve'. A challenge can be used
+once unless it is --reusable. 'list' shows the IDs of the challenges
+and 'del' removes them.
+
+Usage: %s DB challenge [options] add
+       %s DB challenge del ID [ID...]
+       %s DB challenge list
+
+Where 'DB' is the CA Database file name.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
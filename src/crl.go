@@ -13,6 +13,7 @@ import (
 	"io"
 	"os"
 
+	"github.com/opencoff/certik/ops"
 	flag "github.com/opencoff/pflag"
 )
 
@@ -24,13 +25,15 @@ func ListCRL(db string, args []string) {
 
 	var list bool
 	var outfile string
-	var crlvalid int
+	var validity string
+	var format string
 	var envpw string
 	var nopw bool
 
 	fs.BoolVarP(&list, "list", "l", false, "List revoked certificates")
 	fs.StringVarP(&outfile, "outfile", "o", "", "Write the CRL  to `F`")
-	fs.IntVarP(&crlvalid, "validity", "V", 1, "Make the CRL valid for `N` days")
+	fs.StringVarP(&format, "format", "f", "pem", "Write the CRL in format `F`: pem or der")
+	fs.StringVarP(&validity, "validity", "V", "1d", "Make the CRL valid for `D` (e.g. 7d, 12h)")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
 
@@ -39,11 +42,19 @@ func ListCRL(db string, args []string) {
 		die("%s", err)
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	defer ca.Close()
+	crlvalid := mustValidity(validity, 'd')
+	if format != "pem" && format != "der" {
+		die("unknown CRL format %s", format)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
 
 	var out io.Writer = os.Stdout
 	if len(outfile) > 0 && outfile != "-" {
+		if format == "der" {
+			outfile = outName(outfile, ".crl")
+		}
 		fd := mustOpen(outfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 		defer fd.Close()
 
@@ -51,25 +62,26 @@ func ListCRL(db string, args []string) {
 	}
 
 	if !list {
-		pem, err := ca.CRL(crlvalid)
+		o := &ops.CRLOpts{
+			Validity: crlvalid,
+			DER:      format == "der",
+		}
+
+		crl, err := d.CRL(o)
 		if err != nil {
 			die("%s", err)
 		}
 
-		out.Write(pem)
+		out.Write(crl)
 	} else {
-		rv, err := ca.ListRevoked()
+		rv, err := d.Revoked()
 		if err != nil {
-			die("can't list revoked certs: %s", err)
+			die("%s", err)
 		}
 
 		for _, z := range rv {
 			fmt.Fprintf(out, "%-16s  %#x revoked on %s\n", z.Subject.CommonName, z.SerialNumber, z.When)
 		}
-
-		if err != nil {
-			die("%s", err)
-		}
 	}
 }
 
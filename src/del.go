@@ -9,11 +9,10 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"os"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	flag "github.com/opencoff/pflag"
 )
 
@@ -23,9 +22,11 @@ func Delete(db string, args []string) {
 		delUsage(fs)
 	}
 
+	var serials []string
 	var envpw string
 	var nopw bool
 
+	fs.StringSliceVarP(&serials, "serial", "", nil, "Delete the certificate with serial number `N`")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
 
@@ -35,35 +36,31 @@ func Delete(db string, args []string) {
 	}
 
 	args = fs.Args()
-	if len(args) < 1 {
+	if len(args) < 1 && len(serials) == 0 {
 		warn("Insufficient arguments to 'delete'\n")
 		fs.Usage()
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	defer ca.Close()
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
 
 	gone := 0
-	for _, cn := range args {
-		ck, err := ca.Find(cn)
+	for _, s := range serials {
+		sn, err := ops.ParseSerial(s)
 		if err != nil {
-			if !errors.Is(err, pki.ErrExpired) {
-				warn("%s: %s\n", err)
-				continue
-			}
+			die("%s", err)
 		}
-
-		switch {
-		case ck.IsServer:
-			err = ca.RevokeServer(cn)
-		case ck.IsCA:
-			err = ca.RevokeCA(cn)
-		default:
-			err = ca.RevokeClient(cn)
+		if err := d.RevokeSerial(sn); err != nil {
+			warn("%s: %s\n", s, err)
+		} else {
+			gone++
+			Print("Deleted %#x ..\n", sn)
 		}
+	}
 
-		if err != nil {
-			warn("%s\n", err)
+	for _, cn := range args {
+		if err := d.Revoke(cn); err != nil {
+			warn("%s: %s\n", cn, err)
 		} else {
 			gone++
 			Print("Deleted %s ..\n", cn)
@@ -79,11 +76,17 @@ func delUsage(fs *flag.FlagSet) {
 	fmt.Printf(`%s delete: Delete one or more certs ..
 
 Usage: %s DB delete [options] CN [CN...]
+       %s DB delete --serial N [--serial N...]
+
+Where 'DB' is the CA Database file name and 'CN' is the CommonName of a
+server, peer, user or intermediate CA certificate.
 
-Where 'DB' is the CA Database file name and 'CN' is the CommonName for the server
+--serial deletes a single generation of a certificate, e.g. the old
+one that a renewal with --keep-old left valid; 'N' is a serial number
+in hex (0x..) or decimal.
 
 Options:
-`, os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 
 	fs.PrintDefaults()
 	os.Exit(0)
@@ -0,0 +1,140 @@
+// estserve.go -- serve RFC 7030 EST enrollment
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/opencoff/certik/api"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'est-serve' command
+func ESTServe(db string, args []string) {
+	fs := flag.NewFlagSet("est-serve", flag.ExitOnError)
+	fs.Usage = func() {
+		estServeUsage(fs)
+	}
+
+	var listen, cn, aclfile string
+	var signer, kind, validity string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&listen, "listen", "l", ":8443", "Listen for HTTPS requests on `ADDR`")
+	fs.StringVarP(&cn, "cert", "c", "", "Use server cert `CN` from the DB for TLS")
+	fs.StringVarP(&aclfile, "acl", "a", "", "Authorize initial enrollment with the YAML ACL in `F`")
+	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA when the URL has no label [root-CA]")
+	fs.StringVarP(&kind, "kind", "k", "user", "Enroll certs of kind `K` (server, peer, user, spiffe)")
+	fs.StringVarP(&validity, "validity", "V", "", "Issue certificates with validity `D` (e.g. 1y, 90d)")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(cn) == 0 {
+		warn("est-serve: missing --cert\n")
+		fs.Usage()
+	}
+	if len(aclfile) == 0 {
+		warn("est-serve: missing --acl\n")
+		fs.Usage()
+	}
+
+	acl, err := api.LoadACL(aclfile)
+	if err != nil {
+		die("%s", err)
+	}
+
+	o := &api.ESTOpts{
+		Kind:   kind,
+		Signer: signer,
+	}
+	if len(validity) > 0 {
+		o.Validity = mustValidity(validity, 'd')
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	e, err := api.NewEST(d, acl, o)
+	if err != nil {
+		die("%s", err)
+	}
+	e.Log = log.Printf
+
+	cfg, err := e.TLSConfig(cn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           e,
+		TLSConfig:         cfg,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.Default(),
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("est-serve: listening on %s with cert %s", listen, cn)
+	err = srv.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		die("%s", err)
+	}
+}
+
+func estServeUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s est-serve: Serve RFC 7030 EST enrollment
+
+This command serves the EST endpoints under /.well-known/est/ for
+devices that support EST but not ACME. The optional label of an EST URL
+(/.well-known/est/LABEL/...) is the CN of the signing CA.
+
+    GET  cacerts          The CA certs of the signing CA
+    GET  csrattrs         Attributes the CSR should have
+    POST simpleenroll     Issue a new cert for a CSR
+    POST simplereenroll   Renew the client cert with the key in a CSR
+
+Initial enrollment is authorized by ACL entries with the 'enroll' op;
+clients authenticate with a bootstrap cert from the DB or with HTTP
+basic auth as the entry's CN and its bcrypt hashed password (e.g.,
+from 'htpasswd -nbB'). Re-enrollment is authenticated by the current
+cert of the device. The server uses the certificate and key of server
+'CN' from the DB; its key must not be encrypted.
+
+Usage: %s DB est-serve [options] --cert CN --acl ACL
+
+Where 'DB' is the CA Database file name and 'ACL' is a YAML file.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
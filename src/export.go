@@ -9,12 +9,15 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"math/big"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/opencoff/certik/ops"
+	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
 )
 
@@ -26,15 +29,41 @@ func ExportCert(db string, args []string) {
 	}
 
 	var outfile string
-	var chain bool
+	var chain, fullchain bool
+	var trust bool
+	var signer string
+	var serial string
 	var json, showCA bool
+	var kinds []string
+	var noKeys, encrypt bool
+	var keyfile, exppw string
+	var format string
+	var k8s ops.K8sOpts
 	var envpw string
 	var nopw bool
+	var legacy bool
+	var keyPw bool
 
 	fs.StringVarP(&outfile, "outfile", "o", "", "Write the cert to `F`.crt (and key to `F`.key)")
-	fs.BoolVarP(&chain, "chain", "", false, "Export all the CA certs in the chain")
+	fs.BoolVarP(&chain, "chain", "", false, "Export the cert along with all the CA certs in its chain")
+	fs.BoolVarP(&fullchain, "fullchain", "", false, "Also write the cert and its chain to `F`-fullchain.crt")
+	fs.BoolVarP(&trust, "trust-bundle", "", false, "Export all the active root and intermediate CA certs in PEM format")
+	fs.StringVarP(&serial, "serial", "", "", "Export the generation of the cert with serial number `N`")
+	fs.StringVarP(&signer, "signer", "", "", "Limit the trust bundle to the chain of CA `S` and the CAs below it; with --json, only dump the certs signed by S")
 	fs.BoolVarP(&json, "json", "j", false, "Dump DB in JSON format")
+	fs.StringSliceVarP(&kinds, "type", "t", nil, "With --json, only dump the certificates of kind `K` (root-CA, CA, server, peer, user)")
+	fs.BoolVarP(&noKeys, "no-keys", "", false, "With --json, leave out the private keys")
+	fs.BoolVarP(&encrypt, "encrypt", "", false, "With --json, encrypt the dump with a passphrase")
+	fs.StringVarP(&keyfile, "key", "", "", "With --json, encrypt the dump to the X25519 public key in `F`")
+	fs.StringVarP(&exppw, "export-password", "", "", "With --json, encrypt the dump with the passphrase from environment variable `E`")
 	fs.BoolVarP(&showCA, "root-ca", "", false, "Export Root-CA in PEM format")
+	fs.StringVarP(&format, "format", "f", "pem", "Export in format `F`: pem, der, pkcs8, p7b, p12, jwks, k8s-secret, k8s-configmap, cert-manager")
+	fs.BoolVarP(&legacy, "legacy", "", false, "Encrypt p12 files with 3DES for older mail clients")
+	fs.StringVarP(&k8s.Name, "name", "", "", "Use `N` as the kubernetes object name [derived from CN]")
+	fs.StringVarP(&k8s.Namespace, "namespace", "", "", "Put kubernetes objects in namespace `NS`")
+	fs.StringToStringVarP(&k8s.Labels, "label", "", nil, "Add label `K=V` to kubernetes objects")
+	fs.BoolVarP(&k8s.ClusterIssuer, "cluster-issuer", "", false, "Emit a cert-manager ClusterIssuer instead of an Issuer")
+	fs.BoolVarP(&keyPw, "key-password", "", false, "Ask for the password of a password protected private key to decrypt it for kubernetes")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
 
@@ -43,8 +72,112 @@ func ExportCert(db string, args []string) {
 		die("%s", err)
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	defer ca.Close()
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	if len(serial) > 0 && format != "pem" {
+		die("--serial only works with the pem format")
+	}
+
+	switch format {
+	case "pem":
+	case "der", "pkcs8", "p7b":
+		var cn string
+		if args = fs.Args(); len(args) > 0 && !showCA {
+			cn = args[0]
+		} else if !showCA {
+			fs.Usage()
+		}
+		out, err := d.ExportBinary(format, cn, chain)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if len(outfile) == 0 || outfile == "-" {
+			os.Stdout.Write(out)
+			return
+		}
+
+		if err := os.WriteFile(outName(outfile, binExt[format]), out, 0600); err != nil {
+			die("%s", err)
+		}
+		return
+	case "p12":
+		if args = fs.Args(); len(args) == 0 {
+			fs.Usage()
+		}
+		cn := args[0]
+
+		pw, err := utils.Askpass(fmt.Sprintf("Enter PKCS#12 password for '%s'", cn), true)
+		if err != nil {
+			die("Can't get password: %s", err)
+		}
+
+		sign, crypt, err := d.PKCS12(cn, &ops.P12Opts{Passwd: pw, Legacy: legacy})
+		if err != nil {
+			die("%s", err)
+		}
+
+		if len(outfile) == 0 || outfile == "-" {
+			if crypt != nil {
+				die("%s has separate signing and encryption keys; use -o", cn)
+			}
+			os.Stdout.Write(sign)
+			return
+		}
+
+		fn := outName(outfile, ".p12")
+		if err := os.WriteFile(fn, sign, 0600); err != nil {
+			die("%s", err)
+		}
+		if crypt != nil {
+			ext := filepath.Ext(fn)
+			efn := strings.TrimSuffix(fn, ext) + "-enc" + ext
+			if err := os.WriteFile(efn, crypt, 0600); err != nil {
+				die("%s", err)
+			}
+		}
+		return
+	case "jwks":
+		out, err := d.SPIFFEBundle(signer)
+		if err != nil {
+			die("%s", err)
+		}
+
+		if len(outfile) == 0 || outfile == "-" {
+			os.Stdout.Write(out)
+			return
+		}
+
+		if err := os.WriteFile(outName(outfile, ".json"), out, 0600); err != nil {
+			die("%s", err)
+		}
+		return
+	case "k8s-secret", "k8s-configmap", "cert-manager":
+		var out io.Writer = os.Stdout
+		if len(outfile) > 0 && outfile != "-" {
+			fd := mustOpen(outfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			defer fd.Close()
+			out = fd
+		}
+
+		var cn string
+		if args = fs.Args(); len(args) > 0 {
+			cn = args[0]
+		}
+		if keyPw {
+			k8s.KeyPasswd, err = utils.Askpass(fmt.Sprintf("Enter private-key password for '%s'", cn), false)
+			if err != nil {
+				die("Can't get password: %s", err)
+			}
+		}
+		if err := d.ExportK8s(out, format, cn, &k8s); err != nil {
+			die("%s", err)
+		}
+		return
+	default:
+		die("unknown export format %s", format)
+	}
 
 	var cout io.Writer = os.Stdout
 	if len(outfile) > 0 && outfile != "-" {
@@ -60,7 +193,16 @@ func ExportCert(db string, args []string) {
 
 	// Handle Json export first
 	if json {
-		err := ca.ExportJSON(cout)
+		o := &ops.DumpOpts{
+			Signer: signer,
+			Kinds:  kinds,
+			NoKeys: noKeys,
+		}
+		if encrypt || len(keyfile) > 0 || len(exppw) > 0 {
+			o.Seal = sealKey(keyfile, exppw, "export", true)
+		}
+
+		err := d.Dump(cout, o)
 		if err != nil {
 			die("can't dump db: %s", err)
 		}
@@ -68,16 +210,40 @@ func ExportCert(db string, args []string) {
 	}
 
 	if showCA {
-		fmt.Fprintf(cout, "%s\n", ca.PEM())
+		fmt.Fprintf(cout, "%s\n", d.CA.PEM())
+		os.Exit(0)
+	}
+
+	if trust {
+		b, err := d.TrustBundle(signer)
+		if err != nil {
+			die("%s", err)
+		}
+		cout.Write(b)
 		os.Exit(0)
 	}
 
-	args = fs.Args()
-	if len(args) == 0 {
+	// a single generation of a cert or the current cert of a CN
+	var sn *big.Int
+	if len(serial) > 0 {
+		if sn, err = ops.ParseSerial(serial); err != nil {
+			die("%s", err)
+		}
+	}
+	certPEM := func(cn string, chain bool) ([]byte, []byte, error) {
+		if sn != nil {
+			return d.GenerationPEM(sn, chain)
+		}
+		return d.CertPEM(cn, chain)
+	}
+
+	var cn string
+	if args = fs.Args(); len(args) > 0 {
+		cn = args[0]
+	} else if sn == nil {
 		fs.Usage()
 	}
 
-	cn := args[0]
 	var kout io.Writer = os.Stdout
 	if len(outfile) > 0 && outfile != "-" {
 		keyfile := fmt.Sprintf("%s.key", outfile)
@@ -86,33 +252,44 @@ func ExportCert(db string, args []string) {
 		kout = kfd
 	}
 
-	c, err := ca.Find(cn)
+	crt, key, err := certPEM(cn, chain)
 	if err != nil {
-		die("Can't find server or user %s", cn)
+		die("%s", err)
 	}
 
-	var pem []byte
-	var key []byte
-	if c.IsCA && chain {
-		cas, err := ca.ChainFor(c)
+	cout.Write(crt)
+	kout.Write(key)
+
+	if fullchain {
+		full, _, err := certPEM(cn, true)
 		if err != nil {
-			die("can't find cert chain: %s", err)
+			die("%s", err)
 		}
 
-		var cw bytes.Buffer
-		for i := range cas {
-			ck := cas[i]
-			cw.Write(ck.PEM())
+		var fout io.Writer = os.Stdout
+		if len(outfile) > 0 && outfile != "-" {
+			fn := fmt.Sprintf("%s-fullchain.crt", strings.TrimSuffix(outfile, ".crt"))
+			fd := mustOpen(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+			defer fd.Close()
+			fout = fd
 		}
-
-		pem = cw.Bytes()
-		_, key = c.PEM()
-	} else {
-		pem, key = c.PEM()
+		fout.Write(full)
 	}
+}
 
-	cout.Write(pem)
-	kout.Write(key)
+// file extensions of the binary formats
+var binExt = map[string]string{
+	"der":   ".der",
+	"pkcs8": ".p8",
+	"p7b":   ".p7b",
+}
+
+// add the extension 'ext' to 'fn' if it doesn't have one
+func outName(fn, ext string) string {
+	if len(filepath.Ext(fn)) == 0 {
+		return fn + ext
+	}
+	return fn
 }
 
 func exportUsage(fs *flag.FlagSet) {
@@ -121,13 +298,55 @@ func exportUsage(fs *flag.FlagSet) {
 
 Usage: %s DB export [options] name
        %s DB export --root-ca [options]
+       %s DB export --trust-bundle [--signer S] [options]
+       %s DB export --format jwks [--signer S] [options]
+       %s DB export --serial N [options]
        %s DB export --json [options]
+       %s DB export --format k8s-configmap [options] [name]
 
 Where 'DB' is the CA Database file and 'NAME' is the CommonName of the
 server or client credentials to be exported.
 
+The binary formats write a single DER encoded object:
+
+  der            the certificate (the root-CA with --root-ca)
+  pkcs8          the private key as PKCS#8
+  p7b            a certs-only PKCS#7 bundle of the cert and its chain
+
+The p12 format writes the cert, its private key and its chain as a
+password protected PKCS#12 file for mail clients and browsers; a
+password protected key must have the same password. S/MIME certs with
+separate keys also write the encryption key to 'F-enc.p12'.
+
+The JSON dump (--json) has the main DB and the companion store
+(DB.certik) with the private keys of every certificate in the clear
+unless it is encrypted with --encrypt (a passphrase) or --key (an
+X25519 public key); 'init --from-json' reads either. The request queue
+isn't in the dump; 'backup' has it. A dump with --no-keys or limited to
+--signer or --type lists the certificates instead; it can't initialize
+a DB.
+
+The jwks format writes the trust bundle as a SPIFFE bundle: a JSON Web
+Key Set with an x509-svid key for each CA.
+
+With -o, the file extension is added if 'F' doesn't have one.
+
+--serial exports one generation of a certificate in PEM format, e.g.
+the old cert that a renewal with --keep-old left valid; 'N' is a
+serial number in hex (0x..) or decimal. See 'history' for the serial
+numbers of a certificate.
+
+The kubernetes formats write YAML manifests:
+
+  k8s-secret     a kubernetes.io/tls Secret with tls.crt, tls.key and
+                 the CA chain in ca.crt
+  k8s-configmap  a ConfigMap with the CA chain of 'name' in ca.crt; or
+                 all the CA certs if 'name' is omitted
+  cert-manager   a Secret holding the intermediate CA 'name' and a
+                 cert-manager Issuer (or ClusterIssuer) that uses it
+
 Options:
-`, prog, prog, prog, prog)
+`, prog, prog, prog, prog, prog, prog, prog, prog)
 
 	fs.PrintDefaults()
 	os.Exit(0)
@@ -0,0 +1,145 @@
+// gc.go -- purge expired certs and revoked entries
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'gc' command
+func GC(db string, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	fs.Usage = func() {
+		gcUsage(fs)
+	}
+
+	var o ops.GCOpts
+	var before, archive, read string
+	var dryRun bool
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&before, "expired-before", "", "", "Remove certificates that expired before timestamp `T` [now]")
+	fs.StringVarP(&archive, "archive", "a", "", "Write the removed certificates to the encrypted archive `F`")
+	fs.BoolVarP(&o.Shred, "shred", "", false, "Leave the private keys out of the archive; certificates of the main DB are kept")
+	fs.BoolVarP(&dryRun, "dry-run", "n", false, "Show what would be removed but don't change anything")
+	fs.StringVarP(&read, "read", "", "", "Decrypt the archive `F` and print it as JSON")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	pw := getPass(db, envpw, nopw, false)
+
+	if len(read) > 0 {
+		b, err := os.ReadFile(read)
+		if err != nil {
+			die("%s", err)
+		}
+		a, err := ops.OpenArchive(b, pw)
+		if err != nil {
+			die("%s: %s", read, err)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(a); err != nil {
+			die("%s", err)
+		}
+		return
+	}
+
+	if len(archive) == 0 && !dryRun {
+		warn("'gc' needs an archive for the removed certificates\n")
+		fs.Usage()
+	}
+
+	if len(before) > 0 {
+		if o.ExpiredBefore, err = ops.ParseTime(before); err != nil {
+			die("%s", err)
+		}
+	}
+
+	d, err := ops.Open(db, pw)
+	if err != nil {
+		die("%s", err)
+	}
+	d.Warn = warn
+	defer d.Close()
+
+	a, err := d.GCPlan(&o)
+	if err != nil {
+		die("%s", err)
+	}
+
+	for _, z := range a.Certs {
+		fmt.Printf("remove %-16s %-7s %s (%s, expired %s)\n", z.CN, z.Kind, z.Serial, z.State, z.NotAfter.Format("2006-01-02"))
+	}
+	for _, z := range a.Kept {
+		fmt.Printf("keep   %-16s %-7s %s (%s, expired %s; key in the main DB)\n", z.CN, z.Kind, z.Serial, z.State, z.NotAfter.Format("2006-01-02"))
+	}
+	if dryRun || len(a.Certs) == 0 {
+		return
+	}
+
+	// the archive must be safe on disk before anything is removed
+	b, err := a.Seal(pw)
+	if err != nil {
+		die("%s", err)
+	}
+	if err := os.WriteFile(archive, b, 0600); err != nil {
+		die("%s", err)
+	}
+
+	if err := d.GC(a); err != nil {
+		die("%s", err)
+	}
+
+	Print("Removed %d certificates; archived in %s\n", len(a.Certs), archive)
+	fmt.Printf("Don't forget to generate a new CRL (%s %s crl)\n", os.Args[0], db)
+}
+
+func gcUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s gc: Purge expired certificates and revoked entries
+
+This command removes the server, peer and user certificates, the
+superseded certificates and the revoked entries that expired before
+--expired-before (default: now). Revoked entries of expired
+certificates are dropped from future CRLs; CAs are never removed.
+
+The removed certificates, their keys and metadata are first written to
+an archive encrypted with the DB passphrase; --read decrypts it. The
+companion store (DB.certik) is compacted so that nothing of the
+removed certificates is left in its free pages. Certificates issued
+by the main DB are revoked there and hidden; their keys stay in it.
+
+With --shred, the private keys are not archived and nothing of them is
+left in the companion store. The main DB can't delete keys, so --shred
+keeps its certificates (and the superseded and revoked copies of them)
+and lists them.
+
+Usage: %s DB gc [options] --archive F
+       %s DB gc --read F
+
+Where 'DB' is the CA Database file name.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -0,0 +1,101 @@
+// history.go -- show every generation of a cert
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'history' command
+func History(db string, args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.Usage = func() {
+		historyUsage(fs)
+	}
+
+	var asJSON bool
+	var envpw string
+	var nopw bool
+
+	fs.BoolVarP(&asJSON, "json", "j", false, "List the generations in JSON format")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'history'\n")
+		fs.Usage()
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	var all []*ops.Cert
+	for _, cn := range args {
+		certs, err := d.History(cn)
+		if err != nil {
+			die("%s", err)
+		}
+		all = append(all, certs...)
+	}
+
+	if asJSON {
+		printJSON(all)
+		return
+	}
+
+	for _, c := range all {
+		var when string
+		switch {
+		case !c.Revoked.IsZero():
+			when = " revoked " + c.Revoked.Format(time.RFC3339)
+		case !c.Superseded.IsZero():
+			when = " superseded " + c.Superseded.Format(time.RFC3339)
+		}
+		fmt.Printf("%-16s  %-10s %#x %s .. %s%s\n", c.Subject.CommonName, c.State(), c.SerialNumber,
+			c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339), when)
+	}
+}
+
+func historyUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s history: Show every generation of a certificate
+
+Each line is a generation of the certificate: its serial number,
+state, validity and when it was superseded or revoked. The states are:
+
+  active      the current certificate of the CN
+  superseded  an older certificate that stays valid until it expires
+  revoked     a revoked certificate
+  expired     a certificate past its expiry
+
+Renewing with 'apply --keep-old' or the API's keep_old supersedes the
+old certificate instead of revoking it. 'export --serial' and
+'delete --serial' work on a single generation.
+
+Usage: %s DB history [options] CN [CN...]
+
+Where 'DB' is the CA Database file name and 'CN' is the CommonName of a
+certificate.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -9,13 +9,11 @@
 package main
 
 import (
-	"crypto/x509/pkix"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"time"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
 )
@@ -39,17 +37,16 @@ func getPass(dbname string, envpw string, nopw, confirm bool) string {
 	return pws
 }
 
-// Open an existing CA or fail
-func OpenCA(db string, envpw string, nopw bool) *pki.CA {
+// Open an existing DB or fail
+func OpenDB(db string, envpw string, nopw bool) *ops.DB {
 	pw := getPass(db, envpw, nopw, false)
-	p := pki.Config{
-		Passwd: pw,
-	}
-	ca, err := pki.New(&p, db, false)
+	d, err := ops.Open(db, pw)
 	if err != nil {
 		die("%s", err)
 	}
-	return ca
+
+	d.Warn = warn
+	return d
 }
 
 // initialize a CA in 'dbfile' or import from json
@@ -59,16 +56,19 @@ func InitCmd(dbfile string, args []string) {
 		initUsage(fs)
 	}
 
-	var country, org, ou string
-	var yrs uint
+	var validity string
 	var envpw, from string
+	var keyfile, exppw string
 	var nopw bool
 
-	fs.StringVarP(&country, "country", "c", "US", "Use `C` as the country name")
-	fs.StringVarP(&org, "organization", "O", "", "Use `O` as the organization name")
-	fs.StringVarP(&ou, "organization-unit", "u", "", "Use `U` as the organization unit name")
-	fs.UintVarP(&yrs, "validity", "V", 5, "Issue CA root cert with `N` years validity")
+	subj := subjectFlags(fs, false)
+	fs.StringArrayVarP(&subj.n.Country, "country", "c", nil, "Use `C` as the country name [US]")
+	fs.StringArrayVarP(&subj.n.Organization, "organization", "O", nil, "Use `O` as the organization name")
+	fs.StringArrayVarP(&subj.n.OrganizationalUnit, "organization-unit", "u", nil, "Add `U` to the organization unit names")
+	fs.StringVarP(&validity, "validity", "V", "5y", "Issue CA root cert with validity `D` (e.g. 5y, 180d)")
 	fs.StringVarP(&from, "from-json", "j", "", "Initialize from an exported JSON dump")
+	fs.StringVarP(&keyfile, "key", "", "", "Decrypt the JSON dump with the X25519 private key in `F`")
+	fs.StringVarP(&exppw, "export-password", "", "", "Decrypt the JSON dump with the passphrase from environment variable `E`")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
 
@@ -77,46 +77,43 @@ func InitCmd(dbfile string, args []string) {
 		die("%s", err)
 	}
 
-	var cn string
-
 	args = fs.Args()
-	if len(args) <= 0 && len(from) == 0 {
+	cn := subj.commonName(args)
+	if len(cn) == 0 && len(from) == 0 {
 		fs.Usage()
 		os.Exit(1)
 	}
 
 	pw := getPass(dbfile, envpw, nopw, true)
 
-	var ca *pki.CA
+	var d *ops.DB
 	if len(from) > 0 {
 		js, err := ioutil.ReadFile(from)
 		if err != nil {
 			die("can't read json: %s", err)
 		}
-
-		cfg := &pki.Config{
-			Passwd: pw,
+		if ops.SealedJSON(js) {
+			if js, err = ops.OpenJSON(js, sealKey(keyfile, exppw, "export", false)); err != nil {
+				die("%s: %s", from, err)
+			}
 		}
-		ca, err = pki.NewFromJSON(cfg, dbfile, string(js))
+
+		d, err = ops.InitFromJSON(dbfile, pw, string(js))
 		if err != nil {
 			die("%s", err)
 		}
-	} else if len(args) > 0 {
+	} else if len(cn) > 0 {
 		var err error
 
-		cn = args[0]
-		p := pki.Config{
+		o := &ops.InitOpts{
 			Passwd:   pw,
-			Validity: years(yrs),
-
-			Subject: pkix.Name{
-				Country:            []string{country},
-				Organization:       []string{org},
-				OrganizationalUnit: []string{ou},
-				CommonName:         cn,
-			},
+			Subject:  subj.name(),
+			Validity: mustValidity(validity, 'y'),
 		}
-		ca, err = pki.New(&p, dbfile, true)
+		if len(o.Subject.Country) == 0 {
+			o.Subject.Country = []string{"US"}
+		}
+		d, err = ops.Init(dbfile, cn, o)
 		if err != nil {
 			die("%s", err)
 		}
@@ -124,8 +121,9 @@ func InitCmd(dbfile string, args []string) {
 		fs.Usage()
 		os.Exit(1)
 	}
+	defer d.Close()
 
-	Print("New CA cert:\n%s\n", Cert(*ca.Certificate))
+	Print("New CA cert:\n%s\n", Cert(*d.CA.Certificate))
 }
 
 // initialize a CA in 'dbfile' or read an already initialized CA
@@ -137,20 +135,18 @@ This command initializes the given CA database and creates
 a new root CA if needed.
 
 Usage: %s DB init [options] CN
+       %s DB init [options] --subject /.../CN=name
+       %s DB init [options] --from-json F
 
 Where 'DB' is the CA Database file name and 'CN' is the CommonName for the CA.
 
+--from-json reads a full dump written by 'export --json'; an encrypted
+dump is decrypted with its passphrase or with --key and the X25519
+private key.
+
 Options:
-`, os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 
 	fs.PrintDefaults()
 	os.Exit(0)
 }
-
-// convert duration in years to time.Duration
-// 365.25 days/year * 24 hours/day
-// .25 days/year = 24 hours / 4 = 6 hrs
-func years(n uint) time.Duration {
-	day := 24 * time.Hour
-	return (6 * time.Hour) + (time.Duration(n*365) * day)
-}
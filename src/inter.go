@@ -12,7 +12,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	flag "github.com/opencoff/pflag"
 )
 
@@ -24,49 +24,47 @@ func IntermediateCA(db string, args []string) {
 		intermediateCAUsage(fs)
 	}
 
-	var yrs uint = 2
+	var validity string
 	var signer string
 	var envpw string
 	var nopw bool
+	var strict bool
 
-	fs.UintVarP(&yrs, "validity", "V", 5, "Issue CA root cert with `N` years validity")
+	fs.StringVarP(&validity, "validity", "V", "5y", "Issue intermediate CA cert with validity `D` (e.g. 5y, 180d)")
 	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA [root-CA]")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't issue the certificate if it has lint errors")
+	subj := subjectFlags(fs, true)
+	meta := metaFlags(fs)
 
 	err := fs.Parse(args)
 	if err != nil {
 		die("%s", err)
 	}
 	args = fs.Args()
-	if len(args) < 1 {
+	cn := subj.commonName(args)
+	if len(cn) == 0 {
 		warn("Insufficient arguments to 'intermediate-ca'\n")
 		fs.Usage()
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	if len(signer) > 0 {
-		ica, err := ca.FindCA(signer)
-		if err != nil {
-			die("can't find signer %s: %s", signer, err)
-		}
-		ca = ica
+	o := &ops.CertOpts{
+		Signer:   signer,
+		Validity: mustValidity(validity, 'y'),
+		Strict:   strict,
+		Subject:  subj.name(),
 	}
-	defer ca.Close()
+	meta.set(o)
 
-	cn := args[0]
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
 
-	ci := &pki.CertInfo{
-		Subject:  ca.Subject,
-		Validity: years(yrs),
-	}
-
-	ci.Subject.CommonName = cn
-	ica, err := ca.NewIntermediateCA(ci)
+	ica, err := d.NewIntermediate(cn, o)
 	if err != nil {
 		die("%s", err)
 	}
-	Print("New intermediate CA:\n%s\n", Cert(*ica.Certificate))
+	Print("New intermediate CA:\n%s\n", Cert(*ica))
 }
 
 func intermediateCAUsage(fs *flag.FlagSet) {
@@ -75,11 +73,12 @@ func intermediateCAUsage(fs *flag.FlagSet) {
 This command creates an intermediate CA chained to the root CA.
 
 Usage: %s DB intermediate-ca [options] CN
+       %s DB intermediate-ca [options] --subject /.../CN=name
 
 Where 'DB' is the CA Database file name and 'CN' is the CommonName for the intermediate CA.
 
 Options:
-`, os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 
 	fs.PrintDefaults()
 	os.Exit(0)
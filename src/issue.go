@@ -0,0 +1,126 @@
+// issue.go -- issue a leaf cert with explicit key usages
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/opencoff/certik/ops"
+	"github.com/opencoff/go-utils"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'issue' command
+func IssueCert(db string, args []string) {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	fs.Usage = func() {
+		issueUsage(fs)
+	}
+
+	var validity string
+	var notBefore, notAfter, skew string
+	var dns, email []string
+	var ips []net.IP
+	var uris []string
+	var profile string
+	var askPw bool
+	var signer string
+	var envpw string
+	var nopw bool
+	var strict bool
+
+	fs.StringVarP(&validity, "validity", "V", "2y", "Issue certificate with validity `D` (e.g. 2y, 90d, 12h, 15m)")
+	fs.StringVarP(&notBefore, "not-before", "", "", "Make the certificate valid from timestamp `T`")
+	fs.StringVarP(&notAfter, "not-after", "", "", "Make the certificate valid until timestamp `T`")
+	fs.StringVarP(&skew, "skew", "", "", "Backdate the start of validity by `D` to allow for clock skew")
+	fs.StringSliceVarP(&dns, "dnsname", "d", []string{}, "Add `M` to list of DNS names")
+	fs.IPSliceVarP(&ips, "ip-address", "i", []net.IP{}, "Add `IP` to list of IP Addresses")
+	fs.StringSliceVarP(&email, "email", "e", []string{}, "Add `E` to list of email addresses")
+	fs.StringArrayVarP(&uris, "uri", "", nil, "Add `U` to the list of URIs (e.g. spiffe://example.org/web)")
+	fs.StringVarP(&profile, "profile", "", "", "Issue the certificate with profile `P` (spiffe)")
+	fs.BoolVarP(&askPw, "password", "p", false, "Ask for a password to protect the private-key")
+	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA [root-CA]")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't issue the certificate if it has lint errors")
+	subj := subjectFlags(fs, true)
+	usage := usageFlags(fs)
+	meta := metaFlags(fs)
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	cn := subj.commonName(args)
+	if len(cn) == 0 {
+		warn("Insufficient arguments to 'issue'\n")
+		fs.Usage()
+	}
+	if len(usage.eku) == 0 {
+		warn("issue: missing --eku\n")
+		fs.Usage()
+	}
+
+	o := &ops.CertOpts{
+		Signer:         signer,
+		DNSNames:       dns,
+		IPAddresses:    ips,
+		EmailAddresses: email,
+		URIs:           mustURIs(uris),
+		Profile:        profile,
+		Strict:         strict,
+		Subject:        subj.name(),
+	}
+	setWindow(o, fs, validity, notBefore, notAfter, skew)
+	usage.set(o)
+	meta.set(o)
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	if askPw {
+		var err error
+		prompt := fmt.Sprintf("Enter private-key password for '%s'", cn)
+		o.Passwd, err = utils.Askpass(prompt, true)
+		if err != nil {
+			die("Can't get password: %s", err)
+		}
+	}
+
+	crt, err := d.Issue(cn, o)
+	if err != nil {
+		die("can't create cert: %s", err)
+	}
+
+	Print("New cert:\n%s\n", Cert(*crt))
+}
+
+func issueUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s issue: Issue a new certificate with explicit key usages
+
+The certificate has exactly the extended key usages in --eku; it is
+kept with the server certificates if they include serverAuth and
+with the user certificates otherwise. Key usages default to
+digitalSignature and keyAgreement.
+
+Usage: %s DB issue [options] --eku U,.. CN
+       %s DB issue [options] --eku U,.. --subject /.../CN=name
+
+Where 'DB' is the CA Database file name and 'CN' is the CommonName for the certificate
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -0,0 +1,106 @@
+// lint.go -- lint command implementation
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'lint' command
+func LintCert(db string, args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = func() {
+		lintUsage(fs)
+	}
+
+	var jsonOut, failWarn bool
+	var envpw string
+	var nopw bool
+
+	fs.BoolVarP(&jsonOut, "json", "j", false, "Write lint results in JSON format")
+	fs.BoolVarP(&failWarn, "fail-on-warn", "", false, "Exit with a non-zero status on warnings too")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	var certs []*ops.Cert
+
+	args = fs.Args()
+	if len(args) == 0 {
+		certs, err = d.List()
+		if err != nil {
+			die("%s", err)
+		}
+	} else {
+		for _, cn := range args {
+			c, err := d.Find(cn)
+			if err != nil {
+				warn("Can't find Common Name %s: %s", cn, err)
+				continue
+			}
+			certs = append(certs, c)
+		}
+	}
+
+	reports := ops.Lint(certs...)
+	errs := 0
+	for i := range reports {
+		errs += reports[i].Errors(failWarn)
+	}
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			die("can't encode lint results: %s", err)
+		}
+	} else {
+		for _, r := range reports {
+			for _, f := range r.Findings {
+				fmt.Printf("%-16s  %-6s %-28s %s\n", r.CN, f.Level, f.Rule, f.Message)
+			}
+		}
+	}
+
+	if errs > 0 {
+		os.Exit(1)
+	}
+}
+
+func lintUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s lint: Check certificates for common mistakes
+
+This command checks one or all certificates in the DB against a set of
+rules modeled after zlint. Each finding has a severity of 'error', 'warn'
+or 'notice'. The command exits with a non-zero status if any errors are
+found.
+
+Usage: %s DB lint [options] [CN...]
+
+Where 'DB' is the CA Database file name and 'CN' is zero or more
+CommonNames to check.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -9,11 +9,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	flag "github.com/opencoff/pflag"
 )
 
@@ -23,11 +25,27 @@ func ListCert(db string, args []string) {
 		listUsage(fs)
 	}
 
-	var showCA bool
+	var q ops.Query
+	var showCA, asJSON bool
+	var before, after, serial, fp string
 	var envpw string
 	var nopw bool
 
 	fs.BoolVarP(&showCA, "root-ca", "", false, "Display the CA certificate")
+	fs.StringSliceVarP(&q.Kinds, "type", "t", nil, "Only list certificates of kind `K` (root-CA, CA, server, peer, user)")
+	fs.StringVarP(&q.Signer, "signer", "s", "", "Only list certificates issued by CA `S`")
+	fs.StringVarP(&before, "expires-before", "", "", "Only list certificates that expire before timestamp `T`")
+	fs.StringVarP(&after, "expires-after", "", "", "Only list certificates that expire after timestamp `T`")
+	fs.StringVarP(&q.Name, "name", "n", "", "Only list certificates whose CN or SANs match `P` (a glob or substring)")
+	fs.StringVarP(&q.SAN, "san", "", "", "Only list certificates whose SANs match `P` (a glob or substring)")
+	fs.BoolVarP(&q.Revoked, "revoked", "", false, "List revoked certificates instead of active ones")
+	fs.StringVarP(&serial, "serial", "", "", "Find the certificate with serial number `N` (e.g. 0x1f2e)")
+	fs.StringVarP(&fp, "fingerprint", "", "", "Find the certificate with SHA-256 fingerprint `F`")
+	fs.StringToStringVarP(&q.Labels, "label", "", nil, "Only list certificates with label `K=V`")
+	fs.StringVarP(&q.Owner, "owner", "", "", "Only list certificates owned by `O`")
+	fs.StringVarP(&q.Sort, "sort", "", "", "Sort by `F` (cn, notBefore, notAfter, serial, kind)")
+	fs.IntVarP(&q.Limit, "limit", "", 0, "List at most `N` certificates")
+	fs.BoolVarP(&asJSON, "json", "j", false, "List the certificates and their metadata in JSON format")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
 
@@ -36,96 +54,170 @@ func ListCert(db string, args []string) {
 		die("%s", err)
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	defer ca.Close()
+	if len(before) > 0 {
+		if q.ExpiresBefore, err = ops.ParseTime(before); err != nil {
+			die("%s", err)
+		}
+	}
+	if len(after) > 0 {
+		if q.ExpiresAfter, err = ops.ParseTime(after); err != nil {
+			die("%s", err)
+		}
+	}
+	if len(serial) > 0 {
+		if q.Serial, err = ops.ParseSerial(serial); err != nil {
+			die("%s", err)
+		}
+	}
+	if len(fp) > 0 {
+		if q.Fingerprint, err = ops.ParseFingerprint(fp); err != nil {
+			die("%s", err)
+		}
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
 
 	if showCA {
-		fmt.Printf("CA Certificate:\n%s\n", Cert(*ca.Certificate))
+		fmt.Printf("CA Certificate:\n%s\n", Cert(*d.CA.Certificate))
 	}
 
-	args = fs.Args()
-	if len(args) == 0 {
-		// always print the abbreviated root-CA
-		c := &pki.Cert{
-			Certificate: ca.Certificate,
+	q.CNs = fs.Args()
+	for _, cn := range q.CNs {
+		if c, _ := d.Find(cn); c == nil && !q.Revoked {
+			warn("Can't find Common Name %s", cn)
 		}
-		printcert(c, true)
+	}
 
-		var certs []*pki.Cert
+	certs, err := d.Query(&q)
+	if err != nil {
+		die("%s", err)
+	}
 
-		certs, err := ca.GetServers()
-		if err != nil {
-			die("can't fetch servers: %s", err)
-		}
+	if asJSON {
+		printJSON(certs)
+		return
+	}
 
-		users, err := ca.GetClients()
-		if err != nil {
-			die("can't fetch users: %s", err)
-		}
-		certs = append(certs, users...)
+	for _, c := range certs {
+		printcert(c)
+	}
+}
 
-		cas, err := ca.GetCAs()
-		if err != nil {
-			die("can't fetch CAs: %s", err)
+// A cert and its metadata in the JSON output of 'list'
+type certJSON struct {
+	CN        string            `json:"cn"`
+	Kind      string            `json:"kind"`
+	Serial    string            `json:"serial"`
+	Issuer    string            `json:"issuer"`
+	NotBefore time.Time         `json:"not_before"`
+	NotAfter  time.Time         `json:"not_after"`
+	DNS       []string          `json:"dns,omitempty"`
+	IP        []string          `json:"ip,omitempty"`
+	Email     []string          `json:"email,omitempty"`
+	URI       []string          `json:"uri,omitempty"`
+	SHA256    string            `json:"sha256"`
+	Revoked   string            `json:"revoked,omitempty"`
+	Replaced  string            `json:"superseded,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Note      string            `json:"note,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// print 'certs' as a JSON array
+func printJSON(certs []*ops.Cert) {
+	out := make([]certJSON, 0, len(certs))
+	for _, c := range certs {
+		cj := certJSON{
+			CN:        c.Subject.CommonName,
+			Kind:      c.Kind,
+			Serial:    fmt.Sprintf("%#x", c.SerialNumber),
+			Issuer:    c.Issuer.CommonName,
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+			DNS:       c.DNSNames,
+			Email:     c.EmailAddresses,
+			SHA256:    fmt.Sprintf("%x", ops.Fingerprint(c.Certificate)),
+			Owner:     c.Meta.Owner,
+			Note:      c.Meta.Note,
+			Labels:    c.Meta.Labels,
 		}
-		for i := range certs {
-			printcert(certs[i], false)
+		for _, ip := range c.IPAddresses {
+			cj.IP = append(cj.IP, ip.String())
 		}
-
-		for i := range cas {
-			c := cas[i]
-			if c.SerialNumber.Cmp(ca.SerialNumber) == 0 {
-				continue
-			}
-			z := &pki.Cert{
-				Certificate: c.Certificate,
-				IsCA:        true,
-			}
-			printcert(z, false)
+		for _, u := range c.URIs {
+			cj.URI = append(cj.URI, u.String())
 		}
-
-		return
+		if !c.Revoked.IsZero() {
+			cj.Revoked = c.Revoked.Format(time.RFC3339)
+		}
+		if !c.Superseded.IsZero() {
+			cj.Replaced = c.Superseded.Format(time.RFC3339)
+		}
+		out = append(out, cj)
 	}
 
-	for _, cn := range args {
-		c, err := ca.Find(cn)
-		if err != nil {
-			warn("Can't find Common Name %s", cn)
-			continue
-		}
-		printcert(c, false)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		die("%s", err)
 	}
 }
 
-func printcert(c *pki.Cert, rootCA bool) {
+func printcert(c *ops.Cert) {
 	var pref string
 	var server string
 
 	now := time.Now().UTC()
-	if now.After(c.NotAfter) {
+	if !c.Revoked.IsZero() {
+		pref = fmt.Sprintf("REVOKED %s", c.Revoked)
+	} else if now.After(c.NotAfter) {
 		pref = fmt.Sprintf("EXPIRED %s", c.NotAfter)
+	} else if !c.Superseded.IsZero() {
+		pref = fmt.Sprintf("SUPERSEDED %s, valid until %s", c.Superseded, c.NotAfter)
 	} else {
 		pref = fmt.Sprintf("valid until %s", c.NotAfter)
 	}
 
-	if c.IsServer {
+	switch c.Kind {
+	case ops.KindServer:
 		server = "server"
-	} else if c.IsCA {
+	case ops.KindPeer:
+		server = "peer"
+	case ops.KindCA:
 		server = "CA (I)"
-	} else if rootCA {
+	case ops.KindRoot:
 		server = "root-CA"
 	}
 
-	fmt.Printf("%-16s  %7.7s %#x (%s)\n", c.Subject.CommonName, server, c.SerialNumber, pref)
-	Print("%s\n", Cert(*c.Certificate))
+	var eku string
+	if names := ops.EKUNames(c.ExtKeyUsage); len(c.ExtKeyUsage) > 0 && len(names) > 0 {
+		eku = " [" + strings.Join(names, ",") + "]"
+	}
+
+	var meta string
+	if len(c.Meta.Owner) > 0 {
+		meta += " owner=" + c.Meta.Owner
+	}
+	if len(c.Meta.Labels) > 0 {
+		meta += " {" + labelString(c.Meta.Labels) + "}"
+	}
+
+	fmt.Printf("%-16s  %7.7s %#x (%s)%s%s\n", c.Subject.CommonName, server, c.SerialNumber, pref, eku, meta)
+	Print("%s%s\n", Cert(*c.Certificate), metaString(&c.Meta))
 }
 
 func listUsage(fs *flag.FlagSet) {
 	fmt.Printf(`%s list: List one or more issued certificates
 
-Usage: %s DB list [options] [NUM...]
+Usage: %s DB list [options] [CN...]
 
-Where 'DB' is the CA Database file and 'NUM' is zero or more certificate serial numbers.
+Where 'DB' is the CA Database file and 'CN' is zero or more certificate
+CommonNames. Every option narrows the list; --label and --owner match
+the metadata set with 'annotate'. Name patterns with '*' or '?' are
+globs that match whole names; other patterns match a substring. Case
+is ignored. --serial and --fingerprint find active and revoked
+certificates.
 
 Options:
 `, os.Args[0], os.Args[0])
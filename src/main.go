@@ -37,14 +37,33 @@ Usage: %s [options] DB CMD [args..]
 Where 'DB' points to the certificate database, and 'CMD' is one of:
 
     init              Initialize a new CA and cert store
+    apply             Issue, renew or revoke certs to match a manifest
+    api-serve         Serve the DB over an authenticated REST API
+    est-serve         Serve RFC 7030 EST enrollment
+    scep-serve        Serve SCEP enrollment for legacy devices
+    challenge         Manage the SCEP challenge passwords
+    requests          Submit, approve or reject certificate requests
     intermediate      Generate an intermediate CA
     server            Create a new server certificate
+    peer              Create a new peer (server and client) certificate
+    issue             Create a new certificate with explicit key usages
     list, show        List one or all certificates in the DB
+    annotate          Show or change the owner, note and labels of a certificate
+    history           Show every generation of a certificate
+    gc                Purge expired certificates and revoked entries
+    backup            Write or verify an encrypted backup of the DB
+    restore           Restore a DB from an encrypted backup
+    lint              Check one or all certificates for common mistakes
     export            Export a client or server certificate & key
     delete	      Delete a user, server or intermediate CA
     user, client      Create a new user/client certificate
     crl		      List revoked certificates or generate CRL
     passwd            Change the DB encryption password
+    policy            Show or set the issuance policy of a CA
+    workload          Manage the SPIFFE workload registrations
+    workload-agent    Serve the SPIFFE Workload API on a Unix socket
+    tsa-serve         Serve RFC 3161 time-stamps over HTTP
+    timestamp         Request or verify an RFC 3161 time-stamp
     help	      Show this help message
 
 Options:
@@ -81,17 +100,35 @@ Options:
 	}
 
 	var cmds = map[string]func(string, []string){
-		"init":         InitCmd,
-		"server":       ServerCert,
-		"user":         UserCert,
-		"delete":       Delete,
-		"client":       UserCert,
-		"export":       ExportCert,
-		"show":         ListCert,
-		"list":         ListCert,
-		"crl":          ListCRL,
-		"intermediate": IntermediateCA,
-		"passwd":       ChangePasswd,
+		"init":           InitCmd,
+		"apply":          ApplyManifest,
+		"api-serve":      APIServe,
+		"est-serve":      ESTServe,
+		"scep-serve":     SCEPServe,
+		"challenge":      ChallengeCmd,
+		"requests":       RequestsCmd,
+		"server":         ServerCert,
+		"peer":           PeerCert,
+		"user":           UserCert,
+		"delete":         Delete,
+		"client":         UserCert,
+		"export":         ExportCert,
+		"show":           ListCert,
+		"list":           ListCert,
+		"annotate":       Annotate,
+		"history":        History,
+		"gc":             GC,
+		"backup":         Backup,
+		"restore":        RestoreCmd,
+		"lint":           LintCert,
+		"crl":            ListCRL,
+		"intermediate":   IntermediateCA,
+		"passwd":         ChangePasswd,
+		"policy":         PolicyCmd,
+		"workload":       WorkloadCmd,
+		"workload-agent": WorkloadAgent,
+		"tsa-serve":      TSAServe,
+		"timestamp":      Timestamp,
 	}
 	words := make([]string, len(cmds))
 	for k := range cmds {
@@ -0,0 +1,172 @@
+// opts.go -- parse command line options
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"crypto/x509/pkix"
+	"net/url"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Like ops.ParseValidity() but dies on errors
+func mustValidity(s string, def byte) time.Duration {
+	d, err := ops.ParseValidity(s, def)
+	if err != nil {
+		die("%s", err)
+	}
+	return d
+}
+
+// Fill in the validity window of 'o' from the command line options.
+// 'vstr' is the --validity option, 'nbstr' and 'nastr' are the
+// --not-before and --not-after options and 'skew' backdates
+// NotBefore. Empty strings denote unset options.
+func setWindow(o *ops.CertOpts, fs *flag.FlagSet, vstr, nbstr, nastr, skew string) {
+	if len(nastr) > 0 && fs.Changed("validity") {
+		die("--validity and --not-after are mutually exclusive")
+	}
+
+	var err error
+	if len(nbstr) > 0 {
+		if o.NotBefore, err = ops.ParseTime(nbstr); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if len(skew) > 0 {
+		if o.Skew, err = ops.ParseValidity(skew, 'm'); err != nil {
+			die("skew: %s", err)
+		}
+	}
+
+	if len(nastr) > 0 {
+		if o.NotAfter, err = ops.ParseTime(nastr); err != nil {
+			die("%s", err)
+		}
+	} else {
+		o.Validity = mustValidity(vstr, 'y')
+	}
+}
+
+// Parse the --uri options; dies on errors
+func mustURIs(v []string) []*url.URL {
+	var uris []*url.URL
+	for _, s := range v {
+		u, err := ops.ParseURI(s)
+		if err != nil {
+			die("%s", err)
+		}
+		uris = append(uris, u)
+	}
+	return uris
+}
+
+// Key usages given on the command line
+type usageOpts struct {
+	eku []string
+	ku  []string
+}
+
+// Add the --eku and --key-usage options to 'fs'
+func usageFlags(fs *flag.FlagSet) *usageOpts {
+	u := &usageOpts{}
+
+	fs.StringSliceVarP(&u.eku, "eku", "", nil, "Use extended key usages `U` (serverAuth, clientAuth, codeSigning, emailProtection, timeStamping, OCSPSigning)")
+	fs.StringSliceVarP(&u.ku, "key-usage", "", nil, "Use key usages `K` (digitalSignature, contentCommitment, keyEncipherment, dataEncipherment, keyAgreement, encipherOnly, decipherOnly)")
+	return u
+}
+
+// Fill in the key usages of 'o'; dies on errors
+func (u *usageOpts) set(o *ops.CertOpts) {
+	var err error
+	if o.ExtKeyUsage, err = ops.ParseEKU(u.eku); err != nil {
+		die("%s", err)
+	}
+	if o.KeyUsage, err = ops.ParseKeyUsage(u.ku); err != nil {
+		die("%s", err)
+	}
+}
+
+// Metadata given on the command line
+type metaOpts struct {
+	owner  string
+	note   string
+	labels map[string]string
+}
+
+// Add the --owner, --note and --label options to 'fs'
+func metaFlags(fs *flag.FlagSet) *metaOpts {
+	m := &metaOpts{}
+
+	fs.StringVarP(&m.owner, "owner", "", "", "Record `O` as the owner of the certificate")
+	fs.StringVarP(&m.note, "note", "", "", "Record the note `N` (e.g. a ticket number) with the certificate")
+	fs.StringToStringVarP(&m.labels, "label", "", nil, "Add label `K=V` to the certificate")
+	return m
+}
+
+// Fill in the metadata of 'o'
+func (m *metaOpts) set(o *ops.CertOpts) {
+	o.Owner = m.owner
+	o.Note = m.note
+	o.Labels = m.labels
+}
+
+// Subject fields given on the command line
+type subjectOpts struct {
+	subject string
+	n       pkix.Name
+}
+
+// Add the subject options to 'fs'; the country, organization and
+// organization unit options are only added if 'all' is set.
+func subjectFlags(fs *flag.FlagSet, all bool) *subjectOpts {
+	s := &subjectOpts{}
+
+	if all {
+		fs.StringArrayVarP(&s.n.Country, "country", "", nil, "Use `C` as the country name")
+		fs.StringArrayVarP(&s.n.Organization, "organization", "", nil, "Use `O` as the organization name")
+		fs.StringArrayVarP(&s.n.OrganizationalUnit, "organization-unit", "", nil, "Add `U` to the organization unit names")
+	}
+	fs.StringArrayVarP(&s.n.Locality, "locality", "", nil, "Use `L` as the locality (city) name")
+	fs.StringArrayVarP(&s.n.Province, "province", "", nil, "Use `P` as the state or province name")
+	fs.StringArrayVarP(&s.n.StreetAddress, "street", "", nil, "Use `S` as the street address")
+	fs.StringArrayVarP(&s.n.PostalCode, "postal-code", "", nil, "Use `Z` as the postal code")
+	fs.StringVarP(&s.n.SerialNumber, "serial-number", "", "", "Use `N` as the subject serial number")
+	fs.StringVarP(&s.subject, "subject", "", "", "Use the subject fields in `S` (e.g. /C=DE/O=Acme/OU=Ops/CN=name)")
+	return s
+}
+
+// Return the subject in --subject with the per-field options applied
+func (s *subjectOpts) name() pkix.Name {
+	var n pkix.Name
+	if len(s.subject) > 0 {
+		var err error
+		if n, err = ops.ParseSubject(s.subject); err != nil {
+			die("%s", err)
+		}
+	}
+	return ops.MergeSubject(n, s.n)
+}
+
+// Return the CommonName from the command line args or --subject
+func (s *subjectOpts) commonName(args []string) string {
+	n := s.name()
+	if len(args) == 0 {
+		return n.CommonName
+	}
+
+	cn := args[0]
+	if len(n.CommonName) > 0 && n.CommonName != cn {
+		die("CN %s doesn't match the --subject CN %s", cn, n.CommonName)
+	}
+	return cn
+}
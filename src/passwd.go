@@ -12,7 +12,7 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
 )
@@ -37,23 +37,19 @@ func ChangePasswd(dbfile string, args []string) {
 		die("%s", err)
 	}
 
-	p := pki.Config{
-		Passwd: oldpw,
-	}
-
-	ca, err := pki.New(&p, oldpw, false)
+	d, err := ops.Open(dbfile, oldpw)
 	if err != nil {
 		die("can't open CA: %s", err)
 	}
 
-	defer ca.Close()
+	defer d.Close()
 
 	newpw, err = utils.Askpass("Enter new password for DB", true)
 	if err != nil {
 		die("%s", err)
 	}
 
-	err = ca.Rekey(newpw)
+	err = d.Rekey(newpw)
 	if err != nil {
 		die("%s", err)
 	}
@@ -0,0 +1,115 @@
+// peer.go -- create a peer cert
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/opencoff/certik/ops"
+	"github.com/opencoff/go-utils"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'peer' command
+func PeerCert(db string, args []string) {
+	fs := flag.NewFlagSet("peer", flag.ExitOnError)
+	fs.Usage = func() {
+		peerUsage(fs)
+	}
+
+	var validity string
+	var notBefore, notAfter, skew string
+	var dns []string
+	var ips []net.IP
+	var askPw bool
+	var signer string
+	var envpw string
+	var nopw bool
+	var strict bool
+	var uris []string
+
+	fs.StringVarP(&validity, "validity", "V", "2y", "Issue peer certificate with validity `D` (e.g. 2y, 90d, 12h, 15m)")
+	fs.StringVarP(&notBefore, "not-before", "", "", "Make the certificate valid from timestamp `T`")
+	fs.StringVarP(&notAfter, "not-after", "", "", "Make the certificate valid until timestamp `T`")
+	fs.StringVarP(&skew, "skew", "", "", "Backdate the start of validity by `D` to allow for clock skew")
+	fs.StringSliceVarP(&dns, "dnsname", "d", []string{}, "Add `M` to list of DNS names for this peer")
+	fs.IPSliceVarP(&ips, "ip-address", "i", []net.IP{}, "Add `IP` to list of IP Addresses for this peer")
+	fs.BoolVarP(&askPw, "password", "p", false, "Ask for a password to protect the peer private-key")
+	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA [root-CA]")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't issue the certificate if it has lint errors")
+	fs.StringArrayVarP(&uris, "uri", "", nil, "Add `U` to the list of URIs (e.g. spiffe://example.org/etcd)")
+	subj := subjectFlags(fs, true)
+	meta := metaFlags(fs)
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	cn := subj.commonName(args)
+	if len(cn) == 0 {
+		warn("Insufficient arguments to 'peer'\n")
+		fs.Usage()
+	}
+
+	o := &ops.CertOpts{
+		Signer:      signer,
+		DNSNames:    dns,
+		IPAddresses: ips,
+		URIs:        mustURIs(uris),
+		Strict:      strict,
+		Subject:     subj.name(),
+	}
+	setWindow(o, fs, validity, notBefore, notAfter, skew)
+	meta.set(o)
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	if askPw {
+		var err error
+		prompt := fmt.Sprintf("Enter private-key password for peer '%s'", cn)
+		o.Passwd, err = utils.Askpass(prompt, true)
+		if err != nil {
+			die("Can't get password: %s", err)
+		}
+	}
+
+	crt, err := d.NewPeer(cn, o)
+	if err != nil {
+		die("can't create peer cert: %s", err)
+	}
+
+	Print("New peer cert:\n%s\n", Cert(*crt))
+}
+
+func peerUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s peer: Issue a new peer certificate
+
+A peer certificate is both a server and a client certificate, e.g. for
+the members of an etcd, Consul or Kafka cluster. It needs at least one
+DNS name or IP address; a CN that looks like a hostname is added to
+the DNS names.
+
+Usage: %s DB peer [options] CN
+       %s DB peer [options] --subject /.../CN=name
+
+Where 'DB' is the CA Database file name and 'CN' is the CommonName for the peer
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
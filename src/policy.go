@@ -0,0 +1,156 @@
+// policy.go -- show or set the issuance policy of a CA
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Implement the 'policy' command
+func PolicyCmd(db string, args []string) {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	fs.Usage = func() {
+		policyUsage(fs)
+	}
+
+	var p ops.Policy
+	var file string
+	var clear bool
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&file, "file", "f", "", "Read the policy from YAML file `F`")
+	fs.BoolVarP(&clear, "clear", "", false, "Remove all the rules of the policy")
+	fs.StringSliceVarP(&p.DNSSuffixes, "dns-suffix", "", nil, "Only allow DNS names in domain `D`")
+	fs.StringSliceVarP(&p.DenyDNSSuffixes, "deny-dns-suffix", "", nil, "Deny DNS names in domain `D`")
+	fs.StringSliceVarP(&p.DNSRegexes, "dns-regex", "", nil, "Only allow DNS names matching regex `R`")
+	fs.StringSliceVarP(&p.DenyDNSRegexes, "deny-dns-regex", "", nil, "Deny DNS names matching regex `R`")
+	fs.StringSliceVarP(&p.IPNets, "ip-net", "", nil, "Only allow IP addresses in network `N`")
+	fs.StringSliceVarP(&p.EmailDomains, "email-domain", "", nil, "Only allow email addresses in domain `D`")
+	fs.StringVarP(&p.MaxValidity, "max-validity", "", "", "Limit the validity of issued certs to `D` (e.g. 90d)")
+	fs.StringSliceVarP(&p.RequireSubject, "require-subject", "", nil, "Require subject field `F` (C, O, OU, L, ST, street, postalCode, serialNumber)")
+	fs.StringSliceVarP(&p.KeyTypes, "key-type", "", nil, "Only allow keys of type `K` (ecdsa-p256, ecdsa-p384, ecdsa-p521, ed25519, rsa-N)")
+	fs.StringVarP(&p.TrustDomain, "trust-domain", "", "", "Use `T` as the SPIFFE trust domain of the CA")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		warn("Insufficient arguments to 'policy'\n")
+		fs.Usage()
+	}
+
+	cmd, cn := args[0], args[1]
+	if cmd != "show" && cmd != "set" {
+		die("unknown policy command '%s'; try 'show' or 'set'", cmd)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	cur, err := d.Policy(cn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if cmd == "set" {
+		np := cur
+		switch {
+		case clear:
+			np = &ops.Policy{}
+		case len(file) > 0:
+			np = readPolicy(file)
+		}
+
+		// rules given as options replace the same rules of the policy
+		fields := map[string]func(){
+			"dns-suffix":      func() { np.DNSSuffixes = p.DNSSuffixes },
+			"deny-dns-suffix": func() { np.DenyDNSSuffixes = p.DenyDNSSuffixes },
+			"dns-regex":       func() { np.DNSRegexes = p.DNSRegexes },
+			"deny-dns-regex":  func() { np.DenyDNSRegexes = p.DenyDNSRegexes },
+			"ip-net":          func() { np.IPNets = p.IPNets },
+			"email-domain":    func() { np.EmailDomains = p.EmailDomains },
+			"max-validity":    func() { np.MaxValidity = p.MaxValidity },
+			"require-subject": func() { np.RequireSubject = p.RequireSubject },
+			"key-type":        func() { np.KeyTypes = p.KeyTypes },
+			"trust-domain":    func() { np.TrustDomain = p.TrustDomain },
+		}
+		for nm, fp := range fields {
+			if fs.Changed(nm) {
+				fp()
+			}
+		}
+
+		if err := d.SetPolicy(cn, np); err != nil {
+			die("%s", err)
+		}
+		cur = np
+	}
+
+	if cur.Empty() {
+		fmt.Printf("# CA %s has no policy\n", cn)
+		return
+	}
+
+	fmt.Printf("# policy of CA %s\n", cn)
+	out, err := yaml.Marshal(cur)
+	if err != nil {
+		die("%s", err)
+	}
+	os.Stdout.Write(out)
+}
+
+// read a YAML policy from file 'fn'
+func readPolicy(fn string) *ops.Policy {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	p := &ops.Policy{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(p); err != nil {
+		die("%s: %s", fn, err)
+	}
+	return p
+}
+
+func policyUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s policy: Show or set the issuance policy of a CA
+
+A policy restricts the names, validity, subject and key type of the
+certs that a CA issues; it also applies to the CAs below it. Every
+issuing command, 'apply' and 'api-serve' enforce it. 'set' starts
+with the current policy (or the policy in --file) and replaces the
+rules given as options.
+
+Usage: %s DB policy [options] show CA-CN
+       %s DB policy [options] set CA-CN
+
+Where 'DB' is the CA Database file name and 'CA-CN' is the CommonName
+of the root or an intermediate CA.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
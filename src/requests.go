@@ -0,0 +1,245 @@
+// requests.go -- submit, review and decide cert requests
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'requests' command
+func RequestsCmd(db string, args []string) {
+	fs := flag.NewFlagSet("requests", flag.ExitOnError)
+	fs.Usage = func() {
+		requestsUsage(fs)
+	}
+
+	var r ops.Request
+	var validity, csr, status, reason string
+	var uris []string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&validity, "validity", "V", "", "Ask for a certificate with validity `D` (e.g. 2y, 90d)")
+	fs.StringSliceVarP(&r.DNSNames, "dnsname", "d", nil, "Add `M` to list of DNS names")
+	fs.IPSliceVarP(&r.IPAddresses, "ip-address", "i", []net.IP{}, "Add `IP` to list of IP Addresses")
+	fs.StringSliceVarP(&r.EmailAddresses, "email", "e", nil, "Add `E` to the list of email addresses")
+	fs.StringArrayVarP(&uris, "uri", "", nil, "Add `U` to the list of URIs (e.g. spiffe://example.org/web)")
+	fs.StringVarP(&r.Signer, "sign-with", "s", "", "Ask for CA `S` as the signing CA [root-CA]")
+	fs.StringVarP(&r.Profile, "profile", "", "", "Ask for a certificate with profile `P`")
+	fs.StringVarP(&csr, "csr", "", "", "Use the public key and names in the PEM CSR file `F`")
+	fs.StringVarP(&r.Justification, "justification", "j", "", "Record `J` as the reason for the request")
+	fs.StringVarP(&r.Requester, "requester", "", whoami(), "Record `R` as the requester")
+	fs.StringVarP(&status, "status", "", ops.RequestPending, "List the requests in state `S` (pending, approved, rejected, all)")
+	fs.StringVarP(&reason, "reason", "r", "", "Record `R` as the reason for the approval or rejection")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'requests'\n")
+		fs.Usage()
+	}
+
+	cmd := args[0]
+	args = args[1:]
+	switch cmd {
+	case "submit":
+		if len(args) < 1 {
+			warn("Insufficient arguments to 'requests submit'\n")
+			fs.Usage()
+		}
+	case "show", "approve", "reject":
+		if len(args) < 1 {
+			warn("Insufficient arguments to 'requests %s'\n", cmd)
+			fs.Usage()
+		}
+	case "list":
+	default:
+		die("unknown requests command '%s'; try 'submit', 'list', 'show', 'approve' or 'reject'", cmd)
+	}
+
+	// submitting and reviewing requests doesn't need the passphrase
+	q, err := ops.OpenQueue(db)
+	if err != nil {
+		die("%s", err)
+	}
+	defer q.Close()
+
+	switch cmd {
+	case "submit":
+		r.Kind = args[0]
+		if len(args) > 1 {
+			r.CN = args[1]
+		}
+		r.URIs = uris
+		if len(validity) > 0 {
+			r.Validity = mustValidity(validity, 'y')
+		}
+		if len(csr) > 0 {
+			pem, err := os.ReadFile(csr)
+			if err != nil {
+				die("%s", err)
+			}
+			r.CSR = string(pem)
+		}
+
+		if err := q.Submit(&r); err != nil {
+			die("%s", err)
+		}
+		Print("Submitted request %d for %s %s\n", r.ID, r.Kind, r.CN)
+
+	case "list":
+		if status == "all" {
+			status = ""
+		}
+		reqs, err := q.List(status)
+		if err != nil {
+			die("%s", err)
+		}
+		for _, r := range reqs {
+			fmt.Printf("%4d  %-8s  %-6s %-24s  %-12s  %s\n", r.ID, r.Status, r.Kind, r.CN,
+				r.Requester, r.Submitted.Local().Format(time.RFC1123))
+		}
+
+	case "show":
+		for _, s := range args {
+			r, err := q.Get(mustID(s))
+			if err != nil {
+				die("%s", err)
+			}
+			printRequest(r)
+		}
+
+	case "approve", "reject":
+		id := mustID(args[0])
+
+		d := OpenDB(db, envpw, nopw)
+		defer d.Close()
+
+		if cmd == "reject" {
+			if err := d.Reject(q, id, whoami(), reason); err != nil {
+				die("%s", err)
+			}
+			Print("Rejected request %d\n", id)
+			return
+		}
+
+		crt, err := d.Approve(q, id, whoami(), reason)
+		if err != nil {
+			die("%s", err)
+		}
+		Print("Approved request %d:\n%s\n", id, Cert(*crt))
+	}
+}
+
+// print the request 'r'
+func printRequest(r *ops.Request) {
+	fmt.Printf("Request %d: %s %s (%s)\n", r.ID, r.Kind, r.CN, r.Status)
+	fmt.Printf("  Requester: %s\n", r.Requester)
+	fmt.Printf("  Submitted: %s\n", r.Submitted.Local().Format(time.RFC1123))
+	fmt.Printf("  Justification: %s\n", r.Justification)
+	if len(r.Signer) > 0 {
+		fmt.Printf("  Signer: %s\n", r.Signer)
+	}
+	if r.Validity > 0 {
+		fmt.Printf("  Validity: %s\n", r.Validity)
+	}
+	if len(r.Profile) > 0 {
+		fmt.Printf("  Profile: %s\n", r.Profile)
+	}
+	if len(r.DNSNames) > 0 {
+		fmt.Printf("  DNS names: %s\n", strings.Join(r.DNSNames, ", "))
+	}
+	if len(r.IPAddresses) > 0 {
+		ips := make([]string, 0, len(r.IPAddresses))
+		for _, ip := range r.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		fmt.Printf("  IP addresses: %s\n", strings.Join(ips, ", "))
+	}
+	if len(r.EmailAddresses) > 0 {
+		fmt.Printf("  Emails: %s\n", strings.Join(r.EmailAddresses, ", "))
+	}
+	if len(r.URIs) > 0 {
+		fmt.Printf("  URIs: %s\n", strings.Join(r.URIs, ", "))
+	}
+	if len(r.CSR) > 0 {
+		fmt.Printf("  Key: from CSR\n")
+	} else {
+		fmt.Printf("  Key: generated on approval\n")
+	}
+
+	if r.Status != ops.RequestPending {
+		fmt.Printf("  %s by %s: %s\n", strings.ToUpper(r.Status[:1])+r.Status[1:], r.Officer, r.Decided.Local().Format(time.RFC1123))
+		if len(r.Reason) > 0 {
+			fmt.Printf("  Reason: %s\n", r.Reason)
+		}
+		if len(r.Serial) > 0 {
+			fmt.Printf("  Serial: %s\n", r.Serial)
+		}
+	}
+}
+
+// Parse a request ID; dies on errors
+func mustID(s string) uint64 {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		die("invalid request ID '%s'", s)
+	}
+	return id
+}
+
+// Return the name of the user running certik
+func whoami() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	return u.Username
+}
+
+func requestsUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s requests: Submit certificate requests or approve them
+
+Requests wait in a queue next to the DB ('DB.queue') until a CA officer
+approves or rejects them. 'submit', 'list' and 'show' don't need the DB
+passphrase; the queue isn't encrypted. 'submit' asks for a server, peer
+or user certificate; with --csr the key pair stays with the requester,
+otherwise it is generated in the DB on approval. 'approve' issues the
+certificate subject to the policy of the signing CA; decided requests
+stay in the queue with the officer, time and reason.
+
+Usage: %s DB requests [options] submit server|peer|user [CN]
+       %s DB requests [options] list
+       %s DB requests show ID [ID...]
+       %s DB requests [options] approve ID
+       %s DB requests [options] reject ID
+
+Where 'DB' is the CA Database file name.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -0,0 +1,124 @@
+// scepserve.go -- serve SCEP enrollment
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	"github.com/opencoff/certik/scep"
+	"github.com/opencoff/go-utils"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'scep-serve' command
+func SCEPServe(db string, args []string) {
+	fs := flag.NewFlagSet("scep-serve", flag.ExitOnError)
+	fs.Usage = func() {
+		scepServeUsage(fs)
+	}
+
+	var listen, cn, signer, validity string
+	var askPw bool
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&listen, "listen", "l", ":8080", "Listen for HTTP SCEP requests on `ADDR`")
+	fs.StringVarP(&cn, "cert", "c", "scep-ra", "Use the RA cert `CN`; issue it if needed")
+	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA of a new RA cert [root-CA]")
+	fs.StringVarP(&validity, "validity", "V", "", "Issue certificates with validity `D` (e.g. 1y, 90d)")
+	fs.BoolVarP(&askPw, "password", "p", false, "Ask for the password of the RA private-key")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	o := &ops.CertOpts{
+		Signer: signer,
+	}
+	if askPw {
+		prompt := fmt.Sprintf("Enter private-key password for '%s'", cn)
+		o.Passwd, err = utils.Askpass(prompt, false)
+		if err != nil {
+			die("Can't get password: %s", err)
+		}
+	}
+
+	ra, err := d.SCEP(cn, o)
+	if err != nil {
+		die("%s", err)
+	}
+
+	s := scep.New(d, ra)
+	if len(validity) > 0 {
+		s.Validity = mustValidity(validity, 'd')
+	}
+	s.Log = log.Printf
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.Default(),
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("scep-serve: listening on %s with RA cert %s (signer %s)", listen, cn, ra.Cert.Issuer.CommonName)
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		die("%s", err)
+	}
+}
+
+func scepServeUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s scep-serve: Serve RFC 8894 SCEP enrollment over HTTP
+
+This command answers the SCEP operations GetCACaps, GetCACert and
+PKIOperation (PKCSReq and GetCertInitial) on any path, e.g.
+http://HOST:8080/scep. Devices enroll user certs signed by the issuer of
+the RA cert 'CN'; use --sign-with to pick the intermediate CA when the
+RA cert is issued. The RA cert has an RSA key: SCEP clients can't
+encrypt to anything else.
+
+Every CSR needs a challenge password made with '%s DB challenge add';
+a one-time challenge is used up only when a cert is issued. The
+request must be signed with the key of the CSR.
+
+Usage: %s DB scep-serve [options]
+
+Where 'DB' is the CA Database file name.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
@@ -12,9 +12,8 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"strings"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
 )
@@ -26,21 +25,34 @@ func ServerCert(db string, args []string) {
 		serverUsage(fs)
 	}
 
-	var yrs uint = 2
+	var validity string
+	var notBefore, notAfter, skew string
 	var dns []string
 	var ips []net.IP
 	var askPw bool
 	var signer string
 	var envpw string
 	var nopw bool
-
-	fs.UintVarP(&yrs, "validity", "V", yrs, "Issue server certificate with `N` years validity")
+	var strict bool
+	var uris []string
+	var profile string
+
+	fs.StringVarP(&validity, "validity", "V", "2y", "Issue server certificate with validity `D` (e.g. 2y, 90d, 12h, 15m)")
+	fs.StringVarP(&notBefore, "not-before", "", "", "Make the certificate valid from timestamp `T`")
+	fs.StringVarP(&notAfter, "not-after", "", "", "Make the certificate valid until timestamp `T`")
+	fs.StringVarP(&skew, "skew", "", "", "Backdate the start of validity by `D` to allow for clock skew")
 	fs.StringSliceVarP(&dns, "dnsname", "d", []string{}, "Add `M` to list of DNS names for this server")
 	fs.IPSliceVarP(&ips, "ip-address", "i", []net.IP{}, "Add `IP` to list of IP Addresses for this server")
 	fs.BoolVarP(&askPw, "password", "p", false, "Ask for a password to protect the server private-key")
 	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA [root-CA]")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't issue the certificate if it has lint errors")
+	fs.StringArrayVarP(&uris, "uri", "", nil, "Add `U` to the list of URIs (e.g. spiffe://example.org/web)")
+	fs.StringVarP(&profile, "profile", "", "", "Issue the certificate with profile `P` (spiffe)")
+	subj := subjectFlags(fs, true)
+	usage := usageFlags(fs)
+	meta := metaFlags(fs)
 
 	err := fs.Parse(args)
 	if err != nil {
@@ -48,67 +60,55 @@ func ServerCert(db string, args []string) {
 	}
 
 	args = fs.Args()
-	if len(args) < 1 {
+	cn := subj.commonName(args)
+	if len(cn) == 0 {
 		warn("Insufficient arguments to 'server'\n")
 		fs.Usage()
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	if len(signer) > 0 {
-		ica, err := ca.FindCA(signer)
-		if err != nil {
-			die("can't find signer %s: %s", signer, err)
-		}
-		ca = ica
+	o := &ops.CertOpts{
+		Signer:      signer,
+		DNSNames:    dns,
+		IPAddresses: ips,
+		URIs:        mustURIs(uris),
+		Profile:     profile,
+		Strict:      strict,
+		Subject:     subj.name(),
 	}
-	defer ca.Close()
+	setWindow(o, fs, validity, notBefore, notAfter, skew)
+	usage.set(o)
+	meta.set(o)
 
-	var pw string
-	var cn string = args[0]
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
 
 	if askPw {
 		var err error
 		prompt := fmt.Sprintf("Enter private-key password for server '%s'", cn)
-		pw, err = utils.Askpass(prompt, true)
+		o.Passwd, err = utils.Askpass(prompt, true)
 		if err != nil {
 			die("Can't get password: %s", err)
 		}
 	}
 
-	if strings.Index(cn, ".") > 0 {
-		dns = append(dns, cn)
-	}
-
-	if len(ips) == 0 && len(dns) == 0 {
-		warn("No server IP or hostnames specified; TLS Hostname verification may not be possible")
-	}
-
-	ci := &pki.CertInfo{
-		Subject:  ca.Subject,
-		Validity: years(yrs),
-
-		DNSNames:    []string(dns),
-		IPAddresses: []net.IP(ips),
-	}
-	ci.Subject.CommonName = cn
-
-	srv, err := ca.NewServerCert(ci, pw)
+	srv, err := d.NewServer(cn, o)
 	if err != nil {
 		die("can't create server cert: %s", err)
 	}
 
-	Print("New server cert:\n%s\n", Cert(*srv.Certificate))
+	Print("New server cert:\n%s\n", Cert(*srv))
 }
 
 func serverUsage(fs *flag.FlagSet) {
 	fmt.Printf(`%s server: Issue a new server certificate
 
 Usage: %s DB server [options] CN
+       %s DB server [options] --subject /.../CN=name
 
 Where 'DB' is the CA Database file name and 'CN' is the CommonName for the server
 
 Options:
-`, os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 
 	fs.PrintDefaults()
 	os.Exit(0)
@@ -0,0 +1,136 @@
+// timestamp.go -- request and verify RFC 3161 time-stamps
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/opencoff/certik/tsa"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'timestamp' command
+func Timestamp(db string, args []string) {
+	fs := flag.NewFlagSet("timestamp", flag.ExitOnError)
+	fs.Usage = func() {
+		timestampUsage(fs)
+	}
+
+	var url, outf, verify, hash, policy string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&url, "url", "u", "http://127.0.0.1:3161/", "Request the time-stamp from the TSA at `URL`")
+	fs.StringVarP(&outf, "outfile", "o", "", "Write the time-stamp response to `F` [FILE.tsr]")
+	fs.StringVarP(&verify, "verify", "", "", "Verify the time-stamp response in `F` instead of requesting one")
+	fs.StringVarP(&hash, "hash", "", "sha256", "Use digest `H` (sha256, sha384, sha512)")
+	fs.StringVarP(&policy, "policy", "", "", "Ask for the TSA policy `OID`")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) != 1 {
+		warn("Insufficient arguments to 'timestamp'\n")
+		fs.Usage()
+	}
+
+	fn := args[0]
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		die("%s", err)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	roots, err := d.TrustCerts("")
+	if err != nil {
+		die("%s", err)
+	}
+
+	var t *tsa.Token
+	if len(verify) > 0 {
+		b, err := os.ReadFile(verify)
+		if err != nil {
+			die("%s", err)
+		}
+		if t, err = tsa.ParseResponse(b); err != nil {
+			die("%s: %s", verify, err)
+		}
+	} else {
+		c := &tsa.Client{URL: url}
+		switch hash {
+		case "sha256":
+			c.Hash = crypto.SHA256
+		case "sha384":
+			c.Hash = crypto.SHA384
+		case "sha512":
+			c.Hash = crypto.SHA512
+		default:
+			die("unknown digest %s", hash)
+		}
+		if len(policy) > 0 {
+			if c.Policy, err = parseOID(policy); err != nil {
+				die("--policy: %s", err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if t, err = c.Timestamp(ctx, data); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if err := t.Verify(data, roots); err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	if len(verify) == 0 {
+		if len(outf) == 0 {
+			outf = fn + ".tsr"
+		}
+		if err := os.WriteFile(outf, t.Raw, 0644); err != nil {
+			die("%s", err)
+		}
+		Print("Wrote time-stamp response to %s\n", outf)
+	}
+
+	fmt.Printf("%s: time-stamped %s by %s (serial %#x, policy %s)\n", fn,
+		t.Time.Format(time.RFC3339), t.Signer.Subject.CommonName, t.Serial, t.Policy)
+}
+
+func timestampUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s timestamp: Request or verify an RFC 3161 time-stamp
+
+This command asks a time-stamping authority (see 'tsa-serve') to
+time-stamp 'FILE' and saves the DER encoded response in FILE.tsr; with
+--verify, it checks an existing response instead. Either way, the
+time-stamp must match FILE and the TSA cert must chain to a CA in 'DB'.
+
+Usage: %s DB timestamp [options] FILE
+
+Where 'DB' is the CA Database file name.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
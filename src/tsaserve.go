@@ -0,0 +1,154 @@
+// tsaserve.go -- serve RFC 3161 time-stamps
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"context"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	"github.com/opencoff/certik/tsa"
+	"github.com/opencoff/go-utils"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'tsa-serve' command
+func TSAServe(db string, args []string) {
+	fs := flag.NewFlagSet("tsa-serve", flag.ExitOnError)
+	fs.Usage = func() {
+		tsaServeUsage(fs)
+	}
+
+	var listen, cn, signer, policy string
+	var askPw bool
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&listen, "listen", "l", "127.0.0.1:3161", "Listen for HTTP time-stamp requests on `ADDR`")
+	fs.StringVarP(&cn, "cert", "c", "tsa", "Sign time-stamps with the cert `CN`; issue it if needed")
+	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA of a new TSA cert [root-CA]")
+	fs.StringVarP(&policy, "policy", "", "", "Use the TSA policy `OID` (required)")
+	fs.BoolVarP(&askPw, "password", "p", false, "Ask for the password of the TSA private-key")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(policy) == 0 {
+		die("tsa-serve: --policy is required")
+	}
+	oid, err := parseOID(policy)
+	if err != nil {
+		die("--policy: %s", err)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	o := &ops.CertOpts{
+		Signer: signer,
+	}
+	if askPw {
+		prompt := fmt.Sprintf("Enter private-key password for '%s'", cn)
+		o.Passwd, err = utils.Askpass(prompt, false)
+		if err != nil {
+			die("Can't get password: %s", err)
+		}
+	}
+
+	t, err := d.TSA(cn, o)
+	if err != nil {
+		die("%s", err)
+	}
+
+	s, err := tsa.New(t, oid)
+	if err != nil {
+		die("%s", err)
+	}
+	s.Log = log.Printf
+
+	srv := &http.Server{
+		Addr:              listen,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.Default(),
+	}
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	log.Printf("tsa-serve: listening on %s with cert %s (policy %s)", listen, cn, s.Policy)
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		die("%s", err)
+	}
+}
+
+// parse a dotted OID
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	v := strings.Split(s, ".")
+	if len(v) < 2 {
+		return nil, fmt.Errorf("invalid OID %s", s)
+	}
+
+	oid := make(asn1.ObjectIdentifier, len(v))
+	for i, x := range v {
+		n, err := strconv.Atoi(x)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %s", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+func tsaServeUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s tsa-serve: Serve RFC 3161 time-stamps over HTTP
+
+This command answers time-stamp requests (application/timestamp-query)
+POSTed to any path. Time-stamps are signed with the cert 'CN' from the
+DB; it must have only the timeStamping extended key usage, marked
+critical. If 'CN' doesn't exist, it is issued with the tsa profile
+under the CA given by --sign-with. Requests may use SHA-256, SHA-384 or
+SHA-512 digests.
+
+Every time-stamp names the TSA policy given by --policy: the OID of the
+operator's time-stamping policy. Clients that ask for another policy
+are refused.
+
+Usage: %s DB tsa-serve [options]
+
+Where 'DB' is the CA Database file name. Use '%s DB timestamp' or
+'openssl ts' to request time-stamps.
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
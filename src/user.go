@@ -11,9 +11,8 @@ package main
 import (
 	"fmt"
 	"os"
-	"strings"
 
-	"github.com/opencoff/go-pki"
+	"github.com/opencoff/certik/ops"
 	"github.com/opencoff/go-utils"
 	flag "github.com/opencoff/pflag"
 )
@@ -24,19 +23,35 @@ func UserCert(db string, args []string) {
 		userUsage(fs)
 	}
 
-	var yrs uint = 2
+	var validity string
+	var notBefore, notAfter, skew string
 	var askPw bool
 	var email string
 	var signer string
 	var envpw string
 	var nopw bool
-
-	fs.UintVarP(&yrs, "validity", "V", yrs, "Issue user certificate with `N` years validity")
+	var strict bool
+	var uris []string
+	var profile string
+	var smime, split bool
+
+	fs.StringVarP(&validity, "validity", "V", "2y", "Issue user certificate with validity `D` (e.g. 2y, 90d, 12h, 15m)")
+	fs.StringVarP(&notBefore, "not-before", "", "", "Make the certificate valid from timestamp `T`")
+	fs.StringVarP(&notAfter, "not-after", "", "", "Make the certificate valid until timestamp `T`")
+	fs.StringVarP(&skew, "skew", "", "", "Backdate the start of validity by `D` to allow for clock skew")
 	fs.BoolVarP(&askPw, "password", "p", false, "Ask for a password to protect the user private-key")
 	fs.StringVarP(&email, "email", "e", email, "Use `E` as the user's email address")
 	fs.StringVarP(&signer, "sign-with", "s", "", "Use `S` as the signing CA [root-CA]")
 	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
 	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+	fs.BoolVarP(&strict, "strict", "", false, "Don't issue the certificate if it has lint errors")
+	fs.StringArrayVarP(&uris, "uri", "", nil, "Add `U` to the list of URIs (e.g. spiffe://example.org/web)")
+	fs.StringVarP(&profile, "profile", "", "", "Issue the certificate with profile `P` (spiffe, smime, codesign, tsa, scep)")
+	fs.BoolVarP(&smime, "smime", "", false, "Issue an S/MIME certificate; same as --profile smime")
+	fs.BoolVarP(&split, "split-keys", "", false, "Issue separate S/MIME signing and encryption key pairs")
+	subj := subjectFlags(fs, true)
+	usage := usageFlags(fs)
+	meta := metaFlags(fs)
 
 	err := fs.Parse(args)
 	if err != nil {
@@ -44,65 +59,78 @@ func UserCert(db string, args []string) {
 	}
 
 	args = fs.Args()
-	if len(args) < 1 {
+	cn := subj.commonName(args)
+	if len(cn) == 0 {
 		warn("Insufficient arguments to 'user'\n")
 		fs.Usage()
 	}
 
-	ca := OpenCA(db, envpw, nopw)
-	if len(signer) > 0 {
-		ica, err := ca.FindCA(signer)
-		if err != nil {
-			die("can't find signer %s: %s", signer, err)
+	if smime || split {
+		if len(profile) > 0 && profile != ops.ProfileSMIME {
+			die("--smime and --split-keys can't be used with --profile %s", profile)
 		}
-		ca = ica
+		profile = ops.ProfileSMIME
+	}
+
+	o := &ops.CertOpts{
+		Signer:    signer,
+		URIs:      mustURIs(uris),
+		Profile:   profile,
+		SplitKeys: split,
+		Strict:    strict,
+		Subject:   subj.name(),
 	}
-	defer ca.Close()
+	setWindow(o, fs, validity, notBefore, notAfter, skew)
+	usage.set(o)
+	meta.set(o)
 
-	var cn string = args[0]
-	var pw string
-	var emails []string
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
 
 	if askPw {
 		var err error
 		prompt := fmt.Sprintf("Enter private-key password for user '%s'", cn)
-		pw, err = utils.Askpass(prompt, true)
+		o.Passwd, err = utils.Askpass(prompt, true)
 		if err != nil {
 			die("Can't get password: %s", err)
 		}
 	}
 
-	// use CN as EmailAddress if one is not provided
 	if len(email) > 0 {
-		emails = []string{email}
-	} else if strings.Index(cn, "@") > 0 {
-		emails = []string{cn}
+		o.EmailAddresses = []string{email}
 	}
 
-	ci := &pki.CertInfo{
-		Subject:        ca.Subject,
-		Validity:       years(yrs),
-		EmailAddresses: emails,
-	}
-	ci.Subject.CommonName = cn
-
-	crt, err := ca.NewClientCert(ci, pw)
+	crt, err := d.NewUser(cn, o)
 	if err != nil {
 		die("can't create user cert: %s", err)
 	}
 
-	Print("New client cert:\n%s\n", Cert(*crt.Certificate))
+	Print("New client cert:\n%s\n", Cert(*crt))
 }
 
 func userUsage(fs *flag.FlagSet) {
 	fmt.Printf(`%s user: Issue a new user (client) certificate
 
 Usage: %s DB user [options] CN
+       %s DB user [options] --subject /.../CN=name
+
+Where 'DB' is the CA Database file name and 'CN' is the CommonName for the user
+
+S/MIME certificates (--smime) have only email addresses and the
+emailProtection extended key usage; the signing CA must restrict the
+email domains with 'policy set --email-domain'. With --split-keys, the
+certificate is for signing and a second key pair and certificate with
+the same name are for encryption. Export both with '--format p12'.
 
-Where 'DB' is the CA Database file name and 'CN' is the CommonName for the server
+Code signing certificates (--profile codesign) have the codeSigning
+extended key usage; the certificate of a time-stamping authority
+(--profile tsa) has only the timeStamping extended key usage, marked
+critical (see 'tsa-serve'). The RA certificate of a SCEP server
+(--profile scep) has a new RSA key for signing and key encipherment
+(see 'scep-serve').
 
 Options:
-`, os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0])
 
 	fs.PrintDefaults()
 	os.Exit(0)
@@ -0,0 +1,118 @@
+// workload.go -- manage SPIFFE workload registrations
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencoff/certik/ops"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'workload' command
+func WorkloadCmd(db string, args []string) {
+	fs := flag.NewFlagSet("workload", flag.ExitOnError)
+	fs.Usage = func() {
+		workloadUsage(fs)
+	}
+
+	var e ops.WorkloadEntry
+	var envpw string
+	var nopw bool
+
+	fs.StringArrayVarP(&e.Selectors, "selector", "S", nil, "Match workloads with selector `S` (unix:uid:N, unix:gid:N, unix:path:P)")
+	fs.StringVarP(&e.TTL, "ttl", "", "", "Issue SVIDs valid for `D` [1h]")
+	fs.StringVarP(&e.Signer, "sign-with", "s", "", "Use `S` as the signing CA [root-CA]")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	args = fs.Args()
+	if len(args) < 1 {
+		warn("Insufficient arguments to 'workload'\n")
+		fs.Usage()
+	}
+
+	cmd := args[0]
+	switch cmd {
+	case "add", "del":
+		if len(args) < 2 {
+			warn("Insufficient arguments to 'workload %s'\n", cmd)
+			fs.Usage()
+		}
+	case "list":
+	default:
+		die("unknown workload command '%s'; try 'add', 'del' or 'list'", cmd)
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	switch cmd {
+	case "add":
+		e.ID = args[1]
+		if err := d.AddWorkload(&e); err != nil {
+			die("%s", err)
+		}
+
+	case "del":
+		if err := d.DelWorkload(args[1]); err != nil {
+			die("%s", err)
+		}
+
+	case "list":
+		ents, err := d.Workloads()
+		if err != nil {
+			die("%s", err)
+		}
+
+		for _, e := range ents {
+			ttl, signer := e.TTL, e.Signer
+			if len(ttl) == 0 {
+				ttl = "1h"
+			}
+			if len(signer) == 0 {
+				signer = d.CA.Subject.CommonName
+			}
+			fmt.Printf("%s\n    selectors %s\n    signer %s, ttl %s\n", e.ID, strings.Join(e.Selectors, " "), signer, ttl)
+		}
+	}
+}
+
+func workloadUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s workload: Manage the SPIFFE workload registrations
+
+A registration maps local processes to a SPIFFE ID; 'workload-agent'
+issues an X509-SVID for that ID to any process that matches all of
+the selectors of its registration. The signing CA must have a SPIFFE
+trust domain (see 'policy set --trust-domain').
+
+Usage: %s DB workload [options] add SPIFFE-ID
+       %s DB workload del SPIFFE-ID
+       %s DB workload list
+
+Where 'DB' is the CA Database file name.
+
+Selectors:
+    unix:uid:N      processes running as user id N
+    unix:gid:N      processes running as group id N
+    unix:path:P     processes running the executable P
+
+Options:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
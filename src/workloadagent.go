@@ -0,0 +1,102 @@
+// workloadagent.go -- serve the SPIFFE Workload API on a Unix socket
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/opencoff/certik/workload"
+	flag "github.com/opencoff/pflag"
+)
+
+// Implement the 'workload-agent' command
+func WorkloadAgent(db string, args []string) {
+	fs := flag.NewFlagSet("workload-agent", flag.ExitOnError)
+	fs.Usage = func() {
+		workloadAgentUsage(fs)
+	}
+
+	var sock string
+	var envpw string
+	var nopw bool
+
+	fs.StringVarP(&sock, "socket", "", "", "Listen for Workload API requests on Unix socket `P`")
+	fs.StringVarP(&envpw, "env-password", "E", "", "Use passphrase from environment variable `E`")
+	fs.BoolVarP(&nopw, "no-password", "", false, "Don't ask for a password for the private key")
+
+	err := fs.Parse(args)
+	if err != nil {
+		die("%s", err)
+	}
+
+	if len(sock) == 0 {
+		warn("workload-agent: missing --socket\n")
+		fs.Usage()
+	}
+
+	d := OpenDB(db, envpw, nopw)
+	defer d.Close()
+
+	// remove the socket of an agent that didn't exit cleanly
+	if fi, err := os.Lstat(sock); err == nil && fi.Mode().Type() == os.ModeSocket {
+		os.Remove(sock)
+	}
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		die("%s", err)
+	}
+	defer os.Remove(sock)
+
+	// every local process may ask; the registrations decide what it gets
+	if err := os.Chmod(sock, 0777); err != nil {
+		die("%s", err)
+	}
+
+	a := workload.New(d)
+	a.Log = log.Printf
+
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		a.Stop()
+	}()
+
+	log.Printf("workload-agent: listening on %s", sock)
+	if err := a.Serve(l); err != nil {
+		die("%s", err)
+	}
+}
+
+func workloadAgentUsage(fs *flag.FlagSet) {
+	fmt.Printf(`%s workload-agent: Serve the SPIFFE Workload API on a Unix socket
+
+This command is a local stand-in for a SPIRE agent. Processes that
+connect to the socket are identified by their user id, group id and
+executable and get X509-SVIDs for the workload registrations they
+match (see 'workload'). The SVIDs are not stored in the DB; they are
+rotated at half their lifetime. JWT-SVIDs are not supported.
+
+Usage: %s DB workload-agent [options] --socket PATH
+
+Where 'DB' is the CA Database file name. Point SPIFFE clients at the
+agent with SPIFFE_ENDPOINT_SOCKET=unix://PATH.
+
+Options:
+`, os.Args[0], os.Args[0])
+
+	fs.PrintDefaults()
+	os.Exit(0)
+}
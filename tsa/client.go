@@ -0,0 +1,131 @@
+// client.go -- RFC 3161 time-stamp client
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package tsa
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+)
+
+// the largest response we'll read
+const maxResponse = 1024 * 1024
+
+// Client requests time-stamps from a TSA over HTTP
+type Client struct {
+	URL string
+
+	// Hash digests the data; the default is SHA-256
+	Hash crypto.Hash
+
+	// Policy asks the TSA for a specific policy
+	Policy asn1.ObjectIdentifier
+
+	// HTTP is the client used for requests; the default is
+	// http.DefaultClient
+	HTTP *http.Client
+}
+
+// Timestamp asks the TSA to time-stamp 'data'. The token's signature,
+// digest and nonce are checked; use Token.Verify to check the TSA cert.
+func (c *Client) Timestamp(ctx context.Context, data []byte) (*Token, error) {
+	h := c.Hash
+	if h == 0 {
+		h = crypto.SHA256
+	}
+
+	alg, ok := hashAlg(h)
+	if !ok {
+		return nil, fmt.Errorf("tsa: unsupported digest %s", h)
+	}
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	req := request{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: alg,
+			HashedMessage: digest(h, data),
+		},
+		ReqPolicy: c.Policy,
+		Nonce:     nonce,
+		CertReq:   true,
+	}
+
+	der, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("tsa: %w", err)
+	}
+
+	resp, err := c.post(ctx, der)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := ParseResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case t.Hash != h || !bytes.Equal(t.Digest, req.MessageImprint.HashedMessage):
+		return nil, fmt.Errorf("tsa: time-stamp is for a different digest")
+	case t.Nonce == nil || t.Nonce.Cmp(nonce) != 0:
+		return nil, fmt.Errorf("tsa: time-stamp nonce doesn't match")
+	case len(c.Policy) > 0 && !t.Policy.Equal(c.Policy):
+		return nil, fmt.Errorf("tsa: time-stamp has policy %s", t.Policy)
+	}
+	return t, nil
+}
+
+// POST the request 'der' and return the response
+func (c *Client) post(ctx context.Context, der []byte) ([]byte, error) {
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(der))
+	if err != nil {
+		return nil, fmt.Errorf("tsa: %w", err)
+	}
+	hr.Header.Set("Content-Type", queryType)
+
+	resp, err := hc.Do(hr)
+	if err != nil {
+		return nil, fmt.Errorf("tsa: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tsa: %s: %s", c.URL, resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != replyType {
+		return nil, fmt.Errorf("tsa: %s: unexpected content type %q", c.URL, mt)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse+1))
+	if err != nil {
+		return nil, fmt.Errorf("tsa: %w", err)
+	}
+	if len(b) > maxResponse {
+		return nil, fmt.Errorf("tsa: %s: response too large", c.URL)
+	}
+	return b, nil
+}
@@ -0,0 +1,338 @@
+// server.go -- RFC 3161 time-stamping authority
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package tsa
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+)
+
+const (
+	queryType = "application/timestamp-query"
+	replyType = "application/timestamp-reply"
+
+	// requests are a few hundred bytes
+	maxRequest = 64 * 1024
+)
+
+// Server is an HTTP handler that answers RFC 3161 time-stamp requests
+type Server struct {
+	// Policy is the TSA policy; requests for another policy are
+	// rejected.
+	Policy asn1.ObjectIdentifier
+
+	// Log is called for every request; the default discards the
+	// messages.
+	Log func(format string, v ...any)
+
+	tsa *ops.TSA
+
+	// digest and signature algorithm of the TSA key
+	hash crypto.Hash
+	dig  pkix.AlgorithmIdentifier
+	sig  pkix.AlgorithmIdentifier
+}
+
+// New returns a Server that signs time-stamps with 't' under the TSA
+// policy 'policy'. RFC 3161 has no default policy; it is the OID of
+// the operator's time-stamping policy.
+func New(t *ops.TSA, policy asn1.ObjectIdentifier) (*Server, error) {
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("tsa: no TSA policy")
+	}
+
+	s := &Server{
+		Policy: policy,
+		tsa:    t,
+	}
+
+	switch t.Key.Public().(type) {
+	case *ecdsa.PublicKey:
+		s.hash = crypto.SHA256
+		s.sig = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	case *rsa.PublicKey:
+		s.hash = crypto.SHA256
+		s.sig = pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+	case ed25519.PublicKey:
+		// RFC 8419: the message digest of ed25519 signers is SHA-512
+		s.hash = crypto.SHA512
+		s.sig = pkix.AlgorithmIdentifier{Algorithm: oidEd25519}
+	default:
+		return nil, fmt.Errorf("tsa: unsupported key type %T", t.Key.Public())
+	}
+
+	s.dig, _ = hashAlg(s.hash)
+	return s, nil
+}
+
+// ServeHTTP answers a time-stamp request POSTed to any path
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != queryType {
+		http.Error(w, "expected "+queryType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequest+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxRequest {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := s.Respond(body)
+	w.Header().Set("Content-Type", replyType)
+	w.Write(resp)
+}
+
+// Respond returns the DER encoded TimeStampResp for the DER encoded
+// TimeStampReq 'der'
+func (s *Server) Respond(der []byte) []byte {
+	var req request
+
+	rest, err := asn1.Unmarshal(der, &req)
+	if err != nil || len(rest) > 0 {
+		return s.reject(failBadDataFormat, "malformed request")
+	}
+
+	if fail, why := s.check(&req); len(why) > 0 {
+		return s.reject(fail, why)
+	}
+
+	tok, serial, err := s.token(&req)
+	if err != nil {
+		s.log("tsa: %s", err)
+		return s.reject(failSystemFailure, "can't sign the time-stamp")
+	}
+
+	r := response{
+		Status:         statusInfo{Status: statusGranted},
+		TimeStampToken: asn1.RawValue{FullBytes: tok},
+	}
+	b, err := asn1.Marshal(r)
+	if err != nil {
+		s.log("tsa: %s", err)
+		return s.reject(failSystemFailure, "can't encode the response")
+	}
+
+	s.log("tsa: time-stamp %#x for %x", serial, req.MessageImprint.HashedMessage)
+	return b
+}
+
+// check if we can grant 'req'; return the failure bit and the reason
+// if not
+func (s *Server) check(req *request) (int, string) {
+	now := time.Now()
+
+	switch {
+	case req.Version != 1:
+		return failBadRequest, fmt.Sprintf("unsupported version %d", req.Version)
+	case len(req.ReqPolicy) > 0 && !req.ReqPolicy.Equal(s.Policy):
+		return failUnacceptedPolicy, fmt.Sprintf("policy %s isn't supported", req.ReqPolicy)
+	case len(req.Extensions) > 0:
+		return failUnacceptedExtension, "extensions aren't supported"
+	case now.Before(s.tsa.Cert.NotBefore) || now.After(s.tsa.Cert.NotAfter):
+		return failTimeNotAvailable, "the TSA cert isn't valid"
+	}
+
+	h, ok := hashFor(req.MessageImprint.HashAlgorithm)
+	if !ok {
+		return failBadAlg, fmt.Sprintf("digest %s isn't supported", req.MessageImprint.HashAlgorithm.Algorithm)
+	}
+	if len(req.MessageImprint.HashedMessage) != h.Size() {
+		return failBadDataFormat, "wrong digest size"
+	}
+	return 0, ""
+}
+
+// return a signed TimeStampToken for 'req' and its serial number
+func (s *Server) token(req *request) ([]byte, *big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ti := tstInfo{
+		Version:        1,
+		Policy:         s.Policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   serial,
+		GenTime:        time.Now().UTC(),
+		Accuracy:       accuracy{Seconds: 1},
+		Nonce:          req.Nonce,
+	}
+
+	content, err := asn1.Marshal(ti)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attrs, err := s.signedAttrs(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sig, err := s.sign(attrs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the signed attributes are signed as a SET but go in the
+	// SignerInfo as [0] IMPLICIT
+	var set asn1.RawValue
+	if _, err := asn1.Unmarshal(attrs, &set); err != nil {
+		return nil, nil, err
+	}
+
+	c := s.tsa.Cert
+	si := signerInfo{
+		Version: 1,
+		SID: issuerAndSerial{
+			Issuer: asn1.RawValue{FullBytes: c.RawIssuer},
+			Serial: c.SerialNumber,
+		},
+		DigestAlgorithm:    s.dig,
+		SignedAttrs:        ctxTag(0, set.Bytes),
+		SignatureAlgorithm: s.sig,
+		Signature:          sig,
+	}
+
+	sd := signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{s.dig},
+		EncapContentInfo: encapContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     content,
+		},
+		SignerInfos: []signerInfo{si},
+	}
+
+	if req.CertReq {
+		raw := c.Raw
+		for _, x := range s.tsa.Chain {
+			raw = append(raw[:len(raw):len(raw)], x.Raw...)
+		}
+		sd.Certificates = ctxTag(0, raw)
+	}
+
+	der, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tok, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     ctxTag(0, der),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tok, serial, nil
+}
+
+// return the DER SET of signed attributes for the TSTInfo 'content'
+func (s *Server) signedAttrs(content []byte) ([]byte, error) {
+	ct, err := asn1.Marshal(oidTSTInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := asn1.Marshal(digest(s.hash, content))
+	if err != nil {
+		return nil, err
+	}
+
+	// ESSCertIDv2 with the default SHA-256 cert hash
+	sc, err := asn1.Marshal(signingCertV2{
+		Certs: []essCertIDv2{{CertHash: digest(crypto.SHA256, s.tsa.Cert.Raw)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []attribute{
+		{oidContentType, []asn1.RawValue{{FullBytes: ct}}},
+		{oidMessageDigest, []asn1.RawValue{{FullBytes: md}}},
+		{oidSigningCertV2, []asn1.RawValue{{FullBytes: sc}}},
+	}
+
+	// DER sorts the SET OF
+	return asn1.MarshalWithParams(attrs, "set")
+}
+
+// sign the DER encoded signed attributes
+func (s *Server) sign(attrs []byte) ([]byte, error) {
+	if s.hash == crypto.SHA512 {
+		if _, ok := s.tsa.Key.Public().(ed25519.PublicKey); ok {
+			return s.tsa.Key.Sign(rand.Reader, attrs, crypto.Hash(0))
+		}
+	}
+	return s.tsa.Key.Sign(rand.Reader, digest(s.hash, attrs), s.hash)
+}
+
+// return a rejection TimeStampResp
+func (s *Server) reject(fail int, why string) []byte {
+	s.log("tsa: rejected: %s", why)
+
+	bits := make([]byte, fail/8+1)
+	bits[fail/8] = 0x80 >> (fail % 8)
+
+	r := response{
+		Status: statusInfo{
+			Status: statusRejection,
+			StatusString: []asn1.RawValue{
+				{Tag: asn1.TagUTF8String, Bytes: []byte(why)},
+			},
+			FailInfo: asn1.BitString{Bytes: bits, BitLength: fail + 1},
+		},
+	}
+
+	b, err := asn1.Marshal(r)
+	if err != nil {
+		panic(fmt.Sprintf("tsa: can't encode rejection: %s", err))
+	}
+	return b
+}
+
+func (s *Server) log(f string, v ...any) {
+	if s.Log != nil {
+		s.Log(f, v...)
+	}
+}
+
+// return a constructed [n] IMPLICIT value
+func ctxTag(n int, b []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        n,
+		IsCompound: true,
+		Bytes:      b,
+	}
+}
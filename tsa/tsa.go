@@ -0,0 +1,534 @@
+// tsa.go -- RFC 3161 time-stamp protocol messages
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package tsa implements an RFC 3161 time-stamping authority that
+// signs with a time-stamping cert of a certik DB, and a client to
+// request and verify time-stamps. Tokens are CMS SignedData (RFC 5652)
+// holding a TSTInfo; the signer is named by an ESS signingCertificateV2
+// attribute (RFC 5816).
+package tsa
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCert   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 12}
+	oidSigningCertV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSA             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+	oidExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+// the message digests a request can use
+var hashes = []struct {
+	oid asn1.ObjectIdentifier
+	h   crypto.Hash
+}{
+	{oidSHA256, crypto.SHA256},
+	{oidSHA384, crypto.SHA384},
+	{oidSHA512, crypto.SHA512},
+}
+
+// PKIStatus values
+const (
+	statusGranted         = 0
+	statusGrantedWithMods = 1
+	statusRejection       = 2
+)
+
+var statusNames = []string{
+	"granted", "granted with modifications", "rejected", "waiting",
+	"revocation warning", "revocation notification",
+}
+
+// PKIFailureInfo bits
+const (
+	failBadAlg              = 0
+	failBadRequest          = 2
+	failBadDataFormat       = 5
+	failTimeNotAvailable    = 14
+	failUnacceptedPolicy    = 15
+	failUnacceptedExtension = 16
+	failSystemFailure       = 25
+)
+
+var failNames = map[int]string{
+	failBadAlg:              "badAlg",
+	failBadRequest:          "badRequest",
+	failBadDataFormat:       "badDataFormat",
+	failTimeNotAvailable:    "timeNotAvailable",
+	failUnacceptedPolicy:    "unacceptedPolicy",
+	failUnacceptedExtension: "unacceptedExtension",
+	17:                      "addInfoNotAvailable",
+	failSystemFailure:       "systemFailure",
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// TimeStampReq
+type request struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+// TimeStampResp
+type response struct {
+	Status         statusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// PKIStatusInfo; the status strings are UTF8Strings
+type statusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+// RFC 5652 ContentInfo
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// RFC 5652 SignedData
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// ESS SigningCertificate and SigningCertificateV2; only the cert hash
+// of the first ESSCertID is used. The V2 hash is SHA-256 unless it
+// names another algorithm.
+type signingCert struct {
+	Certs []essCertID
+}
+
+type essCertID struct {
+	CertHash []byte
+}
+
+type signingCertV2 struct {
+	Certs []essCertIDv2
+}
+
+type essCertIDv2 struct {
+	HashAlgorithm pkix.AlgorithmIdentifier `asn1:"optional"`
+	CertHash      []byte
+}
+
+// TSTInfo
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       accuracy  `asn1:"optional"`
+	Ordering       bool      `asn1:"optional"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+// Token is a verified time-stamp token
+type Token struct {
+	// time of the time-stamp
+	Time time.Time
+
+	Serial *big.Int
+	Policy asn1.ObjectIdentifier
+
+	// the time-stamped digest
+	Hash   crypto.Hash
+	Digest []byte
+
+	Nonce *big.Int
+
+	// the TSA cert and the certs that came with the token
+	Signer *x509.Certificate
+	Certs  []*x509.Certificate
+
+	// DER encoded TimeStampResp
+	Raw []byte
+}
+
+// ParseResponse parses a DER encoded TimeStampResp and verifies the
+// signature of its token. The token must carry the TSA cert.
+func ParseResponse(der []byte) (*Token, error) {
+	var r response
+
+	if rest, err := asn1.Unmarshal(der, &r); err != nil {
+		return nil, fmt.Errorf("tsa: can't parse response: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("tsa: trailing data after response")
+	}
+
+	if st := r.Status.Status; st != statusGranted && st != statusGrantedWithMods {
+		return nil, fmt.Errorf("tsa: %s", r.Status)
+	}
+	if len(r.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("tsa: response has no time-stamp token")
+	}
+
+	t, err := parseToken(r.TimeStampToken.FullBytes)
+	if err != nil {
+		return nil, fmt.Errorf("tsa: %w", err)
+	}
+	t.Raw = der
+	return t, nil
+}
+
+// parse the ContentInfo of a time-stamp token and verify its signature
+func parseToken(der []byte) (*Token, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("can't parse token: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) || ci.Content.Class != asn1.ClassContextSpecific || ci.Content.Tag != 0 {
+		return nil, fmt.Errorf("token isn't a signed-data")
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("can't parse signed-data: %w", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("token doesn't hold a TSTInfo")
+	}
+
+	content := sd.EncapContentInfo.EContent
+	var ti tstInfo
+	if _, err := asn1.Unmarshal(content, &ti); err != nil {
+		return nil, fmt.Errorf("can't parse TSTInfo: %w", err)
+	}
+	if ti.Version != 1 {
+		return nil, fmt.Errorf("unknown TSTInfo version %d", ti.Version)
+	}
+
+	h, ok := hashFor(ti.MessageImprint.HashAlgorithm)
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest %s", ti.MessageImprint.HashAlgorithm.Algorithm)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse certs: %w", err)
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("token has %d signers", len(sd.SignerInfos))
+	}
+	si := &sd.SignerInfos[0]
+
+	i := slices.IndexFunc(certs, func(c *x509.Certificate) bool {
+		return bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) && c.SerialNumber.Cmp(si.SID.Serial) == 0
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("token doesn't carry the TSA cert")
+	}
+	signer := certs[i]
+
+	if err := verifySigner(si, signer, content); err != nil {
+		return nil, err
+	}
+
+	t := &Token{
+		Time:   ti.GenTime,
+		Serial: ti.SerialNumber,
+		Policy: ti.Policy,
+		Hash:   h,
+		Digest: ti.MessageImprint.HashedMessage,
+		Nonce:  ti.Nonce,
+		Signer: signer,
+		Certs:  certs,
+	}
+	return t, nil
+}
+
+// verify the signed attributes and signature of 'si'
+func verifySigner(si *signerInfo, signer *x509.Certificate, content []byte) error {
+	if len(si.SignedAttrs.Bytes) == 0 {
+		return fmt.Errorf("token has no signed attributes")
+	}
+
+	// the signature covers the attributes as a SET
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err != nil {
+		return err
+	}
+
+	var attrs []attribute
+	if _, err := asn1.UnmarshalWithParams(set, &attrs, "set"); err != nil {
+		return fmt.Errorf("can't parse signed attributes: %w", err)
+	}
+
+	h, ok := hashFor(si.DigestAlgorithm)
+	if !ok {
+		return fmt.Errorf("unsupported digest %s", si.DigestAlgorithm.Algorithm)
+	}
+
+	var ctype, md, sc bool
+	for _, a := range attrs {
+		if len(a.Values) != 1 {
+			return fmt.Errorf("attribute %s has %d values", a.Type, len(a.Values))
+		}
+		v := a.Values[0].FullBytes
+
+		switch {
+		case a.Type.Equal(oidContentType):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(v, &oid); err != nil || !oid.Equal(oidTSTInfo) {
+				return fmt.Errorf("wrong content-type attribute")
+			}
+			ctype = true
+
+		case a.Type.Equal(oidMessageDigest):
+			var d []byte
+			if _, err := asn1.Unmarshal(v, &d); err != nil || !bytes.Equal(d, digest(h, content)) {
+				return fmt.Errorf("message digest doesn't match the TSTInfo")
+			}
+			md = true
+
+		case a.Type.Equal(oidSigningCertV2):
+			var s signingCertV2
+			if _, err := asn1.Unmarshal(v, &s); err != nil || len(s.Certs) == 0 {
+				return fmt.Errorf("can't parse the signing-certificate-v2 attribute")
+			}
+			ch := crypto.SHA256
+			if alg := s.Certs[0].HashAlgorithm; len(alg.Algorithm) > 0 {
+				if ch, ok = hashFor(alg); !ok {
+					return fmt.Errorf("unsupported cert hash %s", alg.Algorithm)
+				}
+			}
+			if !bytes.Equal(s.Certs[0].CertHash, digest(ch, signer.Raw)) {
+				return fmt.Errorf("signing cert doesn't match the TSA cert")
+			}
+			sc = true
+
+		case a.Type.Equal(oidSigningCert):
+			var s signingCert
+			if _, err := asn1.Unmarshal(v, &s); err != nil || len(s.Certs) == 0 {
+				return fmt.Errorf("can't parse the signing-certificate attribute")
+			}
+			if d := sha1.Sum(signer.Raw); !bytes.Equal(s.Certs[0].CertHash, d[:]) {
+				return fmt.Errorf("signing cert doesn't match the TSA cert")
+			}
+			sc = true
+		}
+	}
+
+	switch {
+	case !ctype:
+		return fmt.Errorf("token has no content-type attribute")
+	case !md:
+		return fmt.Errorf("token has no message-digest attribute")
+	case !sc:
+		return fmt.Errorf("token has no signing-certificate attribute")
+	}
+
+	alg, err := sigAlgorithm(si.SignatureAlgorithm.Algorithm, h)
+	if err != nil {
+		return err
+	}
+	if err := signer.CheckSignature(alg, set, si.Signature); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	return nil
+}
+
+// return the x509 signature algorithm of a SignerInfo
+func sigAlgorithm(oid asn1.ObjectIdentifier, h crypto.Hash) (x509.SignatureAlgorithm, error) {
+	switch {
+	case oid.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, nil
+	case oid.Equal(oidECDSAWithSHA384):
+		return x509.ECDSAWithSHA384, nil
+	case oid.Equal(oidECDSAWithSHA512):
+		return x509.ECDSAWithSHA512, nil
+	case oid.Equal(oidSHA256WithRSA), oid.Equal(oidRSA) && h == crypto.SHA256:
+		return x509.SHA256WithRSA, nil
+	case oid.Equal(oidSHA384WithRSA), oid.Equal(oidRSA) && h == crypto.SHA384:
+		return x509.SHA384WithRSA, nil
+	case oid.Equal(oidSHA512WithRSA), oid.Equal(oidRSA) && h == crypto.SHA512:
+		return x509.SHA512WithRSA, nil
+	case oid.Equal(oidEd25519):
+		return x509.PureEd25519, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %s", oid)
+}
+
+// Verify checks that 't' time-stamps 'data' and that its TSA cert
+// chains to one of 'roots', was valid at the time of the time-stamp and
+// has the critical timeStamping extended key usage.
+func (t *Token) Verify(data []byte, roots []*x509.Certificate) error {
+	if !bytes.Equal(t.Digest, digest(t.Hash, data)) {
+		return errors.New("tsa: time-stamp doesn't match the data")
+	}
+
+	if !isTSACert(t.Signer) {
+		return fmt.Errorf("tsa: %s is not a time-stamping cert", t.Signer.Subject.CommonName)
+	}
+
+	ro := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   t.Time,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	for _, c := range roots {
+		ro.Roots.AddCert(c)
+	}
+	for _, c := range t.Certs {
+		ro.Intermediates.AddCert(c)
+	}
+	if _, err := t.Signer.Verify(ro); err != nil {
+		return fmt.Errorf("tsa: %w", err)
+	}
+	return nil
+}
+
+// RFC 3161 §2.3: the TSA cert has just the timeStamping EKU and the
+// extension is critical
+func isTSACert(c *x509.Certificate) bool {
+	if !slices.Equal(c.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}) {
+		return false
+	}
+	i := slices.IndexFunc(c.Extensions, func(e pkix.Extension) bool {
+		return e.Id.Equal(oidExtKeyUsage)
+	})
+	return i >= 0 && c.Extensions[i].Critical
+}
+
+func (s statusInfo) String() string {
+	var b strings.Builder
+
+	if s.Status >= 0 && s.Status < len(statusNames) {
+		b.WriteString(statusNames[s.Status])
+	} else {
+		fmt.Fprintf(&b, "status %d", s.Status)
+	}
+
+	var text []string
+	for _, v := range s.StatusString {
+		text = append(text, string(v.Bytes))
+	}
+	if len(text) > 0 {
+		fmt.Fprintf(&b, ": %s", strings.Join(text, "; "))
+	}
+
+	var fails []string
+	for i := 0; i < s.FailInfo.BitLength; i++ {
+		if s.FailInfo.At(i) == 0 {
+			continue
+		}
+		if n, ok := failNames[i]; ok {
+			fails = append(fails, n)
+		} else {
+			fails = append(fails, fmt.Sprintf("failure %d", i))
+		}
+	}
+	if len(fails) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(fails, ", "))
+	}
+	return b.String()
+}
+
+// return the hash named by 'ai'
+func hashFor(ai pkix.AlgorithmIdentifier) (crypto.Hash, bool) {
+	for _, v := range hashes {
+		if v.oid.Equal(ai.Algorithm) {
+			return v.h, true
+		}
+	}
+	return 0, false
+}
+
+// return the AlgorithmIdentifier of 'h'
+func hashAlg(h crypto.Hash) (pkix.AlgorithmIdentifier, bool) {
+	for _, v := range hashes {
+		if v.h == h {
+			return pkix.AlgorithmIdentifier{Algorithm: v.oid}, true
+		}
+	}
+	return pkix.AlgorithmIdentifier{}, false
+}
+
+func digest(h crypto.Hash, b []byte) []byte {
+	w := h.New()
+	w.Write(b)
+	return w.Sum(nil)
+}
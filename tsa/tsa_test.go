@@ -0,0 +1,203 @@
+// tsa_test.go -- tests for the time-stamping authority
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package tsa
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+)
+
+// the TSA policy of the tests
+var testPolicy = asn1.ObjectIdentifier{1, 2, 3, 4, 5}
+
+// start a TSA for a new DB; return the DB and the server URL
+func newTestTSA(t *testing.T) (*ops.DB, *Server, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	d, err := ops.Init(filepath.Join(dir, "test.db"), "test-ca", &ops.InitOpts{Passwd: "test-pw"})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	d.Warn = t.Logf
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+
+	ta, err := d.TSA("tsa", &ops.CertOpts{Signer: "ica"})
+	if err != nil {
+		t.Fatalf("tsa cert: %s", err)
+	}
+	if len(ta.Chain) != 1 || ta.Chain[0].Subject.CommonName != "ica" {
+		t.Fatalf("tsa chain: %v", ta.Chain)
+	}
+
+	if _, err := New(ta, nil); err == nil {
+		t.Fatalf("server without a policy")
+	}
+	s, err := New(ta, testPolicy)
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+	s.Log = t.Logf
+
+	hs := httptest.NewServer(s)
+	t.Cleanup(hs.Close)
+	return d, s, hs.URL
+}
+
+func TestTimestamp(t *testing.T) {
+	d, _, url := newTestTSA(t)
+
+	data := []byte("hello, world\n")
+	c := &Client{URL: url}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tok, err := c.Timestamp(ctx, data)
+	if err != nil {
+		t.Fatalf("timestamp: %s", err)
+	}
+	if tok.Signer.Subject.CommonName != "tsa" {
+		t.Fatalf("signer: %s", tok.Signer.Subject.CommonName)
+	}
+	if !tok.Policy.Equal(testPolicy) {
+		t.Fatalf("policy: %s", tok.Policy)
+	}
+	if d := time.Since(tok.Time); d < -2*time.Second || d > time.Minute {
+		t.Fatalf("time: %s", tok.Time)
+	}
+
+	roots, err := d.TrustCerts("")
+	if err != nil {
+		t.Fatalf("trust certs: %s", err)
+	}
+	if err := tok.Verify(data, roots); err != nil {
+		t.Fatalf("verify: %s", err)
+	}
+
+	// the saved response verifies on its own
+	tok2, err := ParseResponse(tok.Raw)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if err := tok2.Verify(data, roots); err != nil {
+		t.Fatalf("verify saved: %s", err)
+	}
+
+	if err := tok.Verify([]byte("hello, world"), roots); err == nil {
+		t.Fatalf("verified different data")
+	}
+
+	// a different root-CA
+	o, err := ops.Init(filepath.Join(t.TempDir(), "other.db"), "other-ca", &ops.InitOpts{Passwd: "pw"})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	defer o.Close()
+	if err := tok.Verify(data, []*x509.Certificate{o.CA.Certificate}); err == nil {
+		t.Fatalf("verified with the wrong root-CA")
+	}
+
+	// a tampered token fails the signature check
+	b := append([]byte{}, tok.Raw...)
+	i := strings.Index(string(b), string(tok.Digest))
+	b[i] ^= 1
+	if _, err := ParseResponse(b); err == nil {
+		t.Fatalf("parsed a tampered response")
+	}
+}
+
+func TestTimestampHashes(t *testing.T) {
+	_, _, url := newTestTSA(t)
+
+	for _, h := range []crypto.Hash{crypto.SHA384, crypto.SHA512} {
+		c := &Client{URL: url, Hash: h}
+		tok, err := c.Timestamp(context.Background(), []byte("data"))
+		if err != nil {
+			t.Fatalf("%s: %s", h, err)
+		}
+		if tok.Hash != h {
+			t.Fatalf("%s: token hash %s", h, tok.Hash)
+		}
+	}
+}
+
+func TestReject(t *testing.T) {
+	_, s, url := newTestTSA(t)
+
+	oidSHA1 := asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	tests := []struct {
+		name string
+		req  request
+		fail string
+	}{
+		{"sha1", request{
+			Version:        1,
+			MessageImprint: messageImprint{pkix.AlgorithmIdentifier{Algorithm: oidSHA1}, make([]byte, 20)},
+		}, "badAlg"},
+		{"size", request{
+			Version:        1,
+			MessageImprint: messageImprint{pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, make([]byte, 20)},
+		}, "badDataFormat"},
+		{"policy", request{
+			Version:        1,
+			MessageImprint: messageImprint{pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, make([]byte, 32)},
+			ReqPolicy:      asn1.ObjectIdentifier{1, 2, 3, 4},
+		}, "unacceptedPolicy"},
+		{"version", request{
+			Version:        2,
+			MessageImprint: messageImprint{pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, make([]byte, 32)},
+		}, "badRequest"},
+	}
+
+	for _, tt := range tests {
+		der, err := asn1.Marshal(tt.req)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		_, err = ParseResponse(s.Respond(der))
+		if err == nil || !strings.Contains(err.Error(), tt.fail) {
+			t.Fatalf("%s: expected %s, saw %v", tt.name, tt.fail, err)
+		}
+	}
+
+	if _, err := ParseResponse(s.Respond([]byte("junk"))); err == nil || !strings.Contains(err.Error(), "badDataFormat") {
+		t.Fatalf("junk: saw %v", err)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("get: %s", resp.Status)
+	}
+
+	c := &Client{URL: url, Policy: asn1.ObjectIdentifier{1, 2, 3}}
+	if _, err := c.Timestamp(context.Background(), []byte("data")); err == nil {
+		t.Fatalf("timestamp with an unknown policy")
+	}
+}
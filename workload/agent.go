@@ -0,0 +1,311 @@
+// agent.go -- SPIFFE Workload API agent
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package workload serves the SPIFFE Workload API of a certik DB on a
+// Unix socket. Callers are attested by the uid, gid and executable of
+// the peer process and get short-lived X509-SVIDs for the workload
+// registrations that match them; the SVIDs are rotated at half their
+// lifetime. JWT-SVIDs aren't supported.
+package workload
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	pb "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// every Workload API request must have this header
+const securityHeader = "workload.spiffe.io"
+
+// how often streams look for new registrations and CAs
+const pollInterval = 10 * time.Second
+
+// Agent serves the SPIFFE Workload API for a DB
+type Agent struct {
+	pb.UnimplementedSpiffeWorkloadAPIServer
+
+	// Log is called for every SVID issued; the default discards
+	// the messages.
+	Log func(format string, v ...any)
+
+	db  *ops.DB
+	srv *grpc.Server
+
+	// ops.DB isn't safe for concurrent use; the lock also guards
+	// the SVID cache
+	sync.Mutex
+	svids map[string]*cached
+}
+
+// an issued SVID and the registration it was issued for
+type cached struct {
+	e       ops.WorkloadEntry
+	svid    *ops.SVID
+	renewAt time.Time
+}
+
+// New returns an Agent that issues SVIDs from 'd'
+func New(d *ops.DB) *Agent {
+	a := &Agent{
+		db:    d,
+		svids: make(map[string]*cached),
+	}
+
+	a.srv = grpc.NewServer(grpc.Creds(peerCreds{}))
+	pb.RegisterSpiffeWorkloadAPIServer(a.srv, a)
+	return a
+}
+
+// Serve the Workload API on the Unix socket listener 'l'
+func (a *Agent) Serve(l net.Listener) error {
+	return a.srv.Serve(l)
+}
+
+// Stop closes the listeners and every open stream
+func (a *Agent) Stop() {
+	a.srv.Stop()
+}
+
+// FetchX509SVID sends the SVIDs of the caller and sends them again
+// whenever they are rotated or the registrations change.
+func (a *Agent) FetchX509SVID(_ *pb.X509SVIDRequest, st grpc.ServerStreamingServer[pb.X509SVIDResponse]) error {
+	ctx := st.Context()
+	c, err := caller(ctx)
+	if err != nil {
+		return err
+	}
+
+	var last []byte
+	for {
+		resp, next, err := a.x509SVIDs(c)
+		if err != nil {
+			return err
+		}
+
+		// only send what changed
+		if id := svidKey(resp); !bytes.Equal(id, last) {
+			if err := st.Send(resp); err != nil {
+				return err
+			}
+			last = id
+		}
+
+		if !wait(ctx, next) {
+			return nil
+		}
+	}
+}
+
+// FetchX509Bundles sends the trust bundles of the caller's trust
+// domains and sends them again when the CAs change.
+func (a *Agent) FetchX509Bundles(_ *pb.X509BundlesRequest, st grpc.ServerStreamingServer[pb.X509BundlesResponse]) error {
+	ctx := st.Context()
+	c, err := caller(ctx)
+	if err != nil {
+		return err
+	}
+
+	var last *pb.X509BundlesResponse
+	for {
+		resp, err := a.bundles(c)
+		if err != nil {
+			return err
+		}
+
+		if last == nil || !reflect.DeepEqual(resp.Bundles, last.Bundles) {
+			if err := st.Send(resp); err != nil {
+				return err
+			}
+			last = resp
+		}
+
+		if !wait(ctx, time.Now().Add(pollInterval)) {
+			return nil
+		}
+	}
+}
+
+// Return the SVIDs of the caller 'c' and when to look at them again
+func (a *Agent) x509SVIDs(c *peerInfo) (*pb.X509SVIDResponse, time.Time, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	ents, err := a.db.MatchWorkloads(c.selectors())
+	if err != nil {
+		return nil, time.Time{}, status.Error(codes.Internal, err.Error())
+	}
+	if len(ents) == 0 {
+		return nil, time.Time{}, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+
+	bundle, err := a.bundle()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	next := time.Now().Add(pollInterval)
+	resp := &pb.X509SVIDResponse{}
+	for _, e := range ents {
+		z, err := a.svid(e, c)
+		if err != nil {
+			return nil, time.Time{}, status.Error(codes.Internal, err.Error())
+		}
+
+		s := z.svid
+		var chain bytes.Buffer
+		chain.Write(s.Cert.Raw)
+		for _, ca := range s.Chain {
+			chain.Write(ca.Raw)
+		}
+
+		resp.Svids = append(resp.Svids, &pb.X509SVID{
+			SpiffeId:    s.ID,
+			X509Svid:    chain.Bytes(),
+			X509SvidKey: s.Key,
+			Bundle:      bundle,
+		})
+		if z.renewAt.Before(next) {
+			next = z.renewAt
+		}
+	}
+	return resp, next, nil
+}
+
+// Return the cached SVID of 'e'; issue a new one if it is due for
+// renewal or the registration changed. The caller holds the lock.
+func (a *Agent) svid(e *ops.WorkloadEntry, c *peerInfo) (*cached, error) {
+	z, ok := a.svids[e.ID]
+	if ok && time.Now().Before(z.renewAt) && reflect.DeepEqual(z.e, *e) {
+		return z, nil
+	}
+
+	s, err := a.db.NewSVID(e)
+	if err != nil {
+		return nil, err
+	}
+
+	life := s.Cert.NotAfter.Sub(s.Cert.NotBefore)
+	z = &cached{
+		e:       *e,
+		svid:    s,
+		renewAt: s.Cert.NotBefore.Add(life / 2),
+	}
+	a.svids[e.ID] = z
+	a.log("issued %s to pid %d (uid %d); expires %s", s.ID, c.pid, c.uid, s.Cert.NotAfter.Format(time.RFC3339))
+	return z, nil
+}
+
+// Return the trust bundles of the caller 'c'
+func (a *Agent) bundles(c *peerInfo) (*pb.X509BundlesResponse, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	ents, err := a.db.MatchWorkloads(c.selectors())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if len(ents) == 0 {
+		return nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+
+	bundle, err := a.bundle()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.X509BundlesResponse{
+		Bundles: make(map[string][]byte),
+	}
+	for _, e := range ents {
+		u, err := ops.ParseSPIFFEID(e.ID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Bundles[u.Host] = bundle
+	}
+	return resp, nil
+}
+
+// the DER encoded CA certs of the DB. The caller holds the lock.
+func (a *Agent) bundle() ([]byte, error) {
+	certs, err := a.db.TrustCerts("")
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return derCerts(certs), nil
+}
+
+func (a *Agent) log(f string, v ...any) {
+	if a.Log != nil {
+		a.Log(f, v...)
+	}
+}
+
+// Return the attested caller of a request that has the security header
+func caller(ctx context.Context) (*peerInfo, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(securityHeader); len(v) != 1 || v[0] != "true" {
+		return nil, status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Internal, "can't find the caller")
+	}
+	c, ok := p.AuthInfo.(*peerInfo)
+	if !ok {
+		return nil, status.Error(codes.Internal, "caller isn't attested")
+	}
+	return c, nil
+}
+
+// wait until 't'; return false if 'ctx' is done first
+func wait(ctx context.Context, t time.Time) bool {
+	tm := time.NewTimer(time.Until(t))
+	defer tm.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-tm.C:
+		return true
+	}
+}
+
+// the SPIFFE IDs, certs and bundles of 'resp'; it changes when any of
+// them do
+func svidKey(resp *pb.X509SVIDResponse) []byte {
+	var b bytes.Buffer
+	for _, s := range resp.Svids {
+		b.WriteString(s.SpiffeId)
+		b.Write(s.X509Svid)
+		b.Write(s.Bundle)
+	}
+	return b.Bytes()
+}
+
+// concatenate the DER encoding of 'certs'
+func derCerts(certs []*x509.Certificate) []byte {
+	var b bytes.Buffer
+	for _, c := range certs {
+		b.Write(c.Raw)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,209 @@
+// agent_test.go -- tests for the SPIFFE Workload API agent
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package workload
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencoff/certik/ops"
+	pb "github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// start an agent for a new DB; return the DB and a client
+func newTestAgent(t *testing.T) (*ops.DB, pb.SpiffeWorkloadAPIClient) {
+	t.Helper()
+
+	dir := t.TempDir()
+	d, err := ops.Init(filepath.Join(dir, "test.db"), "test-ca", &ops.InitOpts{Passwd: "test-pw"})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	d.Warn = t.Logf
+
+	if _, err := d.NewIntermediate("ica", nil); err != nil {
+		t.Fatalf("intermediate: %s", err)
+	}
+	if err := d.SetPolicy("", &ops.Policy{TrustDomain: "example.org"}); err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	a := New(d)
+	a.Log = t.Logf
+	go a.Serve(l)
+	t.Cleanup(a.Stop)
+
+	cc, err := grpc.NewClient("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return d, pb.NewSpiffeWorkloadAPIClient(cc)
+}
+
+// a context with the Workload API security header
+func apiContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx, securityHeader, "true")
+}
+
+func TestFetchX509SVID(t *testing.T) {
+	d, c := newTestAgent(t)
+
+	e := &ops.WorkloadEntry{
+		ID:        "spiffe://example.org/test",
+		Signer:    "ica",
+		Selectors: []string{fmt.Sprintf("unix:uid:%d", os.Getuid())},
+		TTL:       "2s",
+	}
+	if err := d.AddWorkload(e); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+
+	st, err := c.FetchX509SVID(apiContext(t), &pb.X509SVIDRequest{})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	resp, err := st.Recv()
+	if err != nil {
+		t.Fatalf("recv: %s", err)
+	}
+	if len(resp.Svids) != 1 {
+		t.Fatalf("fetch: exp 1 SVID, saw %d", len(resp.Svids))
+	}
+
+	s := resp.Svids[0]
+	certs, err := x509.ParseCertificates(s.X509Svid)
+	if err != nil {
+		t.Fatalf("svid: %s", err)
+	}
+	if s.SpiffeId != e.ID || len(certs) != 2 || certs[0].URIs[0].String() != e.ID {
+		t.Fatalf("svid: bad SVID %s", s.SpiffeId)
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(s.X509SvidKey); err != nil {
+		t.Fatalf("svid: key: %s", err)
+	}
+
+	// the SVID chains to the bundle
+	cas, err := x509.ParseCertificates(s.Bundle)
+	if err != nil {
+		t.Fatalf("bundle: %s", err)
+	}
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AddCert(ca)
+	}
+	inter := x509.NewCertPool()
+	inter.AddCert(certs[1])
+	vo := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := certs[0].Verify(vo); err != nil {
+		t.Fatalf("svid: %s", err)
+	}
+
+	// the SVID is rotated at half its lifetime
+	resp, err = st.Recv()
+	if err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+	next, err := x509.ParseCertificates(resp.Svids[0].X509Svid)
+	if err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+	if next[0].SerialNumber.Cmp(certs[0].SerialNumber) == 0 {
+		t.Fatalf("rotate: got the same SVID")
+	}
+}
+
+func TestFetchX509Bundles(t *testing.T) {
+	d, c := newTestAgent(t)
+
+	e := &ops.WorkloadEntry{
+		ID:        "spiffe://example.org/test",
+		Selectors: []string{fmt.Sprintf("unix:gid:%d", os.Getgid())},
+	}
+	if err := d.AddWorkload(e); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+
+	st, err := c.FetchX509Bundles(apiContext(t), &pb.X509BundlesRequest{})
+	if err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	resp, err := st.Recv()
+	if err != nil {
+		t.Fatalf("recv: %s", err)
+	}
+
+	cas, err := x509.ParseCertificates(resp.Bundles["example.org"])
+	if err != nil || len(cas) != 2 {
+		t.Fatalf("bundle: exp 2 CAs, saw %d (%v)", len(cas), err)
+	}
+}
+
+func TestAgentDenied(t *testing.T) {
+	d, c := newTestAgent(t)
+
+	// a registration for somebody else
+	e := &ops.WorkloadEntry{
+		ID:        "spiffe://example.org/other",
+		Selectors: []string{fmt.Sprintf("unix:uid:%d", os.Getuid()+1)},
+	}
+	if err := d.AddWorkload(e); err != nil {
+		t.Fatalf("add: %s", err)
+	}
+
+	st, err := c.FetchX509SVID(apiContext(t), &pb.X509SVIDRequest{})
+	if err == nil {
+		_, err = st.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("no match: exp PermissionDenied, saw %v", err)
+	}
+
+	// requests must have the security header
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	st, err = c.FetchX509SVID(ctx, &pb.X509SVIDRequest{})
+	if err == nil {
+		_, err = st.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("no header: exp InvalidArgument, saw %v", err)
+	}
+
+	_, err = c.FetchJWTSVID(apiContext(t), &pb.JWTSVIDRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("jwt: exp Unimplemented, saw %v", err)
+	}
+}
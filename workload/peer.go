@@ -0,0 +1,83 @@
+// peer.go -- attest the peer of a Unix socket
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// peerInfo is the process at the other end of a Unix socket
+type peerInfo struct {
+	credentials.CommonAuthInfo
+
+	pid  int32
+	uid  uint32
+	gid  uint32
+	path string
+}
+
+func (p *peerInfo) AuthType() string {
+	return "unix-peer"
+}
+
+// the selectors of the peer; the path is missing if we can't find
+// the executable
+func (p *peerInfo) selectors() []string {
+	sel := []string{
+		fmt.Sprintf("unix:uid:%d", p.uid),
+		fmt.Sprintf("unix:gid:%d", p.gid),
+	}
+	if len(p.path) > 0 {
+		sel = append(sel, "unix:path:"+p.path)
+	}
+	return sel
+}
+
+// peerCreds are gRPC transport credentials that attest the peer of a
+// Unix socket connection; the connection itself isn't encrypted.
+type peerCreds struct{}
+
+var _ credentials.TransportCredentials = peerCreds{}
+
+func (peerCreds) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("workload: peer credentials are server only")
+}
+
+func (peerCreds) ServerHandshake(c net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, nil, errors.New("workload: not a Unix socket")
+	}
+
+	p, err := attest(uc)
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("workload: can't attest peer: %w", err)
+	}
+	p.SecurityLevel = credentials.NoSecurity
+	return c, p, nil
+}
+
+func (peerCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "unix-peer"}
+}
+
+func (peerCreds) Clone() credentials.TransportCredentials {
+	return peerCreds{}
+}
+
+func (peerCreds) OverrideServerName(string) error {
+	return nil
+}
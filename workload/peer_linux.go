@@ -0,0 +1,51 @@
+// peer_linux.go -- attest Unix socket peers with SO_PEERCRED
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package workload
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// attest the peer of 'c' by its credentials and executable
+func attest(c *net.UnixConn) (*peerInfo, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		cred, cerr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	p := &peerInfo{
+		pid: cred.Pid,
+		uid: cred.Uid,
+		gid: cred.Gid,
+	}
+
+	// processes of other users may hide their executable
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", cred.Pid)); err == nil {
+		p.path = exe
+	}
+	return p, nil
+}
@@ -0,0 +1,21 @@
+// peer_other.go -- Unix socket peers can't be attested
+//
+// (c) 2018 Sudhi Herle; License GPLv2
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package workload
+
+import (
+	"errors"
+	"net"
+)
+
+// workload attestation needs SO_PEERCRED
+func attest(c *net.UnixConn) (*peerInfo, error) {
+	return nil, errors.New("workload attestation is only supported on Linux")
+}